@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// scanArchives makes uploads of zip and tar archives be rejected when they
+// contain files with a disallowed extension.
+var scanArchives bool
+
+// Limits on archives checked by -scan-archives. Zip entries are only listed,
+// never extracted, but an archive that claims to expand more than
+// maxArchiveRatio times its size is still rejected as a likely zip bomb.
+// Compressed tars have to be decompressed to be listed, which stops once
+// that much has been inflated.
+const (
+	maxArchiveEntries = 10000
+	maxArchiveRatio   = 100
+)
+
+// archiveError is the reason an archive was rejected, as opposed to a
+// failure while checking it.
+type archiveError string
+
+func (e archiveError) Error() string { return string(e) }
+
+const errArchiveTooLarge = archiveError("Archive expands to more than allowed")
+
+// archiveKind returns "zip", "tar" or "tar.gz" for archives -scan-archives
+// checks, going by the detected content type and then the filename.
+func archiveKind(contentType, filename string) string {
+	name := strings.ToLower(filename)
+	switch {
+	case contentType == "application/zip" || strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// checkUploadArchive is the -scan-archives check every write of a file
+// goes through, whether uploaded, replaced, resumed or written over WebDAV.
+// src is the content of the file to be stored as filename with the detected
+// contentType. It returns what to store in place of src, which the caller
+// closes, or an archiveError when the archive is rejected.
+func checkUploadArchive(src io.Reader, contentType, filename string) (io.ReadCloser, error) {
+	kind := archiveKind(contentType, filename)
+	if !scanArchives || kind == "" {
+		return io.NopCloser(src), nil
+	}
+	checked, entry, err := checkArchive(src, kind)
+	if err != nil {
+		return nil, err
+	}
+	if entry != "" {
+		return nil, archiveError("Archive contains a disallowed file: " + entry)
+	}
+	return checked, nil
+}
+
+// checkArchiveAt is checkUploadArchive for a complete file on local disk at
+// p, such as a file written over WebDAV.
+func checkArchiveAt(p, contentType, filename string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = checkUploadArchive(f, contentType, filename)
+	return err
+}
+
+// archiveUploadError is the response for an archive checkUploadArchive
+// rejected or was unable to check.
+func archiveUploadError(logger *slog.Logger, filename string, err error) *uploadError {
+	var aerr archiveError
+	if errors.As(err, &aerr) {
+		logger.Warn("Rejected archive", "filename", filename, "err", err)
+		return &uploadError{status: http.StatusUnprocessableEntity, reason: "archive", message: aerr.Error()}
+	}
+	logger.Error("Error checking archive", "filename", filename, "err", err)
+	return &uploadError{status: http.StatusInternalServerError, reason: "archive", message: "Unable to check archive"}
+}
+
+// checkArchive looks through the entries of the archive in src, spooling it
+// to a temp file first unless it is a file already, and returns the content
+// to store if it passes. A non-empty entry is the name of the first
+// disallowed file found.
+func checkArchive(src io.Reader, kind string) (rc io.ReadCloser, entry string, err error) {
+	if f, ok := src.(*os.File); ok {
+		entry, err := checkArchiveFile(f, kind)
+		return io.NopCloser(f), entry, err
+	}
+	tmp, err := os.CreateTemp(uploadDir, ".upload-*")
+	if err != nil {
+		return nil, "", err
+	}
+	spooled := &tempFile{tmp}
+	defer func() {
+		if err != nil || entry != "" {
+			spooled.Close()
+		}
+	}()
+	if _, err := io.Copy(tmp, src); err != nil {
+		return nil, "", err
+	}
+	if entry, err = checkArchiveFile(tmp, kind); err != nil || entry != "" {
+		return nil, entry, err
+	}
+	return spooled, "", nil
+}
+
+// checkArchiveFile checks the archive in f, leaving it rewound to the start
+// when it passes.
+func checkArchiveFile(f *os.File, kind string) (entry string, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := fi.Size()
+	switch kind {
+	case "zip":
+		entry, err = checkZipEntries(f, size)
+	case "tar", "tar.gz":
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		entry, err = checkTarEntries(f, size, kind == "tar.gz")
+	}
+	if err != nil || entry != "" {
+		return entry, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return "", err
+}
+
+func checkZipEntries(r io.ReaderAt, size int64) (string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", archiveError("Unable to read zip archive: " + err.Error())
+	}
+	if len(zr.File) > maxArchiveEntries {
+		return "", archiveError(fmt.Sprintf("Archive has more than %d entries", maxArchiveEntries))
+	}
+	var expanded uint64
+	for _, f := range zr.File {
+		if isDisallowedEntry(f.Name) {
+			return f.Name, nil
+		}
+		expanded += f.UncompressedSize64
+		if expanded > uint64(size)*maxArchiveRatio {
+			return "", errArchiveTooLarge
+		}
+	}
+	return "", nil
+}
+
+func checkTarEntries(r io.Reader, size int64, gzipped bool) (string, error) {
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return "", archiveError("Unable to read tar archive: " + err.Error())
+		}
+		defer gz.Close()
+		r = gz
+	}
+	limited := &io.LimitedReader{R: r, N: size*maxArchiveRatio + 1}
+	tr := tar.NewReader(limited)
+	for n := 0; ; n++ {
+		h, err := tr.Next()
+		if limited.N <= 0 {
+			return "", errArchiveTooLarge
+		}
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", archiveError("Unable to read tar archive: " + err.Error())
+		}
+		if n >= maxArchiveEntries {
+			return "", archiveError(fmt.Sprintf("Archive has more than %d entries", maxArchiveEntries))
+		}
+		if isDisallowedEntry(h.Name) {
+			return h.Name, nil
+		}
+	}
+}
+
+func isDisallowedEntry(name string) bool {
+	return disallowedExtensions[strings.ToLower(path.Ext(name))]
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// archiveEntry is a file to put in a test archive.
+type archiveEntry struct {
+	name    string
+	content string
+}
+
+func zipArchive(t *testing.T, entries ...archiveEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func tarArchive(t *testing.T, gzipped bool, entries ...archiveEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.String()
+}
+
+func TestArchiveScanning(t *testing.T) {
+	clean := []archiveEntry{{"readme.txt", "hello"}, {"docs/guide.md", "# guide"}}
+	evil := append(clean, archiveEntry{"bin/setup.EXE", "MZ"})
+	// Zeros compress about a thousandfold, well over maxArchiveRatio.
+	bomb := []archiveEntry{{"zeros.txt", strings.Repeat("\x00", 10<<20)}}
+	var many []archiveEntry
+	for i := range maxArchiveEntries + 1 {
+		many = append(many, archiveEntry{strconv.Itoa(i) + ".txt", ""})
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		scan     bool
+		status   int
+		message  string
+	}{
+		{"clean zip", "clean.zip", zipArchive(t, clean...), true, http.StatusOK, ""},
+		{"zip with exe", "evil.zip", zipArchive(t, evil...), true, http.StatusUnprocessableEntity, "bin/setup.EXE"},
+		{"zip with exe, scanning off", "evil.zip", zipArchive(t, evil...), false, http.StatusOK, ""},
+		{"zip bomb", "bomb.zip", zipArchive(t, bomb...), true, http.StatusUnprocessableEntity, "expands to more than allowed"},
+		{"too many entries", "many.zip", zipArchive(t, many...), true, http.StatusUnprocessableEntity, "more than 10000 entries"},
+		{"clean tar", "clean.tar", tarArchive(t, false, clean...), true, http.StatusOK, ""},
+		{"tar with exe", "evil.tar", tarArchive(t, false, evil...), true, http.StatusUnprocessableEntity, "bin/setup.EXE"},
+		{"clean tar.gz", "clean.tar.gz", tarArchive(t, true, clean...), true, http.StatusOK, ""},
+		{"tgz with exe", "evil.tgz", tarArchive(t, true, evil...), true, http.StatusUnprocessableEntity, "bin/setup.EXE"},
+		{"tar.gz bomb", "bomb.tar.gz", tarArchive(t, true, bomb...), true, http.StatusUnprocessableEntity, "expands to more than allowed"},
+		{"corrupt zip", "corrupt.zip", "PK\x03\x04 not really a zip", true, http.StatusUnprocessableEntity, "Unable to read zip archive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &scanArchives, tt.scan)
+			w := upload(t, "/upload", file(tt.filename, tt.content))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.message) {
+				t.Errorf("body %s doesn't mention %q", w.Body, tt.message)
+			}
+			if tt.status != http.StatusOK {
+				if names := stored(t); len(names) != 0 {
+					t.Errorf("stored %v", names)
+				}
+				return
+			}
+			// An archive that passes is stored whole.
+			up := decodeUploads(t, w)[0]
+			if w := get(up.Filename); w.Body.String() != tt.content {
+				t.Errorf("stored %d bytes, want %d", w.Body.Len(), len(tt.content))
+			}
+		})
+	}
+}
+
+func TestArchiveKind(t *testing.T) {
+	tests := []struct {
+		contentType, filename, want string
+	}{
+		{"application/zip", "download", "zip"},
+		{"application/octet-stream", "a.ZIP", "zip"},
+		{"application/x-gzip", "a.tar.gz", "tar.gz"},
+		{"application/x-gzip", "a.tgz", "tar.gz"},
+		{"application/octet-stream", "a.tar", "tar"},
+		{"application/x-gzip", "a.gz", ""},
+		{"text/plain", "a.txt", ""},
+	}
+	for _, tt := range tests {
+		if got := archiveKind(tt.contentType, tt.filename); got != tt.want {
+			t.Errorf("archiveKind(%q, %q) = %q, want %q", tt.contentType, tt.filename, got, tt.want)
+		}
+	}
+}
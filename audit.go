@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// auditLog appends one JSON line per download to a file, separate from the
+// request log. It is safe for concurrent use, and reopen switches to a new
+// file at the same path once a log rotator has moved the old one away.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// audit is nil unless -audit-log is set.
+var audit *auditLog
+
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	RemoteIP string    `json:"remoteIp"`
+	Method   string    `json:"method"`
+	Filename string    `json:"filename,omitempty"`
+	// Files lists what an archive download bundled, in place of Filename.
+	Files    []string `json:"files,omitempty"`
+	Status   int      `json:"status"`
+	Bytes    int64    `json:"bytes"`
+	Referrer string   `json:"referrer,omitempty"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, f: f}, nil
+}
+
+func (a *auditLog) reopen() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	old := a.f
+	a.f = f
+	a.mu.Unlock()
+	return old.Close()
+}
+
+func (a *auditLog) record(e auditEvent) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Error encoding audit event", "err", err)
+		return
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(line); err != nil {
+		slog.Error("Error writing audit log", "err", err)
+	}
+}
+
+// reopenAuditLogOnHangup reopens the audit log on every SIGHUP. It runs for
+// the lifetime of the process.
+func reopenAuditLogOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := audit.reopen(); err != nil {
+			slog.Error("Error reopening audit log", "err", err)
+			continue
+		}
+		slog.Info("Reopened audit log", "path", audit.path)
+	}
+}
+
+// auditDownloads records each GET or HEAD request to next, which serves the
+// stored files named returns, in the audit log. Bytes are what was actually
+// sent, after any compression.
+func auditDownloads(named func(*http.Request) []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if audit == nil || r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		e := auditEvent{
+			Time:     time.Now().UTC(),
+			RemoteIP: clientIP(r),
+			Method:   r.Method,
+			Status:   rec.status,
+			Bytes:    rec.bytes,
+			Referrer: r.Referer(),
+		}
+		if names := named(r); len(names) == 1 {
+			e.Filename = names[0]
+		} else {
+			e.Files = names
+		}
+		audit.record(e)
+	})
+}
+
+// downloadedName names the file of a request to downloadPath, once the
+// prefix has been stripped.
+func downloadedName(r *http.Request) []string {
+	return []string{strings.TrimPrefix(r.URL.Path, "/")}
+}
+
+// viewedName names the file of a request to /view/{name...}.
+func viewedName(r *http.Request) []string {
+	return []string{r.PathValue("name")}
+}
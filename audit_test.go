@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// auditTo sends the audit log to a file for the rest of the test and
+// returns a function reading back the events recorded so far.
+func auditTo(t *testing.T) func() []auditEvent {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.f.Close() })
+	set(t, &audit, a)
+	return func() []auditEvent {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var events []auditEvent
+		lines := bufio.NewScanner(f)
+		for lines.Scan() {
+			var e auditEvent
+			if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+				t.Fatalf("audit line %q: %v", lines.Text(), err)
+			}
+			events = append(events, e)
+		}
+		return events
+	}
+}
+
+func TestAuditDownloads(t *testing.T) {
+	setup(t)
+	events := auditTo(t)
+	a := uploaded(t, "/upload", "a.txt", "hello")
+	b := uploaded(t, "/upload", "b.txt", "world")
+
+	mux := http.NewServeMux()
+	mux.Handle(downloadPath, http.StripPrefix(downloadPath, auditDownloads(downloadedName, http.HandlerFunc(serveUploaded))))
+	mux.Handle("GET /view/{name...}", auditDownloads(viewedName, http.HandlerFunc(viewFile)))
+	mux.Handle("GET /api/zip", auditDownloads(zippedNames, http.HandlerFunc(downloadZip)))
+	requests := []struct {
+		target string
+		status int
+		want   auditEvent
+	}{
+		{downloadPath + a.Filename, http.StatusOK, auditEvent{Filename: a.Filename, Bytes: 5}},
+		{downloadPath + "missing.txt", http.StatusNotFound, auditEvent{Filename: "missing.txt"}},
+		{"/view/" + b.Filename, http.StatusOK, auditEvent{Filename: b.Filename}},
+		{"/api/zip?files=" + a.Filename + "," + b.Filename, http.StatusOK, auditEvent{Files: []string{a.Filename, b.Filename}}},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest(http.MethodGet, req.target, nil)
+		r.RemoteAddr = "192.0.2.7:1234"
+		r.Header.Set("Referer", "https://example.com/page")
+		if w := serve(mux, r); w.Code != req.status {
+			t.Fatalf("GET %s: status %d, want %d", req.target, w.Code, req.status)
+		}
+	}
+
+	got := events()
+	if len(got) != len(requests) {
+		t.Fatalf("%d audit lines for %d downloads: %+v", len(got), len(requests), got)
+	}
+	for i, e := range got {
+		want := requests[i].want
+		if e.Filename != want.Filename || !slices.Equal(e.Files, want.Files) {
+			t.Errorf("GET %s: logged filename %q, files %v", requests[i].target, e.Filename, e.Files)
+		}
+		if e.Method != http.MethodGet || e.Status != requests[i].status || e.RemoteIP != "192.0.2.7" || e.Referrer != "https://example.com/page" || e.Time.IsZero() {
+			t.Errorf("GET %s: logged %+v", requests[i].target, e)
+		}
+		if want.Bytes != 0 && e.Bytes != want.Bytes || e.Bytes == 0 {
+			t.Errorf("GET %s: logged %d bytes", requests[i].target, e.Bytes)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKeys holds the keys accepted for uploads. When empty, uploads are open
+// to anyone as before.
+var apiKeys []string
+
+// adminKey is the key for admin endpoints such as /api/export. They are not
+// served when it is empty.
+var adminKey string
+
+// loadAPIKeys reads the -api-keys value, which is either a path to a file
+// with one key per line or a comma-separated list of keys.
+func loadAPIKeys(value string) ([]string, error) {
+	sep := ","
+	if data, err := os.ReadFile(value); err == nil {
+		value, sep = string(data), "\n"
+	} else if !os.IsNotExist(err) && !strings.Contains(value, ",") {
+		return nil, err
+	}
+	var keys []string
+	for _, k := range strings.Split(value, sep) {
+		if k = strings.TrimSpace(k); k != "" && !strings.HasPrefix(k, "#") {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// keyID identifies an API key in logs and metadata without revealing it.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// requestAPIKey returns the key sent with r, either as a bearer token or in
+// the X-API-Key header.
+func requestAPIKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// validAPIKey compares key against every configured key in constant time, so
+// the response time doesn't reveal how much of a key was right.
+func validAPIKey(key string) bool {
+	valid := 0
+	for _, k := range apiKeys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return valid == 1
+}
+
+type keyIDKey struct{}
+
+// requestKeyID returns the ID of the API key that authenticated r, or "" when
+// API keys aren't configured.
+func requestKeyID(r *http.Request) string {
+	id, _ := r.Context().Value(keyIDKey{}).(string)
+	return id
+}
+
+// requireAPIKey rejects requests without a valid API key when keys are
+// configured: 401 when none was sent and 403 when it isn't recognised. The
+// key's ID is attached to the request logger so uploads can be traced back
+// to it.
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(apiKeys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := requestAPIKey(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="filehost"`)
+			writeJSONError(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		if !validAPIKey(key) {
+			requestLogger(r).Warn("Rejected invalid API key")
+			writeJSONError(w, "Invalid API key", http.StatusForbidden)
+			return
+		}
+		id := keyID(key)
+		ctx := context.WithValue(r.Context(), keyIDKey{}, id)
+		ctx = context.WithValue(ctx, loggerKey{}, requestLogger(r).With("api_key", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAdmin lets through only requests carrying adminKey, sent like an
+// API key.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="filehost"`)
+			writeJSONError(w, "Admin key required", http.StatusUnauthorized)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+			requestLogger(r).Warn("Rejected invalid admin key")
+			writeJSONError(w, "Invalid admin key", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// basicAuthUser and basicAuthPassword, set with -basic-auth, are required
+// for every request but health checks when basicAuthUser isn't empty.
+var basicAuthUser, basicAuthPassword string
+
+// parseBasicAuth reads the user:pass value of -basic-auth.
+func parseBasicAuth(value string) error {
+	user, pass, ok := strings.Cut(value, ":")
+	if !ok || user == "" {
+		return errors.New("expected user:pass")
+	}
+	basicAuthUser, basicAuthPassword = user, pass
+	return nil
+}
+
+// requireBasicAuth lets through only requests with the -basic-auth
+// credentials. Both are compared as hashes so neither their contents nor
+// their lengths show in the timing. Health checks stay open for probes,
+// which can't be given credentials.
+func requireBasicAuth(next http.Handler) http.Handler {
+	wantUser := sha256.Sum256([]byte(basicAuthUser))
+	wantPass := sha256.Sum256([]byte(basicAuthPassword))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		gotUser := sha256.Sum256([]byte(user))
+		gotPass := sha256.Sum256([]byte(pass))
+		if !ok || subtle.ConstantTimeCompare(gotUser[:], wantUser[:])&subtle.ConstantTimeCompare(gotPass[:], wantPass[:]) != 1 {
+			if ok {
+				requestLogger(r).Warn("Rejected invalid basic auth credentials", "user", user)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="filehost", charset="UTF-8"`)
+			writeJSONError(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
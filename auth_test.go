@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadAPIKeys(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keyFile, []byte("# uploaders\nkey-one\n\n  key-two  \n"), 0600)
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"alpha,beta", []string{"alpha", "beta"}, false},
+		{" alpha , ,beta ", []string{"alpha", "beta"}, false},
+		{keyFile, []string{"key-one", "key-two"}, false},
+		// A single key that isn't a file is taken as the key itself.
+		{"lonely-key", []string{"lonely-key"}, false},
+	}
+	for _, tt := range tests {
+		got, err := loadAPIKeys(tt.value)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("loadAPIKeys(%q) = %v, %v; want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		header  string
+		value   string
+		status  int
+		wantID  string
+		wantWWW bool
+	}{
+		{"keys not configured", nil, "", "", http.StatusOK, "", false},
+		{"missing key", []string{"secret"}, "", "", http.StatusUnauthorized, "", true},
+		{"wrong key", []string{"secret"}, "X-API-Key", "guess", http.StatusForbidden, "", false},
+		{"X-API-Key", []string{"other", "secret"}, "X-API-Key", "secret", http.StatusOK, keyID("secret"), false},
+		{"bearer token", []string{"secret"}, "Authorization", "Bearer secret", http.StatusOK, keyID("secret"), false},
+		{"prefix of a key", []string{"secret"}, "X-API-Key", "secre", http.StatusForbidden, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set(t, &apiKeys, tt.keys)
+			var gotID string
+			h := requireAPIKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { gotID = requestKeyID(r) }))
+			r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			w := serve(h, r)
+			if w.Code != tt.status || gotID != tt.wantID {
+				t.Errorf("status %d, key ID %q; want %d, %q", w.Code, gotID, tt.status, tt.wantID)
+			}
+			if (w.Header().Get("WWW-Authenticate") != "") != tt.wantWWW {
+				t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+// TestUploadRecordsOwner checks uploads remember the key that made them.
+func TestUploadRecordsOwner(t *testing.T) {
+	setup(t)
+	set(t, &apiKeys, []string{"secret"})
+	r := uploadRequest(t, "/upload", file("a.txt", "hello"))
+	r.Header.Set("X-API-Key", "secret")
+	w := serve(requireAPIKey(http.HandlerFunc(uploadFile)), r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	m, _ := metadata.get(decodeUploads(t, w)[0].Filename)
+	if m.Owner != keyID("secret") {
+		t.Errorf("owner %q, want %q", m.Owner, keyID("secret"))
+	}
+}
+
+// basicAuthServer is /upload and downloadPath behind -basic-auth
+// admin:s3cret.
+func basicAuthServer(t *testing.T) http.Handler {
+	t.Helper()
+	set(t, &basicAuthUser, "admin")
+	set(t, &basicAuthPassword, "s3cret")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", uploadFile)
+	mux.Handle(downloadPath, http.StripPrefix(downloadPath, http.HandlerFunc(serveUploaded)))
+	return requireBasicAuth(mux)
+}
+
+func TestBasicAuth(t *testing.T) {
+	setup(t)
+	h := basicAuthServer(t)
+	up := uploaded(t, "/upload", "a.txt", "hello")
+	tests := []struct {
+		name   string
+		user   string
+		pass   string
+		status int
+	}{
+		{"missing", "", "", http.StatusUnauthorized},
+		{"wrong password", "admin", "guess", http.StatusUnauthorized},
+		{"wrong user", "root", "s3cret", http.StatusUnauthorized},
+		{"correct", "admin", "s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := map[string]*http.Request{
+				"upload":   uploadRequest(t, "/upload", file("b.txt", "hi")),
+				"download": httptest.NewRequest(http.MethodGet, downloadPath+up.Filename, nil),
+			}
+			for kind, r := range requests {
+				if tt.user != "" {
+					r.SetBasicAuth(tt.user, tt.pass)
+				}
+				w := serve(h, r)
+				if w.Code != tt.status {
+					t.Errorf("%s: status %d, want %d", kind, w.Code, tt.status)
+				}
+				if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+					t.Errorf("%s: no WWW-Authenticate", kind)
+				}
+			}
+		})
+	}
+}
+
+// TestBasicAuthFilePasswords checks password-protected files take their
+// password from the query under -basic-auth, as the Authorization header
+// holds the server's credentials.
+func TestBasicAuthFilePasswords(t *testing.T) {
+	setup(t)
+	h := basicAuthServer(t)
+	up := uploaded(t, "/upload?password=filepw", "a.txt", "private")
+	for _, tt := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"?password=wrong", http.StatusUnauthorized},
+		{"?password=filepw", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, downloadPath+up.Filename+tt.query, nil)
+		r.SetBasicAuth("admin", "s3cret")
+		w := serve(h, r)
+		if w.Code != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.query, w.Code, tt.status)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != "" {
+			t.Errorf("%q: WWW-Authenticate = %q would replace the server credentials", tt.query, got)
+		}
+	}
+}
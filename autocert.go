@@ -0,0 +1,29 @@
+//go:build autocert
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func init() {
+	autocertListen = func(server *http.Server, domains []string, cacheDir string) error {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(cacheDir),
+		}
+		// Answer HTTP-01 challenges on port 80 and redirect everything else
+		// to HTTPS.
+		go func() {
+			if err := http.ListenAndServe(":80", m.HTTPHandler(nil)); err != nil {
+				slog.Error("Error serving ACME challenges", "err", err)
+			}
+		}()
+		server.TLSConfig = m.TLSConfig()
+		return server.ListenAndServeTLS("", "")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build autocert
+
+package main
+
+import "testing"
+
+func TestAutocertRegistered(t *testing.T) {
+	if autocertListen == nil {
+		t.Fatal("autocertListen not set in an autocert build")
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// isTempFile reports whether name, a base name inside uploadDir, is a
+// scratch file that only matters to the request writing it.
+func isTempFile(name string) bool {
+	for _, prefix := range []string{".upload-", ".meta-", ".readyz-", ".strip-", ".import-"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportStore streams uploadDir as it is on disk as a .tar.gz, metadata,
+// download stats, short links and unfinished tus uploads included, for
+// importStore on another server. Files stay encrypted with -encryption-key,
+// and with -storage s3 only the metadata is in uploadDir. Files in the other
+// -upload-dirs are exported as if they were in uploadDir. Symlinks, devices
+// and other non-regular files are left out.
+func exportStore(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	if err := downloadStats.flush(); err != nil {
+		logger.Error("Error saving download stats", "err", err)
+	}
+
+	filename := "filehost-export-" + time.Now().UTC().Format("20060102-150405") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	files := 0
+	var err error
+	for _, dir := range uploadDirs {
+		err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() || isTempFile(d.Name()) {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			if err := addTarFile(tw, p, filepath.ToSlash(rel)); err != nil {
+				return err
+			}
+			files++
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		// The response has started, so all we can do is cut it short.
+		logger.Error("Error writing export", "err", err)
+		return
+	}
+	logger.Info("Exported store", "files", files)
+}
+
+// addTarFile writes the file at p to tw as name. A file that was replaced
+// by something other than a regular file since it was listed is skipped.
+func addTarFile(tw *tar.Writer, p, name string) error {
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// The file may still be growing, as with an unfinished tus upload, so
+	// copy only the size the header promised.
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
+
+// ImportResponse reports what importStore unpacked.
+type ImportResponse struct {
+	Files   int `json:"files"`
+	Skipped int `json:"skipped"`
+}
+
+// importStore unpacks a .tar.gz from exportStore into uploadDir, replacing
+// files of the same name. The metadata, download stats and short links in
+// the archive are merged into the running server's rather than written over
+// them.
+// Entries are written through an os.Root, so no name can reach outside
+// uploadDir; names that try are rejected, and anything but regular files
+// and directories is skipped. Files are unpacked to temp files and only
+// moved into place once the whole archive has been read, when the metadata
+// that may come after them is known: under -strict-unique, files whose
+// recorded hash is already stored under another name are skipped. Other
+// storage backends would never serve files put in uploadDir, so with them
+// nothing is imported.
+func importStore(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	if !isLocalStore(store) {
+		writeJSONError(w, "Importing only works with -storage local", http.StatusNotImplemented)
+		return
+	}
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		writeJSONError(w, "Request body is not a .tar.gz archive", http.StatusBadRequest)
+		return
+	}
+	defer gz.Close()
+	root, err := os.OpenRoot(uploadDir)
+	if err != nil {
+		logger.Error("Error opening upload directory", "err", err)
+		writeJSONError(w, "Unable to import files", http.StatusInternalServerError)
+		return
+	}
+	defer root.Close()
+
+	var response ImportResponse
+	var staged []stagedImport
+	defer func() {
+		for _, f := range staged {
+			root.Remove(f.tmpName)
+		}
+	}()
+	var files map[string]fileMeta
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Warn("Error reading import archive", "err", err)
+			writeJSONError(w, "Unable to read archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			logger.Warn("Rejected import entry", "entry", hdr.Name)
+			writeJSONError(w, "Invalid entry name "+hdr.Name, http.StatusBadRequest)
+			return
+		}
+		switch {
+		case hdr.Typeflag == tar.TypeDir:
+			err = root.MkdirAll(name, dirMode)
+		case hdr.Typeflag != tar.TypeReg || isTempFile(path.Base(name)):
+			logger.Info("Skipping import entry", "entry", hdr.Name, "type", string(hdr.Typeflag))
+			response.Skipped++
+			continue
+		case name == metaFilename:
+			err = json.NewDecoder(tr).Decode(&files)
+		case name == statsFilename:
+			var files map[string]fileStats
+			if err = json.NewDecoder(tr).Decode(&files); err == nil {
+				downloadStats.merge(files)
+			}
+		case name == linksFilename:
+			var codes map[string]shortLink
+			if err = json.NewDecoder(tr).Decode(&codes); err == nil {
+				err = links.merge(codes)
+			}
+		default:
+			var f stagedImport
+			f, err = stageImport(root, name, tr, hdr.ModTime)
+			if err == nil {
+				staged = append(staged, f)
+			}
+		}
+		if isDiskFull(err) {
+			logger.Error("Out of storage space", "err", err)
+			writeJSONError(w, "Not enough storage space left on the server", http.StatusInsufficientStorage)
+			return
+		}
+		if err != nil {
+			logger.Error("Error importing file", "entry", hdr.Name, "err", err)
+			writeJSONError(w, "Unable to import "+hdr.Name, http.StatusInternalServerError)
+			return
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			response.Files++
+		}
+	}
+
+	imported, skipped, err := commitImport(logger, root, staged, files)
+	staged = nil
+	if err != nil {
+		logger.Error("Error importing files", "err", err)
+		writeJSONError(w, "Unable to import files", http.StatusInternalServerError)
+		return
+	}
+	response.Files -= skipped
+	response.Skipped += skipped
+
+	for _, f := range imported {
+		quotas.remove(f.name)
+		if m, ok := metadata.get(f.name); ok && m.Owner != "" {
+			quotas.add(f.name, m.Owner, f.size)
+		}
+		if c, ok := store.(*cachedStorage); ok {
+			c.invalidate(f.name)
+		}
+	}
+	logger.Info("Imported store", "files", response.Files, "skipped", response.Skipped)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// isLocalStore reports whether s keeps files in uploadDir, where
+// importStore unpacks them, once any encryption or caching is looked past.
+func isLocalStore(s Storage) bool {
+	switch s := s.(type) {
+	case localStorage, *multiDirStorage:
+		return true
+	case *encryptedStorage:
+		return isLocalStore(s.Storage)
+	case *cachedStorage:
+		return isLocalStore(s.Storage)
+	}
+	return false
+}
+
+// stagedImport is a file of an import archive unpacked to tmpName, next to
+// where it goes.
+type stagedImport struct {
+	name    string
+	tmpName string
+	size    int64
+}
+
+// stageImport writes r to a temp file next to name inside root, with the
+// modification time it was exported with, so a failed import doesn't leave
+// a truncated file in place of a good one.
+func stageImport(root *os.Root, name string, r io.Reader, modTime time.Time) (stagedImport, error) {
+	if err := root.MkdirAll(path.Dir(name), dirMode); err != nil {
+		return stagedImport{}, err
+	}
+	tmpName := path.Join(path.Dir(name), ".import-"+generateRandomString(16))
+	f, err := root.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+	if err != nil {
+		return stagedImport{}, err
+	}
+	size, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = root.Chtimes(tmpName, modTime, modTime)
+	}
+	if err != nil {
+		root.Remove(tmpName)
+		return stagedImport{}, err
+	}
+	return stagedImport{name: name, tmpName: tmpName, size: size}, nil
+}
+
+// commitImport moves staged files into place and merges files, the
+// archive's metadata, returning the files it moved and how many it skipped.
+// Under -strict-unique it holds duplicateMu like storeUnique, and skips
+// files whose hash in files is stored under another name already or by an
+// earlier file of the archive. Temp files left over are removed.
+func commitImport(logger *slog.Logger, root *os.Root, staged []stagedImport, files map[string]fileMeta) ([]stagedImport, int, error) {
+	if strictUnique {
+		duplicateMu.Lock()
+		defer duplicateMu.Unlock()
+	}
+	var imported []stagedImport
+	skipped := 0
+	sums := make(map[string]bool)
+	for i, f := range staged {
+		sum := files[f.name].Sha256
+		if strictUnique && sum != "" {
+			other, found := metadata.findAnySha256(sum, f.name)
+			if found || sums[sum] {
+				logger.Info("Skipping duplicate import entry", "entry", f.name, "duplicate_of", other)
+				root.Remove(f.tmpName)
+				delete(files, f.name)
+				skipped++
+				continue
+			}
+			sums[sum] = true
+		}
+		if err := root.Rename(f.tmpName, f.name); err != nil {
+			for _, f := range staged[i:] {
+				root.Remove(f.tmpName)
+			}
+			return imported, skipped, err
+		}
+		imported = append(imported, f)
+	}
+	if files == nil {
+		return imported, skipped, nil
+	}
+	return imported, skipped, metadata.merge(files)
+}
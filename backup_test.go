@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// exportArchive returns an export of the current store.
+func exportArchive(t *testing.T) []byte {
+	t.Helper()
+	w := serve(http.HandlerFunc(exportStore), httptest.NewRequest(http.MethodGet, "/api/export", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: status %d: %s", w.Code, w.Body)
+	}
+	return w.Body.Bytes()
+}
+
+// importArchive imports archive into the current store.
+func importArchive(t *testing.T, archive []byte) (ImportResponse, *httptest.ResponseRecorder) {
+	t.Helper()
+	w := serve(http.HandlerFunc(importStore), httptest.NewRequest(http.MethodPost, "/api/import", bytes.NewReader(archive)))
+	var response ImportResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response, w
+}
+
+func TestImportStrictUnique(t *testing.T) {
+	setup(t)
+	dup := uploaded(t, "/upload", "dup.txt", "already here")
+	fresh := uploaded(t, "/upload", "fresh.txt", "new content")
+	archive := exportArchive(t)
+
+	setup(t)
+	set(t, &strictUnique, true)
+	local := uploaded(t, "/upload", "local.txt", "already here")
+	response, w := importArchive(t, archive)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: status %d: %s", w.Code, w.Body)
+	}
+	if response.Skipped != 1 {
+		t.Errorf("response %+v, want one skipped file", response)
+	}
+	if w := get(dup.Filename); w.Code != http.StatusNotFound {
+		t.Errorf("duplicate imported: status %d", w.Code)
+	}
+	if _, ok := metadata.get(dup.Filename); ok {
+		t.Error("metadata of the skipped file was merged")
+	}
+	if w := get(fresh.Filename); w.Body.String() != "new content" {
+		t.Errorf("imported file: status %d, body %q", w.Code, w.Body)
+	}
+	if w := get(local.Filename); w.Body.String() != "already here" {
+		t.Errorf("local file: status %d, body %q", w.Code, w.Body)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	setup(t)
+	plain := uploaded(t, "/upload?description=notes", "notes.txt", "hello")
+	protected := uploaded(t, "/upload?password=hunter2", "secret.txt", "private")
+	w := upload(t, "/upload?preservePaths=1", file("docs/nested.txt", "deep"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+	}
+	nested := decodeUploads(t, w)[0]
+	get(plain.Filename)
+	if err := links.add("abc123", shortLink{URL: "https://example.com/", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	archive := exportArchive(t)
+
+	setup(t)
+	response, w := importArchive(t, archive)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: status %d: %s", w.Code, w.Body)
+	}
+	// The three files plus metadata, download stats and short links.
+	if response.Files != 6 || response.Skipped != 0 {
+		t.Errorf("response %+v", response)
+	}
+	for name, want := range map[string]string{plain.Filename: "hello", nested.Filename: "deep"} {
+		if w := get(name); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%s: status %d, body %q", name, w.Code, w.Body)
+		}
+	}
+	if w := get(protected.Filename); w.Code != http.StatusUnauthorized {
+		t.Errorf("protected file without password: status %d", w.Code)
+	}
+	if w := get(protected.Filename + "?password=hunter2"); w.Body.String() != "private" {
+		t.Errorf("protected file: body %q", w.Body)
+	}
+	if m, _ := metadata.get(plain.Filename); m.Description != "notes" || m.Sha256 != plain.Sha256 {
+		t.Errorf("metadata %+v", m)
+	}
+	// One download before the export and one just now.
+	if got := downloadStats.get(plain.Filename).Downloads; got != 2 {
+		t.Errorf("%d downloads, want 2", got)
+	}
+	if l, ok := links.get("abc123"); !ok || l.URL != "https://example.com/" {
+		t.Errorf("short link %+v, %v", l, ok)
+	}
+	if names := stored(t); len(names) != 3 {
+		t.Errorf("stored %v, want 3 files", names)
+	}
+}
+
+// tarGz builds an import archive with one regular file per entry.
+func tarGz(t *testing.T, entries map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range entries {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportErrors(t *testing.T) {
+	setup(t)
+	tests := []struct {
+		name    string
+		archive []byte
+		status  int
+	}{
+		{"not gzip", []byte("plain text"), http.StatusBadRequest},
+		{"escaping name", tarGz(t, map[string]string{"../escape.txt": "x"}), http.StatusBadRequest},
+		{"absolute name", tarGz(t, map[string]string{"/etc/escape.txt": "x"}), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, w := importArchive(t, tt.archive); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if names := stored(t); len(names) != 0 {
+				t.Errorf("stored %v", names)
+			}
+		})
+	}
+}
+
+// TestImportNonLocalStorage checks imports are refused when the files
+// unpacked into uploadDir would never be served.
+func TestImportNonLocalStorage(t *testing.T) {
+	setup(t)
+	set(t, &store, Storage(newTestS3Storage(t)))
+	if _, w := importArchive(t, tarGz(t, map[string]string{"a.txt": "hello"})); w.Code != http.StatusNotImplemented {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+	if !isLocalStore(newCachedStorage(newTestEncryptedStorage(t, localStorage{dir: t.TempDir()}), 1<<20, 1<<10)) {
+		t.Error("encrypted local storage behind a cache isn't local")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"time"
+)
+
+//go:embed templates/browse.html
+var browseTemplateFS embed.FS
+
+var browsePage = template.Must(template.ParseFS(browseTemplateFS, "templates/browse.html"))
+
+// browseEntry is one row of the /browse page.
+type browseEntry struct {
+	Filename     string
+	Description  string
+	URL          string
+	ThumbnailURL string
+	DeleteURL    string
+	Size         string
+	ModTime      time.Time
+}
+
+// browseFiles renders an HTML page listing the newest uploads, as
+// /api/files does, with thumbnails for images and delete buttons.
+func browseFiles(w http.ResponseWriter, r *http.Request) {
+	files, err := listLiveFiles()
+	if err != nil {
+		requestLogger(r).Error("Error listing files", "err", err)
+		writeJSONError(w, "Unable to list files", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	files = files[:min(len(files), maxListLimit)]
+
+	entries := make([]browseEntry, 0, len(files))
+	for _, f := range files {
+		e := browseEntry{
+			Filename:  f.Name,
+			URL:       fileURL(f.Name),
+			DeleteURL: prefixedPath("/files/" + (&url.URL{Path: f.Name}).EscapedPath()),
+			Size:      formatSize(f.Size),
+			ModTime:   f.ModTime.UTC(),
+		}
+		m, _ := metadata.get(f.Name)
+		e.Description = m.Description
+		// Protected images never get a thumbnail.
+		if m.PasswordHash == "" && canThumbnail(mime.TypeByExtension(path.Ext(f.Name))) {
+			e.ThumbnailURL = fileURL(thumbName(f.Name))
+		}
+		entries = append(entries, e)
+	}
+
+	var page bytes.Buffer
+	err = browsePage.Execute(&page, map[string]any{"Files": entries})
+	if err != nil {
+		requestLogger(r).Error("Error rendering file list", "err", err)
+		writeJSONError(w, "Unable to list files", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(page.Bytes())
+}
+
+// formatSize formats n bytes with a binary unit, like 1.5 MiB.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// browse renders the /browse page.
+func browse(t *testing.T) string {
+	t.Helper()
+	w := serve(http.HandlerFunc(browseFiles), httptest.NewRequest(http.MethodGet, "/browse", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	return w.Body.String()
+}
+
+func TestBrowseEmpty(t *testing.T) {
+	setup(t)
+	if page := browse(t); !strings.Contains(page, "Nothing has been uploaded yet.") {
+		t.Errorf("empty page doesn't say so:\n%s", page)
+	}
+}
+
+func TestBrowseFiles(t *testing.T) {
+	setup(t)
+	set(t, &urlPrefix, "/fh")
+	notes := uploaded(t, "/upload", "notes.txt", strings.Repeat("n", 1536))
+	image := uploaded(t, "/upload", "photo.png", testPNG(t, 4, 4))
+	protected := uploaded(t, "/upload?password=hunter2", "private.png", testPNG(t, 4, 4))
+	described := upload(t, "/upload", formPart{field: "description", content: "<b>bold</b> & more"}, file("d.txt", "d"))
+	if described.Code != http.StatusOK {
+		t.Fatalf("upload with description: status %d: %s", described.Code, described.Body)
+	}
+	if err := store.Put(`x"><script>alert(1)</script>.txt`, strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	page := browse(t)
+
+	tests := []struct {
+		name     string
+		contains string
+		want     bool
+	}{
+		{"file name", ">" + notes.Filename + "</a>", true},
+		{"file link", `href="` + notes.URL + `"`, true},
+		{"size", "1.5 KiB", true},
+		{"thumbnail", `src="` + fileURL(thumbName(image.Filename)) + `"`, true},
+		{"no thumbnail for protected images", thumbName(protected.Filename), false},
+		{"delete under the prefix", `data-url="/fh/files/` + notes.Filename + `"`, true},
+		{"description escaped", "&lt;b&gt;bold&lt;/b&gt; &amp; more", true},
+		{"name escaped", "<script>alert(1)</script>", false},
+		{"escaped name shown", "&lt;script&gt;alert(1)&lt;/script&gt;", true},
+		{"thumbnails not listed", ">" + thumbName(image.Filename) + "<", false},
+	}
+	for _, tt := range tests {
+		if got := strings.Contains(page, tt.contains); got != tt.want {
+			t.Errorf("%s: page contains %q = %v, want %v", tt.name, tt.contains, got, tt.want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
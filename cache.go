@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// cachedStorage keeps the contents of small, recently downloaded files in
+// memory, evicting the least recently used once maxBytes is reached. Files
+// larger than maxFile are always read from the backend.
+type cachedStorage struct {
+	Storage
+	maxBytes int64
+	maxFile  int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	// generation counts invalidations. A file read on a miss is only added
+	// if there was none while it was read, so a file deleted meanwhile
+	// can't be put back.
+	generation uint64
+}
+
+type cacheEntry struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+var cacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "filehost_cache_requests_total",
+	Help: "Downloads looked up in the file cache, by result.",
+}, []string{"result"})
+
+func newCachedStorage(s Storage, maxBytes, maxFile int64) *cachedStorage {
+	return &cachedStorage{
+		Storage:  s,
+		maxBytes: maxBytes,
+		maxFile:  min(maxFile, maxBytes),
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (s *cachedStorage) Get(name string) (StoredFile, error) {
+	s.mu.Lock()
+	if el, ok := s.entries[name]; ok {
+		s.order.MoveToFront(el)
+		e := el.Value.(*cacheEntry)
+		s.mu.Unlock()
+		cacheRequestsTotal.WithLabelValues("hit").Inc()
+		return memFile{bytes.NewReader(e.data), e.modTime}, nil
+	}
+	generation := s.generation
+	s.mu.Unlock()
+	cacheRequestsTotal.WithLabelValues("miss").Inc()
+
+	f, err := s.Storage.Get(name)
+	if err != nil || f.Size() > s.maxFile {
+		return f, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, s.maxFile+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.maxFile {
+		// The file grew since Size was read; don't cache a partial copy.
+		return s.Storage.Get(name)
+	}
+	s.add(&cacheEntry{name: name, data: data, modTime: f.ModTime()}, generation)
+	return memFile{bytes.NewReader(data), f.ModTime()}, nil
+}
+
+// add caches e, read when the cache was at generation.
+func (s *cachedStorage) add(e *cacheEntry, generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != generation {
+		return
+	}
+	s.removeLocked(e.name)
+	s.entries[e.name] = s.order.PushFront(e)
+	s.size += int64(len(e.data))
+	for s.size > s.maxBytes {
+		s.removeLocked(s.order.Back().Value.(*cacheEntry).name)
+	}
+}
+
+// invalidate drops name from the cache. Changes to a file invalidate it
+// both before and after, so reads that overlap the change never cache it.
+func (s *cachedStorage) invalidate(name string) {
+	s.mu.Lock()
+	s.generation++
+	s.removeLocked(name)
+	s.mu.Unlock()
+}
+
+func (s *cachedStorage) removeLocked(name string) {
+	el, ok := s.entries[name]
+	if !ok {
+		return
+	}
+	s.order.Remove(el)
+	delete(s.entries, name)
+	s.size -= int64(len(el.Value.(*cacheEntry).data))
+}
+
+func (s *cachedStorage) Put(name string, r io.Reader) error {
+	s.invalidate(name)
+	return s.Storage.Put(name, r)
+}
+
+// PutFile keeps the wrapped backend's fast path for adopting local files.
+func (s *cachedStorage) PutFile(name, path string) error {
+	s.invalidate(name)
+	if a, ok := s.Storage.(fileAdopter); ok {
+		return a.PutFile(name, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Storage.Put(name, f)
+}
+
+func (s *cachedStorage) Delete(name string) error {
+	s.invalidate(name)
+	defer s.invalidate(name)
+	return s.Storage.Delete(name)
+}
+
+// memFile is a cached file served from memory.
+type memFile struct {
+	*bytes.Reader
+	modTime time.Time
+}
+
+func (f memFile) ModTime() time.Time { return f.modTime }
+func (f memFile) Close() error       { return nil }
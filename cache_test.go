@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestCache returns a cache over a local directory, which it also
+// returns so tests can change files behind the cache's back.
+func newTestCache(t *testing.T, maxBytes, maxFile int64) (*cachedStorage, string) {
+	dir := t.TempDir()
+	return newCachedStorage(localStorage{dir: dir}, maxBytes, maxFile), dir
+}
+
+// readStored reads name from s.
+func readStored(t *testing.T, s Storage, name string) string {
+	t.Helper()
+	f, err := s.Get(name)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCacheHit(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		cached  bool
+	}{
+		{"small file", "small", true},
+		{"at the file limit", strings.Repeat("x", 100), true},
+		{"over the file limit", strings.Repeat("x", 101), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, dir := newTestCache(t, 1000, 100)
+			if err := s.Put("f", strings.NewReader(tt.content)); err != nil {
+				t.Fatal(err)
+			}
+			if got := readStored(t, s, "f"); got != tt.content {
+				t.Fatalf("first read = %q", got)
+			}
+			// Changing the file on disk shows whether the second read came
+			// from memory.
+			if err := os.WriteFile(filepath.Join(dir, "f"), []byte("changed"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			hits := metric(t, `filehost_cache_requests_total{result="hit"}`)
+			got := readStored(t, s, "f")
+			if cached := got == tt.content; cached != tt.cached {
+				t.Errorf("second read = %q, cached %v, want %v", got, cached, tt.cached)
+			}
+			if got := metric(t, `filehost_cache_requests_total{result="hit"}`) - hits; (got == 1) != tt.cached {
+				t.Errorf("hits counted = %v", got)
+			}
+		})
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, s *cachedStorage)
+		want   string
+	}{
+		{"delete", func(t *testing.T, s *cachedStorage) {
+			if err := s.Delete("f"); err != nil {
+				t.Fatal(err)
+			}
+		}, ""},
+		{"replace", func(t *testing.T, s *cachedStorage) {
+			if err := s.Replace("f", strings.NewReader("replaced")); err != nil {
+				t.Fatal(err)
+			}
+		}, "replaced"},
+		{"delete and put", func(t *testing.T, s *cachedStorage) {
+			if err := s.Delete("f"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put("f", strings.NewReader("new")); err != nil {
+				t.Fatal(err)
+			}
+		}, "new"},
+		{"rename away", func(t *testing.T, s *cachedStorage) {
+			if err := s.Rename("f", "g"); err != nil {
+				t.Fatal(err)
+			}
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestCache(t, 1000, 100)
+			if err := s.Put("f", strings.NewReader("original")); err != nil {
+				t.Fatal(err)
+			}
+			readStored(t, s, "f")
+			tt.change(t, s)
+			if tt.want == "" {
+				if _, err := s.Get("f"); err == nil {
+					t.Error("Get succeeded after the file was removed")
+				}
+				return
+			}
+			if got := readStored(t, s, "f"); got != tt.want {
+				t.Errorf("read after change = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	s, dir := newTestCache(t, 100, 50)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := s.Put(name, strings.NewReader(strings.Repeat(name, 40))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readStored(t, s, "a")
+	readStored(t, s, "b")
+	readStored(t, s, "a") // a is now the most recently used
+	readStored(t, s, "c") // over 100 bytes, so b goes
+	if s.size > s.maxBytes {
+		t.Errorf("cache holds %d bytes, more than %d", s.size, s.maxBytes)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("changed"), 0o644)
+	}
+	tests := []struct {
+		name   string
+		cached bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	}
+	for _, tt := range tests {
+		if cached := readStored(t, s, tt.name) != "changed"; cached != tt.cached {
+			t.Errorf("%s cached = %v, want %v", tt.name, cached, tt.cached)
+		}
+	}
+}
+
+// TestCachedDownload checks that downloads served from the cache keep
+// their validators and are dropped when the file is deleted.
+func TestCachedDownload(t *testing.T) {
+	setup(t)
+	set(t, &store, Storage(newCachedStorage(localStorage{dir: uploadDir}, 1<<20, 64<<10)))
+	up := uploaded(t, "/upload", "a.txt", "hot file")
+
+	first := get(up.Filename)
+	second := get(up.Filename)
+	for _, h := range []string{"ETag", "Last-Modified"} {
+		if first.Header().Get(h) == "" || first.Header().Get(h) != second.Header().Get(h) {
+			t.Errorf("%s = %q, then %q from the cache", h, first.Header().Get(h), second.Header().Get(h))
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, downloadPath+up.Filename, nil)
+	r.Header.Set("If-None-Match", first.Header().Get("ETag"))
+	if w := download(r); w.Code != http.StatusNotModified {
+		t.Errorf("conditional GET from the cache: status %d, want 304", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/files/"+up.Filename, nil)
+	req.SetPathValue("name", up.Filename)
+	if w := serve(http.HandlerFunc(deleteFile), req); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	if w := get(up.Filename); w.Code != http.StatusNotFound {
+		t.Errorf("download after delete: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// clamavAddr is the clamd daemon uploads are scanned with, either host:port
+// or the path of its Unix socket. Scanning is disabled when it's empty.
+var clamavAddr string
+
+const (
+	clamavChunkSize = 64 << 10
+	clamavTimeout   = 2 * time.Minute
+)
+
+// scanContent streams r to clamd with the INSTREAM command. It returns the
+// name of the signature found, or "" if the content is clean. With no daemon
+// configured it does nothing.
+func scanContent(r io.Reader) (string, error) {
+	if clamavAddr == "" {
+		return "", nil
+	}
+	network := "tcp"
+	if strings.HasPrefix(clamavAddr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, clamavAddr, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamavTimeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamavChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return "", werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	// Replies look like "stream: OK" or "stream: Eicar-Signature FOUND".
+	result := strings.TrimPrefix(string(bytes.TrimRight(reply, "\x00\n")), "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", result)
+	}
+}
+
+// scanFile is scanContent for a file on local disk.
+func scanFile(path string) (string, error) {
+	if clamavAddr == "" {
+		return "", nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return scanContent(f)
+}
+
+// scanUpload scans an upload before it is stored. With a scanner
+// configured, src is spooled to a temp file in uploadDir, which is scanned
+// and returned to read the content from; closing it removes it. Otherwise
+// src is returned as it is.
+func scanUpload(src io.Reader) (io.ReadCloser, string, error) {
+	if clamavAddr == "" {
+		return io.NopCloser(src), "", nil
+	}
+	tmp, err := os.CreateTemp(uploadDir, ".upload-*")
+	if err != nil {
+		return nil, "", err
+	}
+	spooled := &tempFile{tmp}
+	signature, err := func() (string, error) {
+		if _, err := io.Copy(tmp, src); err != nil {
+			return "", err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		signature, err := scanContent(tmp)
+		if err != nil {
+			return "", err
+		}
+		_, err = tmp.Seek(0, io.SeekStart)
+		return signature, err
+	}()
+	if err != nil {
+		spooled.Close()
+		return nil, "", err
+	}
+	return spooled, signature, nil
+}
+
+// tempFile is a temp file that is removed when closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// eicar stands in for an infected file: the fake clamd finds it in any
+// stream containing it.
+const eicar = "EICAR-TEST-SIGNATURE"
+
+// fakeClamd listens on network and answers INSTREAM commands the way clamd
+// does, replying with reply if it is set. It returns the address to set
+// clamavAddr to, and a channel receiving each stream it is sent.
+func fakeClamd(t *testing.T, network, reply string) (addr string, streams <-chan string) {
+	t.Helper()
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "clamd.sock")
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			stream, err := readInstream(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			received <- stream
+			switch {
+			case reply != "":
+				io.WriteString(conn, reply+"\x00")
+			case strings.Contains(stream, eicar):
+				io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+			default:
+				io.WriteString(conn, "stream: OK\x00")
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+// readInstream reads a zINSTREAM command and its chunks from conn.
+func readInstream(conn net.Conn) (string, error) {
+	cmd := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, cmd); err != nil {
+		return "", err
+	}
+	var stream bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return "", err
+		}
+		if size == 0 {
+			return stream.String(), nil
+		}
+		if _, err := io.CopyN(&stream, conn, int64(size)); err != nil {
+			return "", err
+		}
+	}
+}
+
+func TestScanContent(t *testing.T) {
+	large := strings.Repeat("x", 3*clamavChunkSize+10)
+	tests := []struct {
+		name      string
+		network   string
+		reply     string
+		content   string
+		signature string
+		wantErr   bool
+	}{
+		{"clean", "tcp", "", "hello", "", false},
+		{"infected", "tcp", "", "prefix " + eicar, "Eicar-Signature", false},
+		{"several chunks", "tcp", "", large, "", false},
+		{"infected after first chunk", "tcp", "", large + eicar, "Eicar-Signature", false},
+		{"empty", "tcp", "", "", "", false},
+		{"unix socket", "unix", "", eicar, "Eicar-Signature", false},
+		{"error reply", "tcp", "INSTREAM size limit exceeded. ERROR", "hello", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, streams := fakeClamd(t, tt.network, tt.reply)
+			set(t, &clamavAddr, addr)
+			signature, err := scanContent(strings.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("scanContent: err = %v, want error %v", err, tt.wantErr)
+			}
+			if signature != tt.signature {
+				t.Errorf("signature = %q, want %q", signature, tt.signature)
+			}
+			// The reply is only sent once the stream has been received.
+			if got := <-streams; got != tt.content {
+				t.Errorf("clamd was sent %d bytes, want the %d of the content", len(got), len(tt.content))
+			}
+		})
+	}
+}
+
+func TestScanDisabled(t *testing.T) {
+	set(t, &clamavAddr, "")
+	signature, err := scanContent(strings.NewReader(eicar))
+	if err != nil || signature != "" {
+		t.Errorf("scanContent with no daemon = %q, %v, want nothing found", signature, err)
+	}
+}
+
+func TestScanUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	set(t, &clamavAddr, addr)
+	if _, err := scanContent(strings.NewReader("hello")); err == nil {
+		t.Error("scanContent with no daemon listening succeeded")
+	}
+}
+
+func TestUploadScanning(t *testing.T) {
+	tests := []struct {
+		name    string
+		daemon  bool
+		content string
+		status  int
+		stored  bool
+	}{
+		{"clean", true, "hello", http.StatusOK, true},
+		{"infected", true, "x " + eicar, http.StatusUnprocessableEntity, false},
+		{"scanner down", false, "hello", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			if tt.daemon {
+				addr, _ := fakeClamd(t, "tcp", "")
+				set(t, &clamavAddr, addr)
+			} else {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				set(t, &clamavAddr, l.Addr().String())
+				l.Close()
+			}
+			w := upload(t, "/upload", file("a.txt", tt.content))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := len(stored(t)) == 1; got != tt.stored {
+				t.Errorf("stored = %v, want %v", got, tt.stored)
+			}
+			// The spooled copy is removed whether or not the file was kept.
+			spooled, _ := filepath.Glob(filepath.Join(uploadDir, ".upload-*"))
+			if len(spooled) != 0 {
+				t.Errorf("spooled files left behind: %v", spooled)
+			}
+		})
+	}
+}
+
+func TestScanFile(t *testing.T) {
+	addr, _ := fakeClamd(t, "tcp", "")
+	set(t, &clamavAddr, addr)
+	path := filepath.Join(t.TempDir(), "part")
+	if err := os.WriteFile(path, []byte(eicar), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := scanFile(path)
+	if err != nil || signature != "Eicar-Signature" {
+		t.Errorf("scanFile = %q, %v, want Eicar-Signature", signature, err)
+	}
+	if _, err := scanFile(path + ".missing"); err == nil {
+		t.Error("scanFile of a missing file succeeded")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// configFlags replaces the command line with a few flags like main's,
+// parsed from args.
+func configFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("filehost", flag.ContinueOnError)
+	fs.String("hostname", "http://localhost", "")
+	fs.String("port", "8080", "")
+	fs.String("config", "", "")
+	fs.Bool("dedupe", false, "")
+	fs.Int("max-files", 0, "")
+	fs.String("blocked-ext", "", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &flag.CommandLine, fs)
+	return fs
+}
+
+// writeConfig writes a config file and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	config := `{"hostname": "https://files.example.com", "port": "9000", "dedupe": true,
+		"max-files": 5, "blocked-ext": [".exe", ".bat"]}`
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string
+	}{
+		{
+			"file over defaults", nil,
+			map[string]string{"hostname": "https://files.example.com", "port": "9000", "dedupe": "true", "max-files": "5", "blocked-ext": ".exe,.bat"},
+		},
+		{
+			"flags over file", []string{"-port", "7000", "-dedupe=false"},
+			map[string]string{"hostname": "https://files.example.com", "port": "7000", "dedupe": "false", "max-files": "5"},
+		},
+		// A flag set to its default still wins over the file.
+		{
+			"flag set to default", []string{"-hostname", "http://localhost"},
+			map[string]string{"hostname": "http://localhost", "port": "9000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := configFlags(t, tt.args...)
+			if err := applyConfigFile(writeConfig(t, config)); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"invalid JSON", `{"port": `},
+		{"not an object", `["port"]`},
+		{"unknown setting", `{"prot": "9000"}`},
+		{"config in config", `{"config": "other.json"}`},
+		{"invalid value", `{"max-files": "many"}`},
+		{"list of numbers", `{"blocked-ext": [1, 2]}`},
+		{"nested object", `{"port": {"value": 9000}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFlags(t)
+			if err := applyConfigFile(writeConfig(t, tt.config)); err == nil {
+				t.Error("applyConfigFile succeeded")
+			}
+		})
+	}
+	t.Run("missing file", func(t *testing.T) {
+		configFlags(t)
+		if err := applyConfigFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+			t.Error("applyConfigFile succeeded")
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	// convertImages is the format, webp, jpeg or png, that JPEG, PNG and
+	// GIF uploads are converted to before they are stored. Empty stores them
+	// as they were sent.
+	convertImages string
+	// keepOriginals stores the upload as sent next to its conversion.
+	keepOriginals bool
+	// convertAnimated lets animated GIFs be converted too, which keeps only
+	// their first frame.
+	convertAnimated bool
+)
+
+// imageFormat is a format images can be converted to.
+type imageFormat struct {
+	contentType string
+	ext         string
+	// lossless formats aren't used for JPEGs, which they would only make
+	// bigger.
+	lossless bool
+	encode   func(io.Writer, image.Image) error
+}
+
+// imageFormats are the formats -convert-images accepts. Builds with -tags
+// webp add WebP.
+var imageFormats = map[string]imageFormat{
+	"jpeg": {"image/jpeg", ".jpg", false, func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, flatten(img), &jpeg.Options{Quality: 90})
+	}},
+	"png": {"image/png", ".png", true, png.Encode},
+}
+
+// convertibleTypes are the detected content types -convert-images converts.
+var convertibleTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// maxConvertSize is the largest upload that is converted. Conversion needs
+// the whole image in memory, so bigger ones are stored as they are.
+const maxConvertSize = 32 << 20
+
+// shouldConvert reports whether uploads detected as contentType are
+// converted.
+func shouldConvert(contentType string) bool {
+	format, ok := imageFormats[convertImages]
+	return ok && convertibleTypes[contentType] && contentType != format.contentType &&
+		!(format.lossless && contentType == "image/jpeg") && checkExtension(format.ext) == nil
+}
+
+// convertImage reads the image in src and encodes it in the -convert-images
+// format. It returns the body to store and, when that is the conversion,
+// the original bytes. Images that are too large, animated or can't be
+// decoded are returned as they were sent with a nil original; errors are
+// only from reading src.
+func convertImage(logger *slog.Logger, src io.Reader, contentType string) (body io.Reader, original []byte, err error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(src, maxConvertSize+1)); err != nil {
+		return nil, nil, err
+	}
+	if buf.Len() > maxConvertSize {
+		return io.MultiReader(&buf, src), nil, nil
+	}
+	data := buf.Bytes()
+	converted, err := encodeImage(data, contentType, imageFormats[convertImages])
+	if err != nil {
+		logger.Info("Storing image unconverted", "err", err)
+		return bytes.NewReader(data), nil, nil
+	}
+	return bytes.NewReader(converted), data, nil
+}
+
+var errAnimated = errors.New("image is animated")
+
+func encodeImage(data []byte, contentType string, format imageFormat) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxThumbPixels {
+		return nil, fmt.Errorf("image is too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+	var img image.Image
+	if contentType == "image/gif" {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if len(g.Image) > 1 && !convertAnimated {
+			return nil, errAnimated
+		}
+		img = g.Image[0]
+	} else if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := format.encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// flatten draws img onto white, since JPEG has no transparency.
+func flatten(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+// replaceExt returns name with its extension replaced by ext.
+func replaceExt(name, ext string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ext
+}
+
+// keepOriginal stores data, the upload as sent, next to its conversion
+// stored as name but with the original extension ext, and with the same
+// options. It returns the name it was stored under.
+func keepOriginal(name, ext, originalName, contentType string, data []byte, opts uploadOptions) (string, error) {
+	origName := replaceExt(name, ext)
+	if err := store.Put(origName, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	m := fileMeta{
+		OriginalName: originalName,
+		Owner:        opts.owner,
+		OneTime:      opts.oneTime,
+		PasswordHash: opts.passwordHash,
+		Encrypted:    encryptUploads,
+		Sha256:       hex.EncodeToString(sum[:]),
+		ContentType:  contentType,
+		Size:         int64(len(data)),
+		UploadedAt:   time.Now().UTC(),
+	}
+	if opts.ttl > 0 {
+		m.ExpiresAt = time.Now().Add(opts.ttl)
+	}
+	if opts.oneTime {
+		releaseOneTime(origName)
+	}
+	if err := metadata.set(origName, m); err != nil {
+		return origName, err
+	}
+	if opts.owner != "" {
+		quotas.add(origName, opts.owner, m.Size)
+	}
+	recordUpload(m.Size)
+	return origName, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testJPEG returns a JPEG image of the given size.
+func testJPEG(t *testing.T, width, height int) string {
+	t.Helper()
+	img, _, err := image.Decode(strings.NewReader(testPNG(t, width, height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// testGIF returns a GIF with the given number of frames.
+func testGIF(t *testing.T, frames int) string {
+	t.Helper()
+	g := &gif.GIF{}
+	for i := range frames {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.Black, color.White})
+		frame.SetColorIndex(i%8, 0, 1)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// convertCase is an upload of filename converted to format, stored with
+// extension wantExt as an image of wantType.
+type convertCase struct {
+	name     string
+	format   string
+	filename string
+	content  func(*testing.T) string
+	wantExt  string
+	wantType string
+}
+
+func testConversions(t *testing.T, tests []convertCase) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &convertImages, tt.format)
+			up := uploaded(t, "/upload", tt.filename, tt.content(t))
+			if ext := path.Ext(up.Filename); ext != tt.wantExt {
+				t.Errorf("stored as %s, want extension %s", up.Filename, tt.wantExt)
+			}
+			if up.OriginalName != tt.filename {
+				t.Errorf("original name %q, want %q", up.OriginalName, tt.filename)
+			}
+			w := get(up.Filename)
+			cfg, format, err := image.DecodeConfig(w.Body)
+			if err != nil || format != tt.wantType {
+				t.Fatalf("stored image format %q, %v; want %s", format, err, tt.wantType)
+			}
+			if cfg.Width == 0 || cfg.Height == 0 {
+				t.Errorf("stored image is %dx%d", cfg.Width, cfg.Height)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "image/"+tt.wantType {
+				t.Errorf("Content-Type %q", ct)
+			}
+			if names := stored(t); len(names) != 1 {
+				t.Errorf("stored %v, want only the upload", names)
+			}
+		})
+	}
+}
+
+func TestConvertImages(t *testing.T) {
+	png := func(t *testing.T) string { return testPNG(t, 40, 30) }
+	testConversions(t, []convertCase{
+		{"png to jpeg", "jpeg", "a.png", png, ".jpg", "jpeg"},
+		{"gif to png", "png", "a.gif", func(t *testing.T) string { return testGIF(t, 1) }, ".png", "png"},
+		{"jpeg left alone for png", "png", "a.jpg", func(t *testing.T) string { return testJPEG(t, 40, 30) }, ".jpg", "jpeg"},
+		{"animated gif left alone", "jpeg", "a.gif", func(t *testing.T) string { return testGIF(t, 3) }, ".gif", "gif"},
+	})
+}
+
+func TestConvertKeepOriginal(t *testing.T) {
+	setup(t)
+	set(t, &convertImages, "jpeg")
+	set(t, &keepOriginals, true)
+	src := testPNG(t, 40, 30)
+	up := uploaded(t, "/upload", "a.png", src)
+	if path.Ext(up.Filename) != ".jpg" || up.OriginalURL == "" {
+		t.Fatalf("stored as %s with original at %q", up.Filename, up.OriginalURL)
+	}
+	orig := strings.TrimPrefix(up.OriginalURL, hostname+downloadPath)
+	if orig != replaceExt(up.Filename, ".png") {
+		t.Errorf("original stored as %s", orig)
+	}
+	if got := get(orig).Body.String(); got != src {
+		t.Errorf("original changed: %d bytes, want %d", len(got), len(src))
+	}
+}
+
+func TestConvertCorruptImage(t *testing.T) {
+	setup(t)
+	set(t, &convertImages, "jpeg")
+	// A PNG signature sniffs as image/png but the rest won't decode.
+	corrupt := testPNG(t, 40, 30)[:60]
+	up := uploaded(t, "/upload", "a.png", corrupt)
+	if path.Ext(up.Filename) != ".png" {
+		t.Errorf("corrupt image stored as %s", up.Filename)
+	}
+	if got := get(up.Filename).Body.String(); got != corrupt {
+		t.Errorf("corrupt image changed to %q", got)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsHandler adds CORS headers for requests from allowed origins so browser
+// apps on other domains can call the API. Requests from other origins get no
+// CORS headers at all, which makes the browser block them.
+type corsHandler struct {
+	next    http.Handler
+	any     bool
+	origins map[string]bool
+}
+
+// corsExposedHeaders lets scripts read the response headers tus clients,
+// request tracing and media players streaming byte ranges need.
+const corsExposedHeaders = "Location, Tus-Resumable, Upload-Offset, Upload-Length, X-Upload-URL, X-Request-ID, " +
+	"Accept-Ranges, Content-Range, Content-Disposition"
+
+// newCORSHandler wraps next for a comma-separated origin list, where "*"
+// allows any origin.
+func newCORSHandler(next http.Handler, list string) http.Handler {
+	h := &corsHandler{
+		next:    next,
+		origins: make(map[string]bool),
+	}
+	for _, o := range strings.Split(list, ",") {
+		o = strings.TrimSpace(o)
+		if o == "*" {
+			h.any = true
+		} else if o != "" {
+			h.origins[strings.TrimSuffix(o, "/")] = true
+		}
+	}
+	return h
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	w.Header().Add("Vary", "Origin")
+	if origin != "" && (h.any || h.origins[origin]) {
+		if h.any {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+			if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+		}
+	}
+
+	// Preflights are answered here and never reach the handlers, whether or
+	// not the origin is allowed.
+	if preflight {
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     string
+		method      string
+		origin      string
+		preflight   bool
+		allowOrigin string
+		status      int
+		reached     bool
+	}{
+		{"allowed origin", "https://app.example.com", "POST", "https://app.example.com", false, "https://app.example.com", http.StatusOK, true},
+		{"allowed with trailing slash in list", "https://app.example.com/", "POST", "https://app.example.com", false, "https://app.example.com", http.StatusOK, true},
+		{"other origin", "https://app.example.com", "POST", "https://evil.example.com", false, "", http.StatusOK, true},
+		{"no origin", "https://app.example.com", "GET", "", false, "", http.StatusOK, true},
+		{"any origin", "*", "GET", "https://anything.example", false, "*", http.StatusOK, true},
+		{"preflight", "https://a.example, https://b.example", "OPTIONS", "https://b.example", true, "https://b.example", http.StatusNoContent, false},
+		{"preflight from other origin", "https://a.example", "OPTIONS", "https://c.example", true, "", http.StatusNoContent, false},
+		{"plain OPTIONS", "*", "OPTIONS", "https://a.example", false, "*", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached := false
+			h := newCORSHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }), tt.origins)
+			r := httptest.NewRequest(tt.method, "/upload", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", "POST")
+				r.Header.Set("Access-Control-Request-Headers", "X-API-Key")
+			}
+			w := serve(h, r)
+			if w.Code != tt.status || reached != tt.reached {
+				t.Errorf("status %d, reached handler %v; want %d, %v", w.Code, reached, tt.status, tt.reached)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			if w.Header().Get("Vary") != "Origin" {
+				t.Errorf("Vary = %q", w.Header().Get("Vary"))
+			}
+			allowed := tt.allowOrigin != ""
+			if got := w.Header().Get("Access-Control-Allow-Headers"); (got == "X-API-Key") != (allowed && tt.preflight) {
+				t.Errorf("Access-Control-Allow-Headers = %q", got)
+			}
+			if got := w.Header().Get("Access-Control-Expose-Headers"); (got != "") != allowed {
+				t.Errorf("Access-Control-Expose-Headers = %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files start with a header of cryptMagic and a random base nonce,
+// followed by frames of up to cryptChunkSize plaintext bytes, each sealed
+// with AES-256-GCM on its own. A frame's nonce is the base nonce XORed with
+// its index, and its additional data records the index and whether it is the
+// last frame, so frames can't be reordered or the file silently truncated.
+// Fixed-size frames let a reader seek to any frame without decrypting the
+// ones before it, which keeps range requests cheap.
+const (
+	cryptMagic     = "FHENC1\x00\x00"
+	cryptChunkSize = 64 << 10
+	cryptNonceSize = 12
+	cryptHeaderLen = len(cryptMagic) + cryptNonceSize
+	cryptFrameLen  = cryptChunkSize + 16
+)
+
+// encryptUploads is set when stored files are encrypted.
+var encryptUploads bool
+
+// loadEncryptionKey accepts a 32-byte key as 64 hex digits, or the path of a
+// file holding the key either in hex or as raw bytes.
+func loadEncryptionKey(value string) ([]byte, error) {
+	if key, err := hex.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	data, err := os.ReadFile(value)
+	if err != nil {
+		return nil, fmt.Errorf("not a 64-digit hex key or a readable key file: %w", err)
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	return nil, errors.New("key file must hold 32 bytes, raw or as 64 hex digits")
+}
+
+// encryptedStorage encrypts files on their way into another backend and
+// decrypts them on the way out. Files stored before encryption was enabled
+// lack the header and are passed through as they are.
+type encryptedStorage struct {
+	Storage
+	aead cipher.AEAD
+}
+
+func newEncryptedStorage(s Storage, key []byte) (*encryptedStorage, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStorage{Storage: s, aead: aead}, nil
+}
+
+func (s *encryptedStorage) Put(name string, r io.Reader) error {
+	// The inner backend may read some of the stream before noticing a name
+	// is taken, so check up front to leave r untouched on a collision.
+	exists, err := s.Storage.Exists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(s.encrypt(pw, r))
+	}()
+	err = s.Storage.Put(name, pr)
+	pr.CloseWithError(errors.New("storage stopped reading"))
+	<-done
+	return err
+}
+
+// encrypt writes the encrypted form of r to w.
+func (s *encryptedStorage) encrypt(w io.Writer, r io.Reader) error {
+	header := make([]byte, cryptHeaderLen)
+	copy(header, cryptMagic)
+	base := header[len(cryptMagic):]
+	if _, err := rand.Read(base); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, cryptChunkSize)
+	chunk := make([]byte, cryptChunkSize)
+	frame := make([]byte, 0, cryptFrameLen)
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(br, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		frame = s.aead.Seal(frame[:0], frameNonce(base, i), chunk[:n], frameAD(i, last))
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (s *encryptedStorage) Get(name string) (StoredFile, error) {
+	f, err := s.Storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, cryptHeaderLen)
+	n, err := io.ReadFull(f, header)
+	if err == nil && string(header[:len(cryptMagic)]) == cryptMagic {
+		return &decryptedFile{
+			StoredFile: f,
+			aead:       s.aead,
+			base:       header[len(cryptMagic):],
+			size:       plaintextSize(f.Size()),
+			frame:      -1,
+		}, nil
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, err
+	}
+	if n > 0 {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// List reports plaintext sizes so listings and quotas don't count the
+// encryption overhead.
+func (s *encryptedStorage) List() ([]FileInfo, error) {
+	files, err := s.Storage.List()
+	for i := range files {
+		files[i].Size = plaintextSize(files[i].Size)
+	}
+	return files, err
+}
+
+// plaintextSize is the size of the content of an encrypted file of size
+// stored bytes. Files too short to have been encrypted are left as they are.
+func plaintextSize(stored int64) int64 {
+	n := stored - int64(cryptHeaderLen)
+	if n < 16 {
+		return stored
+	}
+	frames := (n + cryptFrameLen - 1) / cryptFrameLen
+	return n - frames*16
+}
+
+func frameNonce(base []byte, i uint64) []byte {
+	nonce := make([]byte, cryptNonceSize)
+	copy(nonce, base)
+	tail := nonce[cryptNonceSize-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^i)
+	return nonce
+}
+
+func frameAD(i uint64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, i)
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// decryptedFile decrypts an encrypted StoredFile one frame at a time.
+type decryptedFile struct {
+	StoredFile
+	aead   cipher.AEAD
+	base   []byte
+	size   int64
+	offset int64
+	frame  int64
+	plain  []byte
+}
+
+func (f *decryptedFile) Size() int64 { return f.size }
+
+func (f *decryptedFile) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	i := f.offset / cryptChunkSize
+	if i != f.frame {
+		if err := f.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.plain[f.offset-i*cryptChunkSize:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// load reads and decrypts frame i.
+func (f *decryptedFile) load(i int64) error {
+	if _, err := f.StoredFile.Seek(int64(cryptHeaderLen)+i*cryptFrameLen, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, cryptFrameLen)
+	n, err := io.ReadFull(f.StoredFile, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := (i+1)*cryptChunkSize >= f.size
+	plain, err := f.aead.Open(f.plain[:0], frameNonce(f.base, uint64(i)), buf[:n], frameAD(uint64(i), last))
+	if err != nil {
+		return errors.New("encrypted file is corrupt or was stored with a different key")
+	}
+	f.plain, f.frame = plain, i
+	return nil
+}
+
+func (f *decryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative seek offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
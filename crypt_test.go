@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+// newTestEncryptedStorage encrypts files into s with testKey.
+func newTestEncryptedStorage(t *testing.T, s Storage) *encryptedStorage {
+	t.Helper()
+	es, err := newEncryptedStorage(s, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"hex", hex.EncodeToString(testKey), false},
+		{"hex file", write("hex", []byte(hex.EncodeToString(testKey)+"\n")), false},
+		{"raw file", write("raw", testKey), false},
+		{"short hex", hex.EncodeToString(testKey[:16]), true},
+		{"short file", write("short", testKey[:16]), true},
+		{"missing file", filepath.Join(dir, "missing"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := loadEncryptionKey(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadEncryptionKey: err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(key, testKey) {
+				t.Errorf("key = %x, want %x", key, testKey)
+			}
+		})
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	sizes := []int{0, 1, 100, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 3*cryptChunkSize + 5}
+	for _, size := range sizes {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i%251) + 1
+		}
+		dir := t.TempDir()
+		s := newTestEncryptedStorage(t, localStorage{dir: dir})
+		if err := s.Put("f", bytes.NewReader(content)); err != nil {
+			t.Fatalf("%d bytes: Put: %v", size, err)
+		}
+
+		raw, err := os.ReadFile(filepath.Join(dir, "f"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(raw, []byte(cryptMagic)) {
+			t.Errorf("%d bytes: stored file doesn't start with the header", size)
+		}
+		if size >= 16 && bytes.Contains(raw, content[:min(size, 64)]) {
+			t.Errorf("%d bytes: stored file contains the plaintext", size)
+		}
+		if got := plaintextSize(int64(len(raw))); got != int64(size) {
+			t.Errorf("%d bytes: plaintextSize(%d) = %d", size, len(raw), got)
+		}
+
+		// Seek to each side of the frame boundaries, as range requests do.
+		for _, offset := range []int{0, 1, cryptChunkSize - 1, cryptChunkSize, 2*cryptChunkSize + 3, size} {
+			if offset > size {
+				continue
+			}
+			f, err := s.Get("f")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Size() != int64(size) {
+				t.Errorf("%d bytes: Size() = %d", size, f.Size())
+			}
+			if _, err := f.Seek(int64(offset), io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(f)
+			f.Close()
+			if err != nil || !bytes.Equal(got, content[offset:]) {
+				t.Errorf("%d bytes from offset %d: got %d bytes, %v", size, offset, len(got), err)
+			}
+		}
+
+		list, err := s.List()
+		if err != nil || len(list) != 1 || list[0].Size != int64(size) {
+			t.Errorf("%d bytes: List() = %v, %v", size, list, err)
+		}
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	content := strings.Repeat("secret ", cryptChunkSize/3)
+	tests := []struct {
+		name   string
+		tamper func(raw []byte) []byte
+	}{
+		{"flipped bit", func(raw []byte) []byte {
+			raw[cryptHeaderLen+10] ^= 1
+			return raw
+		}},
+		{"truncated to whole frames", func(raw []byte) []byte {
+			return raw[:cryptHeaderLen+cryptFrameLen]
+		}},
+		{"frames swapped", func(raw []byte) []byte {
+			first := slices.Clone(raw[cryptHeaderLen : cryptHeaderLen+cryptFrameLen])
+			second := raw[cryptHeaderLen+cryptFrameLen : cryptHeaderLen+2*cryptFrameLen]
+			copy(raw[cryptHeaderLen:], second)
+			copy(raw[cryptHeaderLen+cryptFrameLen:], first)
+			return raw
+		}},
+		{"other nonce", func(raw []byte) []byte {
+			raw[len(cryptMagic)] ^= 1
+			return raw
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newTestEncryptedStorage(t, localStorage{dir: dir})
+			if err := s.Put("f", strings.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "f")
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.tamper(raw), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := s.Get("f")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := io.ReadAll(f); err == nil {
+				t.Error("reading a tampered file succeeded")
+			}
+		})
+	}
+}
+
+func TestEncryptedWrongKey(t *testing.T) {
+	inner := localStorage{dir: t.TempDir()}
+	if err := newTestEncryptedStorage(t, inner).Put("f", strings.NewReader("secret")); err != nil {
+		t.Fatal(err)
+	}
+	other, err := newEncryptedStorage(inner, bytes.Repeat([]byte{0x24}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := other.Get("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.ReadAll(f); err == nil {
+		t.Error("reading with the wrong key succeeded")
+	}
+}
+
+// TestEncryptedPlaintextFiles checks that files stored before encryption
+// was enabled are still served.
+func TestEncryptedPlaintextFiles(t *testing.T) {
+	for _, content := range []string{"", "short", strings.Repeat("old file ", 100)} {
+		inner := localStorage{dir: t.TempDir()}
+		if err := inner.Put("old", strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		f, err := newTestEncryptedStorage(t, inner).Get("old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(got) != content {
+			t.Errorf("plaintext file = %q, %v; want %q", got, err, content)
+		}
+	}
+}
+
+func TestEncryptedUpload(t *testing.T) {
+	setup(t)
+	set(t, &store, Storage(newTestEncryptedStorage(t, localStorage{dir: uploadDir})))
+	set(t, &encryptUploads, true)
+	content := strings.Repeat("top secret ", 10000)
+	up := uploaded(t, "/upload", "secret.txt", content)
+
+	m, _ := metadata.get(up.Filename)
+	if !m.Encrypted {
+		t.Error("metadata doesn't record the file as encrypted")
+	}
+	raw, err := os.ReadFile(filepath.Join(uploadDir, up.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("top secret")) {
+		t.Error("file is stored in plaintext")
+	}
+
+	if w := get(up.Filename); w.Code != http.StatusOK || w.Body.String() != content {
+		t.Errorf("download: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	r := httptest.NewRequest(http.MethodGet, downloadPath+up.Filename, nil)
+	r.Header.Set("Range", "bytes=65530-65545")
+	if w := download(r); w.Code != http.StatusPartialContent || w.Body.String() != content[65530:65546] {
+		t.Errorf("range across frames: status %d, body %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxDataURISize is the largest file /upload-data-uri takes, whatever
+// maxUploadSize is. The JSON body is decoded in memory, so it is only meant
+// for the small files browsers have as data URIs.
+const maxDataURISize = 32 << 20
+
+// preferredExtensions picks the usual extension for types that have several.
+var preferredExtensions = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/svg+xml": ".svg",
+	"text/plain":    ".txt",
+	"audio/mpeg":    ".mp3",
+	"video/mp4":     ".mp4",
+}
+
+type dataURIRequest struct {
+	DataURI string `json:"dataUri"`
+	// Filename is the name to store the file under, with its extension
+	// replaced by the one for the data URI's type.
+	Filename string `json:"filename"`
+}
+
+// parseDataURI splits a base64 data URI into its media type and payload,
+// which is checked to be valid base64 so it can be decoded as a stream.
+func parseDataURI(uri string) (mediaType, payload string, err error) {
+	rest, ok := strings.CutPrefix(uri, "data:")
+	if !ok {
+		return "", "", errors.New("dataUri must start with data:")
+	}
+	header, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", "", errors.New("dataUri has no comma before its data")
+	}
+	header, ok = strings.CutSuffix(header, ";base64")
+	if !ok {
+		return "", "", errors.New("Only base64 data URIs are supported")
+	}
+	// RFC 2397 makes text/plain the default.
+	mediaType = "text/plain"
+	if header != "" {
+		if mediaType, _, err = mime.ParseMediaType(header); err != nil {
+			return "", "", errors.New("dataUri has an invalid media type")
+		}
+	}
+	if !validBase64(payload) {
+		return "", "", errors.New("dataUri data is not valid base64")
+	}
+	return mediaType, payload, nil
+}
+
+// validBase64 reports whether s is padded standard base64.
+func validBase64(s string) bool {
+	if len(s)%4 != 0 {
+		return false
+	}
+	data := strings.TrimSuffix(strings.TrimSuffix(s, "="), "=")
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '+' || c == '/') {
+			return false
+		}
+	}
+	return true
+}
+
+// extensionForType returns the extension files of mediaType are stored
+// with, or "" if it has none.
+func extensionForType(mediaType string) string {
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
+}
+
+// uploadDataURI stores the file in a data URI as if it had been uploaded,
+// named by the extension for its type and with the same checks. The query
+// parameters work as they do for /upload.
+func uploadDataURI(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	limit := min(int64(maxUploadSize), maxDataURISize)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(base64.StdEncoding.EncodedLen(int(limit)))+4096)
+	var req dataURIRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			uploadErrorsTotal.WithLabelValues("too_large").Inc()
+			writeUploadError(w, r, "Upload exceeds maximum size of "+byteSize(limit).String(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeUploadError(w, r, "Request body must be JSON with a dataUri", http.StatusBadRequest)
+		return
+	}
+	mediaType, payload, err := parseDataURI(req.DataURI)
+	if err != nil {
+		uploadErrorsTotal.WithLabelValues("data_uri").Inc()
+		writeUploadError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ext := extensionForType(mediaType)
+	if ext == "" {
+		uploadErrorsTotal.WithLabelValues("extension").Inc()
+		writeUploadError(w, r, "No file extension is known for type "+mediaType, http.StatusUnsupportedMediaType)
+		return
+	}
+	originalName := "upload"
+	if req.Filename != "" {
+		originalName = path.Base(req.Filename)
+	}
+	originalName = replaceExt(originalName, ext)
+
+	opts, uerr := parseUploadOptions(logger, r)
+	if uerr != nil {
+		if uerr.reason != "" {
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+		}
+		writeUploadError(w, r, uerr.message, uerr.status)
+		return
+	}
+	body := base64.NewDecoder(base64.StdEncoding, strings.NewReader(payload))
+	response, uerr := saveUpload(logger, body, originalName, sanitizeFilename(originalName), "", opts)
+	if uerr != nil {
+		if uerr.reason != "" {
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+		}
+		writeUploadError(w, r, uerr.message, uerr.status)
+		return
+	}
+	if !opts.dryRun {
+		acceptUploads(logger, []any{response})
+	}
+	if wantsPlainText(r) {
+		writePlainUploads(w, []any{response}, http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postDataURI sends uri to /upload-data-uri as a file named filename.
+func postDataURI(t *testing.T, uri, filename string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(dataURIRequest{DataURI: uri, Filename: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/upload-data-uri", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	return serve(http.HandlerFunc(uploadDataURI), r)
+}
+
+func TestUploadDataURI(t *testing.T) {
+	setup(t)
+	img := testPNG(t, 4, 4)
+	w := postDataURI(t, "data:image/png;base64,"+base64.StdEncoding.EncodeToString([]byte(img)), "shot.jpeg")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var up UploadResponse
+	if err := json.NewDecoder(w.Body).Decode(&up); err != nil {
+		t.Fatal(err)
+	}
+	// The extension comes from the data URI's type, not the name sent.
+	if up.OriginalName != "shot.png" || !strings.HasSuffix(up.Filename, ".png") {
+		t.Errorf("stored %s as %s, want shot.png", up.OriginalName, up.Filename)
+	}
+	if up.Sha256 != sha256Hex(img) {
+		t.Errorf("sha256 %s, want %s", up.Sha256, sha256Hex(img))
+	}
+	if got := get(up.Filename).Body.String(); got != img {
+		t.Errorf("stored %d bytes, want the %d byte PNG", len(got), len(img))
+	}
+}
+
+func TestUploadDataURIMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		uri    string
+		status int
+		want   string
+	}{
+		{"no scheme", "image/png;base64,aGk=", http.StatusBadRequest, "must start with data:"},
+		{"no comma", "data:image/png;base64", http.StatusBadRequest, "no comma"},
+		{"not base64", "data:image/png,hi", http.StatusBadRequest, "Only base64"},
+		{"bad base64", "data:image/png;base64,a*Gk", http.StatusBadRequest, "not valid base64"},
+		{"unpadded base64", "data:image/png;base64,aGk", http.StatusBadRequest, "not valid base64"},
+		{"bad media type", "data:image/;base64,aGk=", http.StatusBadRequest, "invalid media type"},
+		{"unknown type", "data:application/x-no-such-type;base64,aGk=", http.StatusUnsupportedMediaType, "No file extension"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			w := postDataURI(t, tt.uri, "")
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("status %d: %s; want %d with %q", w.Code, w.Body, tt.status, tt.want)
+			}
+			if names := stored(t); len(names) != 0 {
+				t.Errorf("stored %v", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+var (
+	// detectDuplicates flags uploads whose content matches a file already
+	// stored, which are still stored again.
+	detectDuplicates bool
+	// rejectDuplicates answers such uploads with the stored file instead.
+	rejectDuplicates bool
+)
+
+// duplicateMu serialises saveUnlessDuplicate so two identical uploads can't
+// both find no match and both be stored.
+var duplicateMu sync.Mutex
+
+// checksDuplicates reports whether uploads made with opts are looked up by
+// content. One-time and password-protected uploads are never matched, like
+// with dedupe.
+func checksDuplicates(opts uploadOptions) bool {
+	return (detectDuplicates || rejectDuplicates) && !opts.oneTime && opts.passwordHash == ""
+}
+
+// spoolUpload streams src to a temp file in uploadDir, hashing it on the
+// way, for saves that need the content's hash before the file is stored.
+// The caller removes the temp file.
+func spoolUpload(src io.Reader) (tmpPath, sum string, size int64, err error) {
+	tmp, err := os.CreateTemp(uploadDir, ".upload-*")
+	if err != nil {
+		return "", "", 0, err
+	}
+	// CreateTemp makes the file private to the server; match the permissions
+	// regular uploads get so the web server can still read it.
+	if err := tmp.Chmod(fileMode); err != nil {
+		tmp.Close()
+		return tmp.Name(), "", 0, err
+	}
+	hasher := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, hasher), src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	return tmp.Name(), hex.EncodeToString(hasher.Sum(nil)), size, err
+}
+
+// saveDeduplicated stores src in dir under the hex SHA-256 of its content
+// plus ext. Since the name isn't known until the whole body has been
+// hashed, the content is spooled first and then moved into storage, or
+// discarded when a file with that hash already exists.
+func saveDeduplicated(src io.Reader, dir, ext string) (savedFile, error) {
+	tmpPath, sum, size, err := spoolUpload(src)
+	if tmpPath != "" {
+		defer os.Remove(tmpPath)
+	}
+	if err != nil {
+		return savedFile{}, err
+	}
+
+	name := path.Join(dir, sum+ext)
+	exists, err := store.Exists(name)
+	if err != nil {
+		return savedFile{}, err
+	}
+	if !exists {
+		err = adoptFile(name, tmpPath)
+		// A concurrent identical upload may have won the race to name,
+		// which leaves us in the same state as finding it up front.
+		if errors.Is(err, os.ErrExist) {
+			exists, err = true, nil
+		}
+	}
+	if err != nil {
+		return savedFile{}, err
+	}
+	return savedFile{name: name, sha256: sum, size: size, existed: exists}, nil
+}
+
+// isContentAddressed reports whether name is one dedupe stored under sum,
+// the SHA-256 of its content. Such files may be shared by several uploads
+// and their names have to keep matching their content.
+func isContentAddressed(name, sum string) bool {
+	base := path.Base(name)
+	return sum != "" && base == sum+path.Ext(base)
+}
+
+// saveUnlessDuplicate stores src under a random prefix and filename unless
+// a file with the same content is already stored, in which case that file
+// is returned with existed set and src is discarded.
+func saveUnlessDuplicate(src io.Reader, filename string) (savedFile, error) {
+	tmpPath, sum, size, err := spoolUpload(src)
+	if tmpPath != "" {
+		defer os.Remove(tmpPath)
+	}
+	if err != nil {
+		return savedFile{}, err
+	}
+
+	duplicateMu.Lock()
+	defer duplicateMu.Unlock()
+	if name, ok := metadata.findSha256(sum, ""); ok {
+		return savedFile{name: name, sha256: sum, size: size, existed: true}, nil
+	}
+	name, err := adoptWithGeneratedName(tmpPath, filename, sum)
+	if err != nil {
+		return savedFile{}, err
+	}
+	return savedFile{name: name, sha256: sum, size: size}, recordSha256(name, sum, size)
+}
+
+// recordSha256 adds a just stored file to the hash index before the next
+// upload looks, as its full metadata is only written once the upload is
+// done. The caller holds duplicateMu; on failure the file is removed.
+func recordSha256(name, sum string, size int64) error {
+	if err := metadata.set(name, fileMeta{Sha256: sum, Size: size}); err != nil {
+		store.Delete(name)
+		return err
+	}
+	return nil
+}
+
+// strictUnique refuses to store content that is already stored under any
+// name, so each is kept exactly once and the client is told about it.
+var strictUnique bool
+
+// duplicateError is the failure of a save under strictUnique.
+type duplicateError struct {
+	// name is the stored file with the same content.
+	name string
+}
+
+func (e *duplicateError) Error() string {
+	return "content is already stored as " + e.name
+}
+
+// storeUnique runs save, which stores content with the hex SHA-256 sum,
+// unless a file with that content is already stored, and returns the name
+// it stored it under. Checking and storing happen under duplicateMu, so of
+// two identical uploads at once only one is stored. Files whose metadata
+// has no hash, from before hashes were recorded, aren't found.
+func storeUnique(sum string, size int64, save func() (string, error)) (string, error) {
+	duplicateMu.Lock()
+	defer duplicateMu.Unlock()
+	if name, ok := metadata.findAnySha256(sum, ""); ok {
+		return "", &duplicateError{name: name}
+	}
+	name, err := save()
+	if err != nil {
+		return "", err
+	}
+	return name, recordSha256(name, sum, size)
+}
+
+// replaceUnique runs replace, which puts content with the hex SHA-256 sum
+// in place of name's and records it in name's metadata, unless a file other
+// than name already has that content. Like storeUnique it holds duplicateMu
+// throughout, so the check and the change are one step.
+func replaceUnique(name, sum string, replace func() error) error {
+	duplicateMu.Lock()
+	defer duplicateMu.Unlock()
+	if other, ok := metadata.findAnySha256(sum, name); ok {
+		return &duplicateError{name: other}
+	}
+	return replace()
+}
+
+// saveUnique spools src and stores it with save under storeUnique.
+func saveUnique(src io.Reader, save func(io.Reader) (savedFile, error)) (savedFile, error) {
+	tmpPath, sum, size, err := spoolUpload(src)
+	if tmpPath != "" {
+		defer os.Remove(tmpPath)
+	}
+	if err != nil {
+		return savedFile{}, err
+	}
+	var saved savedFile
+	_, err = storeUnique(sum, size, func() (string, error) {
+		f, err := os.Open(tmpPath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		saved, err = save(f)
+		return saved.name, err
+	})
+	return saved, err
+}
+
+// mergeExpiry updates the expiry of a reused upload so it lives at least as
+// long as the latest request for it asked: a ttl of zero makes it permanent.
+func mergeExpiry(name string, ttl time.Duration) error {
+	m, ok := metadata.get(name)
+	if !ok || m.ExpiresAt.IsZero() {
+		return nil
+	}
+	if ttl == 0 {
+		m.ExpiresAt = time.Time{}
+	} else if expiresAt := time.Now().Add(ttl); expiresAt.After(m.ExpiresAt) {
+		m.ExpiresAt = expiresAt
+	} else {
+		return nil
+	}
+	return metadata.set(name, m)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDedupe(t *testing.T) {
+	tests := []struct {
+		name       string
+		first      string
+		second     string
+		query      string
+		sameName   bool
+		wantPrefix bool
+	}{
+		{"same content", "hello", "hello", "", true, false},
+		{"different content", "hello", "world", "", false, false},
+		{"one-time upload", "hello", "hello", "?onetime=1", false, true},
+		{"password-protected upload", "hello", "hello", "?password=secret", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &dedupe, true)
+			first := uploaded(t, "/upload", "a.txt", tt.first)
+			if want := sha256Hex(tt.first) + ".txt"; first.Filename != want {
+				t.Fatalf("stored as %s, want %s", first.Filename, want)
+			}
+			second := uploaded(t, "/upload"+tt.query, "b.txt", tt.second)
+			if (first.Filename == second.Filename) != tt.sameName {
+				t.Errorf("stored as %s and %s", first.Filename, second.Filename)
+			}
+			if (second.Filename == sha256Hex(tt.second)+".txt") == tt.wantPrefix {
+				t.Errorf("second upload stored as %s", second.Filename)
+			}
+			if got := get(first.Filename).Body.String(); got != tt.first {
+				t.Errorf("first file = %q, want %q", got, tt.first)
+			}
+		})
+	}
+}
+
+// TestDedupeRollbackKeepsReusedFile checks a rejected batch doesn't delete a
+// file it matched from an earlier upload.
+func TestDedupeRollbackKeepsReusedFile(t *testing.T) {
+	setup(t)
+	set(t, &dedupe, true)
+	set(t, &maxFiles, 1)
+	first := uploaded(t, "/upload", "a.txt", "hello")
+	w := upload(t, "/upload", file("a.txt", "hello"), file("b.txt", "other"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("batch over -max-files: status %d: %s", w.Code, w.Body)
+	}
+	if w := get(first.Filename); w.Code != http.StatusOK {
+		t.Errorf("reused file removed by rollback: status %d", w.Code)
+	}
+}
+
+func TestDedupeMergesExpiry(t *testing.T) {
+	tests := []struct {
+		name      string
+		firstTTL  string
+		secondTTL string
+		permanent bool
+		atLeast   time.Duration
+	}{
+		{"later upload without ttl", "1h", "", true, 0},
+		{"later upload with longer ttl", "1h", "3h", false, 2 * time.Hour},
+		{"later upload with shorter ttl", "3h", "1h", false, 2 * time.Hour},
+		{"first permanent", "", "1h", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &dedupe, true)
+			up := uploaded(t, "/upload?ttl="+tt.firstTTL, "a.txt", "hello")
+			uploaded(t, "/upload?ttl="+tt.secondTTL, "a.txt", "hello")
+			m, _ := metadata.get(up.Filename)
+			if m.ExpiresAt.IsZero() != tt.permanent {
+				t.Fatalf("expires at %v, want permanent %v", m.ExpiresAt, tt.permanent)
+			}
+			if !tt.permanent && time.Until(m.ExpiresAt) < tt.atLeast {
+				t.Errorf("expires at %v, want at least %v away", m.ExpiresAt, tt.atLeast)
+			}
+		})
+	}
+}
+
+// TestStrictUniqueConcurrent checks that of identical uploads made at once
+// exactly one is stored and the others are refused.
+func TestStrictUniqueConcurrent(t *testing.T) {
+	setup(t)
+	set(t, &strictUnique, true)
+	const uploads = 8
+	statuses := make(chan int, uploads)
+	var wg sync.WaitGroup
+	for i := range uploads {
+		r := uploadRequest(t, "/upload", file(fmt.Sprintf("copy%d.txt", i), "the same content"))
+		wg.Go(func() {
+			statuses <- serve(http.HandlerFunc(uploadFile), r).Code
+		})
+	}
+	wg.Wait()
+	close(statuses)
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != uploads-1 {
+		t.Errorf("statuses %v, want one 200 and %d 409s", counts, uploads-1)
+	}
+	if names := stored(t); len(names) != 1 {
+		t.Errorf("stored %v, want one file", names)
+	}
+}
+
+func TestStrictUniqueReplace(t *testing.T) {
+	setup(t)
+	set(t, &strictUnique, true)
+	a := uploaded(t, "/upload", "a.txt", "first")
+	b := uploaded(t, "/upload", "b.txt", "second")
+	if w := replaceRequest(b.Filename, "first"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), a.URL) {
+		t.Errorf("replacing with stored content: status %d: %s", w.Code, w.Body)
+	}
+	if got := get(b.Filename).Body.String(); got != "second" {
+		t.Errorf("refused replacement changed the file to %q", got)
+	}
+	// A file's own content isn't a duplicate of itself.
+	if w := replaceRequest(b.Filename, "second"); w.Code != http.StatusOK {
+		t.Errorf("replacing with the same content: status %d: %s", w.Code, w.Body)
+	}
+	if w := replaceRequest(b.Filename, "third"); w.Code != http.StatusOK {
+		t.Fatalf("replacing with new content: status %d: %s", w.Code, w.Body)
+	}
+	if w := upload(t, "/upload", file("c.txt", "third")); w.Code != http.StatusConflict {
+		t.Errorf("uploading replaced content: status %d", w.Code)
+	}
+}
+
+func TestDuplicateDetection(t *testing.T) {
+	tests := []struct {
+		name          string
+		detect        bool
+		reject        bool
+		query         string
+		wantDuplicate bool
+		wantStored    int
+	}{
+		{"off", false, false, "", false, 2},
+		{"detect", true, false, "", true, 2},
+		{"reject", false, true, "", true, 1},
+		{"reject one-time", false, true, "?onetime=1", false, 2},
+		{"detect password-protected", true, false, "?password=secret", false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &detectDuplicates, tt.detect)
+			set(t, &rejectDuplicates, tt.reject)
+			first := uploaded(t, "/upload", "a.txt", "same content")
+			second := uploaded(t, "/upload"+tt.query, "b.txt", "same content")
+			if second.Duplicate != tt.wantDuplicate {
+				t.Errorf("duplicate %v, want %v", second.Duplicate, tt.wantDuplicate)
+			}
+			if tt.wantDuplicate && second.DuplicateOf != first.Filename {
+				t.Errorf("duplicateOf %q, want %q", second.DuplicateOf, first.Filename)
+			}
+			if tt.reject && tt.wantDuplicate && second.Filename != first.Filename {
+				t.Errorf("rejected duplicate answered with %s, want %s", second.Filename, first.Filename)
+			}
+			// stored leaves out one-time files.
+			if files, _ := store.List(); len(files) != tt.wantStored {
+				t.Errorf("stored %v, want %d files", files, tt.wantStored)
+			}
+			if w := get(second.Filename); w.Code != http.StatusOK && tt.query == "" {
+				t.Errorf("download of the second upload: status %d", w.Code)
+			}
+		})
+	}
+}
+
+// TestRejectDuplicatesConcurrent checks identical uploads made at once are
+// stored only once under -reject-duplicates.
+func TestRejectDuplicatesConcurrent(t *testing.T) {
+	setup(t)
+	set(t, &rejectDuplicates, true)
+	const uploads = 8
+	var wg sync.WaitGroup
+	for i := range uploads {
+		r := uploadRequest(t, "/upload", file(fmt.Sprintf("copy%d.txt", i), "the same content"))
+		wg.Go(func() {
+			if w := serve(http.HandlerFunc(uploadFile), r); w.Code != http.StatusOK {
+				t.Errorf("status %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+	wg.Wait()
+	if names := stored(t); len(names) != 1 {
+		t.Errorf("stored %v, want one file", names)
+	}
+}
+
+func TestFindSha256(t *testing.T) {
+	setup(t)
+	sum := sha256Hex("hello")
+	files := map[string]fileMeta{
+		"expired.txt":   {Sha256: sum, ExpiresAt: time.Now().Add(-time.Minute)},
+		"onetime.txt":   {Sha256: sum, OneTime: true},
+		"protected.txt": {Sha256: sum, PasswordHash: "x"},
+		"other.txt":     {Sha256: sha256Hex("other")},
+	}
+	for name, m := range files {
+		metadata.set(name, m)
+	}
+	if name, ok := metadata.findSha256(sum, ""); ok {
+		t.Errorf("matched %s, which uploads can't share", name)
+	}
+	metadata.set("live.txt", fileMeta{Sha256: sum})
+	if name, ok := metadata.findSha256(sum, ""); !ok || name != "live.txt" {
+		t.Errorf("findSha256 = %q, %v; want live.txt", name, ok)
+	}
+	if name, ok := metadata.findSha256(sum, "live.txt"); ok {
+		t.Errorf("findSha256 excluding live.txt = %q", name)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// expectedDigest is the digest a client sent for content it uploads, so
+// content damaged on the way is caught rather than stored.
+type expectedDigest struct {
+	// header names where the digest came from, for error messages.
+	header string
+	sum    []byte
+	hash   hash.Hash
+}
+
+// parseDigest reads a Digest header (RFC 3230) with a sha-256 or md5 value,
+// or failing that a Content-MD5 header. It returns nil when neither is set.
+func parseDigest(h http.Header) (*expectedDigest, error) {
+	if value := h.Get("Digest"); value != "" {
+		var md5Sum string
+		for _, instance := range strings.Split(value, ",") {
+			algorithm, sum, _ := strings.Cut(strings.TrimSpace(instance), "=")
+			switch strings.ToLower(algorithm) {
+			case "sha-256":
+				return newDigest("Digest", sum, sha256.New())
+			case "md5":
+				md5Sum = sum
+			}
+		}
+		if md5Sum == "" {
+			return nil, errors.New("Digest must have a sha-256 or md5 value")
+		}
+		return newDigest("Digest", md5Sum, md5.New())
+	}
+	if value := h.Get("Content-MD5"); value != "" {
+		return newDigest("Content-MD5", value, md5.New())
+	}
+	return nil, nil
+}
+
+func newDigest(header, value string, h hash.Hash) (*expectedDigest, error) {
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(sum) != h.Size() {
+		return nil, errors.New(header + " must be a base64 " + digestName(h) + " digest")
+	}
+	return &expectedDigest{header: header, sum: sum, hash: h}, nil
+}
+
+func digestName(h hash.Hash) string {
+	if h.Size() == md5.Size {
+		return "MD5"
+	}
+	return "SHA-256"
+}
+
+// reader returns r, hashing what is read from it.
+func (d *expectedDigest) reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, d.hash)
+}
+
+// body is reader for a request body.
+func (d *expectedDigest) body(rc io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{d.reader(rc), rc}
+}
+
+// matches reports whether everything read through reader has the digest.
+func (d *expectedDigest) matches() bool {
+	return bytes.Equal(d.hash.Sum(nil), d.sum)
+}
+
+func digestError(err error) *uploadError {
+	return &uploadError{status: http.StatusBadRequest, reason: "digest", message: err.Error()}
+}
+
+func digestMismatchError(d *expectedDigest) *uploadError {
+	return &uploadError{status: http.StatusUnprocessableEntity, reason: "digest", message: "Content does not match its " + d.header + " header"}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func md5Base64(s string) string {
+	sum := md5.Sum([]byte(s))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func sha256Base64(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestPartDigest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header textproto.MIMEHeader
+		status int
+	}{
+		{"no header", nil, http.StatusOK},
+		{"matching Content-MD5", textproto.MIMEHeader{"Content-Md5": {md5Base64("hello")}}, http.StatusOK},
+		{"matching sha-256", textproto.MIMEHeader{"Digest": {"sha-256=" + sha256Base64("hello")}}, http.StatusOK},
+		{"matching md5 among others", textproto.MIMEHeader{"Digest": {"unixsum=30, md5=" + md5Base64("hello")}}, http.StatusOK},
+		{"mismatching Content-MD5", textproto.MIMEHeader{"Content-Md5": {md5Base64("hullo")}}, http.StatusUnprocessableEntity},
+		{"mismatching sha-256", textproto.MIMEHeader{"Digest": {"sha-256=" + sha256Base64("hullo")}}, http.StatusUnprocessableEntity},
+		{"malformed", textproto.MIMEHeader{"Content-Md5": {"not base64"}}, http.StatusBadRequest},
+		{"wrong length", textproto.MIMEHeader{"Digest": {"sha-256=" + md5Base64("hello")}}, http.StatusBadRequest},
+		{"unsupported algorithm", textproto.MIMEHeader{"Digest": {"unixsum=30"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			w := upload(t, "/upload", formPart{field: "file", filename: "a.txt", content: "hello", header: tt.header})
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			names := stored(t)
+			if tt.status != http.StatusOK {
+				if len(names) != 0 {
+					t.Errorf("stored %v after a rejected upload", names)
+				}
+				return
+			}
+			if len(names) != 1 {
+				t.Errorf("stored %v, want one file", names)
+			}
+		})
+	}
+}
+
+// TestRequestDigest checks a digest on the request covers the whole
+// multipart body, and a mismatch removes the files already stored from it.
+func TestRequestDigest(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		match  bool
+		status int
+	}{
+		{"matching", true, http.StatusOK},
+		{"mismatching", false, http.StatusUnprocessableEntity},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			r := uploadRequest(t, "/upload", file("a.txt", "hello"), file("b.txt", "world"))
+			body, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256Base64(string(body))
+			if !tt.match {
+				sum = sha256Base64("something else")
+			}
+			r.Header.Set("Digest", "sha-256="+sum)
+			w := serve(http.HandlerFunc(uploadFile), r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			want := 2
+			if !tt.match {
+				want = 0
+				if !strings.Contains(w.Body.String(), "Digest header") {
+					t.Errorf("error %s doesn't name the header", w.Body)
+				}
+			}
+			if names := stored(t); len(names) != want {
+				t.Errorf("stored %v, want %d files", names, want)
+			}
+		})
+	}
+}
+
+func TestPasteDigest(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		md5    string
+		status int
+		stored int
+	}{
+		{"no header", "", http.StatusOK, 1},
+		{"matching", md5Base64("log output"), http.StatusOK, 1},
+		{"mismatching", md5Base64("other output"), http.StatusUnprocessableEntity, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			r := httptest.NewRequest(http.MethodPost, "/paste", strings.NewReader("log output"))
+			if tt.md5 != "" {
+				r.Header.Set("Content-MD5", tt.md5)
+			}
+			if w := serve(http.HandlerFunc(uploadPaste), r); w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if names := stored(t); len(names) != tt.stored {
+				t.Errorf("stored %v, want %d files", names, tt.stored)
+			}
+		})
+	}
+}
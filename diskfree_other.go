@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// freeSpace isn't supported here, so -placement least-full falls back to
+// round-robin.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// stripEXIF removes metadata from JPEG uploads before they are stored.
+var stripEXIF bool
+
+// strippedJPEGMarkers are the JPEG segments dropped by -strip-exif: APP1
+// (EXIF, including GPS position and camera details, and XMP), APP13 (IPTC)
+// and comments. Segments the decoder needs, such as JFIF, ICC colour
+// profiles and Adobe colour transforms, are kept. Orientation is part of
+// EXIF, so rotated photos are shown as the camera stored them.
+var strippedJPEGMarkers = map[byte]bool{0xe1: true, 0xed: true, 0xfe: true}
+
+// stripJPEGMetadata copies the JPEG in src to dst without its metadata
+// segments. The image data itself is copied byte for byte, so quality is
+// untouched.
+func stripJPEGMetadata(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(br, soi); err != nil {
+		return err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return errors.New("not a JPEG file")
+	}
+	if _, err := dst.Write(soi); err != nil {
+		return err
+	}
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0xff {
+			return errors.New("malformed JPEG segment")
+		}
+		marker, err := br.ReadByte()
+		for err == nil && marker == 0xff {
+			marker, err = br.ReadByte()
+		}
+		if err != nil {
+			return err
+		}
+		// Once the scan starts there is no more metadata to strip.
+		if marker == 0xda || marker == 0xd9 {
+			if _, err := dst.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			_, err := io.Copy(dst, br)
+			return err
+		}
+		// Markers without a length.
+		if marker == 0x01 || 0xd0 <= marker && marker <= 0xd7 {
+			if _, err := dst.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header := []byte{0xff, marker, 0, 0}
+		if _, err := io.ReadFull(br, header[2:]); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return errors.New("malformed JPEG segment")
+		}
+		if strippedJPEGMarkers[marker] {
+			if _, err := br.Discard(int(length - 2)); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := dst.Write(header); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, br, length-2); err != nil {
+			return err
+		}
+	}
+}
+
+// stripJPEGReader returns src with its JPEG metadata stripped as it is
+// read. Closing it stops the stripping if the reader gives up early.
+func stripJPEGReader(src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(stripJPEGMetadata(pw, src))
+	}()
+	return pr
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// jpegSegment returns a JPEG segment with the given marker and payload.
+func jpegSegment(marker byte, payload string) string {
+	n := len(payload) + 2
+	return string([]byte{0xff, marker, byte(n >> 8), byte(n)}) + payload
+}
+
+// exifJPEG returns a small JPEG with the given segments inserted after its
+// start of image marker.
+func exifJPEG(t *testing.T, segments ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.String()
+	return encoded[:2] + strings.Join(segments, "") + encoded[2:]
+}
+
+var (
+	exifSegment = jpegSegment(0xe1, "Exif\x00\x00GPS 51.5N 0.1W Canon EOS")
+	iptcSegment = jpegSegment(0xed, "Photoshop 3.0\x00IPTC byline")
+	comSegment  = jpegSegment(0xfe, "taken at home")
+	iccSegment  = jpegSegment(0xe2, "ICC_PROFILE\x00profile")
+	jfifSegment = jpegSegment(0xe0, "JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00")
+)
+
+func TestStripJPEGMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		removed []string
+		kept    []string
+		wantErr bool
+	}{
+		{"exif", exifJPEG(t, exifSegment), []string{"GPS 51.5N"}, nil, false},
+		{"iptc and comment", exifJPEG(t, iptcSegment, comSegment), []string{"IPTC byline", "taken at home"}, nil, false},
+		{"icc profile kept", exifJPEG(t, iccSegment, exifSegment), []string{"Canon"}, []string{"ICC_PROFILE"}, false},
+		{"jfif kept", exifJPEG(t, jfifSegment, exifSegment), []string{"GPS"}, []string{"JFIF"}, false},
+		{"no metadata", exifJPEG(t), nil, nil, false},
+		{"not a JPEG", "\x89PNG\r\n", nil, nil, true},
+		{"truncated segment", exifJPEG(t)[:2] + "\xff\xe1\x01", nil, nil, true},
+		{"bad length", exifJPEG(t)[:2] + "\xff\xe1\x00\x01", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := stripJPEGMetadata(&out, strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("stripJPEGMetadata: err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for _, s := range tt.removed {
+				if strings.Contains(out.String(), s) {
+					t.Errorf("output still contains %q", s)
+				}
+			}
+			for _, s := range tt.kept {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("output lost %q", s)
+				}
+			}
+			// The image data is copied as it is, so it still decodes the same.
+			if _, err := jpeg.Decode(&out); err != nil {
+				t.Errorf("stripped JPEG doesn't decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestStripEXIFUploads(t *testing.T) {
+	photo := exifJPEG(t, exifSegment)
+	png := testPNG(t, 4, 4)
+	tests := []struct {
+		name     string
+		strip    bool
+		filename string
+		content  string
+		want     string
+	}{
+		{"jpeg", true, "photo.jpg", photo, exifJPEG(t)},
+		{"stripping off", false, "photo.jpg", photo, photo},
+		{"png unchanged", true, "image.png", png, png},
+		{"text unchanged", true, "notes.txt", "Exif GPS", "Exif GPS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &stripEXIF, tt.strip)
+			up := uploaded(t, "/upload", tt.filename, tt.content)
+			data, err := os.ReadFile(filepath.Join(uploadDir, up.Filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("stored %d bytes, want %d", len(data), len(tt.want))
+			}
+			if up.Size != int64(len(tt.want)) || up.Sha256 != sha256Hex(tt.want) {
+				t.Errorf("response describes %d bytes with sha256 %s, not the stored file", up.Size, up.Sha256)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTTL parses the ttl query parameter. On top of time.ParseDuration it
+// accepts a "d" suffix for days, e.g. "7d". A zero return means the file
+// never expires.
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, errors.New("invalid ttl " + strconv.Quote(s))
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid ttl " + strconv.Quote(s))
+	}
+	return d, nil
+}
+
+// sweepExpiredFiles removes expired uploads, and resumable uploads abandoned
+// for tusExpiry, every interval. It runs for the lifetime of the process.
+func sweepExpiredFiles(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !readOnly.Load() {
+			removeExpiredFiles(time.Now())
+			removeStaleTusUploads(time.Now())
+		}
+	}
+}
+
+func removeExpiredFiles(now time.Time) {
+	for _, name := range metadata.expired(now) {
+		err := store.Delete(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Error removing expired file", "file", name, "err", err)
+			continue
+		}
+		if err := forgetUpload(name); err != nil {
+			slog.Error("Error updating metadata", "file", name, "err", err)
+		}
+		slog.Info("Removed expired file", "file", name)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"90s", 90 * time.Second, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"0d", 0, false},
+		{"-1h", 0, true},
+		{"-2d", 0, true},
+		{"xd", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTTL(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTTL(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRemoveExpiredFiles(t *testing.T) {
+	setup(t)
+	expiring := uploaded(t, "/upload?ttl=1h", "a.txt", "expiring")
+	kept := uploaded(t, "/upload", "b.txt", "kept")
+	// A malformed ttl is ignored rather than rejecting the upload.
+	ignored := uploaded(t, "/upload?ttl=soon", "c.txt", "kept")
+
+	removeExpiredFiles(time.Now())
+	if w := get(expiring.Filename); w.Code != http.StatusOK {
+		t.Fatalf("file removed before its ttl: status %d", w.Code)
+	}
+
+	removeExpiredFiles(time.Now().Add(2 * time.Hour))
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{expiring.Filename, http.StatusNotFound},
+		{kept.Filename, http.StatusOK},
+		{ignored.Filename, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := get(tt.name); w.Code != tt.status {
+			t.Errorf("GET %s after sweep: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+	if _, ok := metadata.get(expiring.Filename); ok {
+		t.Error("metadata kept for removed file")
+	}
+}
+
+func TestExpiredFileNotServed(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload?ttl=1ms", "a.txt", "expiring")
+	time.Sleep(10 * time.Millisecond)
+	// Not swept yet, but no longer served.
+	if w := get(up.Filename); w.Code != http.StatusNotFound {
+		t.Errorf("expired file: status %d, want 404", w.Code)
+	}
+}
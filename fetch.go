@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+)
+
+// allowPrivateFetch lets /upload-url fetch from private, loopback and
+// link-local addresses, which are refused by default so the endpoint can't
+// be used to reach services behind the server.
+var allowPrivateFetch bool
+
+const (
+	fetchTimeout      = 10 * time.Minute
+	fetchMaxRedirects = 5
+)
+
+var errPrivateAddress = errors.New("address is not publicly routable")
+
+// sharedAddressSpace is the carrier-grade NAT range, which netip doesn't
+// count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// fetchClient checks every address it connects to, after DNS resolution and
+// on each redirect, so a hostname can't be pointed at an internal address.
+var fetchClient = &http.Client{
+	Timeout: fetchTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip, err := netip.ParseAddr(host)
+				if err != nil {
+					return err
+				}
+				if !allowPrivateFetch && !isPublicAddr(ip) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= fetchMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", fetchMaxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("redirect to unsupported scheme")
+		}
+		return nil
+	},
+}
+
+type fetchRequest struct {
+	URL string `json:"url"`
+}
+
+// uploadFromURL downloads the file at a remote URL and stores it as if it
+// had been uploaded, with the same size limit and checks. The query
+// parameters work as they do for /upload.
+func uploadFromURL(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	var req fetchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8192)).Decode(&req); err != nil {
+		writeUploadError(w, r, "Request body must be JSON with a url", http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		writeUploadError(w, r, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+
+	opts, uerr := parseUploadOptions(logger, r)
+	if uerr != nil {
+		if uerr.reason != "" {
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+		}
+		writeUploadError(w, r, uerr.message, uerr.status)
+		return
+	}
+
+	fetch, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		writeUploadError(w, r, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	resp, err := fetchClient.Do(fetch)
+	if errors.Is(err, errPrivateAddress) {
+		uploadErrorsTotal.WithLabelValues("fetch").Inc()
+		logger.Warn("Refused to fetch private address", "url", target.Redacted())
+		writeUploadError(w, r, "url points to a private address", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		uploadErrorsTotal.WithLabelValues("fetch").Inc()
+		logger.Warn("Error fetching URL", "url", target.Redacted(), "err", err)
+		writeUploadError(w, r, "Unable to fetch url", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		uploadErrorsTotal.WithLabelValues("fetch").Inc()
+		writeUploadError(w, r, "Remote server answered "+resp.Status, http.StatusBadGateway)
+		return
+	}
+	if resp.ContentLength > int64(maxUploadSize) {
+		uploadErrorsTotal.WithLabelValues("too_large").Inc()
+		writeUploadError(w, r, "Upload exceeds maximum size of "+maxUploadSize.String(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	originalName := remoteFilename(resp)
+	body := http.MaxBytesReader(nil, resp.Body, int64(maxUploadSize))
+	response, uerr := saveUpload(logger, body, originalName, sanitizeFilename(originalName), "", opts)
+	if uerr != nil {
+		if uerr.reason != "" {
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+		}
+		writeUploadError(w, r, uerr.message, uerr.status)
+		return
+	}
+	if !opts.dryRun {
+		acceptUploads(logger, []any{response})
+	}
+	if wantsPlainText(r) {
+		writePlainUploads(w, []any{response}, http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// remoteFilename picks a name for a fetched file from Content-Disposition,
+// falling back to the last segment of the final URL.
+func remoteFilename(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	return path.Base(resp.Request.URL.Path)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// remoteServer serves files for /upload-url to fetch.
+func remoteServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/notes.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("remote notes"))
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../report.txt"`)
+		w.Write([]byte("named by the server"))
+	})
+	mux.HandleFunc("/evil", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="evil.exe"`)
+		w.Write([]byte("MZ"))
+	})
+	mux.HandleFunc("/missing.txt", http.NotFound)
+	mux.HandleFunc("/big.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(4<<10))
+		w.Write([]byte(strings.Repeat("x", 4<<10)))
+	})
+	mux.HandleFunc("/streamed.txt", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing first leaves the size unknown until the body ends.
+		w.Write([]byte("x"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(strings.Repeat("x", 4<<10)))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/notes.txt", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/ftp", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://example.com/file.txt", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fetchRequestFor builds a POST /upload-url for target.
+func fetchRequestFor(target string) *http.Request {
+	body, _ := json.Marshal(fetchRequest{URL: target})
+	return httptest.NewRequest(http.MethodPost, "/upload-url", strings.NewReader(string(body)))
+}
+
+func TestUploadFromURL(t *testing.T) {
+	srv := remoteServer(t)
+	tests := []struct {
+		name    string
+		path    string
+		status  int
+		suffix  string
+		content string
+	}{
+		{"file", "/notes.txt", http.StatusOK, "_notes.txt", "remote notes"},
+		{"named by Content-Disposition", "/download", http.StatusOK, "_report.txt", "named by the server"},
+		{"redirect followed", "/redirect", http.StatusOK, "_notes.txt", "remote notes"},
+		{"disallowed extension", "/evil", http.StatusBadRequest, "", ""},
+		{"remote error", "/missing.txt", http.StatusBadGateway, "", ""},
+		{"declared too large", "/big.txt", http.StatusRequestEntityTooLarge, "", ""},
+		{"streamed too large", "/streamed.txt", http.StatusRequestEntityTooLarge, "", ""},
+		{"redirect loop", "/loop", http.StatusBadGateway, "", ""},
+		{"redirect to another scheme", "/ftp", http.StatusBadGateway, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			// The test server is on loopback.
+			set(t, &allowPrivateFetch, true)
+			set(t, &maxUploadSize, 1<<10)
+			w := serve(http.HandlerFunc(uploadFromURL), fetchRequestFor(srv.URL+tt.path))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if names := stored(t); len(names) != 0 {
+					t.Errorf("stored %v", names)
+				}
+				return
+			}
+			var up UploadResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &up); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(up.Filename, tt.suffix) {
+				t.Errorf("stored as %q, want a name ending %s", up.Filename, tt.suffix)
+			}
+			if w := get(up.Filename); w.Body.String() != tt.content {
+				t.Errorf("stored content = %q, want %q", w.Body, tt.content)
+			}
+		})
+	}
+}
+
+// TestUploadFromURLPrivate checks that private addresses are refused,
+// including hostnames that resolve to them.
+func TestUploadFromURLPrivate(t *testing.T) {
+	srv := remoteServer(t)
+	u, _ := url.Parse(srv.URL)
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"loopback", srv.URL + "/notes.txt"},
+		{"localhost name", "http://localhost:" + u.Port() + "/notes.txt"},
+		{"metadata service", "http://169.254.169.254/latest/meta-data/"},
+		{"private network", "http://10.0.0.1/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &allowPrivateFetch, false)
+			w := serve(http.HandlerFunc(uploadFromURL), fetchRequestFor(tt.target))
+			if w.Code != http.StatusForbidden {
+				t.Errorf("status %d, want 403: %s", w.Code, w.Body)
+			}
+			if names := stored(t); len(names) != 0 {
+				t.Errorf("stored %v", names)
+			}
+		})
+	}
+}
+
+func TestUploadFromURLBadRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not JSON", "url=http://example.com"},
+		{"no url", `{}`},
+		{"relative", `{"url": "/notes.txt"}`},
+		{"file scheme", `{"url": "file:///etc/passwd"}`},
+		{"ftp scheme", `{"url": "ftp://example.com/a.txt"}`},
+		{"no host", `{"url": "http:///a.txt"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			r := httptest.NewRequest(http.MethodPost, "/upload-url", strings.NewReader(tt.body))
+			if w := serve(http.HandlerFunc(uploadFromURL), r); w.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want 400: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+module github.com/wrigglebug/filehost
+
+go 1.26.0
+
+require (
+	github.com/HugoSmits86/nativewebp v1.3.0
+	github.com/alecthomas/chroma/v2 v2.27.0
+	github.com/prometheus/client_golang v1.24.1
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.59.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dlclark/regexp2/v2 v2.2.1 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.2 // indirect
+	github.com/prometheus/common v0.70.1 // indirect
+	github.com/prometheus/procfs v0.21.1 // indirect
+	golang.org/x/image v0.24.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
+)
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"gzip", true},
+		{"deflate, gzip;q=0.8", true},
+		{"GZIP", true},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"br, deflate", false},
+		{"identity", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/plain; charset=utf-8", true},
+		{"text/css", true},
+		{"application/json", true},
+		{"Image/SVG+XML", true},
+		{"image/jpeg", false},
+		{"application/zip", false},
+		{"video/mp4", false},
+		{"application/octet-stream", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isCompressible(tt.contentType); got != tt.want {
+			t.Errorf("isCompressible(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestCompressedDownloads(t *testing.T) {
+	setup(t)
+	text := strings.Repeat("compress me please ", 200)
+	jpeg := "\xff\xd8\xff\xe0" + strings.Repeat("\x00\x10JFIF", 400)
+	files := map[string]string{
+		"text": uploaded(t, "/upload", "a.txt", text).Filename,
+		"tiny": uploaded(t, "/upload", "tiny.txt", "small").Filename,
+		"jpeg": uploaded(t, "/upload", "photo.jpg", jpeg).Filename,
+	}
+	contents := map[string]string{"text": text, "tiny": "small", "jpeg": jpeg}
+	h := http.StripPrefix(downloadPath, compressResponses(http.HandlerFunc(serveUploaded)))
+
+	tests := []struct {
+		name           string
+		file           string
+		method         string
+		acceptEncoding string
+		rng            string
+		gzipped        bool
+	}{
+		{"text", "text", http.MethodGet, "gzip, br", "", true},
+		{"text without gzip", "text", http.MethodGet, "br", "", false},
+		{"text refused", "text", http.MethodGet, "gzip;q=0", "", false},
+		{"below threshold", "tiny", http.MethodGet, "gzip", "", false},
+		{"jpeg", "jpeg", http.MethodGet, "gzip", "", false},
+		{"range", "text", http.MethodGet, "gzip", "bytes=0-9", false},
+		{"head", "text", http.MethodHead, "gzip", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, downloadPath+files[tt.file], nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			if tt.rng != "" {
+				r.Header.Set("Range", tt.rng)
+			}
+			w := serve(h, r)
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.gzipped {
+				t.Fatalf("gzipped = %v, want %v", got, tt.gzipped)
+			}
+			if w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q", w.Header().Get("Vary"))
+			}
+			if !tt.gzipped {
+				return
+			}
+			// A Content-Length for the uncompressed file would leave clients
+			// waiting for bytes that never come.
+			if cl := w.Header().Get("Content-Length"); cl != "" {
+				t.Errorf("Content-Length = %s on a gzipped response", cl)
+			}
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(zr)
+			if err != nil || string(body) != contents[tt.file] {
+				t.Errorf("decompressed body: %d bytes, %v", len(body), err)
+			}
+		})
+	}
+}
+
+// TestCompressedETag checks that the gzipped representation has its own
+// ETag, which conditional requests can still use.
+func TestCompressedETag(t *testing.T) {
+	setup(t)
+	name := uploaded(t, "/upload", "a.txt", strings.Repeat("etag ", 500)).Filename
+	h := http.StripPrefix(downloadPath, compressResponses(http.HandlerFunc(serveUploaded)))
+
+	r := httptest.NewRequest(http.MethodGet, downloadPath+name, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	etag := serve(h, r).Header().Get("ETag")
+	if !strings.HasSuffix(etag, `-gzip"`) {
+		t.Fatalf("ETag = %q, want a -gzip suffix", etag)
+	}
+	if plain := get(name).Header().Get("ETag"); plain == etag {
+		t.Errorf("gzipped and plain responses share the ETag %s", etag)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, downloadPath+name, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-None-Match", etag)
+	if w := serve(h, r); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match with the gzip ETag: status %d, want 304", w.Code)
+	}
+}
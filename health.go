@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the server version reported by /healthz. Release builds set it
+// with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+type healthResponse struct {
+	Status    string `json:"status"`
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Revision  string `json:"revision,omitempty"`
+}
+
+// healthz reports that the process is up. It does no I/O so it stays cheap
+// enough for frequent load balancer probes.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: "ok", Version: version, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				resp.Revision = s.Value
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// readyz additionally checks that uploadDir is writable by creating and
+// removing a temp file, returning 503 when it isn't, e.g. because it was
+// removed after startup.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	f, err := os.CreateTemp(uploadDir, ".readyz-*")
+	if err == nil {
+		f.Close()
+		err = os.Remove(f.Name())
+	}
+	if err != nil {
+		requestLogger(r).Error("Readiness check failed", "err", err)
+		writeJSONError(w, "Upload directory is not writable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	w := serve(http.HandlerFunc(healthz), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var resp healthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || resp.Status != "ok" || resp.Version != version || resp.GoVersion == "" {
+		t.Errorf("status %d, response %+v", w.Code, resp)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name   string
+		dir    func(t *testing.T) string
+		status int
+	}{
+		{"writable", func(t *testing.T) string { return uploadDir }, http.StatusOK},
+		{"removed", func(t *testing.T) string { return filepath.Join(t.TempDir(), "gone") }, http.StatusServiceUnavailable},
+		{"not a directory", func(t *testing.T) string {
+			p := filepath.Join(t.TempDir(), "file")
+			os.WriteFile(p, nil, 0644)
+			return p
+		}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &uploadDir, tt.dir(t))
+			w := serve(http.HandlerFunc(readyz), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if entries, _ := os.ReadDir(uploadDir); len(entries) != 0 {
+				t.Errorf("readyz left %d files behind", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// highlightStyle colours the tokens chroma finds; it suits /view's dark page.
+var highlightStyle = styles.Get("github-dark")
+
+// highlightFormatter writes tokens as spans with CSS classes rather than
+// inline styles, so the page's CSP only has to allow one style sheet.
+var highlightFormatter = html.New(html.WithClasses(true), html.PreventSurroundingPre(true))
+
+// highlightCSS is the style sheet for the classes highlight emits.
+var highlightCSS = func() template.CSS {
+	var b bytes.Buffer
+	if err := highlightFormatter.WriteCSS(&b, highlightStyle); err != nil {
+		panic(err)
+	}
+	return template.CSS(b.String())
+}()
+
+// highlight returns src as HTML highlighted with chroma, using the lexer
+// for filename's extension. Files no lexer matches, and any chroma fails
+// on, are shown escaped without highlighting.
+func highlight(src, filename string) template.HTML {
+	lexer := lexers.Match(filename)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	tokens, err := chroma.Coalesce(lexer).Tokenise(nil, src)
+	if err != nil {
+		return template.HTML(template.HTMLEscapeString(src))
+	}
+	var b bytes.Buffer
+	if err := highlightFormatter.Format(&b, highlightStyle, tokens); err != nil {
+		return template.HTML(template.HTMLEscapeString(src))
+	}
+	return template.HTML(b.String())
+}
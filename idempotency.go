@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL is how long the response to a request with an
+// Idempotency-Key is kept for retries of it.
+var idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds Idempotency-Key header values.
+const maxIdempotencyKeyLength = 255
+
+// idempotentResponse is a stored response, or a reservation for one while
+// done is false and the first request with its key is still running.
+type idempotentResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	done        bool
+	expires     time.Time
+}
+
+// idempotencyCache holds responses by client and Idempotency-Key. It lives
+// in memory only, so retries across a restart store the upload again.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+}
+
+var idempotency = &idempotencyCache{responses: make(map[string]*idempotentResponse)}
+
+// claim returns the stored response for key, or reserves key and returns
+// nil. ok is false when key is reserved by a request still in progress.
+func (c *idempotencyCache) claim(key string, now time.Time) (resp *idempotentResponse, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, found := c.responses[key]; found && (!e.done || now.Before(e.expires)) {
+		if !e.done {
+			return nil, false
+		}
+		return e, true
+	}
+	c.evict(now)
+	c.responses[key] = &idempotentResponse{}
+	return nil, true
+}
+
+// finish stores the response for a reserved key, or releases the key when
+// resp is nil so a retry runs the request again.
+func (c *idempotencyCache) finish(key string, resp *idempotentResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if resp == nil {
+		delete(c.responses, key)
+		return
+	}
+	c.responses[key] = resp
+}
+
+// evict drops expired responses. The caller must hold c.mu.
+func (c *idempotencyCache) evict(now time.Time) {
+	for key, e := range c.responses {
+		if e.done && !now.Before(e.expires) {
+			delete(c.responses, key)
+		}
+	}
+}
+
+// bodyRecorder passes a response through while keeping a copy of it.
+type bodyRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	b.body.Write(p)
+	return b.statusRecorder.Write(p)
+}
+
+// idempotent makes next safe to retry: a request with an Idempotency-Key
+// already seen from the same API key within idempotencyTTL gets the first
+// response again, and next isn't run. Only successful responses are kept,
+// so a retry after a failure tries again, and a retry while the first
+// request is still running is refused with 409. The key is not checked
+// against the rest of the request. Without API keys clients are told apart
+// by IP address, so one can't replay another's response by guessing its key.
+func idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Idempotency-Key")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(header) > maxIdempotencyKeyLength {
+			writeUploadError(w, r, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		key := "ip:" + clientIP(r)
+		if id := requestKeyID(r); id != "" {
+			key = "key:" + id
+		}
+		key += "\x00" + header
+		stored, ok := idempotency.claim(key, time.Now())
+		if !ok {
+			writeUploadError(w, r, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			return
+		}
+		if stored != nil {
+			requestLogger(r).Info("Replayed idempotent response", "idempotency_key", header)
+			w.Header().Set("Content-Type", stored.contentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			w.Write(stored.body)
+			return
+		}
+
+		rec := &bodyRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+		defer func() {
+			if rec.status < 200 || rec.status > 299 {
+				idempotency.finish(key, nil)
+				return
+			}
+			idempotency.finish(key, &idempotentResponse{
+				status:      rec.status,
+				contentType: w.Header().Get("Content-Type"),
+				body:        rec.body.Bytes(),
+				done:        true,
+				expires:     time.Now().Add(idempotencyTTL),
+			})
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	setup(t)
+	h := idempotent(http.HandlerFunc(uploadFile))
+	send := func(key, content string) *httptest.ResponseRecorder {
+		r := uploadRequest(t, "/upload", file("a.txt", content))
+		r.Header.Set("Idempotency-Key", key)
+		return serve(h, r)
+	}
+
+	first := send("retry-1", "hello")
+	if first.Code != http.StatusOK {
+		t.Fatalf("first upload: status %d: %s", first.Code, first.Body)
+	}
+	retry := send("retry-1", "hello")
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry: status %d, body %s; want %d, %s", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("retry not marked Idempotent-Replayed")
+	}
+	if names := stored(t); len(names) != 1 {
+		t.Errorf("stored %v, want one file", names)
+	}
+
+	if w := send("retry-2", "hello"); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another key: status %d, Idempotent-Replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if names := stored(t); len(names) != 2 {
+		t.Errorf("stored %v after another key, want two files", names)
+	}
+}
+
+// TestIdempotencyKeyAfterFailure checks a failed request isn't replayed, so
+// retrying it with the same key runs the upload again.
+func TestIdempotencyKeyAfterFailure(t *testing.T) {
+	setup(t)
+	h := idempotent(http.HandlerFunc(uploadFile))
+	r := uploadRequest(t, "/upload", file("run.exe", "MZ"))
+	r.Header.Set("Idempotency-Key", "k")
+	if w := serve(h, r); w.Code == http.StatusOK {
+		t.Fatalf("disallowed upload: status %d", w.Code)
+	}
+	r = uploadRequest(t, "/upload", file("a.txt", "hello"))
+	r.Header.Set("Idempotency-Key", "k")
+	if w := serve(h, r); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after failure: status %d, Idempotent-Replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+// TestIdempotencyKeyScopedByClient checks one client can't replay another's
+// response behind -trust-proxy by putting that client's address first in
+// X-Forwarded-For.
+func TestIdempotencyKeyScopedByClient(t *testing.T) {
+	setup(t)
+	set(t, &trustProxy, true)
+	h := idempotent(http.HandlerFunc(uploadFile))
+	send := func(forwarded string) *httptest.ResponseRecorder {
+		r := uploadRequest(t, "/upload", file("a.txt", "hello"))
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", forwarded)
+		r.Header.Set("Idempotency-Key", "k")
+		return serve(h, r)
+	}
+	if w := send("192.0.2.1"); w.Code != http.StatusOK {
+		t.Fatalf("first client: status %d: %s", w.Code, w.Body)
+	}
+	if w := send("192.0.2.1, 198.51.100.9"); w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("another client was replayed the first client's response")
+	}
+}
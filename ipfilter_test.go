@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	prefixes, err := parseCIDRs(" 10.0.0.0/8, 192.168.1.7 ,2001:db8::/32,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range prefixes {
+		got = append(got, p.String())
+	}
+	if want := "10.0.0.0/8 192.168.1.7/32 2001:db8::/32"; strings.Join(got, " ") != want {
+		t.Errorf("prefixes %v, want %s", got, want)
+	}
+	if _, err := parseCIDRs("10.0.0.0/33"); err == nil {
+		t.Error("no error for an invalid block")
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name       string
+		allow      string
+		deny       string
+		trustProxy bool
+		// client is the remote address, then any X-Forwarded-For header
+		// after a |.
+		client string
+		status int
+	}{
+		{"no rules", "", "", false, "203.0.113.5", http.StatusOK},
+		{"allowed IP", "203.0.113.5", "", false, "203.0.113.5", http.StatusOK},
+		{"not allowed", "203.0.113.5", "", false, "203.0.113.6", http.StatusForbidden},
+		{"denied IP", "", "198.51.100.9", false, "198.51.100.9", http.StatusForbidden},
+		{"CIDR match", "10.0.0.0/8", "", false, "10.20.30.40", http.StatusOK},
+		{"CIDR miss", "10.0.0.0/8", "", false, "11.0.0.1", http.StatusForbidden},
+		{"deny wins over allow", "10.0.0.0/8", "10.1.0.0/16", false, "10.1.2.3", http.StatusForbidden},
+		{"IPv4-mapped IPv6", "10.0.0.0/8", "", false, "[::ffff:10.0.0.1]", http.StatusOK},
+		{"proxy ignored", "10.0.0.0/8", "", false, "192.0.2.1|10.0.0.1", http.StatusForbidden},
+		{"forwarded by proxy", "10.0.0.0/8", "", true, "192.0.2.1|10.0.0.1", http.StatusOK},
+		{"forwarded denied", "", "198.51.100.0/24", true, "192.0.2.1|198.51.100.9", http.StatusForbidden},
+		// The client's own X-Forwarded-For comes first, before the entry
+		// the proxy adds.
+		{"spoofed allowed IP", "10.0.0.0/8", "", true, "192.0.2.1|10.0.0.1, 198.51.100.9", http.StatusForbidden},
+		{"spoofed past denylist", "", "198.51.100.0/24", true, "192.0.2.1|10.0.0.1, 198.51.100.9", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set(t, &trustProxy, tt.trustProxy)
+			var f ipFilter
+			var err error
+			if f.allow, err = parseCIDRs(tt.allow); err != nil {
+				t.Fatal(err)
+			}
+			if f.deny, err = parseCIDRs(tt.deny); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			addr, fwd, _ := strings.Cut(tt.client, "|")
+			r.RemoteAddr = addr + ":1234"
+			if fwd != "" {
+				r.Header.Set("X-Forwarded-For", fwd)
+			}
+			if w := serve(f.filter(ok), r); w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
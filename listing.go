@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FileListing is one entry in the GET /api/files response.
+type FileListing struct {
+	Filename     string    `json:"filename"`
+	OriginalName string    `json:"originalName"`
+	ContentType  string    `json:"contentType,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	URL          string    `json:"url"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"modTime"`
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listFiles returns the stored uploads as JSON. It supports ?sort=date
+// (newest first, the default), name or size (largest first), and pages with
+// ?limit= and ?offset=.
+func listFiles(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, ok := queryInt(q.Get("limit"), defaultListLimit)
+	if !ok || limit < 1 || limit > maxListLimit {
+		writeJSONError(w, "limit must be between 1 and "+strconv.Itoa(maxListLimit), http.StatusBadRequest)
+		return
+	}
+	offset, ok := queryInt(q.Get("offset"), 0)
+	if !ok || offset < 0 {
+		writeJSONError(w, "offset must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	files, err := listLiveFiles()
+	if err != nil {
+		requestLogger(r).Error("Error listing files", "err", err)
+		writeJSONError(w, "Unable to list files", http.StatusInternalServerError)
+		return
+	}
+
+	switch q.Get("sort") {
+	case "", "date":
+		sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	case "name":
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	case "size":
+		sort.Slice(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+	default:
+		writeJSONError(w, "sort must be one of date, name or size", http.StatusBadRequest)
+		return
+	}
+
+	listing := []FileListing{}
+	for i := offset; i < len(files) && len(listing) < limit; i++ {
+		f := files[i]
+		m, _ := metadata.get(f.Name)
+		listing = append(listing, FileListing{
+			Filename:     f.Name,
+			OriginalName: originalName(f.Name, m),
+			ContentType:  m.ContentType,
+			Description:  m.Description,
+			URL:          fileURL(f.Name),
+			Size:         f.Size,
+			ModTime:      f.ModTime,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+// FileDetails is the GET /api/files/{name} response.
+type FileDetails struct {
+	Filename     string    `json:"filename"`
+	OriginalName string    `json:"originalName"`
+	URL          string    `json:"url"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"contentType,omitempty"`
+	Sha256       string    `json:"sha256,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	UploadedAt   time.Time `json:"uploadedAt"`
+	ExpiresAt    time.Time `json:"expiresAt,omitzero"`
+	Downloads    int64     `json:"downloads"`
+	OneTime      bool      `json:"oneTime,omitempty"`
+	// PasswordProtected is set when downloading the file needs a password.
+	PasswordProtected bool `json:"passwordProtected,omitempty"`
+}
+
+// serveFileDetails describes a stored file from its metadata and download
+// stats without sending its content. Files stored before metadata recorded
+// a type or upload time get them from their extension and modification
+// time.
+func serveFileDetails(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !isValidName(name) || isThumbnail(name) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	m, _ := metadata.get(name)
+	if m.expired(time.Now()) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	f, err := store.Get(name)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error opening file", "file", name, "err", err)
+		writeJSONError(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	size, modTime := f.Size(), f.ModTime()
+	f.Close()
+
+	details := FileDetails{
+		Filename:          name,
+		OriginalName:      originalName(name, m),
+		URL:               fileURL(name),
+		Size:              size,
+		ContentType:       m.ContentType,
+		Sha256:            m.Sha256,
+		Description:       m.Description,
+		UploadedAt:        m.UploadedAt,
+		ExpiresAt:         m.ExpiresAt,
+		Downloads:         downloadStats.get(name).Downloads,
+		OneTime:           m.OneTime,
+		PasswordProtected: m.PasswordHash != "",
+	}
+	if details.ContentType == "" {
+		details.ContentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if details.UploadedAt.IsZero() {
+		details.UploadedAt = modTime.UTC()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+}
+
+// listLiveFiles lists stored uploads, leaving out thumbnails, one-time files
+// whose names are meant only for their recipient, and expired files the
+// sweeper hasn't removed yet.
+func listLiveFiles() ([]FileInfo, error) {
+	files, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	live := files[:0]
+	for _, f := range files {
+		if isThumbnail(f.Name) {
+			continue
+		}
+		if m, ok := metadata.get(f.Name); ok && (m.expired(now) || m.OneTime) {
+			continue
+		}
+		live = append(live, f)
+	}
+	return live, nil
+}
+
+func queryInt(s string, def int) (int, bool) {
+	if s == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadListed stores files named after their content, each a minute newer
+// than the last, so every sort order is distinct.
+func uploadListed(t *testing.T, contents ...string) map[string]string {
+	t.Helper()
+	names := make(map[string]string)
+	start := time.Now().Add(-time.Hour)
+	for i, content := range contents {
+		up := uploaded(t, "/upload", content+".txt", content)
+		modTime := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filepath.Join(uploadDir, up.Filename), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		names[up.Filename] = content
+	}
+	return names
+}
+
+func TestListFiles(t *testing.T) {
+	tests := []struct {
+		query  string
+		status int
+		want   []string
+	}{
+		{"", http.StatusOK, []string{"ccc", "a", "bb"}},
+		{"?sort=date", http.StatusOK, []string{"ccc", "a", "bb"}},
+		{"?sort=size", http.StatusOK, []string{"ccc", "bb", "a"}},
+		{"?sort=size&limit=2", http.StatusOK, []string{"ccc", "bb"}},
+		{"?sort=size&limit=2&offset=2", http.StatusOK, []string{"a"}},
+		{"?offset=10", http.StatusOK, []string{}},
+		{"?sort=color", http.StatusBadRequest, nil},
+		{"?limit=0", http.StatusBadRequest, nil},
+		{"?limit=5000", http.StatusBadRequest, nil},
+		{"?offset=-1", http.StatusBadRequest, nil},
+		{"?limit=many", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			setup(t)
+			uploadListed(t, "bb", "a", "ccc")
+			w := serve(http.HandlerFunc(listFiles), httptest.NewRequest(http.MethodGet, "/api/files"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var listing []FileListing
+			if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, f := range listing {
+				got = append(got, strings.TrimSuffix(f.OriginalName, ".txt"))
+				if f.URL != fileURL(f.Filename) || f.Size != int64(len(f.OriginalName)-len(".txt")) {
+					t.Errorf("entry %+v", f)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("listed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListFilesSortByName(t *testing.T) {
+	setup(t)
+	names := uploadListed(t, "bb", "a", "ccc")
+	w := serve(http.HandlerFunc(listFiles), httptest.NewRequest(http.MethodGet, "/api/files?sort=name", nil))
+	var listing []FileListing
+	json.Unmarshal(w.Body.Bytes(), &listing)
+	var got []string
+	for _, f := range listing {
+		got = append(got, f.Filename)
+	}
+	if !slices.IsSorted(got) || len(got) != len(names) {
+		t.Errorf("listed %v, want all of %v sorted", got, names)
+	}
+}
+
+// TestListFilesHidden checks files only their recipient should know about
+// stay out of the listing.
+func TestListFilesHidden(t *testing.T) {
+	setup(t)
+	uploaded(t, "/upload", "listed.png", testPNG(t, 20, 20))
+	uploaded(t, "/upload?onetime=1", "secret.txt", "one-time")
+	uploaded(t, "/upload?ttl=1ms", "gone.txt", "expired")
+	time.Sleep(10 * time.Millisecond)
+	thumbnailJobs.Wait()
+
+	w := serve(http.HandlerFunc(listFiles), httptest.NewRequest(http.MethodGet, "/api/files", nil))
+	var listing []FileListing
+	json.Unmarshal(w.Body.Bytes(), &listing)
+	if len(listing) != 1 || listing[0].OriginalName != "listed.png" {
+		t.Errorf("listed %+v, want only listed.png", listing)
+	}
+}
+
+// TestDescriptions checks a caption given with an upload comes back in the
+// response and the file listing, whether sent in the query or as a form
+// field ahead of the file.
+func TestDescriptions(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload?description=for+every+file",
+		file("a.txt", "a"),
+		formPart{field: "description", content: "  Ünïcode caption  "},
+		file("b.txt", "b"),
+		file("c.txt", "c"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	want := map[string]string{}
+	for i, up := range decodeUploads(t, w) {
+		// The form field only captions the file sent right after it.
+		wantDesc := []string{"for every file", "Ünïcode caption", "for every file"}[i]
+		if up.Description != wantDesc {
+			t.Errorf("%s: response description %q, want %q", up.OriginalName, up.Description, wantDesc)
+		}
+		want[up.Filename] = wantDesc
+	}
+
+	lw := serve(http.HandlerFunc(listFiles), httptest.NewRequest(http.MethodGet, "/api/files", nil))
+	var listed []FileListing
+	if err := json.NewDecoder(lw.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range listed {
+		if f.Description != want[f.Filename] {
+			t.Errorf("%s: listed description %q, want %q", f.Filename, f.Description, want[f.Filename])
+		}
+	}
+	if len(listed) != len(want) {
+		t.Errorf("listed %d files, want %d", len(listed), len(want))
+	}
+
+	tooLong := strings.Repeat("x", maxDescriptionLength+1)
+	if w := upload(t, "/upload?description="+tooLong, file("d.txt", "d")); w.Code != http.StatusBadRequest {
+		t.Errorf("over-long description in the query: status %d", w.Code)
+	}
+	if w := upload(t, "/upload", formPart{field: "description", content: tooLong}, file("d.txt", "d")); w.Code != http.StatusBadRequest {
+		t.Errorf("over-long description field: status %d", w.Code)
+	}
+}
+
+// details fetches /api/files/{name}.
+func details(name string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/files/{name...}", serveFileDetails)
+	return serve(mux, httptest.NewRequest(http.MethodGet, "/api/files/"+name, nil))
+}
+
+func TestFileDetails(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload?ttl=1h&description=notes&password=secret", "Notes.txt", "hello")
+	get(up.Filename + "?password=secret")
+	w := details(up.Filename)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var got FileDetails
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := metadata.get(up.Filename)
+	want := FileDetails{
+		Filename:          up.Filename,
+		OriginalName:      "Notes.txt",
+		URL:               up.URL,
+		Size:              int64(len("hello")),
+		ContentType:       m.ContentType,
+		Sha256:            sha256Hex("hello"),
+		Description:       "notes",
+		UploadedAt:        m.UploadedAt,
+		ExpiresAt:         m.ExpiresAt,
+		Downloads:         1,
+		PasswordProtected: true,
+	}
+	if !got.UploadedAt.Equal(want.UploadedAt) || !got.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Errorf("times %v, %v; want %v, %v", got.UploadedAt, got.ExpiresAt, want.UploadedAt, want.ExpiresAt)
+	}
+	got.UploadedAt, got.ExpiresAt = want.UploadedAt, want.ExpiresAt
+	if got != want {
+		t.Errorf("details %+v\nwant %+v", got, want)
+	}
+	if m.ContentType == "" || m.UploadedAt.IsZero() || m.ExpiresAt.IsZero() {
+		t.Errorf("upload recorded metadata %+v", m)
+	}
+
+	if w := details("missing.txt"); w.Code != http.StatusNotFound {
+		t.Errorf("missing file: status %d", w.Code)
+	}
+}
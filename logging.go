@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// setupLogging installs the default slog logger. Output from the log package
+// goes through the same handler, so every line shares one format.
+func setupLogging(format string) error {
+	var h slog.Handler
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, nil)
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, nil)
+	default:
+		return fmt.Errorf("unknown -log-format %q, expected json or text", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+type loggerKey struct{}
+
+// requestLogger returns the logger for r, which carries its request ID.
+func requestLogger(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// statusRecorder captures the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// logRequests gives every request an ID, returned in X-Request-ID and
+// attached to the request's logger, and writes one access log line per
+// request. Health checks are skipped so frequent probes don't flood the log.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := generateRandomString(12)
+		w.Header().Set("X-Request-ID", id)
+		logger := slog.Default().With("request_id", id)
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		logger.Info("Request",
+			"method", r.Method,
+			"remote_addr", r.RemoteAddr,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+		)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the default logger to a buffer of JSON lines for the
+// rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+// logLines decodes the captured JSON log lines.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestSetupLogging(t *testing.T) {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{"json", false},
+		{"text", false},
+		{"xml", true},
+	}
+	for _, tt := range tests {
+		if err := setupLogging(tt.format); (err != nil) != tt.wantErr {
+			t.Errorf("setupLogging(%q) = %v, want error %v", tt.format, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	setup(t)
+	logs := captureLogs(t)
+	w := serve(logRequests(http.HandlerFunc(uploadFile)), uploadRequest(t, "/upload", file("a.txt", "hello")))
+	id := w.Header().Get("X-Request-ID")
+	if id == "" {
+		t.Fatal("no X-Request-ID")
+	}
+	lines := logLines(t, logs)
+	var messages []string
+	for _, line := range lines {
+		if line["request_id"] != id {
+			t.Errorf("log line without the request ID: %v", line)
+		}
+		messages = append(messages, line["msg"].(string))
+	}
+	if got := strings.Join(messages, ", "); got != "Stored upload, Request" {
+		t.Errorf("logged %s, want the upload and then the request", got)
+	}
+	if access := lines[len(lines)-1]; access["status"] != float64(http.StatusOK) || access["path"] != "/upload" {
+		t.Errorf("access log line %v", access)
+	}
+}
+
+func TestHealthChecksNotLogged(t *testing.T) {
+	setup(t)
+	logs := captureLogs(t)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		w := serve(logRequests(http.HandlerFunc(healthz)), httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Header().Get("X-Request-ID") != "" {
+			t.Errorf("%s got a request ID", path)
+		}
+	}
+	if logs.Len() != 0 {
+		t.Errorf("health checks logged: %s", logs)
+	}
+}
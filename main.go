@@ -1,22 +1,67 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type UploadResponse struct {
 	Filename string `json:"filename"`
-	URL      string `json:"url"`
+	// OriginalName is the name the file was sent with, so responses can be
+	// matched to the files of a batch even when several share a name.
+	OriginalName string `json:"originalName,omitempty"`
+	URL          string `json:"url"`
+	// PreviewURL shows the file in the browser, for types it is safe to
+	// show there, and DownloadURL saves it whatever the type.
+	PreviewURL  string `json:"previewUrl,omitempty"`
+	DownloadURL string `json:"downloadUrl,omitempty"`
+	Sha256      string `json:"sha256"`
+	// Size is the number of bytes actually stored.
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploadedAt,omitzero"`
+	// ThumbnailURL is empty unless the upload is an image.
+	ThumbnailURL string `json:"thumbnailUrl"`
+	Description  string `json:"description,omitempty"`
+	// SignedURL is a download URL that expires, given when -signing-key is
+	// set.
+	SignedURL string `json:"signedUrl,omitempty"`
+	// OriginalURL is the upload as sent, when it was converted with
+	// -convert-images and -keep-original.
+	OriginalURL string `json:"originalUrl,omitempty"`
+	// DuplicateOf names the stored file with the same content when the
+	// upload is Duplicate.
+	Duplicate   bool   `json:"duplicate,omitempty"`
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+	// reused is set when dedupe matched a file stored earlier, which must
+	// be kept if this upload is rolled back.
+	reused bool
+	// thumbnail is set when the file's thumbnail is still to be generated.
+	thumbnail bool
 }
 
 type ErrorResponse struct {
@@ -26,8 +71,14 @@ type ErrorResponse struct {
 var (
 	hostname             string
 	port                 string
-	uploadDir            string = "./uploaded"
-	disallowedExtensions        = map[string]bool{
+	urlPrefix            string
+	staticDir            string
+	uploadDir            string   = "./uploaded"
+	maxUploadSize        byteSize = 2 << 30
+	maxFiles             int      = 20
+	dedupe               bool
+	trustProxy           bool
+	disallowedExtensions = map[string]bool{
 		".exe":  true,
 		".bat":  true,
 		".cmd":  true,
@@ -35,128 +86,1775 @@ var (
 		".vbs":  true,
 		".scr":  true,
 		".html": true,
+		// Browsers run script in these too.
+		".htm":   true,
+		".xhtml": true,
+		".xht":   true,
+		".svg":   true,
 	}
+	// allowedExtensions switches to allowlist mode when non-nil: only the
+	// listed extensions are accepted.
+	allowedExtensions map[string]bool
+)
+
+// dirMode and fileMode are the permissions uploadDir and the directories and
+// files in it are created with, set with -dir-mode and -file-mode.
+var (
+	dirMode  os.FileMode = 0755
+	fileMode os.FileMode = 0644
 )
 
+// createUploadDirs creates those of dirs that don't exist yet with dirMode.
+// It runs once at startup, and handlers count on the directories being
+// there rather than creating them again.
+func createUploadDirs(dirs []string) error {
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.MkdirAll(dir, dirMode); err != nil {
+			return err
+		}
+		// Set the mode again so the umask doesn't change it.
+		if err := os.Chmod(dir, dirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// octalMode is a flag.Func parser for file permissions like 0750.
+func octalMode(mode *os.FileMode) func(string) error {
+	return func(s string) error {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || m > 0777 {
+			return errors.New("expected an octal mode such as 0750")
+		}
+		*mode = os.FileMode(m)
+		return nil
+	}
+}
+
+// checkExtension reports whether uploads with extension ext are accepted.
+// Matching is case-insensitive so ".EXE" is treated like ".exe".
+func checkExtension(ext string) error {
+	if ext == "" {
+		return errors.New("Filename must have an extension")
+	}
+	ext = strings.ToLower(ext)
+	if disallowedExtensions[ext] {
+		return errors.New("Disallowed file extension")
+	}
+	if allowedExtensions != nil && !allowedExtensions[ext] {
+		return errors.New("File extension is not in the allowed list")
+	}
+	return nil
+}
+
+// parseExtensions turns a comma-separated list like "exe,.BAT" into a set of
+// lowercase extensions with a leading dot.
+func parseExtensions(list string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		exts[e] = true
+	}
+	return exts
+}
+
 func uploadFile(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received %s request from %s for URL: %s", r.Method, r.RemoteAddr, r.URL.Path)
+	logger := requestLogger(r)
 
-	err := r.ParseMultipartForm(2 << 30) // 2 GiB limit
+	// Parts are streamed to storage one at a time, so memory use stays
+	// bounded by a few small buffers whatever the size of the upload.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadSize))
+	if id := r.Header.Get("X-Upload-Id"); id != "" {
+		if !isValidUploadID(id) {
+			writeUploadError(w, r, "X-Upload-Id must be up to 64 letters, digits, dashes or underscores", http.StatusBadRequest)
+			return
+		}
+		finish, ok := trackProgress(r, id)
+		if !ok {
+			writeUploadError(w, r, "X-Upload-Id is already in use", http.StatusConflict)
+			return
+		}
+		defer finish()
+	}
+	// A digest on the request covers the whole multipart body, as HTTP has
+	// it; a part can carry its own for just the file in it.
+	digest, err := parseDigest(r.Header)
 	if err != nil {
-		log.Printf("Error parsing multipart form: %v", err)
-		writeJSONError(w, "Unable to parse form", http.StatusBadRequest)
+		uploadErrorsTotal.WithLabelValues("digest").Inc()
+		writeUploadError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	files := r.MultipartForm.File["file"]
-	if len(files) == 0 {
-		writeJSONError(w, "No files uploaded", http.StatusBadRequest)
+	if digest != nil {
+		r.Body = digest.body(r.Body)
+	}
+	// Sending JSON or a raw body here is a common mistake, so say what was
+	// wrong rather than that the form couldn't be parsed.
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, params, _ := mime.ParseMediaType(contentType); (mediaType != "multipart/form-data" && mediaType != "multipart/mixed") || params["boundary"] == "" {
+		received := "no Content-Type"
+		if contentType != "" {
+			received = "Content-Type " + contentType
+		}
+		uploadErrorsTotal.WithLabelValues("content_type").Inc()
+		writeUploadError(w, r, "Uploads must be sent as multipart/form-data with a boundary, got "+received, http.StatusBadRequest)
 		return
 	}
-
-	err = os.MkdirAll(uploadDir, os.ModePerm)
+	reader, err := r.MultipartReader()
 	if err != nil {
-		log.Printf("Error creating upload directory: %v", err)
-		writeJSONError(w, "Unable to create directory", http.StatusInternalServerError)
+		uploadErrorsTotal.WithLabelValues("parse").Inc()
+		logger.Warn("Error reading multipart form", "err", err)
+		writeUploadError(w, r, "Unable to parse form", http.StatusBadRequest)
 		return
 	}
 
-	var responses []UploadResponse
-
-	for _, fileHeader := range files {
-		ext := filepath.Ext(fileHeader.Filename)
-		if ext == "" {
-			writeJSONError(w, "Filename must have an extension", http.StatusBadRequest)
+	opts, uerr := parseUploadOptions(logger, r)
+	if uerr != nil {
+		if uerr.reason != "" {
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+		}
+		writeUploadError(w, r, uerr.message, uerr.status)
+		return
+	}
+	slug := opts.slug
+	// A plain HTML form can ask for the browser to be sent on to a page of
+	// the site rather than shown JSON.
+	var redirect *url.URL
+	if target := r.URL.Query().Get("redirect"); target != "" {
+		if redirect, err = checkRedirect(target); err != nil {
+			uploadErrorsTotal.WithLabelValues("redirect").Inc()
+			writeUploadError(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
+	}
 
-		if disallowedExtensions[ext] {
-			writeJSONError(w, "Disallowed file extension", http.StatusBadRequest)
+	// With preservePaths, the files of one request share a random top-level
+	// directory and keep the relative paths they were sent with.
+	if r.URL.Query().Get("preservePaths") == "1" {
+		if slug != "" {
+			writeUploadError(w, r, "slug and preservePaths can't be combined", http.StatusBadRequest)
 			return
 		}
+		opts.root = randomPrefix()
+	}
 
-		file, err := fileHeader.Open()
+	// The response has an UploadResponse for each stored file and an
+	// UploadFailure for each one that wasn't, in the order they were sent.
+	// It is 200 when every file was stored and 207 when only some were; if
+	// none were, the first failure is returned as a plain error.
+	var responses []any
+	var firstFailure *uploadError
+	var nextDescription *string
+	stored := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			log.Printf("Error opening uploaded file: %v", err)
-			writeJSONError(w, "Unable to open uploaded file", http.StatusInternalServerError)
+			if !opts.dryRun {
+				discardUploads(logger, responses)
+			}
+			uerr := formError(logger, err)
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+			writeUploadError(w, r, uerr.message, uerr.status)
 			return
 		}
-		defer file.Close()
-
-		rand.Seed(time.Now().UnixNano())
-		randomString := generateRandomString(6)
-		filename := strings.ReplaceAll(fileHeader.Filename, " ", "_")
-		newFilename := randomString + "_" + filename
-
-		f, err := os.OpenFile(filepath.Join(uploadDir, newFilename), os.O_WRONLY|os.O_CREATE, 0666)
-		if err != nil {
-			log.Printf("Error creating file on server: %v", err)
-			writeJSONError(w, "Unable to create file on server", http.StatusInternalServerError)
+		// Files are accepted under any field name, so any HTML form or tool
+		// works; parts without a filename are ordinary form values. A
+		// description field captions the file sent after it.
+		if part.FileName() == "" {
+			if part.FormName() == "description" {
+				description, err := readDescription(part)
+				if err != nil {
+					part.Close()
+					uploadErrorsTotal.WithLabelValues("description").Inc()
+					writeUploadError(w, r, err.Error(), http.StatusBadRequest)
+					return
+				}
+				nextDescription = &description
+			}
+			part.Close()
+			continue
+		}
+		// Parts arrive one at a time, so the count is only known to be over
+		// once the first file too many shows up. The request is then rejected
+		// as a whole by removing what it already stored.
+		if maxFiles > 0 && len(responses) >= maxFiles {
+			part.Close()
+			if !opts.dryRun {
+				discardUploads(logger, responses)
+			}
+			uploadErrorsTotal.WithLabelValues("too_many_files").Inc()
+			writeUploadError(w, r, fmt.Sprintf("Too many files; at most %d can be uploaded at once", maxFiles), http.StatusBadRequest)
 			return
 		}
-		defer f.Close()
-
-		_, err = io.Copy(f, file)
-		if err != nil {
-			log.Printf("Error saving file on server: %v", err)
-			writeJSONError(w, "Unable to save file on server", http.StatusInternalServerError)
+		var response UploadResponse
+		var uerr *uploadError
+		if slug != "" && len(responses) > 0 {
+			uerr = &uploadError{status: http.StatusBadRequest, reason: "slug", message: "A slug can only be used when uploading a single file"}
+		} else {
+			fileOpts := opts
+			if nextDescription != nil {
+				fileOpts.description = *nextDescription
+				nextDescription = nil
+			}
+			response, uerr = saveUploadedFile(logger, part, fileOpts)
+		}
+		part.Close()
+		if uerr != nil && uerr.reason != "" {
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+		}
+		switch {
+		case uerr == nil:
+			responses = append(responses, response)
+			stored++
+		case uerr.fatal:
+			if !opts.dryRun {
+				discardUploads(logger, responses)
+			}
+			writeUploadError(w, r, uerr.message, uerr.status)
 			return
+		default:
+			responses = append(responses, UploadFailure{Filename: part.FileName(), Error: uerr.message})
+			if firstFailure == nil {
+				firstFailure = uerr
+			}
 		}
-
-		url := fmt.Sprintf("%s/files/uploaded/%s", hostname, newFilename)
-		response := UploadResponse{
-			Filename: newFilename,
-			URL:      url,
+	}
+	if digest != nil {
+		// The multipart reader stops at the final boundary.
+		io.Copy(io.Discard, r.Body)
+		if !digest.matches() {
+			logger.Warn("Rejected upload not matching its digest", "header", digest.header)
+			if !opts.dryRun {
+				discardUploads(logger, responses)
+			}
+			uerr := digestMismatchError(digest)
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+			writeUploadError(w, r, uerr.message, uerr.status)
+			return
 		}
-		responses = append(responses, response)
+	}
+	if len(responses) == 0 {
+		uploadErrorsTotal.WithLabelValues("no_files").Inc()
+		writeUploadError(w, r, "No files uploaded", http.StatusBadRequest)
+		return
+	}
+	if stored == 0 {
+		writeUploadError(w, r, firstFailure.message, firstFailure.status)
+		return
+	}
+	if !opts.dryRun {
+		acceptUploads(logger, responses)
 	}
 
+	status := http.StatusOK
+	if stored < len(responses) {
+		status = http.StatusMultiStatus
+	}
+	// Only a complete success redirects, so failures aren't hidden.
+	if redirect != nil && status == http.StatusOK {
+		redirectAfterUpload(w, r, redirect, responses)
+		return
+	}
+	if wantsPlainText(r) {
+		writePlainUploads(w, responses, status)
+		return
+	}
 	responseJSON, err := json.Marshal(responses)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %v", err)
+		logger.Error("Error marshalling JSON", "err", err)
 		writeJSONError(w, "Unable to marshal JSON", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(responseJSON)
 }
 
+// discardUploads removes the files stored by an upload that is being
+// rejected, leaving files dedupe matched to earlier uploads in place.
+func discardUploads(logger *slog.Logger, responses []any) {
+	for _, r := range responses {
+		upload, ok := r.(UploadResponse)
+		if !ok || upload.reused {
+			continue
+		}
+		if err := store.Delete(upload.Filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("Error removing file", "file", upload.Filename, "err", err)
+			continue
+		}
+		if err := forgetUpload(upload.Filename); err != nil {
+			logger.Error("Error updating metadata", "file", upload.Filename, "err", err)
+		}
+	}
+}
+
+// acceptUploads starts the background work for the files of an upload once
+// nothing can reject it any more: generating thumbnails and notifying
+// webhooks. Before that the files may still be removed by discardUploads.
+func acceptUploads(logger *slog.Logger, responses []any) {
+	for _, r := range responses {
+		upload, ok := r.(UploadResponse)
+		if !ok {
+			continue
+		}
+		if upload.thumbnail {
+			startThumbnail(upload.Filename)
+		}
+		notifyUpload(logger, upload.Filename, upload.OriginalName, upload.Size)
+	}
+}
+
+// formError describes a failure to read the multipart body, which is either
+// the size limit cutting it off or a malformed request.
+func formError(logger *slog.Logger, err error) *uploadError {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		logger.Warn("Upload exceeds size limit", "limit", maxUploadSize.String())
+		return &uploadError{status: http.StatusRequestEntityTooLarge, reason: "too_large", message: "Upload exceeds maximum size of " + maxUploadSize.String(), fatal: true}
+	}
+	logger.Warn("Error parsing multipart form", "err", err)
+	return &uploadError{status: http.StatusBadRequest, reason: "parse", message: "Unable to parse form", fatal: true}
+}
+
+// parseUploadOptions reads the query parameters that apply to every file of
+// an upload, and makes sure uploadDir exists.
+func parseUploadOptions(logger *slog.Logger, r *http.Request) (uploadOptions, *uploadError) {
+	opts := uploadOptions{
+		owner:   requestKeyID(r),
+		slug:    r.URL.Query().Get("slug"),
+		oneTime: r.URL.Query().Get("onetime") == "1",
+		dryRun:  r.URL.Query().Get("validate") == "1",
+	}
+	if opts.slug != "" {
+		if err := checkSlug(opts.slug); err != nil {
+			return opts, &uploadError{status: http.StatusBadRequest, reason: "slug", message: err.Error()}
+		}
+	}
+
+	if password := r.URL.Query().Get("password"); password != "" {
+		var err error
+		opts.passwordHash, err = hashPassword(password)
+		if errors.Is(err, errPasswordTooLong) {
+			return opts, &uploadError{status: http.StatusBadRequest, reason: "password", message: err.Error()}
+		}
+		if err != nil {
+			logger.Error("Error hashing password", "err", err)
+			return opts, &uploadError{status: http.StatusInternalServerError, message: "Unable to protect file"}
+		}
+	}
+
+	// A missing or malformed ttl means the upload never expires.
+	ttl, err := parseTTL(r.URL.Query().Get("ttl"))
+	if err != nil {
+		logger.Info("Ignoring ttl", "err", err)
+		ttl = 0
+	}
+	opts.ttl = ttl
+
+	opts.description = r.URL.Query().Get("description")
+	if err := checkDescription(opts.description); err != nil {
+		return opts, &uploadError{status: http.StatusBadRequest, reason: "description", message: err.Error()}
+	}
+
+	opts.signedTTL = signedURLTTL
+	if s := r.URL.Query().Get("signed"); s != "" {
+		if d, err := parseTTL(s); err == nil && d > 0 {
+			opts.signedTTL = d
+		} else {
+			logger.Info("Ignoring signed", "value", s)
+		}
+	}
+	return opts, nil
+}
+
+// uploadOptions are the settings from an upload request's query that apply
+// to each of its files.
+type uploadOptions struct {
+	owner        string
+	slug         string
+	root         string
+	oneTime      bool
+	passwordHash string
+	ttl          time.Duration
+	// signedTTL is how long a signed URL in the response stays valid.
+	signedTTL time.Duration
+	// description is the caption stored with each file.
+	description string
+	// dryRun runs every check on the upload without storing it.
+	dryRun bool
+	// digest, when the client sent one for the file, is checked once it
+	// has been read in full.
+	digest *expectedDigest
+}
+
+// uploadError is a failure to store one file of an upload, carrying the
+// response to send and the reason to count it under in uploadErrorsTotal.
+// Normally only that file is left out and the rest of a batch is still
+// stored; fatal errors, where the request body itself is unusable, end the
+// whole request.
+type uploadError struct {
+	status  int
+	reason  string
+	message string
+	fatal   bool
+}
+
+// UploadFailure is the entry for a file that was left out of a batch upload.
+type UploadFailure struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+// saveUploadedFile checks, stores and records one file of a multipart
+// upload, streaming it from the request as it goes.
+func saveUploadedFile(logger *slog.Logger, part *multipart.Part, opts uploadOptions) (UploadResponse, *uploadError) {
+	var relPath string
+	if opts.root != "" {
+		var err error
+		relPath, err = cleanRelativePath(partFilename(part))
+		if err != nil {
+			return UploadResponse{}, &uploadError{status: http.StatusBadRequest, reason: "path", message: err.Error()}
+		}
+	}
+	digest, err := parseDigest(http.Header(part.Header))
+	if err != nil {
+		return UploadResponse{}, digestError(err)
+	}
+	opts.digest = digest
+	filename := sanitizeFilename(flattenPath(partFilename(part)))
+	return saveUpload(logger, part, part.FileName(), filename, relPath, opts)
+}
+
+// saveUpload checks, stores and records one uploaded file read from src,
+// stored under filename or, with opts.root, under relPath inside it.
+// Anything it opens is closed before it returns, so a large batch doesn't
+// hold every file open until the request ends. Its thumbnail and webhook
+// notification wait for acceptUploads.
+func saveUpload(logger *slog.Logger, src io.Reader, originalName, filename, relPath string, opts uploadOptions) (UploadResponse, *uploadError) {
+	ext := filepath.Ext(filename)
+	if err := checkExtension(ext); err != nil {
+		return UploadResponse{}, &uploadError{status: http.StatusBadRequest, reason: "extension", message: err.Error()}
+	}
+	if opts.digest != nil {
+		src = opts.digest.reader(src)
+	}
+
+	// Quota is claimed as the bytes arrive, so an upload is cut off as soon
+	// as it would go over.
+	quotaSrc := &quotaReader{owner: opts.owner, r: src}
+	defer quotaSrc.release()
+
+	// An infected file must never become downloadable, so with a scanner
+	// configured the part is spooled and scanned before anything is stored.
+	scanned, signature, err := scanUpload(quotaSrc)
+	if err != nil {
+		if uerr := streamError(logger, err); uerr != nil {
+			return UploadResponse{}, uerr
+		}
+		if isDiskFull(err) {
+			return UploadResponse{}, diskFullError(logger, err)
+		}
+		logger.Error("Error scanning uploaded file", "err", err)
+		return UploadResponse{}, &uploadError{status: http.StatusInternalServerError, reason: "scan", message: "Unable to scan uploaded file"}
+	}
+	defer scanned.Close()
+	if signature != "" {
+		logger.Warn("Rejected infected upload", "filename", originalName, "signature", signature)
+		return UploadResponse{}, &uploadError{status: http.StatusUnprocessableEntity, reason: "infected", message: "File is infected: " + signature}
+	}
+
+	body, head, err := peekHead(scanned)
+	if err != nil {
+		if uerr := streamError(logger, err); uerr != nil {
+			return UploadResponse{}, uerr
+		}
+		logger.Error("Error reading uploaded file", "err", err)
+		return UploadResponse{}, &uploadError{status: http.StatusInternalServerError, message: "Unable to read uploaded file"}
+	}
+	if len(head) == 0 {
+		return UploadResponse{}, &uploadError{status: http.StatusBadRequest, reason: "empty", message: "Empty file"}
+	}
+	contentType, err := validateContent(head, ext)
+	if err != nil {
+		logger.Warn("Rejected upload content", "filename", originalName, "err", err)
+		return UploadResponse{}, &uploadError{status: http.StatusUnsupportedMediaType, reason: "content", message: err.Error()}
+	}
+	checked, err := checkUploadArchive(body, contentType, filename)
+	if err != nil {
+		if uerr := streamError(logger, err); uerr != nil {
+			return UploadResponse{}, uerr
+		}
+		if isDiskFull(err) {
+			return UploadResponse{}, diskFullError(logger, err)
+		}
+		return UploadResponse{}, archiveUploadError(logger, originalName, err)
+	}
+	defer checked.Close()
+	body = checked
+	if stripEXIF && contentType == "image/jpeg" {
+		stripped := stripJPEGReader(body)
+		defer stripped.Close()
+		body = stripped
+	}
+	// A converted image is stored and downloaded under the extension of its
+	// new format, but the response still names the file it came from.
+	storedName, origType, origExt := originalName, contentType, ext
+	var original []byte
+	if shouldConvert(contentType) {
+		converted, orig, err := convertImage(logger, body, contentType)
+		if err != nil {
+			if uerr := streamError(logger, err); uerr != nil {
+				return UploadResponse{}, uerr
+			}
+			logger.Error("Error reading uploaded file", "err", err)
+			return UploadResponse{}, &uploadError{status: http.StatusInternalServerError, message: "Unable to read uploaded file"}
+		}
+		body = converted
+		if orig != nil {
+			format := imageFormats[convertImages]
+			filename, ext, contentType = replaceExt(filename, format.ext), format.ext, format.contentType
+			storedName = replaceExt(originalName, format.ext)
+			if relPath != "" {
+				relPath = replaceExt(relPath, format.ext)
+			}
+			if keepOriginals {
+				original = orig
+			}
+		}
+	}
+
+	// One-time and password-protected files can't be shared with other
+	// uploads of the same content, which would inherit their restrictions.
+	// Files named by the client, with a slug or their relative path, stay
+	// where it put them rather than being routed by -route-dirs.
+	dir := routeDir(ext, contentType)
+	save := func(body io.Reader) (savedFile, error) {
+		switch {
+		case opts.root != "":
+			return saveAs(body, opts.root+"/"+relPath)
+		case opts.slug != "":
+			return saveWithSlug(body, opts.slug, filename)
+		case dedupe && !opts.oneTime && opts.passwordHash == "":
+			return saveDeduplicated(body, dir, ext)
+		case rejectDuplicates && checksDuplicates(opts):
+			return saveUnlessDuplicate(body, path.Join(dir, filename))
+		}
+		return saveWithGeneratedName(body, path.Join(dir, filename))
+	}
+	var saved savedFile
+	switch {
+	case opts.dryRun:
+		saved, err = dryRunSave(body, opts, relPath, dir, filename, ext)
+		if name, ok := metadata.findAnySha256(saved.sha256, ""); err == nil && strictUnique && ok {
+			err = &duplicateError{name: name}
+		}
+	case strictUnique:
+		saved, err = saveUnique(body, save)
+	default:
+		saved, err = save(body)
+	}
+	if opts.root != "" && errors.Is(err, os.ErrExist) {
+		return UploadResponse{}, &uploadError{status: http.StatusConflict, message: "File " + relPath + " was uploaded twice"}
+	}
+	var dupErr *duplicateError
+	if errors.As(err, &dupErr) {
+		return UploadResponse{}, duplicateUploadError(logger, dupErr.name)
+	}
+	if errors.Is(err, errSlugTaken) {
+		return UploadResponse{}, &uploadError{status: http.StatusConflict, reason: "slug", message: "Slug " + opts.slug + " is already in use"}
+	}
+	if err != nil {
+		if uerr := streamError(logger, err); uerr != nil {
+			return UploadResponse{}, uerr
+		}
+		if isDiskFull(err) {
+			return UploadResponse{}, diskFullError(logger, err)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			return UploadResponse{}, missingDirError(logger, err)
+		}
+		logger.Error("Error saving file on server", "err", err)
+		return UploadResponse{}, &uploadError{status: http.StatusInternalServerError, reason: "storage", message: "Unable to save file on server"}
+	}
+	if opts.digest != nil && !opts.digest.matches() {
+		logger.Warn("Rejected upload not matching its digest", "filename", originalName, "header", opts.digest.header)
+		if !opts.dryRun && !saved.existed {
+			discardUploads(logger, []any{UploadResponse{Filename: saved.name}})
+		}
+		return UploadResponse{}, digestMismatchError(opts.digest)
+	}
+	var duplicateOf string
+	if saved.existed {
+		duplicateOf = saved.name
+	} else if checksDuplicates(opts) {
+		duplicateOf, _ = metadata.findSha256(saved.sha256, saved.name)
+	}
+	if duplicateOf != "" {
+		logger.Info("Upload duplicates a stored file", "file", saved.name, "duplicate_of", duplicateOf)
+	}
+	if opts.dryRun {
+		logger.Info("Validated upload", "file", saved.name, "size", saved.size)
+		return UploadResponse{Filename: saved.name, OriginalName: originalName, URL: fileURL(saved.name), Sha256: saved.sha256, Size: saved.size, Duplicate: duplicateOf != "", DuplicateOf: duplicateOf}, nil
+	}
+
+	if saved.existed {
+		err = mergeExpiry(saved.name, opts.ttl)
+	} else {
+		m := fileMeta{
+			OriginalName: storedName,
+			Owner:        opts.owner,
+			OneTime:      opts.oneTime,
+			PasswordHash: opts.passwordHash,
+			Encrypted:    encryptUploads,
+			Sha256:       saved.sha256,
+			ContentType:  contentType,
+			Size:         saved.size,
+			UploadedAt:   time.Now().UTC(),
+			Description:  opts.description,
+		}
+		if opts.ttl > 0 {
+			m.ExpiresAt = time.Now().Add(opts.ttl)
+		}
+		if opts.oneTime {
+			releaseOneTime(saved.name)
+		}
+		err = metadata.set(saved.name, m)
+	}
+	if err != nil {
+		logger.Error("Error saving metadata", "err", err)
+		return UploadResponse{}, &uploadError{status: http.StatusInternalServerError, reason: "metadata", message: "Unable to save file metadata"}
+	}
+	if !saved.existed && opts.owner != "" {
+		quotas.add(saved.name, opts.owner, saved.size)
+	}
+
+	recordUpload(saved.size)
+	logger.Info("Stored upload", "file", saved.name, "size", saved.size, "deduplicated", saved.existed)
+	var originalURL string
+	if original != nil && !saved.existed {
+		origName, err := keepOriginal(saved.name, origExt, originalName, origType, original, opts)
+		if err != nil {
+			logger.Error("Error storing original image", "err", err)
+		} else {
+			originalURL = fileURL(origName)
+		}
+	}
+	response := UploadResponse{
+		Filename:     saved.name,
+		OriginalName: originalName,
+		URL:          fileURL(saved.name),
+		Sha256:       saved.sha256,
+		Size:         saved.size,
+		UploadedAt:   time.Now().UTC(),
+		Description:  opts.description,
+		OriginalURL:  originalURL,
+		Duplicate:    duplicateOf != "",
+		DuplicateOf:  duplicateOf,
+		reused:       saved.existed,
+	}
+	// Thumbnails are served without a password, so protected images don't
+	// get one.
+	if canThumbnail(contentType) && opts.passwordHash == "" {
+		// A deduplicated file got its thumbnail when first uploaded.
+		response.thumbnail = !saved.existed
+		response.ThumbnailURL = fileURL(thumbName(saved.name))
+	}
+	if len(signingKey) > 0 {
+		expires := time.Now().Add(opts.signedTTL)
+		response.SignedURL = generateSignedURL(saved.name, expires)
+		if requireSigned && response.ThumbnailURL != "" {
+			response.ThumbnailURL = generateSignedURL(thumbName(saved.name), expires)
+		}
+	}
+	response.setDispositionURLs()
+	return response, nil
+}
+
+// streamError maps errors from reading an upload as it streams in to the
+// response for them, or returns nil for other errors.
+func streamError(logger *slog.Logger, err error) *uploadError {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return formError(logger, err)
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		logger.Warn("Upload exceeds storage quota")
+		return &uploadError{status: http.StatusRequestEntityTooLarge, reason: "quota", message: "Upload exceeds storage quota of " + quota.String()}
+	}
+	return nil
+}
+
+// diskFullError is the response for an upload that ran out of disk space.
+// Whatever was written of it has been removed by then.
+func diskFullError(logger *slog.Logger, err error) *uploadError {
+	logger.Error("Out of storage space", "err", err)
+	return &uploadError{status: http.StatusInsufficientStorage, reason: "disk_full", message: "Not enough storage space left on the server"}
+}
+
+// duplicateUploadError is the response for an upload refused by
+// -strict-unique because its content is stored as name. The URL of one-time
+// and password-protected files is left out, so it can't be learned by
+// uploading the same content.
+func duplicateUploadError(logger *slog.Logger, name string) *uploadError {
+	logger.Info("Rejected duplicate upload", "duplicate_of", name)
+	message := "The same content is already stored"
+	if m, ok := metadata.get(name); !ok || (!m.OneTime && m.PasswordHash == "") {
+		message += " at " + fileURL(name)
+	}
+	return &uploadError{status: http.StatusConflict, reason: "duplicate", message: message}
+}
+
+// maxDescriptionLength is the most characters a file's description may have.
+const maxDescriptionLength = 1000
+
+func checkDescription(s string) error {
+	if !utf8.ValidString(s) || utf8.RuneCountInString(s) > maxDescriptionLength {
+		return fmt.Errorf("Description must be valid UTF-8 of at most %d characters", maxDescriptionLength)
+	}
+	return nil
+}
+
+// readDescription reads a description form field, refusing to read much
+// past the length limit.
+func readDescription(part *multipart.Part) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(part, utf8.UTFMax*maxDescriptionLength+1))
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSpace(string(data))
+	return s, checkDescription(s)
+}
+
+// missingDirError is the response for an upload that couldn't be created
+// because uploadDir is gone. It is only created at startup, so removing it
+// while the server runs breaks uploads until a restart.
+func missingDirError(logger *slog.Logger, err error) *uploadError {
+	logger.Error("Upload directory is missing", "dir", uploadDir, "err", err)
+	return &uploadError{status: http.StatusInternalServerError, reason: "storage", message: "Upload directory is missing on the server"}
+}
+
+// fileURL returns the public URL of a stored file, built from -url-template
+// when one is set.
+func fileURL(name string) string {
+	if urlTemplate != nil {
+		return renderURL(urlTemplate, name)
+	}
+	return hostname + urlPrefix + downloadPath + name
+}
+
+// prefixedPath returns the path clients should use for p on this server,
+// which is under -url-prefix when one is set.
+func prefixedPath(p string) string {
+	return urlPrefix + p
+}
+
+// setDispositionURLs fills in the preview and download URLs of response from
+// its URL, or from its signed URL when downloads must be signed. Files that
+// are never shown inline get no preview URL.
+func (u *UploadResponse) setDispositionURLs() {
+	base := u.URL
+	if requireSigned {
+		base = u.SignedURL
+	}
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	if showsInline(u.Filename) {
+		u.PreviewURL = base + sep + "inline=1"
+	}
+	u.DownloadURL = base + sep + "download=1"
+}
+
+// downloadPath is where stored files are served from.
+const downloadPath = "/uploaded/"
+
+// maxNameAttempts bounds how many random prefixes are tried before giving
+// up on finding an unused name.
+const maxNameAttempts = 10
+
+// savedFile describes a file stored by one of the save functions.
+type savedFile struct {
+	name   string
+	sha256 string
+	size   int64
+	// existed is set when dedupe reused an earlier identical upload.
+	existed bool
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// saveWithGeneratedName stores src under a name generated from filename by
+// the naming strategy. Put never overwrites, so on a collision the strategy
+// is asked for another name.
+func saveWithGeneratedName(src io.Reader, filename string) (savedFile, error) {
+	if naming.spool {
+		tmpPath, sum, size, err := spoolUpload(src)
+		if tmpPath != "" {
+			defer os.Remove(tmpPath)
+		}
+		if err != nil {
+			return savedFile{}, err
+		}
+		name, err := adoptWithGeneratedName(tmpPath, filename, sum)
+		if err != nil {
+			return savedFile{}, err
+		}
+		return savedFile{name: name, sha256: sum, size: size}, nil
+	}
+	hasher := sha256.New()
+	var counter countingWriter
+	tee := io.TeeReader(src, io.MultiWriter(hasher, &counter))
+	for i := 0; i < naming.attempts; i++ {
+		newFilename := generatedName(filename, "", i)
+		err := store.Put(newFilename, tee)
+		if errors.Is(err, os.ErrExist) {
+			slog.Info("Filename collision, retrying", "file", newFilename)
+			continue
+		}
+		if err != nil {
+			return savedFile{}, err
+		}
+		return savedFile{name: newFilename, sha256: hex.EncodeToString(hasher.Sum(nil)), size: counter.n}, nil
+	}
+	return savedFile{}, fmt.Errorf("no unique filename for %q after %d attempts", filename, naming.attempts)
+}
+
+// maxSlugLength bounds custom slugs so URLs stay reasonable.
+const maxSlugLength = 64
+
+var errSlugTaken = errors.New("slug is already in use")
+
+// slugMu serialises slugged uploads so two requests can't both find a slug
+// free and claim it.
+var slugMu sync.Mutex
+
+// checkSlug validates a custom slug chosen with ?slug=. Slugs replace the
+// random prefix, so like it they can't contain an underscore.
+func checkSlug(slug string) error {
+	if len(slug) > maxSlugLength {
+		return fmt.Errorf("Slug must be at most %d characters", maxSlugLength)
+	}
+	for _, c := range slug {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return errors.New("Slug may only contain letters, digits and dashes")
+		}
+	}
+	if slug+"_" == thumbPrefix {
+		return errors.New("Slug is reserved")
+	}
+	return nil
+}
+
+// saveWithSlug stores src as slug_filename, failing with errSlugTaken if any
+// stored file already uses the slug.
+func saveWithSlug(src io.Reader, slug, filename string) (savedFile, error) {
+	slugMu.Lock()
+	defer slugMu.Unlock()
+	files, err := store.List()
+	if err != nil {
+		return savedFile{}, err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name, slug+"_") {
+			return savedFile{}, errSlugTaken
+		}
+	}
+
+	saved, err := saveAs(src, slug+"_"+filename)
+	if errors.Is(err, os.ErrExist) {
+		return savedFile{}, errSlugTaken
+	}
+	return saved, err
+}
+
+// saveAs stores src under exactly name, failing with os.ErrExist if it's
+// taken.
+func saveAs(src io.Reader, name string) (savedFile, error) {
+	hasher := sha256.New()
+	var counter countingWriter
+	if err := store.Put(name, io.TeeReader(src, io.MultiWriter(hasher, &counter))); err != nil {
+		return savedFile{}, err
+	}
+	return savedFile{name: name, sha256: hex.EncodeToString(hasher.Sum(nil)), size: counter.n}, nil
+}
+
+// dryRunSave reads src to the end as a real save would and works out the
+// name it would be stored under, without storing anything. Random prefixes
+// are only a guess, as a real upload draws a fresh one.
+func dryRunSave(src io.Reader, opts uploadOptions, relPath, dir, filename, ext string) (savedFile, error) {
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, src)
+	if err != nil {
+		return savedFile{}, err
+	}
+	saved := savedFile{sha256: hex.EncodeToString(hasher.Sum(nil)), size: size}
+
+	switch {
+	case opts.root != "":
+		saved.name = opts.root + "/" + relPath
+	case opts.slug != "":
+		files, err := store.List()
+		if err != nil {
+			return savedFile{}, err
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name, opts.slug+"_") {
+				return savedFile{}, errSlugTaken
+			}
+		}
+		saved.name = opts.slug + "_" + filename
+	case dedupe && !opts.oneTime && opts.passwordHash == "":
+		saved.name = path.Join(dir, saved.sha256+ext)
+		saved.existed, err = store.Exists(saved.name)
+	case rejectDuplicates && checksDuplicates(opts):
+		if name, ok := metadata.findSha256(saved.sha256, ""); ok {
+			saved.name, saved.existed = name, true
+		} else {
+			saved.name = generatedName(path.Join(dir, filename), saved.sha256, 0)
+		}
+	default:
+		saved.name = generatedName(path.Join(dir, filename), saved.sha256, 0)
+	}
+	return saved, err
+}
+
+// adoptWithGeneratedName is saveWithGeneratedName for a complete file
+// already on local disk, such as a finished resumable upload, whose hex
+// SHA-256 is sum. sum may be left empty unless naming.spool is set.
+func adoptWithGeneratedName(path, filename, sum string) (string, error) {
+	for i := 0; i < naming.attempts; i++ {
+		newFilename := generatedName(filename, sum, i)
+		err := adoptFile(newFilename, path)
+		if errors.Is(err, os.ErrExist) {
+			slog.Info("Filename collision, retrying", "file", newFilename)
+			continue
+		}
+		return newFilename, err
+	}
+	return "", fmt.Errorf("no unique filename for %q after %d attempts", filename, naming.attempts)
+}
+
+func deleteFile(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	name := r.PathValue("name")
+
+	if !isValidName(name) {
+		writeJSONError(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	err := store.Delete(name)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Error deleting file", "file", name, "err", err)
+		writeJSONError(w, "Unable to delete file", http.StatusInternalServerError)
+		return
+	}
+	if err := forgetUpload(name); err != nil {
+		logger.Error("Error updating metadata", "file", name, "err", err)
+	}
+	logger.Info("Deleted file", "file", name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forgetUpload cleans up after a stored file has been deleted: its quota
+// usage, thumbnail, download stats and metadata.
+func forgetUpload(name string) error {
+	quotas.remove(name)
+	removeThumbnail(name)
+	downloadStats.remove(name)
+	return metadata.remove(name)
+}
+
+// isValidFilename reports whether name refers to a single file directly inside
+// uploadDir, rejecting anything that could escape it once joined.
+func isValidFilename(name string) bool {
+	if name == "" || name == "." || strings.Contains(name, "..") {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\\x00")
+}
+
 func writeJSONError(w http.ResponseWriter, message string, code int) {
+	errorResponsesTotal.WithLabelValues(strconv.Itoa(code)).Inc()
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	errorResponse := ErrorResponse{Error: message}
 	json.NewEncoder(w).Encode(errorResponse)
 }
 
+// alphanumeric is the default alphabet for random strings.
+const alphanumeric = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// prefixLength and prefixAlphabet shape the random prefixes of stored
+// filenames, set with -prefix-length and -prefix-alphabet.
+var (
+	prefixLength   = 6
+	prefixAlphabet = alphanumeric
+)
+
+// checkPrefixAlphabet validates a -prefix-alphabet value. Prefixes end at
+// the first underscore of a stored name and appear in URLs, so only ASCII
+// letters, digits and dashes are allowed, each at most once.
+func checkPrefixAlphabet(alphabet string) error {
+	if alphabet == "" {
+		return errors.New("alphabet is empty")
+	}
+	seen := make(map[rune]bool)
+	for _, c := range alphabet {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return fmt.Errorf("alphabet may only contain ASCII letters, digits and dashes, not %q", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("alphabet repeats %q", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// randomPrefix returns a random prefix for a stored filename. Prefixes that
+// would make a file look like a thumbnail are skipped.
+func randomPrefix() string {
+	for {
+		prefix := randomString(prefixLength, prefixAlphabet)
+		if prefix+"_" != thumbPrefix {
+			return prefix
+		}
+	}
+}
+
+// generateRandomString returns length alphanumeric characters, for IDs.
 func generateRandomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
+	return randomString(length, alphanumeric)
+}
+
+// randRead is where randomString gets its bytes. It is crypto/rand outside
+// tests, which stub it to force name collisions.
+var randRead = rand.Read
+
+// randomString returns length characters drawn uniformly from charset using
+// crypto/rand, so it is safe for concurrent use and strings can't be
+// predicted from earlier ones.
+func randomString(length int, charset string) string {
+	// Bytes at or above limit are discarded so every character is equally likely.
+	limit := 256 - 256%len(charset)
+	b := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(b) < length {
+		randRead(buf)
+		for _, c := range buf {
+			if int(c) < limit && len(b) < length {
+				b = append(b, charset[int(c)%len(charset)])
+			}
+		}
 	}
 	return string(b)
 }
 
-func logRequests(next http.Handler) http.Handler {
+// byteSize is a flag value holding a size in bytes. It accepts plain byte
+// counts as well as human-friendly values like "500M" or "2G" (binary units).
+type byteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+func parseByteSize(s string) (byteSize, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "IB"), "B")
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			mult = u.mult
+			v = strings.TrimSuffix(v, u.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > 0 && mult > 1 && n > (1<<63-1)/mult {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return byteSize(n * mult), nil
+}
+
+func (b *byteSize) Set(s string) error {
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+func (b byteSize) String() string {
+	for _, u := range sizeUnits {
+		if b != 0 && int64(b)%u.mult == 0 {
+			return strconv.FormatInt(int64(b)/u.mult, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// serveUploaded serves a stored file from the storage backend. Internal
+// files such as the metadata index and expired-but-not-yet-swept uploads are
+// never served. Range and conditional requests are handled by
+// http.ServeContent, which needs a seekable file; every backend's Get
+// provides one so media players can stream and seek. HEAD requests get the
+// same headers as a GET, Content-Length, Content-Type, Last-Modified and
+// ETag included, so clients can check a file is still there; they never
+// count as a download or use up a one-time file.
+func serveUploaded(w http.ResponseWriter, r *http.Request) {
+	// Stored files come from anyone, so browsers mustn't guess a riskier
+	// type for them or run them with this site's privileges.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if !isValidName(name) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	m, _ := metadata.get(name)
+	if m.expired(time.Now()) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if requireSigned {
+		if err := checkSignature(name, r.URL.Query(), time.Now()); err != nil {
+			writeJSONError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if m.PasswordHash != "" && !checkPassword(m.PasswordHash, downloadPassword(r)) {
+		writePasswordRequired(w)
+		return
+	}
+
+	// A one-time file is claimed before it is opened, so only the request
+	// that wins the claim ever holds it open. HEADs never claim it.
+	claimed := m.OneTime && r.Method != http.MethodHead
+	if claimed && !claimOneTime(name) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	f, err := store.Get(name)
+	if err != nil {
+		if claimed {
+			releaseOneTime(name)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			writeJSONError(w, "File not found", http.StatusNotFound)
+			return
+		}
+		requestLogger(r).Error("Error opening file", "file", name, "err", err)
+		writeJSONError(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if m.OneTime {
+		if claimed {
+			defer consumeOneTime(requestLogger(r), name)
+		}
+		// The file is gone after the download, so send all of it. A HEAD
+		// gets the headers the download would.
+		r.Header.Del("Range")
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	// Files download by default; ?inline=1 shows those of inlineTypes in the
+	// browser, and ?download=1 makes sure they download whatever else the
+	// URL says.
+	disposition := "attachment"
+	if r.URL.Query().Get("inline") == "1" && r.URL.Query().Get("download") != "1" && showsInline(name) {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, originalName(name, m)))
+	w.Header().Set("ETag", fileETag(f, m))
+
+	// Only complete GETs count as downloads, not HEADs, ranges or transfers
+	// cut short.
+	rec := &statusRecorder{ResponseWriter: w}
+	http.ServeContent(rec, r, name, f.ModTime(), f)
+	if r.Method == http.MethodGet && rec.status == http.StatusOK && rec.bytes == f.Size() {
+		downloadStats.record(name, time.Now())
+	}
+}
+
+// inlineTypes are the media types ?inline=1 shows in the browser, along with
+// audio and video. Anything else, HTML, SVG and XML in particular, could run
+// script on this origin, so it is always downloaded.
+var inlineTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/avif":      true,
+	"image/bmp":       true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// showsInline reports whether name may be shown in the browser rather than
+// downloaded, going by the type it is served as.
+func showsInline(name string) bool {
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+	family, _, _ := strings.Cut(mediaType, "/")
+	return inlineTypes[mediaType] || family == "audio" || family == "video"
+}
+
+// fileETag returns a strong ETag for a stored file: its SHA-256 when that
+// was recorded on upload, and otherwise its modification time and size.
+// Both survive restarts, so clients can keep revalidating cached copies.
+func fileETag(f StoredFile, m fileMeta) string {
+	if m.Sha256 != "" {
+		return `"` + m.Sha256 + `"`
+	}
+	return fmt.Sprintf(`"%x-%x"`, f.ModTime().UnixNano(), f.Size())
+}
+
+// originalName returns the name a file was uploaded as. Files stored before
+// metadata recorded it fall back to the part after the random prefix.
+func originalName(name string, m fileMeta) string {
+	if m.OriginalName != "" {
+		return m.OriginalName
+	}
+	if _, orig, ok := strings.Cut(name, "_"); ok && orig != "" {
+		return orig
+	}
+	return name
+}
+
+// contentDisposition formats a Content-Disposition header for filename. An
+// ASCII-only filename parameter is always included for old clients, plus an
+// RFC 5987 filename* parameter when the name needs more than that.
+func contentDisposition(disposition, filename string) string {
+	var fallback, encoded strings.Builder
+	for _, c := range filename {
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(c)
+		}
+	}
+	for _, b := range []byte(filename) {
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	header := fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback.String())
+	if fallback.String() != filename {
+		header += "; filename*=UTF-8''" + encoded.String()
+	}
+	return header
+}
+
+// requirePost answers anything but POST with 405, before rate limiting or
+// authentication, and OPTIONS with the allowed methods.
+func requirePost(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasPrefix(r.URL.Path, "/uploaded/") && r.Method == http.MethodGet {
-			log.Printf("GET request to /uploaded/: %s", r.URL.Path)
+		if r.Method == http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", "POST, OPTIONS")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+}
+
+// activeUploads counts upload handlers that are still running, so shutdown
+// can wait for them to clean up after an aborted transfer.
+var activeUploads sync.WaitGroup
+
+func trackUploads(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeUploads.Add(1)
+		defer activeUploads.Done()
+		extendDeadlines(w)
+		next(w, r)
+	})
+}
+
+// transferTimeout replaces the server's read and write timeouts for
+// uploads and downloads, which legitimately take longer than other requests.
+var transferTimeout = time.Hour
+
+// extendDeadlines gives the request behind w transferTimeout to finish.
+func extendDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(transferTimeout)
+	rc.SetReadDeadline(deadline)
+	rc.SetWriteDeadline(deadline)
+}
+
+// longTransfer is extendDeadlines as middleware, for downloads.
+func longTransfer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extendDeadlines(w)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// newWebDAVHandler returns the handler for WebDAV access to the stored files
+// under prefix. It is nil unless built with -tags webdav.
+var newWebDAVHandler func(prefix string) http.Handler
+
+// autocertListen serves server over HTTPS with certificates obtained from
+// Let's Encrypt for domains. It is nil unless built with -tags autocert.
+var autocertListen func(server *http.Server, domains []string, cacheDir string) error
+
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func main() {
 	flag.StringVar(&hostname, "hostname", "http://localhost", "The hostname for the URL in the response")
+	flag.Func("url-template", "Template for the URLs of stored files, such as https://cdn.example.com/{name}, with placeholders {host}, {name}, {prefix} and {orig}", func(s string) error {
+		var err error
+		urlTemplate, err = parseURLTemplate(s)
+		return err
+	})
 	flag.StringVar(&port, "port", "8080", "The port number for the server")
+	flag.StringVar(&uploadDir, "upload-dir", uploadDir, "Directory uploads, metadata and in-progress uploads are kept in")
+	flag.Func("dir-mode", "Permissions, in octal, to create the upload directory and directories in it with (default 0755)", octalMode(&dirMode))
+	flag.Func("file-mode", "Permissions, in octal, to create stored files with (default 0644)", octalMode(&fileMode))
+	flag.StringVar(&staticDir, "static-dir", staticDir, "Directory of files to serve at / in place of the built-in upload page and favicon; files it lacks are served from the binary")
+	flag.StringVar(&urlPrefix, "url-prefix", "", "Path prefix the app is reachable under, e.g. /files behind a reverse proxy; returned file URLs include it")
+	flag.Var(&maxUploadSize, "max-upload-size", "Maximum size of an upload request, e.g. 500M or 2G; larger requests are rejected with 413")
+	flag.Var(&memoryBuffer, "memory-buffer", "How much of a multipart /paste form to hold in memory before spilling to temp files; this doesn't limit its size, -max-upload-size does")
+	flag.Func("route-dirs", "Store uploads in subdirectories by type, as dir=pattern,...;dir=... with extensions or media types as patterns, e.g. images=image/*;docs=.pdf,.docx", parseDirRoutes)
+	flag.BoolVar(&dedupe, "dedupe", false, "Store uploads under their SHA-256 so identical content is kept once")
+	flag.BoolVar(&detectDuplicates, "detect-duplicates", false, "Mark uploads whose content matches a stored file as duplicates in the response")
+	flag.BoolVar(&strictUnique, "strict-unique", false, "Refuse uploads, with 409, whose content is already stored under any name")
+	flag.BoolVar(&rejectDuplicates, "reject-duplicates", false, "Answer uploads whose content matches a stored file with that file instead of storing them")
+	uploadRate := flag.Float64("rate", 0, "Uploads allowed per minute per client IP (0 disables rate limiting)")
+	uploadBurst := flag.Int("burst", 20, "Uploads a client IP may make at once before -rate applies")
+	flag.BoolVar(&trustProxy, "trust-proxy", false, "Take the client IP from the right-most X-Forwarded-For address, which the proxy in front added")
+	allowCIDR := flag.String("allow-cidr", "", "Comma-separated CIDR blocks of the only clients allowed to connect (all when empty)")
+	denyCIDR := flag.String("deny-cidr", "", "Comma-separated CIDR blocks of clients to refuse, even when -allow-cidr includes them")
+	storageBackend := flag.String("storage", "local", "Where uploads are stored: local or s3. With s3, the upload directory still holds metadata and in-progress uploads")
+	flag.Func("upload-dirs", "Comma-separated directories to spread uploads over, e.g. one per disk; the first replaces -upload-dir", parseUploadDirs)
+	flag.Func("redirect-paths", "Comma-separated paths an upload's ?redirect= may point to (default any path on -hostname)", func(value string) error {
+		redirectPaths = make(map[string]bool)
+		for _, p := range strings.Split(value, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				redirectPaths[p] = true
+			}
+		}
+		return nil
+	})
+	placement := flag.String("placement", "least-full", "How -upload-dirs are picked for new files: "+strings.Join(placements, " or "))
+	s3Bucket := flag.String("bucket", "", "S3 bucket for -storage s3")
+	s3Region := flag.String("region", "us-east-1", "S3 region for -storage s3")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3-compatible endpoint URL (default AWS for -region)")
+	cleanupInterval := flag.Duration("cleanup-interval", time.Minute, "How often expired uploads are removed")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serve HTTPS together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file; serve HTTPS together with -tls-cert")
+	autocertDomain := flag.String("autocert-domain", "", "Comma-separated domains to obtain Let's Encrypt certificates for (requires building with -tags autocert)")
+	enableWebDAV := flag.Bool("enable-webdav", false, "Serve the stored files over WebDAV at /dav/, with the API key as the Basic auth password (requires building with -tags webdav)")
+	autocertCache := flag.String("autocert-cache", "./autocert-cache", "Directory where -autocert-domain certificates are cached")
+	blockedExt := flag.String("blocked-ext", "", "Comma-separated extensions to reject, replacing the defaults; prefix the list with + to add to them instead")
+	allowedExt := flag.String("allowed-ext", "", "Comma-separated extensions to accept; when set every other extension is rejected")
+	flag.BoolVar(&checkContent, "check-content", true, "Reject executables and files whose content doesn't match their extension")
+	flag.BoolVar(&scanArchives, "scan-archives", false, "Reject zip and tar uploads containing files with a disallowed extension")
+	flag.StringVar(&convertImages, "convert-images", "", "Convert JPEG, PNG and GIF uploads to this format before storing them: webp (requires building with -tags webp), jpeg or png. JPEGs are left as they are for the lossless webp and png")
+	flag.BoolVar(&keepOriginals, "keep-original", false, "Also store images converted by -convert-images as they were sent")
+	flag.BoolVar(&convertAnimated, "convert-animated", false, "Let -convert-images convert animated GIFs, keeping only their first frame")
+	flag.BoolVar(&stripEXIF, "strip-exif", false, "Remove EXIF, XMP and IPTC metadata such as GPS position from JPEG uploads")
+	metricsInterval := flag.Duration("metrics-interval", time.Minute, "How often the storage size metrics are recomputed")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "How long a client may take to send request headers")
+	readTimeout := flag.Duration("read-timeout", time.Minute, "How long a client may take to send a request, except for uploads")
+	writeTimeout := flag.Duration("write-timeout", time.Minute, "How long writing a response may take, except for downloads")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "How long to keep idle keep-alive connections open")
+	flag.DurationVar(&transferTimeout, "transfer-timeout", transferTimeout, "How long a single upload or download may take")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for active requests on SIGINT/SIGTERM before aborting them")
+	flag.Var(&quota, "quota", "Maximum total size of the files stored with each API key, e.g. 1G (0 for no limit)")
+	flag.IntVar(&thumbSize, "thumb-size", thumbSize, "Maximum width and height of image thumbnails (0 to disable)")
+	flag.BoolVar(&allowPrivateFetch, "allow-private-fetch", false, "Let /upload-url fetch from private, loopback and link-local addresses")
+	flag.StringVar(&clamavAddr, "clamav-addr", "", "Address of a clamd daemon to scan uploads with, host:port or a Unix socket path (disabled if empty)")
+	var cacheSize byteSize
+	cacheMaxFile := byteSize(1 << 20)
+	flag.Var(&cacheSize, "cache-size", "Memory to use for caching small downloaded files, e.g. 64M (0 disables the cache)")
+	flag.Var(&cacheMaxFile, "cache-max-file", "Largest file the download cache holds")
+	flag.IntVar(&maxFiles, "max-files", maxFiles, "Maximum number of files in one upload request (0 for no limit)")
+	flag.IntVar(&prefixLength, "prefix-length", prefixLength, "Length of the random prefix added to stored filenames")
+	flag.StringVar(&prefixAlphabet, "prefix-alphabet", prefixAlphabet, "Characters random filename prefixes are drawn from, e.g. a lowercase-only or base58 set")
+	flag.Func("naming", "How stored files are named: random, timestamp, uuid, hash or original (default random)", parseNaming)
+	var downloadRate byteSize
+	flag.Var(&downloadRate, "download-rate", "Maximum download speed in bytes per second, e.g. 1M (0 for no limit)")
+	downloadRateMode := flag.String("download-rate-mode", "connection", "Whether -download-rate applies to each download (connection) or all of them together (global)")
+	compress := flag.Bool("compress", true, "Gzip downloads of text and other compressible files for clients that accept it")
+	encryptionKey := flag.String("encryption-key", "", "AES-256 key to encrypt stored files with, as 64 hex digits or a key file path")
+	signKey := flag.String("signing-key", "", "Secret to sign download URLs in upload responses with, or a file holding it")
+	flag.BoolVar(&requireSigned, "require-signed", false, "Only serve downloads through unexpired signed URLs; requires -signing-key")
+	flag.DurationVar(&tusExpiry, "tus-expiry", tusExpiry, "How long an unfinished resumable upload is kept after data last arrived for it")
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", idempotencyTTL, "How long the response to an upload with an Idempotency-Key is replayed to retries")
+	flag.DurationVar(&signedURLTTL, "signed-url-ttl", signedURLTTL, "How long signed URLs stay valid unless an upload's signed parameter says otherwise")
+	apiKeyList := flag.String("api-keys", "", "Comma-separated API keys, or a file with one per line, required for uploads and deletes")
+	flag.StringVar(&webhookURL, "webhook-url", "", "Slack or Discord compatible webhook to post a message to for every upload")
+	flag.Func("webhook-template", "Go template for webhook messages, with .Filename, .OriginalName, .Size and .URL (default \""+defaultWebhookTemplate+"\")", parseWebhookTemplate)
+	flag.Func("basic-auth", "Credentials as user:pass that every request must give with HTTP Basic auth", parseBasicAuth)
+	flag.StringVar(&adminKey, "admin-key", "", "Key for the admin endpoints /api/export, /api/import and /api/admin/..., which are disabled without one")
+	flag.BoolFunc("read-only", "Start in read-only mode, rejecting uploads and other changes with 503 while still serving downloads", func(s string) error {
+		v, err := strconv.ParseBool(s)
+		readOnly.Store(v)
+		return err
+	})
+	corsOrigins := flag.String("cors-origins", "", "Comma-separated origins allowed to make cross-origin requests, or * for any")
+	auditLogPath := flag.String("audit-log", "", "File to append a JSON line to for every download; reopened on SIGHUP for log rotation")
+	logFormat := flag.String("log-format", "json", "Log output format: json or text")
+	configFile := flag.String("config", "", "JSON file of flag names to values; flags given on the command line override it")
 	flag.Parse()
 
-	http.Handle("/", http.FileServer(http.Dir("./static")))
-	http.Handle("/uploaded/", logRequests(http.StripPrefix("/uploaded/", http.FileServer(http.Dir(uploadDir)))))
-	http.HandleFunc("/upload", uploadFile)
+	if *configFile != "" {
+		if err := applyConfigFile(*configFile); err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+	}
+
+	if err := setupLogging(*logFormat); err != nil {
+		log.Fatal(err)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+	if *autocertDomain != "" && *tlsCert != "" {
+		log.Fatal("-autocert-domain can't be combined with -tls-cert/-tls-key")
+	}
+	if *autocertDomain != "" && autocertListen == nil {
+		log.Fatal("-autocert-domain requires a binary built with -tags autocert")
+	}
+	if *enableWebDAV && newWebDAVHandler == nil {
+		log.Fatal("-enable-webdav requires a binary built with -tags webdav")
+	}
+	if isFlagSet("blocked-ext") {
+		if extra, ok := strings.CutPrefix(*blockedExt, "+"); ok {
+			for ext := range parseExtensions(extra) {
+				disallowedExtensions[ext] = true
+			}
+		} else {
+			disallowedExtensions = parseExtensions(*blockedExt)
+		}
+	}
+	if *allowedExt != "" {
+		allowedExtensions = parseExtensions(*allowedExt)
+	}
+
+	if *apiKeyList != "" {
+		keys, err := loadAPIKeys(*apiKeyList)
+		if err != nil {
+			log.Fatalf("Error loading API keys: %v", err)
+		}
+		if len(keys) == 0 {
+			log.Fatal("-api-keys is set but contains no keys")
+		}
+		apiKeys = keys
+	}
+	if quota > 0 && len(apiKeys) == 0 {
+		log.Fatal("-quota requires -api-keys")
+	}
+	if strictUnique && (dedupe || rejectDuplicates) {
+		log.Fatal("-strict-unique can't be combined with -dedupe or -reject-duplicates")
+	}
+	if *signKey != "" {
+		key, err := loadSigningKey(*signKey)
+		if err != nil {
+			log.Fatalf("Error loading -signing-key: %v", err)
+		}
+		signingKey = key
+	}
+	if requireSigned && len(signingKey) == 0 {
+		log.Fatal("-require-signed requires -signing-key")
+	}
+
+	useTLS := *tlsCert != "" || *autocertDomain != ""
+	if useTLS && !isFlagSet("hostname") {
+		hostname = "https://localhost"
+	}
+
+	urlPrefix = "/" + strings.Trim(urlPrefix, "/")
+	if urlPrefix == "/" {
+		urlPrefix = ""
+	}
+	if _, ok := imageFormats[convertImages]; convertImages == "webp" && !ok {
+		log.Fatal("-convert-images webp requires a binary built with -tags webp")
+	} else if convertImages != "" && !ok {
+		log.Fatalf("Unknown -convert-images %q, expected webp, jpeg or png", convertImages)
+	}
+	if err := checkPrefixAlphabet(prefixAlphabet); err != nil {
+		log.Fatalf("Invalid -prefix-alphabet: %v", err)
+	}
+	if prefixLength < 1 || prefixLength > maxSlugLength {
+		log.Fatalf("-prefix-length must be between 1 and %d", maxSlugLength)
+	}
+	if len(uploadDirs) > 0 {
+		if *storageBackend != "local" {
+			log.Fatalf("-upload-dirs only works with -storage local")
+		}
+		uploadDir = uploadDirs[0]
+	} else {
+		uploadDirs = []string{uploadDir}
+	}
+	if err := createUploadDirs(uploadDirs); err != nil {
+		log.Fatalf("Error creating upload directory: %v", err)
+	}
+	static := staticFiles()
+
+	var err error
+	switch *storageBackend {
+	case "local":
+		store = localStorage{dir: uploadDir}
+		if len(uploadDirs) > 1 {
+			store, err = newMultiDirStorage(uploadDirs, *placement)
+			if err != nil {
+				log.Fatalf("Invalid -placement: %v", err)
+			}
+		}
+	case "s3":
+		store, err = newS3Storage(*s3Endpoint, *s3Bucket, *s3Region)
+		if err != nil {
+			log.Fatalf("Error configuring S3 storage: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown -storage %q, expected local or s3", *storageBackend)
+	}
+	if *encryptionKey != "" {
+		key, err := loadEncryptionKey(*encryptionKey)
+		if err != nil {
+			log.Fatalf("Error loading -encryption-key: %v", err)
+		}
+		if store, err = newEncryptedStorage(store, key); err != nil {
+			log.Fatalf("Error configuring encryption: %v", err)
+		}
+		encryptUploads = true
+	}
+	if cacheSize > 0 {
+		store = newCachedStorage(store, int64(cacheSize), int64(cacheMaxFile))
+	}
+
+	metadata, err = loadMetaStore(filepath.Join(uploadDir, metaFilename))
+	if err != nil {
+		log.Fatalf("Error loading metadata: %v", err)
+	}
+	downloadStats, err = loadStatsStore(filepath.Join(uploadDir, statsFilename))
+	if err != nil {
+		log.Fatalf("Error loading download stats: %v", err)
+	}
+	go flushStats(statsFlushInterval)
+	links, err = loadLinkStore(filepath.Join(uploadDir, linksFilename))
+	if err != nil {
+		log.Fatalf("Error loading short links: %v", err)
+	}
+	if err := loadQuotaUsage(); err != nil {
+		log.Fatalf("Error computing quota usage: %v", err)
+	}
+	go sweepExpiredFiles(*cleanupInterval)
+	if webhookURL != "" {
+		go sendWebhooks()
+	}
+	go updateStorageMetrics(*metricsInterval)
+
+	http.Handle("/", http.FileServer(static))
+	http.HandleFunc("GET /healthz", healthz)
+	http.HandleFunc("GET /readyz", readyz)
+	http.Handle("GET /metrics", promhttp.Handler())
+	http.HandleFunc("GET /openapi.json", serveOpenAPI)
+	compressible := func(h http.Handler) http.Handler { return h }
+	if *compress {
+		compressible = compressResponses
+	}
+	throttle := func(h http.Handler) http.Handler { return h }
+	switch *downloadRateMode {
+	case "connection", "global":
+		if downloadRate > 0 {
+			throttle = throttleDownloads(int64(downloadRate), *downloadRateMode == "global")
+		}
+	default:
+		log.Fatalf("Unknown -download-rate-mode %q, expected connection or global", *downloadRateMode)
+	}
+	if *auditLogPath != "" {
+		if audit, err = openAuditLog(*auditLogPath); err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		go reopenAuditLogOnHangup()
+	}
+	download := auditDownloads(downloadedName, longTransfer(throttle(compressible(http.HandlerFunc(serveUploaded)))))
+	view := auditDownloads(viewedName, compressible(http.HandlerFunc(viewFile)))
+	http.Handle("GET "+downloadPath, http.StripPrefix(downloadPath, download))
+	http.Handle("GET /view/{name...}", view)
+	http.Handle("GET /browse", compressible(http.HandlerFunc(browseFiles)))
+	http.HandleFunc("GET /sharex", serveShareXConfig)
+	http.HandleFunc("GET /random", randomFile)
+	http.HandleFunc("GET /s/{code}", followShortLink)
+	if urlPrefix != "" {
+		// Returned URLs include the prefix, so they work whether or not a
+		// proxy in front strips it.
+		http.Handle("GET "+urlPrefix+downloadPath, http.StripPrefix(urlPrefix+downloadPath, download))
+		http.Handle("GET "+urlPrefix+"/view/{name...}", view)
+		http.Handle("GET "+urlPrefix+"/browse", compressible(http.HandlerFunc(browseFiles)))
+		http.HandleFunc("GET "+urlPrefix+"/sharex", serveShareXConfig)
+		http.HandleFunc("GET "+urlPrefix+"/random", randomFile)
+		http.HandleFunc("GET "+urlPrefix+"/s/{code}", followShortLink)
+	}
+	limitUploads := func(h http.Handler) http.Handler { return h }
+	if *uploadRate > 0 {
+		limitUploads = newRateLimiter(*uploadRate, *uploadBurst).limit
+	}
+	http.Handle("/upload", requirePost(rejectWhenReadOnly(limitUploads(requireAPIKey(idempotent(trackUploads(uploadFile)))))))
+	http.HandleFunc("GET /upload-progress/{id}", serveUploadProgress)
+	http.Handle("POST /paste", rejectWhenReadOnly(limitUploads(requireAPIKey(idempotent(trackUploads(uploadPaste))))))
+	http.Handle("POST /upload-url", rejectWhenReadOnly(limitUploads(requireAPIKey(idempotent(trackUploads(uploadFromURL))))))
+	http.Handle("POST /upload-data-uri", rejectWhenReadOnly(limitUploads(requireAPIKey(idempotent(trackUploads(uploadDataURI))))))
+	http.Handle("POST /shorten", rejectWhenReadOnly(limitUploads(requireAPIKey(http.HandlerFunc(shortenURL)))))
+	http.Handle("POST /files", rejectWhenReadOnly(limitUploads(requireAPIKey(trackUploads(tusCreate)))))
+	http.HandleFunc("OPTIONS /files", tusOptions)
+	http.HandleFunc("HEAD /files/{id}", tusHead)
+	http.Handle("PATCH /files/{id}", rejectWhenReadOnly(requireAPIKey(trackUploads(tusPatch))))
+	http.Handle("PUT /files/{name...}", rejectWhenReadOnly(requireAPIKey(trackUploads(replaceFile))))
+	http.Handle("DELETE /files/{name...}", rejectWhenReadOnly(requireAPIKey(http.HandlerFunc(deleteFile))))
+	if urlPrefix != "" {
+		// The browse page deletes, and tus clients follow Location, through
+		// the prefix.
+		http.HandleFunc("HEAD "+urlPrefix+"/files/{id}", tusHead)
+		http.Handle("PATCH "+urlPrefix+"/files/{id}", rejectWhenReadOnly(requireAPIKey(trackUploads(tusPatch))))
+		http.Handle("DELETE "+urlPrefix+"/files/{name...}", rejectWhenReadOnly(requireAPIKey(http.HandlerFunc(deleteFile))))
+	}
+	if *enableWebDAV {
+		http.Handle("/dav/", rejectWhenReadOnly(newWebDAVHandler("/dav")))
+	}
+	http.HandleFunc("GET /api/files", listFiles)
+	http.HandleFunc("GET /api/stats", serveServerStats)
+	http.HandleFunc("GET /api/files/{name...}", serveFileDetails)
+	// A {name} followed by /stats is a single path segment, so stats of files
+	// in subdirectories are also served under a prefix of their own.
+	http.HandleFunc("GET /api/files/{name}/stats", serveFileStats)
+	http.HandleFunc("GET /api/stats/files/{name...}", serveFileStats)
+	http.Handle("PATCH /api/files/{name...}", rejectWhenReadOnly(requireAPIKey(http.HandlerFunc(renameFile))))
+	http.Handle("GET /api/zip", auditDownloads(zippedNames, longTransfer(throttle(http.HandlerFunc(downloadZip)))))
+	if adminKey != "" {
+		http.Handle("GET /api/export", requireAdmin(longTransfer(http.HandlerFunc(exportStore))))
+		http.Handle("POST /api/import", rejectWhenReadOnly(requireAdmin(trackUploads(importStore))))
+		http.Handle("POST /api/admin/purge", rejectWhenReadOnly(requireAdmin(http.HandlerFunc(purgeFiles))))
+		http.Handle("GET /api/admin/read-only", requireAdmin(http.HandlerFunc(serveReadOnly)))
+		http.Handle("PUT /api/admin/read-only", requireAdmin(http.HandlerFunc(setReadOnly)))
+	}
 
 	serverAddress := fmt.Sprintf(":%s", port)
-	fmt.Printf("Server started on %s\n", serverAddress)
-	log.Fatal(http.ListenAndServe(serverAddress, nil))
+	var handler http.Handler = http.DefaultServeMux
+	// Inside CORS, so preflight requests, which carry no credentials, are
+	// still answered.
+	if basicAuthUser != "" {
+		handler = requireBasicAuth(handler)
+	}
+	if *corsOrigins != "" {
+		handler = newCORSHandler(handler, *corsOrigins)
+	}
+	if *allowCIDR != "" || *denyCIDR != "" {
+		var filter ipFilter
+		var err error
+		if filter.allow, err = parseCIDRs(*allowCIDR); err != nil {
+			log.Fatalf("Invalid -allow-cidr: %v", err)
+		}
+		if filter.deny, err = parseCIDRs(*denyCIDR); err != nil {
+			log.Fatalf("Invalid -deny-cidr: %v", err)
+		}
+		handler = filter.filter(handler)
+	}
+	// The read and write timeouts bound ordinary requests, so slow or stalled
+	// clients can't hold connections open. They start once the headers are
+	// read, which ReadHeaderTimeout bounds on its own. Upload and download
+	// handlers push both deadlines out to -transfer-timeout when they start.
+	server := &http.Server{
+		Addr:              serverAddress,
+		Handler:           logRequests(handler),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	listen := server.ListenAndServe
+	switch {
+	case *tlsCert != "":
+		listen = func() error { return server.ListenAndServeTLS(*tlsCert, *tlsKey) }
+	case *autocertDomain != "":
+		listen = func() error { return autocertListen(server, strings.Split(*autocertDomain, ","), *autocertCache) }
+	}
+	go func() {
+		slog.Info("Server started", "addr", serverAddress)
+		if err := listen(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	slog.Info("Shutting down, waiting for active requests", "timeout", shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// Closing the connections makes in-flight copies fail, and the
+		// storage backend removes what they had written so far. Wait for
+		// those handlers so no truncated file outlives the process.
+		slog.Warn("Grace period expired, aborting active requests", "err", err)
+		server.Close()
+		activeUploads.Wait()
+	}
+	thumbnailJobs.Wait()
+	if err := downloadStats.flush(); err != nil {
+		slog.Error("Error saving download stats", "err", err)
+	}
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,1658 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setup points the server at a fresh upload directory with empty stores,
+// as main leaves it with the default flags. Settings a test changes with set
+// are put back when it ends.
+func setup(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	set(t, &uploadDir, dir)
+	set(t, &uploadDirs, []string{dir})
+	set(t, &hostname, "http://localhost")
+	set(t, &store, Storage(localStorage{dir: dir}))
+	m, err := loadMetaStore(filepath.Join(dir, metaFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, &metadata, m)
+	s, err := loadStatsStore(filepath.Join(dir, statsFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, &downloadStats, s)
+	l, err := loadLinkStore(filepath.Join(dir, linksFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, &links, l)
+	set(t, &quotas, &quotaTracker{used: make(map[string]int64), files: make(map[string]ownedFile)})
+	set(t, &idempotency, &idempotencyCache{responses: make(map[string]*idempotentResponse)})
+	// Registered last so it runs first: thumbnails still being written
+	// would otherwise race the cleanup of the directory.
+	t.Cleanup(thumbnailJobs.Wait)
+}
+
+// set changes a setting for the rest of the test.
+func set[T any](t *testing.T, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// formPart is one part of a multipart upload: a file when filename is set,
+// otherwise a form value.
+type formPart struct {
+	field    string
+	filename string
+	content  string
+	header   textproto.MIMEHeader
+}
+
+// file is a formPart for a file sent under the usual "file" field.
+func file(filename, content string) formPart {
+	return formPart{field: "file", filename: filename, content: content}
+}
+
+// uploadRequest builds a multipart POST of parts to target.
+func uploadRequest(t *testing.T, target string, parts ...formPart) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range parts {
+		h := make(textproto.MIMEHeader)
+		for k, v := range p.header {
+			h[k] = v
+		}
+		disposition := `form-data; name="` + p.field + `"`
+		if p.filename != "" {
+			disposition += `; filename="` + p.filename + `"`
+			if h.Get("Content-Type") == "" {
+				h.Set("Content-Type", "application/octet-stream")
+			}
+		}
+		h.Set("Content-Disposition", disposition)
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(p.content))
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// serve runs r through h and returns the response.
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// upload posts parts to /upload with the query in target.
+func upload(t *testing.T, target string, parts ...formPart) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(http.HandlerFunc(uploadFile), uploadRequest(t, target, parts...))
+}
+
+// uploaded posts one file and returns its response, failing the test unless
+// it was stored.
+func uploaded(t *testing.T, target, filename, content string) UploadResponse {
+	t.Helper()
+	w := upload(t, target, file(filename, content))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload of %s: status %d: %s", filename, w.Code, w.Body)
+	}
+	return decodeUploads(t, w)[0]
+}
+
+// decodeUploads reads an upload response, in which failed files have an
+// empty URL.
+func decodeUploads(t *testing.T, w *httptest.ResponseRecorder) []UploadResponse {
+	t.Helper()
+	var responses []UploadResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+	return responses
+}
+
+// download GETs a stored file through downloadPath.
+func download(r *http.Request) *httptest.ResponseRecorder {
+	return serve(http.StripPrefix(downloadPath, http.HandlerFunc(serveUploaded)), r)
+}
+
+// get GETs the stored file name.
+func get(name string) *httptest.ResponseRecorder {
+	return download(httptest.NewRequest(http.MethodGet, downloadPath+name, nil))
+}
+
+// stored lists the names in uploadDir, leaving out internal files.
+func stored(t *testing.T) []string {
+	t.Helper()
+	files, err := listLiveFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// testPNG returns a PNG image of the given size.
+func testPNG(t *testing.T, width, height int) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := range width {
+		for y := range height {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 200, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  byteSize
+		size   int
+		status int
+	}{
+		{"under limit", 1 << 10, 100, http.StatusOK},
+		{"over limit", 1 << 10, 4 << 10, http.StatusRequestEntityTooLarge},
+		{"far over limit", 1 << 10, 1 << 20, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &maxUploadSize, tt.limit)
+			w := upload(t, "/upload", file("a.txt", strings.Repeat("x", tt.size)))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if names := stored(t); len(names) != 0 {
+					t.Errorf("stored %v after rejecting upload", names)
+				}
+				if !strings.Contains(w.Body.String(), tt.limit.String()) {
+					t.Errorf("error %q doesn't give the limit", w.Body)
+				}
+			}
+		})
+	}
+}
+
+// readCounter counts how much of a request body a handler reads.
+type readCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// TestMaxUploadSizeStopsReading checks oversized bodies are cut off by
+// http.MaxBytesReader once they pass the limit, rather than read to the
+// end first.
+func TestMaxUploadSizeStopsReading(t *testing.T) {
+	const limit = 64 << 10
+	big := strings.Repeat("x", 8<<20)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		request func() *http.Request
+	}{
+		{"upload", uploadFile, func() *http.Request { return uploadRequest(t, "/upload", file("a.txt", big)) }},
+		{"paste", uploadPaste, func() *http.Request { return httptest.NewRequest(http.MethodPost, "/paste", strings.NewReader(big)) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &maxUploadSize, limit)
+			r := tt.request()
+			counter := &readCounter{r: r.Body}
+			r.Body = io.NopCloser(counter)
+			w := serve(tt.handler, r)
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var maxErr *http.MaxBytesError
+			if _, err := r.Body.Read(make([]byte, 1)); !errors.As(err, &maxErr) || maxErr.Limit != limit {
+				t.Errorf("body error %v, want the MaxBytesReader's", err)
+			}
+			if counter.n > 2*limit {
+				t.Errorf("read %d bytes of the body for a limit of %d", counter.n, limit)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    byteSize
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"500M", 500 << 20, false},
+		{"2G", 2 << 30, false},
+		{"2GiB", 2 << 30, false},
+		{"1k", 1 << 10, false},
+		{"10MB", 10 << 20, false},
+		{"", 0, true},
+		{"-1", 0, true},
+		{"lots", 0, true},
+		{"99999999999T", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	tests := []struct {
+		in   byteSize
+		want string
+	}{
+		{0, "0"},
+		{1000, "1000"},
+		{2 << 30, "2G"},
+		{1536 << 10, "1536K"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("byteSize(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"stored file", "", http.StatusNoContent},
+		{"missing file", "nothing.txt", http.StatusNotFound},
+		{"traversal", "../secret.txt", http.StatusBadRequest},
+		{"internal file", metaFilename, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			// A ttl makes sure the upload has metadata to remove.
+			up := uploaded(t, "/upload?ttl=1h", "a.txt", "hello")
+			target := tt.target
+			if target == "" {
+				target = up.Filename
+			}
+			r := httptest.NewRequest(http.MethodDelete, "/files/x", nil)
+			r.SetPathValue("name", target)
+			w := serve(http.HandlerFunc(deleteFile), r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			_, hasMeta := metadata.get(up.Filename)
+			gone := get(up.Filename).Code == http.StatusNotFound
+			if deleted := tt.status == http.StatusNoContent; gone != deleted || hasMeta == deleted {
+				t.Errorf("after delete: file gone %v, metadata kept %v", gone, hasMeta)
+			}
+		})
+	}
+}
+
+func TestRandomString(t *testing.T) {
+	tests := []struct {
+		length  int
+		charset string
+	}{
+		{6, alphanumeric},
+		{16, alphanumeric},
+		{8, "ab"},
+		{3, "x"},
+	}
+	for _, tt := range tests {
+		s := randomString(tt.length, tt.charset)
+		if len(s) != tt.length {
+			t.Errorf("randomString(%d, %q) = %q, wrong length", tt.length, tt.charset, s)
+		}
+		if strings.Trim(s, tt.charset) != "" {
+			t.Errorf("randomString(%d, %q) = %q, outside charset", tt.length, tt.charset, s)
+		}
+	}
+}
+
+// TestPrefixSettings checks uploads get prefixes of -prefix-length drawn
+// from -prefix-alphabet.
+func TestPrefixSettings(t *testing.T) {
+	tests := []struct {
+		length   int
+		alphabet string
+	}{
+		{6, alphanumeric},
+		{12, "abcdefghijkmnopqrstuvwxyz"},
+		{4, "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"},
+		{2, "x-"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d of %s", tt.length, tt.alphabet), func(t *testing.T) {
+			setup(t)
+			set(t, &prefixLength, tt.length)
+			set(t, &prefixAlphabet, tt.alphabet)
+			up := uploaded(t, "/upload", "a_b.txt", "hello")
+			prefix, rest, _ := strings.Cut(up.Filename, "_")
+			if len(prefix) != tt.length || strings.Trim(prefix, tt.alphabet) != "" || rest != "a_b.txt" {
+				t.Errorf("stored as %s", up.Filename)
+			}
+		})
+	}
+}
+
+func TestCheckPrefixAlphabet(t *testing.T) {
+	tests := []struct {
+		alphabet string
+		valid    bool
+	}{
+		{alphanumeric, true},
+		{"abcdefghijkmnopqrstuvwxyz", true},
+		{"a-z", true},
+		{"", false},
+		{"abca", false},
+		{"ab_", false},
+		{"ab/", false},
+		{"aé", false},
+	}
+	for _, tt := range tests {
+		if err := checkPrefixAlphabet(tt.alphabet); (err == nil) != tt.valid {
+			t.Errorf("checkPrefixAlphabet(%q) = %v, want valid %v", tt.alphabet, err, tt.valid)
+		}
+	}
+}
+
+// TestRandomStringConcurrent is meant for -race: prefixes are drawn from
+// every upload goroutine at once.
+func TestRandomStringConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := generateRandomString(16)
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[s] {
+				t.Errorf("generateRandomString repeated %q", s)
+			}
+			seen[s] = true
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNameCollisions(t *testing.T) {
+	setup(t)
+	// Each random string drawn is one repeated character: "aaaaaa", then
+	// "bbbbbb", and so on.
+	draws := 0
+	set(t, &randRead, func(b []byte) (int, error) {
+		for i := range b {
+			b[i] = byte(draws)
+		}
+		draws++
+		return len(b), nil
+	})
+	taken := filepath.Join(uploadDir, "aaaaaa_a.txt")
+	if err := os.WriteFile(taken, []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	up := uploaded(t, "/upload", "a.txt", "new")
+	if up.Filename != "bbbbbb_a.txt" {
+		t.Errorf("upload stored as %s, want bbbbbb_a.txt", up.Filename)
+	}
+	if got := get(up.Filename).Body.String(); got != "new" {
+		t.Errorf("%s = %q, want %q", up.Filename, got, "new")
+	}
+
+	// With every draw the same, no attempt finds a free name.
+	set(t, &randRead, func(b []byte) (int, error) {
+		clear(b)
+		return len(b), nil
+	})
+	w := upload(t, "/upload", file("a.txt", "third"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("upload with every name taken: status %d, want 500: %s", w.Code, w.Body)
+	}
+	if got, _ := os.ReadFile(taken); string(got) != "existing" {
+		t.Errorf("taken file = %q, want it untouched", got)
+	}
+}
+
+func TestUploadSha256(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"text", "hello world"},
+		{"binary", "\x00\x01\x02\xff"},
+		{"larger", strings.Repeat("0123456789", 10000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			up := uploaded(t, "/upload", "a.bin", tt.content)
+			sum := sha256.Sum256([]byte(tt.content))
+			if want := hex.EncodeToString(sum[:]); up.Sha256 != want {
+				t.Errorf("sha256 = %s, want %s", up.Sha256, want)
+			}
+		})
+	}
+}
+
+// TestShutdownWaitsForUploads checks what shutdown relies on: once the
+// connections of in-flight uploads are closed, waiting on activeUploads
+// returns only after their partial files are removed.
+func TestShutdownWaitsForUploads(t *testing.T) {
+	setup(t)
+	srv := httptest.NewServer(trackUploads(uploadFile))
+	defer srv.Close()
+
+	body, bodyW := io.Pipe()
+	mw := multipart.NewWriter(bodyW)
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/upload", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	part, _ := mw.CreateFormFile("file", "big.txt")
+	part.Write(bytes.Repeat([]byte("x"), 64<<10))
+
+	// Wait until the partial file is on disk, then abort as Shutdown does
+	// once its grace period runs out.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		entries, _ := os.ReadDir(uploadDir)
+		if len(entries) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upload never started")
+		}
+	}
+	srv.CloseClientConnections()
+	bodyW.CloseWithError(errors.New("aborted"))
+	<-done
+	activeUploads.Wait()
+
+	entries, _ := os.ReadDir(uploadDir)
+	for _, e := range entries {
+		if e.Name() != metaFilename {
+			t.Errorf("%s left behind by the aborted upload", e.Name())
+		}
+	}
+}
+
+func TestIsFlagSet(t *testing.T) {
+	tests := []struct {
+		args []string
+		name string
+		want bool
+	}{
+		{nil, "hostname", false},
+		{[]string{"-hostname", "https://example.com"}, "hostname", true},
+		{[]string{"-tls-cert", "cert.pem"}, "hostname", false},
+		// Setting a flag to its default still counts as setting it.
+		{[]string{"-hostname", "http://localhost"}, "hostname", true},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("filehost", flag.ContinueOnError)
+		fs.String("hostname", "http://localhost", "")
+		fs.String("tls-cert", "", "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		set(t, &flag.CommandLine, fs)
+		if got := isFlagSet(tt.name); got != tt.want {
+			t.Errorf("isFlagSet(%q) with %v = %v, want %v", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseExtensions(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"exe,.BAT", []string{".bat", ".exe"}},
+		{" .sh , ps1 ,,", []string{".ps1", ".sh"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got := parseExtensions(tt.in)
+		var exts []string
+		for e := range got {
+			exts = append(exts, e)
+		}
+		slices.Sort(exts)
+		if !slices.Equal(exts, tt.want) {
+			t.Errorf("parseExtensions(%q) = %v, want %v", tt.in, exts, tt.want)
+		}
+	}
+}
+
+func TestExtensionChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  string
+		filename string
+		status   int
+	}{
+		{"ordinary file", "", "notes.txt", http.StatusOK},
+		{"denied", "", "setup.exe", http.StatusBadRequest},
+		{"denied in upper case", "", "SETUP.EXE", http.StatusBadRequest},
+		{"markup browsers run script in", "", "page.htm", http.StatusBadRequest},
+		{"svg", "", "logo.SVG", http.StatusBadRequest},
+		{"no extension", "", "README", http.StatusBadRequest},
+		{"allowlisted", "txt,png", "notes.TXT", http.StatusOK},
+		{"not allowlisted", "txt,png", "data.csv", http.StatusBadRequest},
+		{"denied even when allowlisted", "exe", "setup.exe", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			if tt.allowed != "" {
+				set(t, &allowedExtensions, parseExtensions(tt.allowed))
+			}
+			w := upload(t, "/upload", file(tt.filename, "text"))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+// TestValidateOnly checks ?validate=1 runs the upload checks but leaves
+// nothing behind in the upload directory, whatever the outcome.
+func TestValidateOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		dedupe bool
+		parts  []formPart
+		status int
+	}{
+		{"valid", false, []formPart{file("notes.txt", "hello")}, http.StatusOK},
+		{"valid with dedupe", true, []formPart{file("notes.txt", "hello")}, http.StatusOK},
+		{"disallowed extension", false, []formPart{file("setup.exe", "MZ")}, http.StatusBadRequest},
+		{"one of two disallowed", false, []formPart{file("notes.txt", "hello"), file("setup.exe", "MZ")}, http.StatusMultiStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &dedupe, tt.dedupe)
+			w := upload(t, "/upload?validate=1", tt.parts...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if w.Code == http.StatusOK {
+				up := decodeUploads(t, w)[0]
+				if up.Sha256 != sha256Hex("hello") || up.Size != 5 || !strings.HasSuffix(up.Filename, ".txt") {
+					t.Errorf("response %+v", up)
+				}
+				if tt.dedupe && up.Filename != sha256Hex("hello")+".txt" {
+					t.Errorf("predicted name %s under -dedupe", up.Filename)
+				}
+			}
+			entries, err := os.ReadDir(uploadDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				t.Errorf("left %s in the upload directory", e.Name())
+			}
+		})
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		disposition string
+		filename    string
+		want        string
+	}{
+		{"attachment", "report.pdf", `attachment; filename="report.pdf"`},
+		{"inline", "my photo.png", `inline; filename="my photo.png"`},
+		{"attachment", `say "hi".txt`, `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"attachment", "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"attachment", "a\r\nb.txt", `attachment; filename="a__b.txt"; filename*=UTF-8''a%0D%0Ab.txt`},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition(tt.disposition, tt.filename); got != tt.want {
+			t.Errorf("contentDisposition(%q, %q) = %s, want %s", tt.disposition, tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadKeepsOriginalName(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", `attachment; filename="Quarterly Report.txt"`},
+		{"?inline=1", `inline; filename="Quarterly Report.txt"`},
+		{"?inline=1&download=1", `attachment; filename="Quarterly Report.txt"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			setup(t)
+			up := uploaded(t, "/upload", "Quarterly Report.txt", "numbers")
+			w := download(httptest.NewRequest(http.MethodGet, downloadPath+up.Filename+tt.query, nil))
+			if got := w.Header().Get("Content-Disposition"); got != tt.want {
+				t.Errorf("Content-Disposition = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDispositionURLs checks an upload's previewUrl shows the file inline
+// and its downloadUrl saves it.
+func TestDispositionURLs(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload", "Notes.txt", "hello")
+	if up.PreviewURL == up.DownloadURL {
+		t.Fatalf("previewUrl and downloadUrl are both %s", up.PreviewURL)
+	}
+	for rawURL, want := range map[string]string{
+		up.PreviewURL:  `inline; filename="Notes.txt"`,
+		up.DownloadURL: `attachment; filename="Notes.txt"`,
+	} {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := download(httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+		if w.Code != http.StatusOK || w.Body.String() != "hello" {
+			t.Errorf("GET %s: status %d, body %q", rawURL, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != want {
+			t.Errorf("GET %s: Content-Disposition = %s, want %s", rawURL, got, want)
+		}
+	}
+
+	// Under -require-signed they extend the signed URL.
+	signed := UploadResponse{Filename: "a.txt", URL: "http://h/uploaded/a.txt", SignedURL: "http://h/uploaded/a.txt?expires=1&signature=s"}
+	set(t, &requireSigned, true)
+	signed.setDispositionURLs()
+	if signed.PreviewURL != signed.SignedURL+"&inline=1" || signed.DownloadURL != signed.SignedURL+"&download=1" {
+		t.Errorf("signed previewUrl %s, downloadUrl %s", signed.PreviewURL, signed.DownloadURL)
+	}
+}
+
+// TestInlineOnlySafeTypes checks ?inline=1 doesn't show files that could run
+// script on this origin, even where -blocked-ext lets them be uploaded, and
+// that downloads are always sandboxed.
+func TestInlineOnlySafeTypes(t *testing.T) {
+	setup(t)
+	set(t, &disallowedExtensions, map[string]bool{})
+	tests := []struct {
+		filename string
+		content  string
+		inline   bool
+	}{
+		{"a.htm", "<script>alert(1)</script>", false},
+		{"a.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><script>alert(1)</script></html>`, false},
+		{"a.svg", `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`, false},
+		{"a.xml", "<a/>", false},
+		{"a.txt", "hello", true},
+		{"a.png", testPNG(t, 2, 2), true},
+	}
+	for _, tt := range tests {
+		up := uploaded(t, "/upload", tt.filename, tt.content)
+		if (up.PreviewURL != "") != tt.inline {
+			t.Errorf("%s: previewUrl %q", tt.filename, up.PreviewURL)
+		}
+		w := get(up.Filename + "?inline=1")
+		if got := strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline;"); got != tt.inline {
+			t.Errorf("%s: Content-Disposition = %s", tt.filename, w.Header().Get("Content-Disposition"))
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("%s: X-Content-Type-Options %q, Content-Security-Policy %q", tt.filename,
+				w.Header().Get("X-Content-Type-Options"), w.Header().Get("Content-Security-Policy"))
+		}
+	}
+}
+
+// mainCommand runs the test binary as the server started with args.
+func mainCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FILEHOST_MAIN_ARGS="+strings.Join(args, " "))
+	return cmd
+}
+
+// TestMain keeps log output out of test results unless run with -v, and
+// runs the server itself for mainCommand.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("FILEHOST_MAIN_ARGS"); ok {
+		os.Args = append([]string{"filehost"}, strings.Fields(args)...)
+		main()
+		return
+	}
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.DiscardHandler))
+	}
+	os.Exit(m.Run())
+}
+
+func TestSlugUploads(t *testing.T) {
+	tests := []struct {
+		name   string
+		slugs  []string
+		status []int
+		want   string
+	}{
+		{"custom slug", []string{"my-report"}, []int{200}, "my-report_a.txt"},
+		{"slug taken", []string{"mine", "mine"}, []int{200, 409}, "mine_a.txt"},
+		{"slug with underscore", []string{"my_report"}, []int{400}, ""},
+		{"slug with slash", []string{"a/b"}, []int{400}, ""},
+		{"reserved slug", []string{strings.TrimSuffix(thumbPrefix, "_")}, []int{400}, ""},
+		{"overlong slug", []string{strings.Repeat("a", maxSlugLength+1)}, []int{400}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			for i, slug := range tt.slugs {
+				w := upload(t, "/upload?slug="+url.QueryEscape(slug), file("a.txt", "content"))
+				if w.Code != tt.status[i] {
+					t.Fatalf("upload %d: status %d, want %d: %s", i, w.Code, tt.status[i], w.Body)
+				}
+			}
+			if got := strings.Join(stored(t), ","); got != tt.want {
+				t.Errorf("stored %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlugSingleFile(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload?slug=pair", file("a.txt", "one"), file("b.txt", "two"))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("status %d, want 207: %s", w.Code, w.Body)
+	}
+	if got := stored(t); !slices.Equal(got, []string{"pair_a.txt"}) {
+		t.Errorf("stored %v, want only the first file", got)
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		rng     string
+		ifRange string
+		status  int
+		body    string
+	}{
+		{"prefix", "bytes=0-4", "", http.StatusPartialContent, "hello"},
+		{"from offset", "bytes=6-", "", http.StatusPartialContent, "world"},
+		{"suffix", "bytes=-3", "", http.StatusPartialContent, "rld"},
+		{"unsatisfiable", "bytes=50-60", "", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"matching If-Range", "bytes=0-4", "etag", http.StatusPartialContent, "hello"},
+		{"stale If-Range", "bytes=0-4", `"stale"`, http.StatusOK, "hello world"},
+	}
+	for _, backend := range storageBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				setup(t)
+				set(t, &store, backend.new(t))
+				up := uploaded(t, "/upload", "a.txt", "hello world")
+				r := httptest.NewRequest(http.MethodGet, downloadPath+up.Filename, nil)
+				r.Header.Set("Range", tt.rng)
+				if tt.ifRange == "etag" {
+					tt.ifRange = `"` + up.Sha256 + `"`
+				}
+				if tt.ifRange != "" {
+					r.Header.Set("If-Range", tt.ifRange)
+				}
+				w := download(r)
+				if w.Code != tt.status {
+					t.Fatalf("status %d, want %d", w.Code, tt.status)
+				}
+				if tt.body != "" && w.Body.String() != tt.body {
+					t.Errorf("body %q, want %q", w.Body, tt.body)
+				}
+				if w.Code != http.StatusRequestedRangeNotSatisfiable && w.Header().Get("Accept-Ranges") != "bytes" {
+					t.Errorf("Accept-Ranges = %q", w.Header().Get("Accept-Ranges"))
+				}
+			})
+		}
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			setup(t)
+			set(t, &store, backend.new(t))
+			// Registered after the store swap, so the PNG's thumbnail is
+			// written before the store it reads from is put back.
+			t.Cleanup(thumbnailJobs.Wait)
+			content := testPNG(t, 8, 8)
+			up := uploaded(t, "/upload", "a.png", content)
+			getResp := get(up.Filename)
+			w := download(httptest.NewRequest(http.MethodHead, downloadPath+up.Filename, nil))
+			if w.Code != http.StatusOK || w.Body.Len() != 0 {
+				t.Fatalf("status %d, %d byte body", w.Code, w.Body.Len())
+			}
+			want := map[string]string{
+				"Content-Length": strconv.Itoa(len(content)),
+				"Content-Type":   "image/png",
+				"ETag":           `"` + up.Sha256 + `"`,
+				"Last-Modified":  getResp.Header().Get("Last-Modified"),
+			}
+			for h, v := range want {
+				if got := w.Header().Get(h); got != v || got == "" {
+					t.Errorf("%s = %q, want %q", h, got, v)
+				}
+			}
+			// The server drops the body of the error, which the recorder keeps.
+			if w := download(httptest.NewRequest(http.MethodHead, downloadPath+"missing.png", nil)); w.Code != http.StatusNotFound {
+				t.Errorf("missing file: status %d", w.Code)
+			}
+		})
+	}
+}
+
+// TestHeadOneTime checks checking on a one-time file doesn't use it up.
+func TestHeadOneTime(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload?onetime=1", "a.txt", "once")
+	for range 2 {
+		if w := download(httptest.NewRequest(http.MethodHead, downloadPath+up.Filename, nil)); w.Code != http.StatusOK || w.Header().Get("Content-Length") != "4" {
+			t.Fatalf("HEAD: status %d, Content-Length %q", w.Code, w.Header().Get("Content-Length"))
+		}
+	}
+	if w := get(up.Filename); w.Body.String() != "once" {
+		t.Fatalf("GET after HEADs: status %d", w.Code)
+	}
+	if w := download(httptest.NewRequest(http.MethodHead, downloadPath+up.Filename, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD after the download: status %d", w.Code)
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{"matching", "etag", http.StatusNotModified},
+		{"weak match", "W/etag", http.StatusNotModified},
+		{"one of several", `"other", etag`, http.StatusNotModified},
+		{"any", "*", http.StatusNotModified},
+		{"stale", `"` + sha256Hex("earlier content") + `"`, http.StatusOK},
+	}
+	for _, backend := range storageBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				setup(t)
+				set(t, &store, backend.new(t))
+				up := uploaded(t, "/upload", "a.txt", "hello world")
+				etag := `"` + up.Sha256 + `"`
+				if got := get(up.Filename).Header().Get("ETag"); got != etag {
+					t.Fatalf("ETag = %q, want %q", got, etag)
+				}
+				r := httptest.NewRequest(http.MethodGet, downloadPath+up.Filename, nil)
+				r.Header.Set("If-None-Match", strings.ReplaceAll(tt.ifNoneMatch, "etag", etag))
+				w := download(r)
+				if w.Code != tt.status {
+					t.Fatalf("status %d, want %d", w.Code, tt.status)
+				}
+				if want := map[int]string{http.StatusOK: "hello world"}[w.Code]; w.Body.String() != want {
+					t.Errorf("body %q, want %q", w.Body, want)
+				}
+			})
+		}
+	}
+}
+
+// TestIfNoneMatchAfterReplace checks a cached copy is revalidated as stale
+// once the file's content is replaced.
+func TestIfNoneMatchAfterReplace(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload", "a.txt", "first")
+	etag := get(up.Filename).Header().Get("ETag")
+	if w := replaceRequest(up.Filename, "second"); w.Code != http.StatusOK {
+		t.Fatalf("replace: status %d: %s", w.Code, w.Body)
+	}
+	r := httptest.NewRequest(http.MethodGet, downloadPath+up.Filename, nil)
+	r.Header.Set("If-None-Match", etag)
+	w := download(r)
+	if w.Code != http.StatusOK || w.Body.String() != "second" {
+		t.Errorf("status %d, body %q; want 200 and the new content", w.Code, w.Body)
+	}
+	if got := w.Header().Get("ETag"); got != `"`+sha256Hex("second")+`"` {
+		t.Errorf("ETag = %q", got)
+	}
+}
+
+// TestUploadDir checks that uploads land in -upload-dir and are served from
+// the URL returned under -url-prefix.
+func TestUploadDir(t *testing.T) {
+	setup(t)
+	dir := filepath.Join(t.TempDir(), "nested", "uploads")
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &uploadDir, dir)
+	set(t, &store, Storage(localStorage{dir: dir}))
+	set(t, &urlPrefix, "/files")
+
+	up := uploaded(t, "/upload", "a.txt", "in the upload dir")
+	if want := "http://localhost/files" + downloadPath + up.Filename; up.URL != want {
+		t.Errorf("URL = %q, want %q", up.URL, want)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, up.Filename))
+	if err != nil || string(data) != "in the upload dir" {
+		t.Errorf("stored file = %q, %v", data, err)
+	}
+	// The proxy in front strips the prefix.
+	if w := get(up.Filename); w.Code != http.StatusOK || w.Body.String() != "in the upload dir" {
+		t.Errorf("download: status %d, body %q", w.Code, w.Body)
+	}
+}
+
+func TestCreateUploadDirs(t *testing.T) {
+	set(t, &dirMode, 0770)
+	root := t.TempDir()
+	existing := filepath.Join(root, "existing")
+	if err := os.Mkdir(existing, 0700); err != nil {
+		t.Fatal(err)
+	}
+	created := filepath.Join(root, "a", "b")
+	if err := createUploadDirs([]string{existing, created}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(created); err != nil || fi.Mode().Perm() != 0770 {
+		t.Errorf("created %v, %v; want mode 0770 whatever the umask", fi.Mode(), err)
+	}
+	// A directory the admin made is left as it is.
+	if fi, _ := os.Stat(existing); fi.Mode().Perm() != 0700 {
+		t.Errorf("existing directory changed to %v", fi.Mode())
+	}
+}
+
+// TestUploadDirRemoved checks the upload handler doesn't create the upload
+// directory itself: uploads fail once it's gone, rather than quietly
+// starting a new one.
+func TestUploadDirRemoved(t *testing.T) {
+	setup(t)
+	if err := os.RemoveAll(uploadDir); err != nil {
+		t.Fatal(err)
+	}
+	if w := upload(t, "/upload", file("a.txt", "hello")); w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(uploadDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("upload directory recreated: %v", err)
+	}
+}
+
+// TestNestedDirMode checks directories made for files in subdirectories
+// get -dir-mode.
+func TestNestedDirMode(t *testing.T) {
+	setup(t)
+	set(t, &dirMode, 0750)
+	up := uploaded(t, "/upload?preservePaths=1", "docs/notes.txt", "hello")
+	dir := filepath.Join(uploadDir, filepath.FromSlash(path.Dir(up.Filename)))
+	if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("%s: %v, %v; want 0750", dir, fi.Mode(), err)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0600, 0640, 0664} {
+		for _, tt := range []struct {
+			name   string
+			dedupe bool
+		}{{"upload", false}, {"deduplicated upload", true}} {
+			t.Run(fmt.Sprintf("%s %o", tt.name, mode), func(t *testing.T) {
+				setup(t)
+				set(t, &fileMode, mode)
+				set(t, &dedupe, tt.dedupe)
+				up := uploaded(t, "/upload", "a.txt", "hello")
+				check := func(what string) {
+					fi, err := os.Stat(filepath.Join(uploadDir, up.Filename))
+					if err != nil || fi.Mode().Perm() != mode {
+						t.Errorf("%s: mode %v, %v; want %o", what, fi.Mode(), err, mode)
+					}
+				}
+				check("stored")
+				if w := replaceRequest(up.Filename, "replaced"); w.Code != http.StatusOK && !tt.dedupe {
+					t.Fatalf("replace: status %d: %s", w.Code, w.Body)
+				}
+				check("replaced")
+			})
+		}
+	}
+}
+
+func TestOctalMode(t *testing.T) {
+	tests := []struct {
+		value string
+		want  os.FileMode
+		ok    bool
+	}{
+		{"0750", 0750, true},
+		{"640", 0640, true},
+		{"0", 0, true},
+		{"0777", 0777, true},
+		{"01777", 0, false},
+		{"0789", 0, false},
+		{"rwxr-x---", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		var mode os.FileMode
+		err := octalMode(&mode)(tt.value)
+		if (err == nil) != tt.ok || mode != tt.want {
+			t.Errorf("octalMode(%q) = %o, %v; want %o, ok %v", tt.value, mode, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestReturnedURLServes GETs the exact URL an upload returns, through the
+// routes main registers for downloads.
+func TestReturnedURLServes(t *testing.T) {
+	for _, prefix := range []string{"", "/files"} {
+		t.Run("prefix "+prefix, func(t *testing.T) {
+			setup(t)
+			set(t, &urlPrefix, prefix)
+			mux := http.NewServeMux()
+			download := http.HandlerFunc(serveUploaded)
+			mux.Handle("GET "+downloadPath, http.StripPrefix(downloadPath, download))
+			if prefix != "" {
+				mux.Handle("GET "+prefix+downloadPath, http.StripPrefix(prefix+downloadPath, download))
+			}
+
+			up := uploaded(t, "/upload", "report 1.txt", "served")
+			u, err := url.Parse(up.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := serve(mux, httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+			if w.Code != http.StatusOK || w.Body.String() != "served" {
+				t.Errorf("GET %s: status %d, body %q", up.URL, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestRequirePost(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+		called bool
+	}{
+		{http.MethodPost, http.StatusOK, true},
+		{http.MethodGet, http.StatusMethodNotAllowed, false},
+		{http.MethodPut, http.StatusMethodNotAllowed, false},
+		{http.MethodDelete, http.StatusMethodNotAllowed, false},
+		{http.MethodOptions, http.StatusNoContent, false},
+	}
+	for _, tt := range tests {
+		called := false
+		h := requirePost(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+		w := serve(h, httptest.NewRequest(tt.method, "/upload", nil))
+		if w.Code != tt.status || called != tt.called {
+			t.Errorf("%s: status %d, handler called %v; want %d, %v", tt.method, w.Code, called, tt.status, tt.called)
+		}
+		if !called && w.Header().Get("Allow") != "POST, OPTIONS" {
+			t.Errorf("%s: Allow = %q", tt.method, w.Header().Get("Allow"))
+		}
+		if w.Code == http.StatusMethodNotAllowed && !strings.Contains(w.Body.String(), `"error"`) {
+			t.Errorf("%s: body %q is not a JSON error", tt.method, w.Body)
+		}
+	}
+}
+
+// TestNoFilesUploaded pins the error for a form without any file in it.
+// Files under other field names than "file" are stored, so there are no
+// misnamed fields left to point out.
+func TestNoFilesUploaded(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []formPart
+	}{
+		{"empty form", nil},
+		{"only form values", []formPart{{field: "file", content: "not a file"}, {field: "description", content: "caption"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			w := upload(t, "/upload", tt.parts...)
+			var resp ErrorResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if w.Code != http.StatusBadRequest || resp.Error != "No files uploaded" {
+				t.Errorf("status %d, error %q; want 400 No files uploaded", w.Code, resp.Error)
+			}
+		})
+	}
+	t.Run("file under another field", func(t *testing.T) {
+		setup(t)
+		w := upload(t, "/upload", formPart{field: "attachment", filename: "a.txt", content: "hello"})
+		if w.Code != http.StatusOK {
+			t.Errorf("status %d: %s", w.Code, w.Body)
+		}
+	})
+}
+
+// TestNotMultipart checks a body that isn't a multipart form, like JSON
+// posted by mistake, gets an error saying what to send instead.
+func TestNotMultipart(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"JSON", "application/json", `{"file":"aGVsbG8="}`, "got Content-Type application/json"},
+		{"raw body", "", "hello", "got no Content-Type"},
+		{"no boundary", "multipart/form-data", "hello", "got Content-Type multipart/form-data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := serve(http.HandlerFunc(uploadFile), r)
+			var resp ErrorResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if w.Code != http.StatusBadRequest || !strings.HasPrefix(resp.Error, "Uploads must be sent as multipart/form-data") ||
+				!strings.HasSuffix(resp.Error, tt.want) {
+				t.Errorf("status %d, error %q", w.Code, resp.Error)
+			}
+			if names := stored(t); len(names) != 0 {
+				t.Errorf("stored %v", names)
+			}
+		})
+	}
+}
+
+// TestAnyFieldName checks files are stored whatever field each was sent
+// under, several in one request.
+func TestAnyFieldName(t *testing.T) {
+	setup(t)
+	parts := []formPart{
+		{field: "file", filename: "a.txt", content: "a"},
+		{field: "attachment", filename: "b.txt", content: "bb"},
+		{field: "files[]", filename: "c.txt", content: "ccc"},
+		{field: "image", filename: "d.txt", content: "dddd"},
+	}
+	w := upload(t, "/upload", parts...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	ups := decodeUploads(t, w)
+	if len(ups) != len(parts) {
+		t.Fatalf("%d files in the response, want %d", len(ups), len(parts))
+	}
+	for i, up := range ups {
+		if up.OriginalName != parts[i].filename || get(up.Filename).Body.String() != parts[i].content {
+			t.Errorf("%s field: stored %+v", parts[i].field, up)
+		}
+	}
+	if names := stored(t); len(names) != len(parts) {
+		t.Errorf("stored %v", names)
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		files  int
+		status int
+	}{
+		{"under the limit", 3, 2, http.StatusOK},
+		{"at the limit", 3, 3, http.StatusOK},
+		{"over the limit", 3, 4, http.StatusBadRequest},
+		{"unlimited", 0, 20, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &maxFiles, tt.max)
+			var parts []formPart
+			for i := range tt.files {
+				parts = append(parts, file(fmt.Sprintf("f%d.txt", i), fmt.Sprintf("content %d", i)))
+			}
+			w := upload(t, "/upload", parts...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			want := tt.files
+			if tt.status != http.StatusOK {
+				// The files read before the one too many are removed again.
+				want = 0
+				if !strings.Contains(w.Body.String(), "at most 3") {
+					t.Errorf("error %s", w.Body)
+				}
+			}
+			if names := stored(t); len(names) != want {
+				t.Errorf("stored %v, want %d files", names, want)
+			}
+			if n := len(metadata.files); n != want {
+				t.Errorf("metadata for %d files, want %d", n, want)
+			}
+		})
+	}
+}
+
+// TestSameNameInOneUpload checks files sharing a name in one request are
+// stored apart and can be told apart in the response.
+func TestSameNameInOneUpload(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload", file("photo.txt", "first"), file("photo.txt", "second"), file("photo.txt", "third"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	ups := decodeUploads(t, w)
+	seen := make(map[string]bool)
+	for i, want := range []string{"first", "second", "third"} {
+		up := ups[i]
+		if seen[up.URL] {
+			t.Errorf("URL %s returned twice", up.URL)
+		}
+		seen[up.URL] = true
+		if up.OriginalName != "photo.txt" {
+			t.Errorf("file %d: originalName %q", i, up.OriginalName)
+		}
+		if got := get(up.Filename).Body.String(); got != want {
+			t.Errorf("file %d at %s: %q, want %q", i, up.URL, got, want)
+		}
+	}
+}
+
+func TestUploadSizeAndTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"small", "hello"},
+		{"large", strings.Repeat("x", 3<<20+7)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			before := time.Now()
+			// The size comes from the bytes stored, not what the part claims.
+			part := file("a.txt", tt.content)
+			part.header = textproto.MIMEHeader{"Content-Length": {"1"}}
+			w := upload(t, "/upload", part)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			up := decodeUploads(t, w)[0]
+			if up.Size != int64(len(tt.content)) {
+				t.Errorf("size = %d, want %d", up.Size, len(tt.content))
+			}
+			if up.UploadedAt.Before(before.Add(-time.Second)) || up.UploadedAt.After(time.Now()) {
+				t.Errorf("uploadedAt = %v, want about %v", up.UploadedAt, before)
+			}
+
+			var raw []map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := time.Parse(time.RFC3339, raw[0]["uploadedAt"].(string)); err != nil {
+				t.Errorf("uploadedAt is not RFC 3339: %v", err)
+			}
+		})
+	}
+}
+
+// fdCountingStorage records how many descriptors the process has open
+// whenever a file is stored.
+type fdCountingStorage struct {
+	Storage
+	t   *testing.T
+	max int
+}
+
+func (s *fdCountingStorage) Put(name string, r io.Reader) error {
+	s.max = max(s.max, openFDs(s.t))
+	return s.Storage.Put(name, r)
+}
+
+// openFDs returns the number of descriptors the process has open.
+func openFDs(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("can't count open descriptors:", err)
+	}
+	return len(fds)
+}
+
+// TestManyFilesClosed checks that each file of a batch is closed before the
+// next is read, so descriptors don't pile up until the request ends.
+func TestManyFilesClosed(t *testing.T) {
+	setup(t)
+	before := openFDs(t)
+	counting := &fdCountingStorage{Storage: store, t: t}
+	set(t, &store, Storage(counting))
+	set(t, &maxFiles, 0)
+	const n = 200
+	var parts []formPart
+	for i := range n {
+		parts = append(parts, file("f.txt", strings.Repeat("x", i+1)))
+	}
+	w := upload(t, "/upload", parts...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := len(decodeUploads(t, w)); got != n {
+		t.Errorf("%d files in the response, want %d", got, n)
+	}
+	if counting.max > before+10 {
+		t.Errorf("%d descriptors open while storing, %d before the upload", counting.max, before)
+	}
+	if after := openFDs(t); after > before+2 {
+		t.Errorf("%d descriptors open after the upload, %d before", after, before)
+	}
+}
+
+// TestUploadStreams uploads a file larger than anything the handler may
+// buffer and checks it was streamed: allocations stay far below its size.
+func TestUploadStreams(t *testing.T) {
+	setup(t)
+	const size = 64 << 20
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", "big.bin")
+		if err == nil {
+			chunk := bytes.Repeat([]byte{0xAB}, 64<<10)
+			for written := 0; written < size && err == nil; written += len(chunk) {
+				_, err = part.Write(chunk)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	r := httptest.NewRequest(http.MethodPost, "/upload", pr)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	w := serve(http.HandlerFunc(uploadFile), r)
+	runtime.ReadMemStats(&after)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if up := decodeUploads(t, w)[0]; up.Size != size {
+		t.Errorf("size = %d, want %d", up.Size, size)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Errorf("allocated %d bytes uploading %d", allocated, size)
+	}
+}
+
+// batchEntry is one entry of an upload response: a stored file, or a
+// failure with Error set.
+type batchEntry struct {
+	UploadResponse
+	Error string `json:"error"`
+}
+
+// decodeBatch reads an upload response that may hold failures.
+func decodeBatch(t *testing.T, w *httptest.ResponseRecorder) []batchEntry {
+	t.Helper()
+	var entries []batchEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+	return entries
+}
+
+func TestEmptyFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		parts  []formPart
+		status int
+		errors []string
+		stored int
+	}{
+		{"single empty file", []formPart{file("empty.txt", "")}, http.StatusBadRequest, nil, 0},
+		{
+			"mixed batch",
+			[]formPart{file("a.txt", "a"), file("empty.txt", ""), file("b.txt", "b")},
+			http.StatusMultiStatus, []string{"", "Empty file", ""}, 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			w := upload(t, "/upload", tt.parts...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.errors == nil && !strings.Contains(w.Body.String(), "Empty file") {
+				t.Errorf("body %q doesn't say the file was empty", w.Body)
+			} else if tt.errors != nil {
+				for i, entry := range decodeBatch(t, w) {
+					if entry.Error != tt.errors[i] || (entry.Error == "") == (entry.URL == "") {
+						t.Errorf("entry %d = %+v, want error %q", i, entry, tt.errors[i])
+					}
+				}
+			}
+			if got := len(stored(t)); got != tt.stored {
+				t.Errorf("stored %d files, want %d", got, tt.stored)
+			}
+			// Empty files never reach the upload directory.
+			entries, _ := os.ReadDir(uploadDir)
+			for _, e := range entries {
+				if fi, err := e.Info(); err == nil && fi.Size() == 0 {
+					t.Errorf("empty file %s left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		parts  []formPart
+		status int
+		errors []string
+	}{
+		{
+			"one disallowed of three",
+			[]formPart{file("a.txt", "a"), file("evil.exe", "MZ"), file("b.txt", "b")},
+			http.StatusMultiStatus, []string{"", "Disallowed file extension", ""},
+		},
+		{
+			"all stored",
+			[]formPart{file("a.txt", "a"), file("b.txt", "b")},
+			http.StatusOK, []string{"", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			w := upload(t, "/upload", tt.parts...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			entries := decodeBatch(t, w)
+			if len(entries) != len(tt.parts) {
+				t.Fatalf("%d entries, want one per file: %s", len(entries), w.Body)
+			}
+			for i, entry := range entries {
+				if entry.Error != tt.errors[i] {
+					t.Errorf("entry %d error = %q, want %q", i, entry.Error, tt.errors[i])
+				}
+				// Failures are named by the file sent, so clients can match them up.
+				if entry.Error != "" && entry.Filename != tt.parts[i].filename {
+					t.Errorf("entry %d filename = %q, want %q", i, entry.Filename, tt.parts[i].filename)
+				}
+				if entry.Error == "" {
+					if w := get(entry.Filename); w.Code != http.StatusOK || w.Body.String() != tt.parts[i].content {
+						t.Errorf("entry %d: download status %d, body %q", i, w.Code, w.Body)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestAllFilesFailed checks that a batch where nothing was stored gets the
+// first failure as a plain error.
+func TestAllFilesFailed(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload", file("evil.exe", "MZ"), file("empty.txt", ""))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] != "Disallowed file extension" {
+		t.Errorf("body = %s, want the first failure", w.Body)
+	}
+}
+
+// startServer serves h with the given timeouts on a loopback port and
+// returns its address.
+func startServer(t *testing.T, h http.Handler, readHeader, read time.Duration) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: readHeader, ReadTimeout: read, WriteTimeout: read}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+func TestSlowHeadersDisconnected(t *testing.T) {
+	addr := startServer(t, http.NotFoundHandler(), 100*time.Millisecond, time.Minute)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Start a request and never finish its headers.
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connection held open for %v with ReadHeaderTimeout 100ms", elapsed)
+	}
+}
+
+// TestTransferDeadlines checks that uploads and downloads outlast the
+// server's read timeout, which still cuts off other slow requests.
+func TestTransferDeadlines(t *testing.T) {
+	set(t, &transferTimeout, time.Minute)
+	readBody := func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, n)
+	}
+	tests := []struct {
+		name    string
+		handler http.Handler
+		wantOK  bool
+	}{
+		{"ordinary request", http.HandlerFunc(readBody), false},
+		{"long transfer", longTransfer(http.HandlerFunc(readBody)), true},
+		{"upload", trackUploads(readBody), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startServer(t, tt.handler, time.Second, 200*time.Millisecond)
+			pr, pw := io.Pipe()
+			go func() {
+				for range 3 {
+					pw.Write([]byte("chunk"))
+					time.Sleep(150 * time.Millisecond)
+				}
+				pw.Close()
+			}()
+			resp, err := http.Post("http://"+addr+"/", "text/plain", pr)
+			ok := err == nil && resp.StatusCode == http.StatusOK
+			if err == nil {
+				resp.Body.Close()
+			}
+			if ok != tt.wantOK {
+				t.Errorf("slow body finished = %v, want %v (err %v)", ok, tt.wantOK, err)
+			}
+		})
+	}
+}
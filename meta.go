@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// metaFilename is the index of per-file metadata kept inside uploadDir. It
+// starts with a dot so it is never served or treated as an upload.
+const metaFilename = ".filehost-meta.json"
+
+// fileMeta holds what we know about a stored file beyond its bytes on disk.
+type fileMeta struct {
+	OriginalName string    `json:"originalName,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt,omitzero"`
+	// Owner is the ID of the API key the file was uploaded with.
+	Owner string `json:"owner,omitempty"`
+	// OneTime files are deleted after their first download.
+	OneTime bool `json:"oneTime,omitempty"`
+	// PasswordHash, when set, is required to download the file. See
+	// hashPassword.
+	PasswordHash string `json:"passwordHash,omitempty"`
+	// Encrypted records that the file was stored with -encryption-key.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Sha256 is the hex SHA-256 of the content, when it was computed on
+	// upload.
+	Sha256      string    `json:"sha256,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	UploadedAt  time.Time `json:"uploadedAt,omitzero"`
+	// Description is a caption given with the upload.
+	Description string `json:"description,omitempty"`
+}
+
+func (m fileMeta) expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// metaStore is a small JSON-backed map from stored filename to fileMeta. Every
+// change is written through to disk so it survives restarts.
+type metaStore struct {
+	mu    sync.Mutex
+	path  string
+	files map[string]fileMeta
+}
+
+var metadata *metaStore
+
+func loadMetaStore(path string) (*metaStore, error) {
+	s := &metaStore{path: path, files: make(map[string]fileMeta)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *metaStore) get(name string) (fileMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.files[name]
+	return m, ok
+}
+
+func (s *metaStore) set(name string, m fileMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = m
+	return s.save()
+}
+
+func (s *metaStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return nil
+	}
+	delete(s.files, name)
+	return s.save()
+}
+
+// rename moves the metadata of oldName, if it has any, to newName.
+func (s *metaStore) rename(oldName, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.files[oldName]
+	if !ok {
+		return nil
+	}
+	delete(s.files, oldName)
+	s.files[newName] = m
+	return s.save()
+}
+
+// merge adds files to the index, replacing what it held for the same names.
+func (s *metaStore) merge(files map[string]fileMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, m := range files {
+		s.files[name] = m
+	}
+	return s.save()
+}
+
+// expired returns the names of all files whose expiry is at or before now.
+func (s *metaStore) expired(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name, m := range s.files {
+		if m.expired(now) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// findSha256 returns a stored file other than except whose content has the
+// hex SHA-256 sum. Expired, one-time and password-protected files don't
+// count.
+func (s *metaStore) findSha256(sum, except string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for name, m := range s.files {
+		if m.Sha256 == sum && name != except && !m.expired(now) && !m.OneTime && m.PasswordHash == "" {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// findAnySha256 returns any stored file other than except that hasn't
+// expired whose content has the hex SHA-256 sum.
+func (s *metaStore) findAnySha256(sum, except string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for name, m := range s.files {
+		if m.Sha256 == sum && name != except && !m.expired(now) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// save writes the index to a temp file and renames it into place so a crash
+// mid-write never leaves a truncated index. The caller must hold s.mu.
+func (s *metaStore) save() error {
+	data, err := json.Marshal(s.files)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces the file at path with data via a temp file in the
+// same directory.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
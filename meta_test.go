@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestOriginalNameRoundTrip checks an original name with underscores comes
+// back whole from the metadata, also after a restart, including when the
+// stored name doesn't contain it at all.
+func TestOriginalNameRoundTrip(t *testing.T) {
+	const original = "my_report_v2_final.txt"
+	for _, dedupeOn := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dedupe=%v", dedupeOn), func(t *testing.T) {
+			setup(t)
+			set(t, &dedupe, dedupeOn)
+			up := uploaded(t, "/upload", original, "numbers")
+			if up.OriginalName != original {
+				t.Errorf("response original name %q", up.OriginalName)
+			}
+
+			// A restart reloads the metadata from disk.
+			reloaded, err := loadMetaStore(filepath.Join(uploadDir, metaFilename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			set(t, &metadata, reloaded)
+			m, ok := metadata.get(up.Filename)
+			if !ok || m.OriginalName != original || m.ContentType != "text/plain; charset=utf-8" || m.Size != 7 || time.Since(m.UploadedAt) > time.Minute {
+				t.Errorf("metadata after reload %+v", m)
+			}
+
+			want := `attachment; filename="` + original + `"`
+			if got := get(up.Filename).Header().Get("Content-Disposition"); got != want {
+				t.Errorf("Content-Disposition = %s, want %s", got, want)
+			}
+			w := serve(http.HandlerFunc(listFiles), httptest.NewRequest(http.MethodGet, "/api/files", nil))
+			var listed []FileListing
+			if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+				t.Fatal(err)
+			}
+			if len(listed) != 1 || listed[0].OriginalName != original {
+				t.Errorf("listed %+v", listed)
+			}
+		})
+	}
+}
+
+// TestMetaStoreConcurrentWrites checks no change is lost when many are
+// written at once.
+func TestMetaStoreConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), metaFilename)
+	s, err := loadMetaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const files = 50
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Go(func() {
+			name := fmt.Sprintf("f%d_a_b.txt", i)
+			if err := s.set(name, fileMeta{OriginalName: fmt.Sprintf("a_b_%d.txt", i)}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	reloaded, err := loadMetaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range files {
+		m, ok := reloaded.get(fmt.Sprintf("f%d_a_b.txt", i))
+		if want := fmt.Sprintf("a_b_%d.txt", i); !ok || m.OriginalName != want {
+			t.Errorf("f%d_a_b.txt: original name %q, want %q", i, m.OriginalName, want)
+		}
+	}
+}
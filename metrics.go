@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics below are registered with the default Prometheus registry and
+// exposed on /metrics by promhttp, along with the Go runtime's.
+var (
+	uploadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "filehost_uploads_total",
+		Help: "Files stored successfully.",
+	})
+	uploadBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "filehost_upload_bytes_total",
+		Help: "Bytes stored by successful uploads.",
+	})
+	uploadErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filehost_upload_errors_total",
+		Help: "Uploads rejected or failed, by reason.",
+	}, []string{"reason"})
+	errorResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filehost_error_responses_total",
+		Help: "JSON error responses sent, by HTTP status code.",
+	}, []string{"code"})
+	uploadSizeBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "filehost_upload_size_bytes",
+		Help:    "Size of stored files.",
+		Buckets: []float64{1 << 10, 64 << 10, 1 << 20, 16 << 20, 128 << 20, 1 << 30},
+	})
+	storageBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "filehost_storage_bytes",
+		Help: "Total size of stored files, refreshed periodically.",
+	})
+	storageFiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "filehost_storage_files",
+		Help: "Number of stored files, refreshed periodically.",
+	})
+)
+
+// recordUpload updates the metrics for a successfully stored file.
+func recordUpload(size int64) {
+	uploadsTotal.Inc()
+	uploadBytesTotal.Add(float64(size))
+	uploadSizeBytes.Observe(float64(size))
+}
+
+// updateStorageMetrics recomputes the storage gauges every interval, since
+// summing the whole store on each scrape could be slow.
+func updateStorageMetrics(interval time.Duration) {
+	for {
+		files, err := store.List()
+		if err != nil {
+			slog.Error("Error computing storage metrics", "err", err)
+		} else {
+			var total int64
+			for _, f := range files {
+				total += f.Size
+			}
+			storageBytes.Set(float64(total))
+			storageFiles.Set(float64(len(files)))
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metric returns the value of the sample named series on /metrics, or 0
+// when there is none.
+func metric(t *testing.T, series string) float64 {
+	t.Helper()
+	w := serve(promhttp.Handler(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestUploadSizeHistogram(t *testing.T) {
+	setup(t)
+	small, large := metric(t, `filehost_upload_size_bytes_bucket{le="1024"}`), metric(t, `filehost_upload_size_bytes_bucket{le="65536"}`)
+	count := metric(t, "filehost_upload_size_bytes_count")
+	uploaded(t, "/upload", "a.txt", strings.Repeat("x", 2000))
+	if got := metric(t, `filehost_upload_size_bytes_bucket{le="1024"}`) - small; got != 0 {
+		t.Errorf("le=1024 bucket went up by %v, want 0", got)
+	}
+	if got := metric(t, `filehost_upload_size_bytes_bucket{le="65536"}`) - large; got != 1 {
+		t.Errorf("le=65536 bucket went up by %v, want 1", got)
+	}
+	if got := metric(t, "filehost_upload_size_bytes_count") - count; got != 1 {
+		t.Errorf("count went up by %v, want 1", got)
+	}
+}
+
+func TestUploadMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		parts   []formPart
+		uploads float64
+		bytes   float64
+		reason  string
+	}{
+		{"stored", []formPart{file("a.txt", "12345")}, 1, 5, ""},
+		{"two stored", []formPart{file("a.txt", "12"), file("b.txt", "345")}, 2, 5, ""},
+		{"bad extension", []formPart{file("a.exe", "12345")}, 0, 0, "extension"},
+		{"empty", []formPart{file("a.txt", "")}, 0, 0, "empty"},
+		{"no files", nil, 0, 0, "no_files"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			uploads, bytes := metric(t, "filehost_uploads_total"), metric(t, "filehost_upload_bytes_total")
+			errorSeries := `filehost_upload_errors_total{reason="` + tt.reason + `"}`
+			errors := metric(t, errorSeries)
+			upload(t, "/upload", tt.parts...)
+			if got := metric(t, "filehost_uploads_total") - uploads; got != tt.uploads {
+				t.Errorf("uploads went up by %v, want %v", got, tt.uploads)
+			}
+			if got := metric(t, "filehost_upload_bytes_total") - bytes; got != tt.bytes {
+				t.Errorf("upload bytes went up by %v, want %v", got, tt.bytes)
+			}
+			if tt.reason != "" && metric(t, errorSeries)-errors != 1 {
+				t.Errorf("%s not counted", errorSeries)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// uploadDirs, set with -upload-dirs, are the directories files are spread
+// over, such as separately mounted disks. The first is uploadDir, which
+// also keeps the metadata and temp files.
+var uploadDirs []string
+
+// placements are the -placement values: least-full puts each new file in
+// the directory with the most free space, and round-robin takes turns.
+var placements = []string{"least-full", "round-robin"}
+
+// parseUploadDirs reads a comma-separated -upload-dirs value.
+func parseUploadDirs(value string) error {
+	var dirs []string
+	for _, dir := range strings.Split(value, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return errors.New("no directories given")
+	}
+	uploadDirs = dirs
+	return nil
+}
+
+// multiDirStorage keeps each file in one of several local directories.
+// Which one isn't recorded: files are found by looking in each in turn, so
+// files moved between them by hand or imported into the first are still
+// served.
+type multiDirStorage struct {
+	dirs      []localStorage
+	leastFull bool
+	// freeSpace reads a directory's free space for least-full placement.
+	freeSpace func(dir string) (uint64, error)
+	next      atomic.Uint64
+	// mu makes checking that a name is free in every directory and creating
+	// it in one atomic, so two uploads can't take a name in different ones.
+	mu sync.Mutex
+}
+
+func newMultiDirStorage(dirs []string, placement string) (*multiDirStorage, error) {
+	s := &multiDirStorage{freeSpace: freeSpace}
+	switch placement {
+	case "least-full":
+		s.leastFull = true
+	case "round-robin":
+	default:
+		return nil, fmt.Errorf("unknown placement %q, expected %s", placement, strings.Join(placements, " or "))
+	}
+	for _, dir := range dirs {
+		s.dirs = append(s.dirs, localStorage{dir: dir})
+	}
+	return s, nil
+}
+
+// place picks the directory for a new file. Directories whose free space
+// can't be read are passed over, and if none can be placement falls back to
+// round-robin.
+func (s *multiDirStorage) place() localStorage {
+	if s.leastFull {
+		best, bestFree := -1, uint64(0)
+		for i, d := range s.dirs {
+			free, err := s.freeSpace(d.dir)
+			if err == nil && (best < 0 || free > bestFree) {
+				best, bestFree = i, free
+			}
+		}
+		if best >= 0 {
+			return s.dirs[best]
+		}
+	}
+	return s.dirs[(s.next.Add(1)-1)%uint64(len(s.dirs))]
+}
+
+// find returns the directory holding name.
+func (s *multiDirStorage) find(name string) (localStorage, error) {
+	for _, d := range s.dirs {
+		exists, err := d.Exists(name)
+		if err != nil {
+			return localStorage{}, err
+		}
+		if exists {
+			return d, nil
+		}
+	}
+	return localStorage{}, os.ErrNotExist
+}
+
+// taken reports whether name is in any directory. The caller must hold mu.
+func (s *multiDirStorage) taken(name string) error {
+	_, err := s.find(name)
+	if err == nil {
+		return os.ErrExist
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *multiDirStorage) Put(name string, r io.Reader) error {
+	s.mu.Lock()
+	if err := s.taken(name); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	f, err := s.place().create(name)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Once created the file claims name, so it can be filled unlocked.
+	return fill(f, r)
+}
+
+func (s *multiDirStorage) Get(name string) (StoredFile, error) {
+	d, err := s.find(name)
+	if err != nil {
+		return nil, err
+	}
+	return d.Get(name)
+}
+
+func (s *multiDirStorage) Delete(name string) error {
+	d, err := s.find(name)
+	if err != nil {
+		return err
+	}
+	return d.Delete(name)
+}
+
+func (s *multiDirStorage) Exists(name string) (bool, error) {
+	_, err := s.find(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *multiDirStorage) List() ([]FileInfo, error) {
+	var files []FileInfo
+	for _, d := range s.dirs {
+		list, err := d.List()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, list...)
+	}
+	return files, nil
+}
+
+// Rename keeps the file in the directory it is in.
+func (s *multiDirStorage) Rename(oldName, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.taken(newName); err != nil {
+		return err
+	}
+	d, err := s.find(oldName)
+	if err != nil {
+		return err
+	}
+	return d.Rename(oldName, newName)
+}
+
+func (s *multiDirStorage) Replace(name string, r io.Reader) error {
+	d, err := s.find(name)
+	if err != nil {
+		return err
+	}
+	return d.Replace(name, r)
+}
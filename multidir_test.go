@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// multiDirStore spreads uploads over uploadDir and a second temp dir,
+// returning the second.
+func multiDirStore(t *testing.T, placement string) (*multiDirStorage, string) {
+	t.Helper()
+	second := t.TempDir()
+	s, err := newMultiDirStorage([]string{uploadDir, second}, placement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, &store, Storage(s))
+	return s, second
+}
+
+// dirOf reports which of dirs holds name.
+func dirOf(t *testing.T, name string, dirs ...string) string {
+	t.Helper()
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return dir
+		}
+	}
+	t.Fatalf("%s is in none of %v", name, dirs)
+	return ""
+}
+
+func TestLeastFullPlacement(t *testing.T) {
+	setup(t)
+	s, second := multiDirStore(t, "least-full")
+	free := map[string]uint64{uploadDir: 1 << 30, second: 2 << 30}
+	s.freeSpace = func(dir string) (uint64, error) { return free[dir], nil }
+
+	a := uploaded(t, "/upload", "a.txt", "first")
+	if dir := dirOf(t, a.Filename, uploadDir, second); dir != second {
+		t.Errorf("stored in %s, want the emptier %s", dir, second)
+	}
+	free[uploadDir] = 3 << 30
+	b := uploaded(t, "/upload", "b.txt", "second")
+	if dir := dirOf(t, b.Filename, uploadDir, second); dir != uploadDir {
+		t.Errorf("stored in %s, want the emptier %s", dir, uploadDir)
+	}
+
+	for name, want := range map[string]string{a.Filename: "first", b.Filename: "second"} {
+		if w := get(name); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("download of %s: status %d, body %q", name, w.Code, w.Body)
+		}
+	}
+	if names := stored(t); len(names) != 2 {
+		t.Errorf("listed %v, want both files", names)
+	}
+}
+
+func TestRoundRobinPlacement(t *testing.T) {
+	setup(t)
+	_, second := multiDirStore(t, "round-robin")
+	counts := make(map[string]int)
+	for range 4 {
+		up := uploaded(t, "/upload", "a.txt", "hello")
+		counts[dirOf(t, up.Filename, uploadDir, second)]++
+	}
+	if counts[uploadDir] != 2 || counts[second] != 2 {
+		t.Errorf("files per directory %v, want two in each", counts)
+	}
+}
+
+// TestMultiDirFindsMovedFiles checks a file moved between directories by
+// hand is still served, and its name isn't given to another upload.
+func TestMultiDirFindsMovedFiles(t *testing.T) {
+	setup(t)
+	_, second := multiDirStore(t, "round-robin")
+	if err := os.WriteFile(filepath.Join(second, "moved.txt"), []byte("by hand"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("moved.txt"); w.Code != http.StatusOK || w.Body.String() != "by hand" {
+		t.Errorf("download: status %d, body %q", w.Code, w.Body)
+	}
+	if err := store.Put("moved.txt", nil); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Put of a name taken in another directory: %v", err)
+	}
+}
+
+func TestUnknownPlacement(t *testing.T) {
+	if _, err := newMultiDirStorage([]string{"a", "b"}, "fullest"); err == nil {
+		t.Error("newMultiDirStorage accepted placement fullest")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// namingStrategy names a stored file from its sanitized filename. attempt
+// counts the names already found taken, and sum is the hex SHA-256 of the
+// content.
+type namingStrategy struct {
+	generate func(filename, sum string, attempt int) string
+	// spool is set for strategies that need sum or expect collisions. Their
+	// uploads are spooled to disk before storing, so a retry under the next
+	// name doesn't depend on the backend having left the body unread.
+	spool bool
+	// attempts bounds how many names are tried before giving up.
+	attempts int
+}
+
+// maxSuffixAttempts bounds the numeric suffixes tried by strategies whose
+// names collide whenever the same file is uploaded twice.
+const maxSuffixAttempts = 1000
+
+var namingStrategies = map[string]namingStrategy{
+	"random":    {generate: randomNaming, attempts: maxNameAttempts},
+	"timestamp": {generate: timestampNaming, spool: true, attempts: maxSuffixAttempts},
+	"uuid":      {generate: uuidNaming, attempts: maxNameAttempts},
+	"hash":      {generate: hashNaming, spool: true, attempts: maxSuffixAttempts},
+	"original":  {generate: originalNaming, spool: true, attempts: maxSuffixAttempts},
+}
+
+// naming, set with -naming, is how uploads stored under a name of their own
+// are named. Slugs, preserved paths and dedupe name files themselves.
+var naming = namingStrategies["random"]
+
+// parseNaming sets naming from a -naming value.
+func parseNaming(value string) error {
+	s, ok := namingStrategies[value]
+	if !ok {
+		names := make([]string, 0, len(namingStrategies))
+		for name := range namingStrategies {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("unknown strategy %q, expected one of %s", value, strings.Join(names, ", "))
+	}
+	naming = s
+	return nil
+}
+
+// generatedName returns the name to try for filename on attempt. Only the
+// last element is named by the strategy, which is the whole name unless it
+// is routed into a subdirectory.
+func generatedName(filename, sum string, attempt int) string {
+	i := strings.LastIndexByte(filename, '/') + 1
+	return filename[:i] + naming.generate(filename[i:], sum, attempt)
+}
+
+// randomNaming gives every file a fresh random prefix, as in
+// aB3xY9_report.pdf.
+func randomNaming(filename, _ string, _ int) string {
+	return randomPrefix() + "_" + filename
+}
+
+// timestampNaming prefixes the upload time in UTC, as in
+// 20240101-120000_report.pdf, with a counter for uploads in the same second.
+func timestampNaming(filename, _ string, attempt int) string {
+	return withCounter(time.Now().UTC().Format("20060102-150405"), attempt) + "_" + filename
+}
+
+// uuidNaming prefixes a random UUID, as in
+// 0b5c1b4e-8b2f-4d6c-9a57-3f0e2a1d9c4b_report.pdf.
+func uuidNaming(filename, _ string, _ int) string {
+	return newUUID() + "_" + filename
+}
+
+// hashNaming prefixes the first 16 hex digits of the content's SHA-256, as
+// in 9f86d081884c7d65_report.pdf.
+func hashNaming(filename, sum string, attempt int) string {
+	return withCounter(sum[:16], attempt) + "_" + filename
+}
+
+// originalNaming keeps the filename, numbering later uploads of the same
+// name as in report-1.pdf. Names that would be taken for thumbnails get a
+// dash in place of their underscore.
+func originalNaming(filename, _ string, attempt int) string {
+	if isThumbnail(filename) {
+		filename = strings.TrimSuffix(thumbPrefix, "_") + "-" + strings.TrimPrefix(filename, thumbPrefix)
+	}
+	if attempt == 0 {
+		return filename
+	}
+	ext := path.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + strconv.Itoa(attempt) + ext
+}
+
+// withCounter appends -attempt to prefix after the first attempt.
+func withCounter(prefix string, attempt int) string {
+	if attempt == 0 {
+		return prefix
+	}
+	return prefix + "-" + strconv.Itoa(attempt)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
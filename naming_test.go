@@ -0,0 +1,64 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestNamingStrategies uploads the same file twice under each -naming
+// strategy and checks the shape of both names.
+func TestNamingStrategies(t *testing.T) {
+	hash := sha256Hex("hello")[:16]
+	tests := []struct {
+		strategy string
+		first    string
+		second   string
+	}{
+		{"random", `^[a-zA-Z0-9]{6}_report\.txt$`, `^[a-zA-Z0-9]{6}_report\.txt$`},
+		{"timestamp", `^\d{8}-\d{6}_report\.txt$`, `^\d{8}-\d{6}(-1)?_report\.txt$`},
+		{"uuid", `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}_report\.txt$`,
+			`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}_report\.txt$`},
+		{"hash", `^` + hash + `_report\.txt$`, `^` + hash + `-1_report\.txt$`},
+		{"original", `^report\.txt$`, `^report-1\.txt$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			setup(t)
+			set(t, &naming, naming)
+			if err := parseNaming(tt.strategy); err != nil {
+				t.Fatal(err)
+			}
+			first := uploaded(t, "/upload", "report.txt", "hello")
+			second := uploaded(t, "/upload", "report.txt", "hello")
+			if !regexp.MustCompile(tt.first).MatchString(first.Filename) {
+				t.Errorf("first upload stored as %s, want %s", first.Filename, tt.first)
+			}
+			if !regexp.MustCompile(tt.second).MatchString(second.Filename) {
+				t.Errorf("second upload stored as %s, want %s", second.Filename, tt.second)
+			}
+			if first.Filename == second.Filename {
+				t.Errorf("both uploads stored as %s", first.Filename)
+			}
+		})
+	}
+}
+
+// TestOriginalNamingThumbnailName checks a file named like a thumbnail
+// isn't stored where thumbnails go.
+func TestOriginalNamingThumbnailName(t *testing.T) {
+	setup(t)
+	set(t, &naming, namingStrategies["original"])
+	up := uploaded(t, "/upload", thumbPrefix+"a.txt", "hello")
+	if isThumbnail(up.Filename) || up.Filename != strings.TrimSuffix(thumbPrefix, "_")+"-a.txt" {
+		t.Errorf("stored as %s", up.Filename)
+	}
+}
+
+func TestParseNaming(t *testing.T) {
+	set(t, &naming, naming)
+	err := parseNaming("sequential")
+	if err == nil || !strings.Contains(err.Error(), "hash, original, random, timestamp, uuid") {
+		t.Errorf("parseNaming(sequential) = %v, want an error listing the strategies", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// wantsPlainText reports whether r's Accept header prefers text/plain to
+// JSON. Each type is weighed by the most specific range that matches it,
+// and JSON wins ties, so */* and a missing header keep the JSON response.
+func wantsPlainText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	plainQ, plainRank := 0.0, 0
+	jsonQ, jsonRank := 0.0, 0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if rank := mediaRangeRank(mediaType, "text/plain"); rank > plainRank {
+			plainQ, plainRank = q, rank
+		}
+		if rank := mediaRangeRank(mediaType, "application/json"); rank > jsonRank {
+			jsonQ, jsonRank = q, rank
+		}
+	}
+	return plainQ > jsonQ
+}
+
+// mediaRangeRank returns 3 when mediaRange names mediaType exactly, 2 for a
+// type/* range covering it, 1 for */* and 0 when it doesn't match.
+func mediaRangeRank(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 3
+	case mediaRange == "*/*":
+		return 1
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 2
+	}
+	return 0
+}
+
+// writeUploadError is writeJSONError for the upload endpoints, which answer
+// clients that asked for text/plain with just the message.
+func writeUploadError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if !wantsPlainText(r) {
+		writeJSONError(w, message, code)
+		return
+	}
+	errorResponsesTotal.WithLabelValues(strconv.Itoa(code)).Inc()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, message)
+}
+
+// writePlainUploads writes the plain text form of an upload response: the
+// URL of each stored file on its own line, signed with -require-signed, and
+// "Error: <filename>: <reason>" for each one that wasn't.
+func writePlainUploads(w http.ResponseWriter, responses []any, code int) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	for _, r := range responses {
+		switch r := r.(type) {
+		case UploadResponse:
+			if requireSigned {
+				fmt.Fprintln(w, r.SignedURL)
+			} else {
+				fmt.Fprintln(w, r.URL)
+			}
+		case UploadFailure:
+			fmt.Fprintf(w, "Error: %s: %s\n", r.Filename, r.Error)
+		}
+	}
+}
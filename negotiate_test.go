@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWantsPlainText(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"text/plain", true},
+		{"text/*", true},
+		{"text/plain, application/json", false},
+		{"text/plain, application/json;q=0.5", true},
+		{"application/json;q=0.9, text/plain;q=0.8", false},
+		{"text/*, */*;q=0.1", true},
+		{"text/html", false},
+		{"text/plain;q=bad", false},
+	}
+	for _, tt := range tests {
+		r := uploadRequest(t, "/upload")
+		r.Header.Set("Accept", tt.accept)
+		if got := wantsPlainText(r); got != tt.want {
+			t.Errorf("wantsPlainText(Accept: %q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestUploadNegotiation(t *testing.T) {
+	tests := []struct {
+		name      string
+		accept    string
+		parts     []formPart
+		status    int
+		plain     bool
+		wantLines []string
+	}{
+		{"json", "application/json", []formPart{file("a.txt", "hello")}, http.StatusOK, false, nil},
+		{"plain", "text/plain", []formPart{file("a.txt", "hello")}, http.StatusOK, true, []string{"url"}},
+		{"plain partial", "text/plain", []formPart{file("a.txt", "hello"), file("b.exe", "MZ")}, http.StatusMultiStatus, true,
+			[]string{"url", "Error: b.exe: Disallowed file extension"}},
+		{"plain error", "text/plain", nil, http.StatusBadRequest, true, []string{"No files uploaded"}},
+		{"json error", "application/json", nil, http.StatusBadRequest, false, nil},
+		{"plain rejected file", "text/plain", []formPart{file("b.exe", "MZ")}, http.StatusBadRequest, true, []string{"Disallowed file extension"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			r := uploadRequest(t, "/upload", tt.parts...)
+			r.Header.Set("Accept", tt.accept)
+			w := serve(http.HandlerFunc(uploadFile), r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			ct := w.Header().Get("Content-Type")
+			if !tt.plain {
+				if ct != "application/json" {
+					t.Errorf("Content-Type %q, want JSON", ct)
+				}
+				return
+			}
+			if ct != "text/plain; charset=utf-8" {
+				t.Errorf("Content-Type %q, want text/plain", ct)
+			}
+			lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+			if len(lines) != len(tt.wantLines) {
+				t.Fatalf("body %q, want %d lines", w.Body, len(tt.wantLines))
+			}
+			for i, want := range tt.wantLines {
+				if want == "url" {
+					if !strings.HasPrefix(lines[i], hostname+downloadPath) || strings.HasSuffix(lines[i], "/") {
+						t.Errorf("line %d = %q, want a file URL", i, lines[i])
+					} else if got := get(strings.TrimPrefix(lines[i], hostname+downloadPath)); got.Code != http.StatusOK {
+						t.Errorf("line %d = %q: download status %d", i, lines[i], got.Code)
+					}
+				} else if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("line %d = %q, want it to start with %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
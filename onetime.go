@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// oneTimeClaims holds one-time files whose single download is under way or
+// done, so other requests for them get a 404 rather than a second copy. A
+// claim outlives the file as a tombstone: a request that opened the file
+// before it was deleted could otherwise claim it afterwards and serve it
+// again.
+var oneTimeClaims sync.Map
+
+// claimOneTime reports whether the caller won the right to serve the named
+// one-time file. It must be called before the file is opened.
+func claimOneTime(name string) bool {
+	_, taken := oneTimeClaims.LoadOrStore(name, struct{}{})
+	return !taken
+}
+
+// releaseOneTime drops the claim on name: that of a download that didn't
+// start, or the tombstone of a consumed file whose name a new one-time
+// upload takes, such as one reusing its slug.
+func releaseOneTime(name string) {
+	oneTimeClaims.Delete(name)
+}
+
+// consumeOneTime removes a one-time file once its download has been sent.
+// Its claim is kept.
+func consumeOneTime(logger *slog.Logger, name string) {
+	err := store.Delete(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("Error removing one-time file", "file", name, "err", err)
+		return
+	}
+	if err := forgetUpload(name); err != nil {
+		logger.Error("Error updating metadata", "file", name, "err", err)
+	}
+	logger.Info("Removed one-time file after download", "file", name)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestOneTimeDownload(t *testing.T) {
+	type request struct {
+		method string
+		rng    string
+		status int
+		body   string
+	}
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{"second download fails", []request{
+			{"GET", "", 200, "secret data"},
+			{"GET", "", 404, ""},
+		}},
+		{"HEAD doesn't use it up", []request{
+			{"HEAD", "", 200, ""},
+			{"HEAD", "", 200, ""},
+			{"GET", "", 200, "secret data"},
+			{"HEAD", "", 404, ""},
+		}},
+		// A range would let the file be used up by a partial download.
+		{"range requests get the whole file", []request{
+			{"GET", "bytes=0-3", 200, "secret data"},
+			{"GET", "bytes=4-", 404, ""},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			up := uploaded(t, "/upload?onetime=1", "a.txt", "secret data")
+			for i, req := range tt.requests {
+				r := httptest.NewRequest(req.method, downloadPath+up.Filename, nil)
+				if req.rng != "" {
+					r.Header.Set("Range", req.rng)
+				}
+				w := download(r)
+				if w.Code != req.status || (req.status == 200 && req.method == "GET" && w.Body.String() != req.body) {
+					t.Fatalf("request %d (%s %s): status %d, body %q; want %d, %q", i, req.method, req.rng, w.Code, w.Body, req.status, req.body)
+				}
+				if w.Code == 200 && w.Header().Get("Cache-Control") != "no-store" {
+					t.Errorf("request %d: Cache-Control = %q, want no-store", i, w.Header().Get("Cache-Control"))
+				}
+			}
+			if exists, _ := store.Exists(up.Filename); exists {
+				t.Error("file kept after its download")
+			}
+			if _, ok := metadata.get(up.Filename); ok {
+				t.Error("metadata kept after its download")
+			}
+		})
+	}
+}
+
+// TestOneTimeConcurrentDownloads is meant for -race as well: of many
+// simultaneous downloads only one may get the file.
+func TestOneTimeConcurrentDownloads(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload?onetime=1", "a.txt", "secret data")
+	var mu sync.Mutex
+	served := 0
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := get(up.Filename); w.Code == http.StatusOK {
+				mu.Lock()
+				served++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if served != 1 {
+		t.Errorf("served %d times, want once", served)
+	}
+}
+
+// TestOneTimeSlugReused checks a slug can take a new one-time file after
+// the last one under it was downloaded.
+func TestOneTimeSlugReused(t *testing.T) {
+	setup(t)
+	for i, content := range []string{"first", "second"} {
+		up := uploaded(t, "/upload?onetime=1&slug=drop", "a.txt", content)
+		if w := get(up.Filename); w.Code != http.StatusOK || w.Body.String() != content {
+			t.Fatalf("download %d: status %d, body %q", i, w.Code, w.Body)
+		}
+		if w := get(up.Filename); w.Code != http.StatusNotFound {
+			t.Fatalf("second download %d: status %d", i, w.Code)
+		}
+	}
+}
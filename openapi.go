@@ -0,0 +1,33 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+)
+
+// openAPISpec describes the HTTP API for client generators. It is kept by
+// hand, so it needs updating along with the endpoints and types it covers.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// serveOpenAPI serves openAPISpec with its server URL set to this server,
+// under -url-prefix like the URLs in responses.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	var spec map[string]any
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		requestLogger(r).Error("Error parsing OpenAPI spec", "err", err)
+		writeJSONError(w, "Unable to load API description", http.StatusInternalServerError)
+		return
+	}
+	spec["servers"] = []map[string]string{{"url": hostname + urlPrefix}}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		requestLogger(r).Error("Error marshalling JSON", "err", err)
+		writeJSONError(w, "Unable to marshal JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
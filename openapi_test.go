@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeOpenAPI(t *testing.T) {
+	set(t, &hostname, "https://files.example.com")
+	set(t, &urlPrefix, "/fh")
+	w := serve(http.HandlerFunc(serveOpenAPI), httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var spec struct {
+		OpenAPI string                    `json:"openapi"`
+		Servers []struct{ URL string }    `json:"servers"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("not valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi %q", spec.OpenAPI)
+	}
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "https://files.example.com/fh" {
+		t.Errorf("servers %+v", spec.Servers)
+	}
+	if _, ok := spec.Paths["/upload"]["post"]; !ok {
+		t.Errorf("no POST /upload in paths %v", spec.Paths)
+	}
+}
+
+// TestOpenAPIRefs checks every $ref in the spec points at a component it
+// defines, as the spec is maintained by hand.
+func TestOpenAPIRefs(t *testing.T) {
+	var spec map[string]any
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, child := range v {
+				if ref, ok := child.(string); ok && k == "$ref" {
+					var target any = spec
+					for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+						m, _ := target.(map[string]any)
+						target = m[key]
+					}
+					if target == nil {
+						t.Errorf("$ref %s points nowhere", ref)
+					}
+				}
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(spec)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errPasswordTooLong refuses passwords bcrypt would silently cut short: it
+// only uses the first 72 bytes.
+var errPasswordTooLong = errors.New("password must be at most 72 bytes")
+
+// Download passwords are stored as bcrypt hashes.
+func hashPassword(password string) (string, error) {
+	if len(password) > 72 {
+		return "", errPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword reports whether password matches a hash from hashPassword.
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// downloadPassword returns the password sent with a download, either as the
+// HTTP Basic auth password, with any username, or in the password parameter.
+// Under -basic-auth the Authorization header carries the server's
+// credentials, so only the parameter is used.
+func downloadPassword(r *http.Request) string {
+	if basicAuthUser == "" {
+		if _, password, ok := r.BasicAuth(); ok {
+			return password
+		}
+	}
+	return r.URL.Query().Get("password")
+}
+
+// writePasswordRequired answers a download of a protected file without the
+// right password. Browsers are asked for it with a Basic auth prompt, unless
+// that would replace the -basic-auth credentials they are sending.
+func writePasswordRequired(w http.ResponseWriter) {
+	if basicAuthUser == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="filehost"`)
+	}
+	writeJSONError(w, "Password required", http.StatusUnauthorized)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := hashPassword("correct horse")
+	if hash == other {
+		t.Error("two hashes of one password are equal, so they aren't salted")
+	}
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{hash, "correct horse", true},
+		{hash, "correct horse ", false},
+		{hash, "", false},
+		{"", "", false},
+		{"plain$1$c2FsdA$aGFzaA", "x", false},
+		{hash[:len(hash)-4], "correct horse", false},
+	}
+	for _, tt := range tests {
+		if got := checkPassword(tt.hash, tt.password); got != tt.want {
+			t.Errorf("checkPassword(%q, %q) = %v, want %v", tt.hash, tt.password, got, tt.want)
+		}
+	}
+}
+
+// TestLongPassword checks a password bcrypt would cut short is refused
+// rather than protecting the file with only its start.
+func TestLongPassword(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload?password="+strings.Repeat("x", 73), file("a.txt", "private"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400: %s", w.Code, w.Body)
+	}
+	if names := stored(t); len(names) != 0 {
+		t.Errorf("stored %v", names)
+	}
+}
+
+func TestPasswordProtectedDownload(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload?password=hunter2", "a.txt", "private")
+	if m, _ := metadata.get(up.Filename); !strings.HasPrefix(m.PasswordHash, "$2a$") {
+		t.Fatalf("password stored as %q", m.PasswordHash)
+	}
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		user   string
+		pass   string
+		status int
+	}{
+		{"no password", "GET", "", "", "", http.StatusUnauthorized},
+		{"HEAD without password", "HEAD", "", "", "", http.StatusUnauthorized},
+		{"wrong password", "GET", "?password=hunter3", "", "", http.StatusUnauthorized},
+		{"query password", "GET", "?password=hunter2", "", "", http.StatusOK},
+		{"basic auth", "GET", "", "anyone", "hunter2", http.StatusOK},
+		{"wrong basic auth", "GET", "?password=hunter2", "anyone", "wrong", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, downloadPath+up.Filename+tt.query, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := download(r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+				t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+			}
+			if tt.status == http.StatusOK && w.Body.String() != "private" {
+				t.Errorf("body %q", w.Body)
+			}
+		})
+	}
+}
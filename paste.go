@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// memoryBuffer is how much of a multipart paste form is held in memory;
+// ParseMultipartForm spills the rest to temp files. It doesn't limit the
+// size of the form, which only maxUploadSize does. /upload streams its
+// parts and never buffers the form.
+var memoryBuffer byteSize = 1 << 20
+
+// uploadPaste stores a text paste sent either as the raw request body or as
+// a form field named content, for sharing logs and snippets without building
+// a multipart file upload. ?ext= picks the extension, txt by default, and the
+// other query parameters work as they do for /upload.
+func uploadPaste(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadSize))
+
+	ext := r.URL.Query().Get("ext")
+	if ext == "" {
+		ext = "txt"
+	}
+	filename := sanitizeFilename("paste." + strings.TrimPrefix(ext, "."))
+	if !strings.HasSuffix(filename, "."+strings.TrimPrefix(ext, ".")) {
+		uploadErrorsTotal.WithLabelValues("extension").Inc()
+		writeUploadError(w, r, "Invalid extension", http.StatusBadRequest)
+		return
+	}
+
+	opts, uerr := parseUploadOptions(logger, r)
+	if uerr != nil {
+		if uerr.reason != "" {
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+		}
+		writeUploadError(w, r, uerr.message, uerr.status)
+		return
+	}
+
+	digest, err := parseDigest(r.Header)
+	if err != nil {
+		uploadErrorsTotal.WithLabelValues("digest").Inc()
+		writeUploadError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.digest = digest
+
+	var src io.Reader = r.Body
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+		// The digest covers the form rather than the paste in it, so it is
+		// checked once the form is read.
+		if digest != nil {
+			r.Body = digest.body(r.Body)
+			opts.digest = nil
+		}
+		if mediaType == "multipart/form-data" {
+			err = r.ParseMultipartForm(int64(memoryBuffer))
+		} else {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			uerr := formError(logger, err)
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+			writeUploadError(w, r, uerr.message, uerr.status)
+			return
+		}
+		if digest != nil {
+			io.Copy(io.Discard, r.Body)
+			if !digest.matches() {
+				uerr := digestMismatchError(digest)
+				uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+				writeUploadError(w, r, uerr.message, uerr.status)
+				return
+			}
+		}
+		src = strings.NewReader(r.PostFormValue("content"))
+		if d := r.PostFormValue("description"); d != "" {
+			if err := checkDescription(d); err != nil {
+				uploadErrorsTotal.WithLabelValues("description").Inc()
+				writeUploadError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			opts.description = d
+		}
+	}
+
+	response, uerr := saveUpload(logger, src, filename, filename, "", opts)
+	if uerr != nil {
+		if uerr.reason != "" {
+			uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+		}
+		writeUploadError(w, r, uerr.message, uerr.status)
+		return
+	}
+	if !opts.dryRun {
+		acceptUploads(logger, []any{response})
+	}
+	if wantsPlainText(r) {
+		writePlainUploads(w, []any{response}, http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPaste(t *testing.T) {
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	mw.WriteField("content", "from multipart")
+	mw.Close()
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		status      int
+		suffix      string
+		content     string
+	}{
+		{"raw body", "/paste", "text/plain", "some log output\n", http.StatusOK, "_paste.txt", "some log output\n"},
+		{"no content type", "/paste", "", "raw", http.StatusOK, "_paste.txt", "raw"},
+		{"form field", "/paste?ext=go", "application/x-www-form-urlencoded",
+			url.Values{"content": {"package main\n"}}.Encode(), http.StatusOK, "_paste.go", "package main\n"},
+		{"multipart field", "/paste", mw.FormDataContentType(), multipartBody.String(), http.StatusOK, "_paste.txt", "from multipart"},
+		{"extension with dot", "/paste?ext=.md", "text/plain", "# title", http.StatusOK, "_paste.md", "# title"},
+		{"disallowed extension", "/paste?ext=exe", "text/plain", "MZ", http.StatusBadRequest, "", ""},
+		{"unsafe extension", "/paste?ext=a/b", "text/plain", "text", http.StatusBadRequest, "", ""},
+		{"empty", "/paste", "text/plain", "", http.StatusBadRequest, "", ""},
+		{"empty form field", "/paste", "application/x-www-form-urlencoded", "content=", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := serve(http.HandlerFunc(uploadPaste), r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if names := stored(t); len(names) != 0 {
+					t.Errorf("stored %v", names)
+				}
+				return
+			}
+			var up UploadResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &up); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(up.Filename, tt.suffix) || up.URL != fileURL(up.Filename) {
+				t.Errorf("response = %+v, want a name ending %s", up, tt.suffix)
+			}
+			data, err := os.ReadFile(filepath.Join(uploadDir, up.Filename))
+			if err != nil || string(data) != tt.content {
+				t.Errorf("stored %q, %v; want %q", data, err, tt.content)
+			}
+		})
+	}
+}
+
+func TestPasteTooLarge(t *testing.T) {
+	setup(t)
+	set(t, &maxUploadSize, 1<<10)
+	r := httptest.NewRequest(http.MethodPost, "/paste", strings.NewReader(strings.Repeat("x", 4<<10)))
+	w := serve(http.HandlerFunc(uploadPaste), r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413: %s", w.Code, w.Body)
+	}
+	if names := stored(t); len(names) != 0 {
+		t.Errorf("stored %v", names)
+	}
+}
+
+// TestPasteMemoryBuffer checks -memory-buffer only decides how much of a
+// multipart paste is held in memory: a larger one is still stored, and only
+// -max-upload-size rejects it.
+func TestPasteMemoryBuffer(t *testing.T) {
+	content := strings.Repeat("log line\n", 8<<10)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("content", content)
+	mw.Close()
+	paste := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/paste", bytes.NewReader(body.Bytes()))
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return serve(http.HandlerFunc(uploadPaste), r)
+	}
+
+	setup(t)
+	set(t, &memoryBuffer, 1<<10)
+	w := paste()
+	if w.Code != http.StatusOK {
+		t.Fatalf("paste over -memory-buffer: status %d: %s", w.Code, w.Body)
+	}
+	var up UploadResponse
+	json.Unmarshal(w.Body.Bytes(), &up)
+	if got := get(up.Filename).Body.String(); got != content {
+		t.Errorf("stored %d bytes, want %d", len(got), len(content))
+	}
+
+	set(t, &memoryBuffer, 1<<20)
+	set(t, &maxUploadSize, byteSize(len(content)/2))
+	if w := paste(); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("paste over -max-upload-size: status %d", w.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"mime/multipart"
+	"strings"
+)
+
+// partFilename returns the filename a multipart part was sent with, including
+// any directories. multipart.Part.FileName keeps only the last element.
+func partFilename(p *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return p.FileName()
+	}
+	return params["filename"]
+}
+
+// pathSegments splits a client-supplied path on either kind of slash,
+// dropping empty and "." elements.
+func pathSegments(p string) []string {
+	var segments []string
+	for _, s := range strings.FieldsFunc(p, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if s != "." {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+// cleanRelativePath validates a relative path for ?preservePaths=1 uploads
+// and returns it with forward slashes and each element sanitized. Paths that
+// climb out with "..", or that name hidden files or directories, are
+// rejected.
+func cleanRelativePath(p string) (string, error) {
+	segments := pathSegments(p)
+	if len(segments) == 0 {
+		return "", errors.New("Empty file path")
+	}
+	for i, s := range segments {
+		if s == ".." {
+			return "", errors.New("File path must not contain ..")
+		}
+		if strings.HasPrefix(s, ".") || !isValidFilename(s) {
+			return "", errors.New("Invalid file path " + p)
+		}
+		segments[i] = sanitizeFilename(s)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// flattenPath turns a client-supplied path into a single filename, joining
+// its directories with underscores, for uploads that don't preserve paths.
+func flattenPath(p string) string {
+	var kept []string
+	for _, s := range pathSegments(p) {
+		if s != ".." {
+			kept = append(kept, s)
+		}
+	}
+	return strings.Join(kept, "_")
+}
+
+// isValidName reports whether name is a stored upload that may be served or
+// deleted: one or more valid filenames separated by slashes, none of them
+// hidden.
+func isValidName(name string) bool {
+	for _, s := range strings.Split(name, "/") {
+		if !isValidFilename(s) || strings.HasPrefix(s, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	maxFilenameLength  = 128
+	maxExtensionLength = 16
+)
+
+// sanitizeFilename reduces a client-supplied filename to characters that are
+// safe in a URL path segment without escaping: ASCII letters, digits, dots,
+// dashes and underscores. Anything else becomes an underscore, runs of
+// separators are collapsed, and the name is shortened to maxFilenameLength
+// while keeping its extension. The original name is kept in metadata for
+// Content-Disposition.
+func sanitizeFilename(name string) string {
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 && len(name)-i <= maxExtensionLength {
+		base, ext = name[:i], name[i:]
+	}
+	base = sanitizeSegment(base)
+	ext = sanitizeSegment(ext)
+	if ext != "" {
+		ext = "." + ext
+	}
+	if base == "" {
+		base = "file"
+	}
+	if len(base)+len(ext) > maxFilenameLength {
+		base = strings.TrimRight(base[:maxFilenameLength-len(ext)], "._-")
+	}
+	return base + ext
+}
+
+// sanitizeSegment replaces unsafe characters in s and collapses runs of
+// separators, trimming them from both ends.
+func sanitizeSegment(s string) string {
+	var b strings.Builder
+	var pending byte
+	for _, c := range s {
+		var out byte
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			if pending != 0 && b.Len() > 0 {
+				b.WriteByte(pending)
+			}
+			pending = 0
+			b.WriteRune(c)
+			continue
+		case c == '.' || c == '-':
+			out = byte(c)
+		default:
+			out = '_'
+		}
+		// A dot wins over other separators so "a_.txt" style runs don't
+		// hide extensions, and "_" over "-".
+		if pending == 0 || out == '.' || pending == '-' && out == '_' {
+			pending = out
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanRelativePath(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"docs/report.pdf", "docs/report.pdf", false},
+		{`docs\sub\report.pdf`, "docs/sub/report.pdf", false},
+		{"./docs//report.pdf", "docs/report.pdf", false},
+		{"my docs/q1 report.pdf", "my_docs/q1_report.pdf", false},
+		{"/abs/report.pdf", "abs/report.pdf", false},
+		{"../report.pdf", "", true},
+		{"docs/../../etc/passwd", "", true},
+		{`docs\..\report.pdf`, "", true},
+		{".git/config", "", true},
+		{"docs/.hidden", "", true},
+		{"", "", true},
+		{"./", "", true},
+	}
+	for _, tt := range tests {
+		got, err := cleanRelativePath(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("cleanRelativePath(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFlattenPath(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"docs/report.pdf", "docs_report.pdf"},
+		{`C:\Users\me\report.pdf`, "C:_Users_me_report.pdf"},
+		{"../../etc/passwd", "etc_passwd"},
+		{"./a/./b", "a_b"},
+	}
+	for _, tt := range tests {
+		if got := flattenPath(tt.in); got != tt.want {
+			t.Errorf("flattenPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIsValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"report.pdf", true},
+		{"root/docs/report.pdf", true},
+		{".meta.json", false},
+		{"root/.hidden/report.pdf", false},
+		{"../report.pdf", false},
+		{"root//report.pdf", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isValidName(tt.name); got != tt.want {
+			t.Errorf("isValidName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPreservePaths(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload?preservePaths=1",
+		file("site/index.txt", "hi"),
+		file(`site\css\style.css`, "body {}"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	ups := decodeUploads(t, w)
+	root, _, _ := strings.Cut(ups[0].Filename, "/")
+	want := []string{root + "/site/index.txt", root + "/site/css/style.css"}
+	for i, up := range ups {
+		if up.Filename != want[i] {
+			t.Errorf("file %d stored as %q, want %q", i, up.Filename, want[i])
+		}
+		if !strings.HasSuffix(up.URL, downloadPath+want[i]) {
+			t.Errorf("file %d URL = %q", i, up.URL)
+		}
+		if _, err := os.Stat(filepath.Join(uploadDir, filepath.FromSlash(want[i]))); err != nil {
+			t.Error(err)
+		}
+	}
+	if w := get(want[1]); w.Code != http.StatusOK || w.Body.String() != "body {}" {
+		t.Errorf("download of %s: status %d, body %q", want[1], w.Code, w.Body)
+	}
+
+	// Every request gets a root of its own.
+	again := decodeUploads(t, upload(t, "/upload?preservePaths=1", file("site/index.txt", "again")))
+	if strings.HasPrefix(again[0].Filename, root+"/") {
+		t.Errorf("second upload reused the root %s", root)
+	}
+}
+
+func TestPreservePathsRejected(t *testing.T) {
+	tests := []struct {
+		name, target, filename string
+	}{
+		{"escape", "/upload?preservePaths=1", "../../etc/passwd"},
+		{"hidden", "/upload?preservePaths=1", "site/.htaccess"},
+		{"with slug", "/upload?preservePaths=1&slug=site", "site/index.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			w := upload(t, tt.target, file(tt.filename, "content"))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400: %s", w.Code, w.Body)
+			}
+			if names := stored(t); len(names) != 0 {
+				t.Errorf("stored %v", names)
+			}
+		})
+	}
+}
+
+// TestPathsFlattened checks that without preservePaths the directories a
+// filename was sent with become part of a single name.
+func TestPathsFlattened(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload", "../docs/report.txt", "content")
+	if strings.Contains(up.Filename, "/") || !strings.HasSuffix(up.Filename, "_docs_report.txt") {
+		t.Errorf("stored as %q, want a flattened name", up.Filename)
+	}
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			t.Errorf("upload created directory %s", e.Name())
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"spaces", "my report.pdf", "my_report.pdf"},
+		{"reserved URL characters", "a#b?c%d&e=f.txt", "a_b_c_d_e_f.txt"},
+		{"control characters", "a\x00b\nc\tz.txt", "a_b_c_z.txt"},
+		{"unicode", "résumé.pdf", "r_sum.pdf"},
+		{"emoji", "party 🎉 time.png", "party_time.png"},
+		{"collapsed separators", "a  __--b.txt", "a_b.txt"},
+		{"dash kept", "a-b.txt", "a-b.txt"},
+		{"trimmed separators", "__a__.txt", "a.txt"},
+		{"all bad characters", "#?%&.txt", "file.txt"},
+		{"all bad, no extension", "🎉🎉", "file"},
+		{"dot file", ".bashrc", "bashrc"},
+		{"bad extension", "a.t#t", "a.t_t"},
+		{"long extension kept in base", "a." + strings.Repeat("x", 20), "a." + strings.Repeat("x", 20)},
+		{"multiple dots", "archive.tar.gz", "archive.tar.gz"},
+		{"too long", strings.Repeat("a", 200) + ".txt", strings.Repeat("a", maxFilenameLength-4) + ".txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFilename(tt.in)
+			if got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if len(got) > maxFilenameLength || !isValidName(got) {
+				t.Errorf("sanitizeFilename(%q) = %q is not a valid name", tt.in, got)
+			}
+		})
+	}
+}
+
+// TestOriginalNameKept checks that a sanitized upload is still downloaded
+// under the name it was sent with.
+func TestOriginalNameKept(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload", "résumé #1.txt", "content")
+	if !strings.HasSuffix(up.Filename, "_r_sum_1.txt") {
+		t.Errorf("stored as %q", up.Filename)
+	}
+	if up.OriginalName != "résumé #1.txt" {
+		t.Errorf("originalName = %q", up.OriginalName)
+	}
+	w := get(up.Filename)
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "filename*=UTF-8''r%C3%A9sum%C3%A9%20#1.txt") {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressRetention is how long the progress of a finished upload can still
+// be fetched, so a client polling at an interval sees it complete.
+const progressRetention = time.Minute
+
+// maxUploadIDLength bounds client-chosen X-Upload-Id values.
+const maxUploadIDLength = 64
+
+// uploadProgress maps X-Upload-Id values to the *progress of their upload.
+var uploadProgress sync.Map
+
+type progress struct {
+	received atomic.Int64
+	total    int64
+	done     atomic.Bool
+}
+
+// UploadProgress is the GET /upload-progress/{id} response. Total is the
+// request's Content-Length, or -1 if it wasn't sent.
+type UploadProgress struct {
+	Received int64 `json:"received"`
+	Total    int64 `json:"total"`
+	Done     bool  `json:"done"`
+}
+
+// progressReader counts the bytes read through it into p.
+type progressReader struct {
+	io.ReadCloser
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.p.received.Add(int64(n))
+	return n, err
+}
+
+func isValidUploadID(id string) bool {
+	if id == "" || len(id) > maxUploadIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// trackProgress starts recording how much of r's body has arrived under id,
+// returning a function to call when the upload is over. It fails if id is
+// already used by an upload in progress.
+func trackProgress(r *http.Request, id string) (finish func(), ok bool) {
+	p := &progress{total: r.ContentLength}
+	if old, loaded := uploadProgress.LoadOrStore(id, p); loaded {
+		if !old.(*progress).done.Load() || !uploadProgress.CompareAndSwap(id, old, p) {
+			return nil, false
+		}
+	}
+	r.Body = &progressReader{ReadCloser: r.Body, p: p}
+	return func() {
+		p.done.Store(true)
+		time.AfterFunc(progressRetention, func() { uploadProgress.CompareAndDelete(id, p) })
+	}, true
+}
+
+func serveUploadProgress(w http.ResponseWriter, r *http.Request) {
+	v, ok := uploadProgress.Load(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	p := v.(*progress)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(UploadProgress{
+		Received: p.received.Load(),
+		Total:    p.total,
+		Done:     p.done.Load(),
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// pollProgress fetches the progress of the upload with id.
+func pollProgress(t *testing.T, id string) (UploadProgress, int) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/upload-progress/"+id, nil)
+	r.SetPathValue("id", id)
+	w := serve(http.HandlerFunc(serveUploadProgress), r)
+	var p UploadProgress
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p, w.Code
+}
+
+// TestUploadProgress sends an upload a chunk at a time, polling its
+// progress after each.
+func TestUploadProgress(t *testing.T) {
+	setup(t)
+	const id = "progress-test"
+	t.Cleanup(func() { uploadProgress.Delete(id) })
+	if _, status := pollProgress(t, id); status != http.StatusNotFound {
+		t.Fatalf("progress before the upload: status %d, want 404", status)
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	r := httptest.NewRequest(http.MethodPost, "/upload", pr)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("X-Upload-Id", id)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(http.HandlerFunc(uploadFile), r) }()
+
+	part, err := mw.CreateFormFile("file", "big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := strings.Repeat("x", 64<<10)
+	var last int64
+	for i := range 5 {
+		if _, err := io.WriteString(part, chunk); err != nil {
+			t.Fatal(err)
+		}
+		// The pipe returns once the handler has read the chunk.
+		p, status := pollProgress(t, id)
+		if status != http.StatusOK {
+			t.Fatalf("poll %d: status %d", i, status)
+		}
+		if p.Received <= last || p.Done {
+			t.Errorf("poll %d: %+v, want more than %d bytes and not done", i, p, last)
+		}
+		last = p.Received
+	}
+	mw.Close()
+	pw.Close()
+	if w := <-done; w.Code != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+	}
+	p, status := pollProgress(t, id)
+	if status != http.StatusOK || !p.Done || p.Received < 5*int64(len(chunk)) {
+		t.Errorf("after the upload: %+v, status %d", p, status)
+	}
+	// httptest requests with a streamed body have no Content-Length.
+	if p.Total != -1 {
+		t.Errorf("total = %d, want -1", p.Total)
+	}
+}
+
+func TestUploadProgressIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		status int
+	}{
+		{"valid", "abc-123_XYZ", http.StatusOK},
+		{"invalid characters", "../etc", http.StatusBadRequest},
+		{"too long", strings.Repeat("a", maxUploadIDLength+1), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			t.Cleanup(func() { uploadProgress.Delete(tt.id) })
+			r := uploadRequest(t, "/upload", file("a.txt", "content"))
+			r.Header.Set("X-Upload-Id", tt.id)
+			w := serve(http.HandlerFunc(uploadFile), r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			p, status := pollProgress(t, tt.id)
+			if status != http.StatusOK || !p.Done || p.Total != r.ContentLength || p.Received != p.Total {
+				t.Errorf("progress = %+v, status %d; want all %d bytes received", p, status, r.ContentLength)
+			}
+		})
+	}
+}
+
+// TestUploadProgressInUse checks that an id can't be taken over while its
+// upload is running, but can be reused once it is done.
+func TestUploadProgressInUse(t *testing.T) {
+	setup(t)
+	const id = "in-use"
+	t.Cleanup(func() { uploadProgress.Delete(id) })
+	running := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("body"))
+	finish, ok := trackProgress(running, id)
+	if !ok {
+		t.Fatal("trackProgress of a new id failed")
+	}
+
+	r := uploadRequest(t, "/upload", file("a.txt", "content"))
+	r.Header.Set("X-Upload-Id", id)
+	if w := serve(http.HandlerFunc(uploadFile), r); w.Code != http.StatusConflict {
+		t.Errorf("upload with an id in use: status %d, want 409", w.Code)
+	}
+
+	finish()
+	r = uploadRequest(t, "/upload", file("a.txt", "content"))
+	r.Header.Set("X-Upload-Id", id)
+	if w := serve(http.HandlerFunc(uploadFile), r); w.Code != http.StatusOK {
+		t.Errorf("upload reusing a finished id: status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+// PurgeRequest selects the files POST /api/admin/purge removes: mode
+// "expired" or "all", or olderThan, a ttl-style age such as 30d.
+type PurgeRequest struct {
+	Mode      string `json:"mode"`
+	OlderThan string `json:"olderThan"`
+}
+
+type PurgeResponse struct {
+	Removed    int   `json:"removed"`
+	BytesFreed int64 `json:"bytesFreed"`
+}
+
+// purgeFiles deletes stored files in bulk, as an operator's counterpart to
+// the expiry sweeper. Files are removed one at a time the way deletes are,
+// so uploads can carry on meanwhile; files modified after the purge
+// started, which includes any still being written, are never removed.
+func purgeFiles(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	var req PurgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeJSONError(w, "Request body must be JSON like {\"mode\": \"expired\"}", http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	var match func(FileInfo, fileMeta) bool
+	switch {
+	case req.Mode != "" && req.OlderThan != "":
+		writeJSONError(w, "Give either mode or olderThan", http.StatusBadRequest)
+		return
+	case req.Mode == "expired":
+		match = func(f FileInfo, m fileMeta) bool { return m.expired(start) }
+	case req.Mode == "all":
+		match = func(f FileInfo, m fileMeta) bool { return true }
+	case req.Mode != "":
+		writeJSONError(w, "mode must be expired or all", http.StatusBadRequest)
+		return
+	case req.OlderThan != "":
+		age, err := parseTTL(req.OlderThan)
+		if err != nil || age <= 0 {
+			writeJSONError(w, "olderThan must be a duration such as 12h or 30d", http.StatusBadRequest)
+			return
+		}
+		cutoff := start.Add(-age)
+		match = func(f FileInfo, m fileMeta) bool {
+			uploaded := m.UploadedAt
+			if uploaded.IsZero() {
+				uploaded = f.ModTime
+			}
+			return uploaded.Before(cutoff)
+		}
+	default:
+		writeJSONError(w, "Give mode or olderThan", http.StatusBadRequest)
+		return
+	}
+
+	files, err := store.List()
+	if err != nil {
+		logger.Error("Error listing files", "err", err)
+		writeJSONError(w, "Unable to list files", http.StatusInternalServerError)
+		return
+	}
+	var response PurgeResponse
+	for _, f := range files {
+		// Thumbnails go with the files they belong to.
+		if isThumbnail(f.Name) || f.ModTime.After(start) {
+			continue
+		}
+		m, _ := metadata.get(f.Name)
+		if !match(f, m) {
+			continue
+		}
+		err := store.Delete(f.Name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			logger.Error("Error deleting file", "file", f.Name, "err", err)
+			continue
+		}
+		if err := forgetUpload(f.Name); err != nil {
+			logger.Error("Error updating metadata", "file", f.Name, "err", err)
+		}
+		response.Removed++
+		response.BytesFreed += f.Size
+	}
+	logger.Info("Purged files", "mode", req.Mode, "older_than", req.OlderThan, "removed", response.Removed, "bytes", response.BytesFreed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
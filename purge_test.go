@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func purge(t *testing.T, body string) (int, PurgeResponse) {
+	t.Helper()
+	w := serve(http.HandlerFunc(purgeFiles), httptest.NewRequest(http.MethodPost, "/api/admin/purge", strings.NewReader(body)))
+	var resp PurgeResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestPurge(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		// keep lists the files left afterwards, of "fresh", "expired" and
+		// "old".
+		keep []string
+	}{
+		{"expired", `{"mode": "expired"}`, []string{"fresh", "old"}},
+		{"older than", `{"olderThan": "7d"}`, []string{"fresh", "expired"}},
+		{"all", `{"mode": "all"}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			names := map[string]string{
+				"fresh":   uploaded(t, "/upload", "fresh.png", testPNG(t, 8, 8)).Filename,
+				"expired": uploaded(t, "/upload?ttl=1h", "expired.txt", "gone").Filename,
+				"old":     uploaded(t, "/upload", "old.txt", "from last month").Filename,
+			}
+			thumbnailJobs.Wait()
+			m, _ := metadata.get(names["expired"])
+			m.ExpiresAt = time.Now().Add(-time.Minute)
+			metadata.set(names["expired"], m)
+			m, _ = metadata.get(names["old"])
+			m.UploadedAt = time.Now().Add(-30 * 24 * time.Hour)
+			metadata.set(names["old"], m)
+
+			var wantFreed int64
+			var want []string
+			for label, name := range names {
+				if slices.Contains(tt.keep, label) {
+					want = append(want, name)
+				} else {
+					m, _ := metadata.get(name)
+					wantFreed += m.Size
+				}
+			}
+			status, resp := purge(t, tt.body)
+			if status != http.StatusOK {
+				t.Fatalf("status %d", status)
+			}
+			if resp.Removed != len(names)-len(tt.keep) {
+				t.Errorf("removed %d, want %d", resp.Removed, len(names)-len(tt.keep))
+			}
+			if resp.BytesFreed != wantFreed {
+				t.Errorf("freed %d bytes, want %d", resp.BytesFreed, wantFreed)
+			}
+			files, _ := store.List()
+			var left []string
+			for _, f := range files {
+				left = append(left, f.Name)
+			}
+			slices.Sort(left)
+			slices.Sort(want)
+			if slices.Contains(tt.keep, "fresh") {
+				// Its thumbnail stays with it.
+				want = append(want, thumbName(names["fresh"]))
+				slices.Sort(want)
+			}
+			if !slices.Equal(left, want) {
+				t.Errorf("left %v, want %v", left, want)
+			}
+			for label, name := range names {
+				if _, ok := metadata.get(name); ok != slices.Contains(tt.keep, label) {
+					t.Errorf("%s: metadata kept %v", label, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestPurgeBadRequests(t *testing.T) {
+	setup(t)
+	uploaded(t, "/upload", "a.txt", "kept")
+	for _, body := range []string{
+		``,
+		`not json`,
+		`{}`,
+		`{"mode": "everything"}`,
+		`{"olderThan": "soon"}`,
+		`{"olderThan": "-1h"}`,
+		`{"mode": "all", "olderThan": "1h"}`,
+	} {
+		if status, _ := purge(t, body); status != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", body, status)
+		}
+	}
+	if names := stored(t); len(names) != 1 {
+		t.Errorf("stored %v after rejected purges", names)
+	}
+}
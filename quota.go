@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// quota caps how many bytes the files uploaded with each API key may add up
+// to. Zero means no limit.
+var quota byteSize
+
+// quotaTracker keeps each key's storage usage in memory. It is rebuilt from
+// the store and the owners recorded in metadata on startup.
+type quotaTracker struct {
+	mu    sync.Mutex
+	used  map[string]int64
+	files map[string]ownedFile
+}
+
+type ownedFile struct {
+	owner string
+	size  int64
+}
+
+var quotas = &quotaTracker{used: make(map[string]int64), files: make(map[string]ownedFile)}
+
+// loadQuotaUsage computes every key's usage by listing the store.
+func loadQuotaUsage() error {
+	files, err := store.List()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if m, ok := metadata.get(f.Name); ok && m.Owner != "" {
+			quotas.add(f.Name, m.Owner, f.Size)
+		}
+	}
+	return loadTusClaims()
+}
+
+// reserve claims n bytes of owner's quota ahead of an upload, reporting false
+// if that would exceed it. The reservation must be released once the upload
+// is done, whether or not it succeeded.
+func (q *quotaTracker) reserve(owner string, n int64) bool {
+	if quota == 0 || owner == "" {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used[owner]+n > int64(quota) {
+		return false
+	}
+	q.used[owner] += n
+	return true
+}
+
+func (q *quotaTracker) release(owner string, n int64) {
+	if quota == 0 || owner == "" {
+		return
+	}
+	q.mu.Lock()
+	q.used[owner] -= n
+	q.mu.Unlock()
+}
+
+// claim is reserve for an upload that stays unfinished for a while: the
+// bytes are attributed to name like a stored file, until remove frees them.
+func (q *quotaTracker) claim(name, owner string, n int64) bool {
+	if owner == "" {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if quota > 0 && q.used[owner]+n > int64(quota) {
+		return false
+	}
+	q.files[name] = ownedFile{owner, n}
+	q.used[owner] += n
+	return true
+}
+
+// add attributes a stored file to owner.
+func (q *quotaTracker) add(name, owner string, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.files[name] = ownedFile{owner, size}
+	q.used[owner] += size
+}
+
+// remove frees the quota used by a deleted file.
+func (q *quotaTracker) remove(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f, ok := q.files[name]
+	if !ok {
+		return
+	}
+	delete(q.files, name)
+	q.used[f.owner] -= f.size
+}
+
+// rename keeps a renamed file attributed to its owner.
+func (q *quotaTracker) rename(oldName, newName string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if f, ok := q.files[oldName]; ok {
+		delete(q.files, oldName)
+		q.files[newName] = f
+	}
+}
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// quotaReader claims quota for an owner's upload as it is read, failing
+// with errQuotaExceeded once the owner would go over. The claim is handed
+// back with release once the file has been stored and added, or discarded.
+type quotaReader struct {
+	owner string
+	r     io.Reader
+	n     int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	if n > 0 {
+		if !quotas.reserve(q.owner, int64(n)) {
+			return 0, errQuotaExceeded
+		}
+		q.n += int64(n)
+	}
+	return n, err
+}
+
+func (q *quotaReader) release() {
+	quotas.release(q.owner, q.n)
+	q.n = 0
+}
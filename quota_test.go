@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyUpload uploads one file of size bytes with an API key.
+func keyUpload(t *testing.T, key string, size int) *httptest.ResponseRecorder {
+	t.Helper()
+	r := uploadRequest(t, "/upload", file("a.txt", strings.Repeat("x", size)))
+	r.Header.Set("X-API-Key", key)
+	return serve(requireAPIKey(http.HandlerFunc(uploadFile)), r)
+}
+
+func TestQuota(t *testing.T) {
+	type step struct {
+		key    string
+		size   int
+		status int
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"within quota", []step{{"alice", 40, 200}, {"alice", 60, 200}}},
+		{"over quota", []step{{"alice", 60, 200}, {"alice", 60, 413}, {"alice", 40, 200}}},
+		{"single file over quota", []step{{"alice", 101, 413}}},
+		{"keys have their own quota", []step{{"alice", 100, 200}, {"bob", 100, 200}, {"alice", 1, 413}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &apiKeys, []string{"alice", "bob"})
+			set(t, &quota, 100)
+			for i, s := range tt.steps {
+				w := keyUpload(t, s.key, s.size)
+				if w.Code != s.status {
+					t.Fatalf("upload %d by %s of %d bytes: status %d, want %d: %s", i, s.key, s.size, w.Code, s.status, w.Body)
+				}
+			}
+			// Rejected uploads leave nothing behind, and their claims are
+			// released.
+			var want int64
+			for _, s := range tt.steps {
+				if s.status == http.StatusOK && s.key == "alice" {
+					want += int64(s.size)
+				}
+			}
+			if got := quotas.used[keyID("alice")]; got != want {
+				t.Errorf("alice uses %d bytes, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestQuotaFreedByDelete(t *testing.T) {
+	setup(t)
+	set(t, &apiKeys, []string{"alice"})
+	set(t, &quota, 100)
+	w := keyUpload(t, "alice", 100)
+	name := decodeUploads(t, w)[0].Filename
+	if w := keyUpload(t, "alice", 1); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload over quota: status %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodDelete, "/files/"+name, nil)
+	r.SetPathValue("name", name)
+	serve(http.HandlerFunc(deleteFile), r)
+	if w := keyUpload(t, "alice", 100); w.Code != http.StatusOK {
+		t.Errorf("upload after delete: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLoadQuotaUsage(t *testing.T) {
+	setup(t)
+	set(t, &apiKeys, []string{"alice"})
+	set(t, &quota, 100)
+	keyUpload(t, "alice", 30)
+	keyUpload(t, "alice", 20)
+	uploaded(t, "/upload", "anonymous.txt", "not counted")
+	set(t, &quotas, &quotaTracker{used: make(map[string]int64), files: make(map[string]ownedFile)})
+	if err := loadQuotaUsage(); err != nil {
+		t.Fatal(err)
+	}
+	if got := quotas.used[keyID("alice")]; got != 50 {
+		t.Errorf("usage after restart %d, want 50", got)
+	}
+}
+
+// TestTusQuota checks an unfinished resumable upload holds its whole length
+// of the quota until it completes.
+func TestTusQuota(t *testing.T) {
+	setup(t)
+	set(t, &apiKeys, []string{"alice"})
+	set(t, &quota, 100)
+	h := requireAPIKey(tusHandler())
+	create := func(length int) *httptest.ResponseRecorder {
+		r := tusCreateRequest(strconv.Itoa(length), "a.txt")
+		r.Header.Set("X-API-Key", "alice")
+		return serve(h, r)
+	}
+	location := create(60).Header().Get("Location")
+	if location == "" {
+		t.Fatal("upload not created")
+	}
+	if w := create(60); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("second unfinished upload over quota: status %d, want 413", w.Code)
+	}
+	if w := keyUpload(t, "alice", 60); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over quota held by an unfinished one: status %d, want 413", w.Code)
+	}
+	patch := tusPatchRequest(location, 0, strings.Repeat("x", 60))
+	patch.Header.Set("X-API-Key", "alice")
+	if w := serve(h, patch); w.Code != http.StatusNoContent {
+		t.Fatalf("completing upload: status %d: %s", w.Code, w.Body)
+	}
+	if got := quotas.used[keyID("alice")]; got != 60 {
+		t.Errorf("alice uses %d bytes, want 60", got)
+	}
+}
+
+// TestTusQuotaAfterRestart checks unfinished uploads are counted again when
+// usage is recomputed on startup, and their claim goes when they expire.
+func TestTusQuotaAfterRestart(t *testing.T) {
+	setup(t)
+	set(t, &apiKeys, []string{"alice"})
+	set(t, &quota, 100)
+	r := tusCreateRequest("40", "a.txt")
+	r.Header.Set("X-API-Key", "alice")
+	if w := serve(requireAPIKey(tusHandler()), r); w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	set(t, &quotas, &quotaTracker{used: make(map[string]int64), files: make(map[string]ownedFile)})
+	if err := loadQuotaUsage(); err != nil {
+		t.Fatal(err)
+	}
+	if got := quotas.used[keyID("alice")]; got != 40 {
+		t.Errorf("usage after restart %d, want 40", got)
+	}
+	removeStaleTusUploads(time.Now().Add(tusExpiry))
+	if got := quotas.used[keyID("alice")]; got != 0 {
+		t.Errorf("usage after the upload expired %d, want 0", got)
+	}
+}
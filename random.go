@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// randomFile redirects to a stored file picked uniformly at random, or with
+// ?type=image, video, audio or text, to one of that kind. Password-protected
+// files are left out along with those listLiveFiles skips.
+func randomFile(w http.ResponseWriter, r *http.Request) {
+	// The redirect would hand out an unsigned link.
+	if requireSigned {
+		writeJSONError(w, errSignatureMissing.Error(), http.StatusForbidden)
+		return
+	}
+	files, err := listLiveFiles()
+	if err != nil {
+		requestLogger(r).Error("Error listing files", "err", err)
+		writeJSONError(w, "Unable to list files", http.StatusInternalServerError)
+		return
+	}
+	kind := strings.ToLower(r.URL.Query().Get("type"))
+	var names []string
+	for _, f := range files {
+		m, _ := metadata.get(f.Name)
+		if m.PasswordHash != "" {
+			continue
+		}
+		if kind != "" {
+			contentType := m.ContentType
+			if contentType == "" {
+				contentType = mime.TypeByExtension(path.Ext(f.Name))
+			}
+			if !strings.HasPrefix(contentType, kind+"/") {
+				continue
+			}
+		}
+		names = append(names, f.Name)
+	}
+	if len(names) == 0 {
+		writeJSONError(w, "No files found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, urlPrefix+downloadPath+names[rand.IntN(len(names))], http.StatusFound)
+}
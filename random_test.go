@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// randomPick requests /random with query and returns the status and the
+// stored file it redirected to.
+func randomPick(query string) (int, string) {
+	w := serve(http.HandlerFunc(randomFile), httptest.NewRequest(http.MethodGet, "/random"+query, nil))
+	return w.Code, strings.TrimPrefix(w.Header().Get("Location"), downloadPath)
+}
+
+func TestRandomFile(t *testing.T) {
+	setup(t)
+	if status, _ := randomPick(""); status != http.StatusNotFound {
+		t.Errorf("empty directory: status %d, want 404", status)
+	}
+
+	img := uploaded(t, "/upload", "a.png", testPNG(t, 4, 4)).Filename
+	text := uploaded(t, "/upload", "b.txt", "hello").Filename
+	uploaded(t, "/upload?password=secret", "c.txt", "private")
+	uploaded(t, "/upload?onetime=1", "d.txt", "once")
+
+	picked := make(map[string]int)
+	for range 100 {
+		status, name := randomPick("")
+		if status != http.StatusFound {
+			t.Fatalf("status %d", status)
+		}
+		picked[name]++
+	}
+	if len(picked) != 2 || picked[img] == 0 || picked[text] == 0 {
+		t.Errorf("picked %v, want both of %s and %s", picked, img, text)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"?type=image", http.StatusFound, img},
+		{"?type=IMAGE", http.StatusFound, img},
+		{"?type=text", http.StatusFound, text},
+		{"?type=video", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		for range 10 {
+			if status, name := randomPick(tt.query); status != tt.status || name != tt.want {
+				t.Errorf("%s: status %d, picked %q; want %d, %q", tt.query, status, name, tt.status, tt.want)
+				break
+			}
+		}
+	}
+}
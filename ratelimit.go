@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a per-client token bucket. Each client may make burst
+// requests at once, refilled at rate requests per minute.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	clients map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	l := &rateLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		clients: make(map[string]*bucket),
+	}
+	go l.evictStale(time.Minute)
+	return l
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.clients[key]
+	if !ok {
+		b = &bucket{tokens: l.burst}
+		l.clients[key] = b
+	} else {
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evictStale drops clients whose bucket has refilled completely, since they
+// are indistinguishable from a client we have never seen.
+func (l *rateLimiter) evictStale(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mu.Lock()
+		now := time.Now()
+		for key, b := range l.clients {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.clients, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (l *rateLimiter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.allow(clientIP(r)) {
+			w.Header().Set("Retry-After", "60")
+			writeJSONError(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client that made r, without the port.
+// With -trust-proxy the right-most X-Forwarded-For entry, which the proxy
+// itself appended, is used; those before it are whatever the client sent.
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			fwd := values[len(values)-1]
+			if ip := strings.TrimSpace(fwd[strings.LastIndex(fwd, ",")+1:]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
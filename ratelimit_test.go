@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name       string
+		trustProxy bool
+		// requests are made from these clients in order.
+		requests []string
+		want     []int
+	}{
+		{"within burst", false, []string{"1.1.1.1", "1.1.1.1"}, []int{200, 200}},
+		{"over burst", false, []string{"1.1.1.1", "1.1.1.1", "1.1.1.1"}, []int{200, 200, 429}},
+		{"separate clients", false, []string{"1.1.1.1", "1.1.1.1", "2.2.2.2", "1.1.1.1"}, []int{200, 200, 200, 429}},
+		{"forwarded ignored", false, []string{"1.1.1.1|3.3.3.3", "1.1.1.1|4.4.4.4", "1.1.1.1|5.5.5.5"}, []int{200, 200, 429}},
+		{"forwarded trusted", true, []string{"10.0.0.1|3.3.3.3", "10.0.0.1|3.3.3.3", "10.0.0.1|4.4.4.4"}, []int{200, 200, 200}},
+		// Only the entry the proxy appends counts; the client writes the rest.
+		{"forwarded spoofed", true, []string{"10.0.0.1|9.9.9.1, 3.3.3.3", "10.0.0.1|9.9.9.2, 3.3.3.3", "10.0.0.1|9.9.9.3, 3.3.3.3"}, []int{200, 200, 429}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set(t, &trustProxy, tt.trustProxy)
+			h := newRateLimiter(1, 2).limit(ok)
+			for i, client := range tt.requests {
+				r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+				// Clients are written as remote address|X-Forwarded-For.
+				addr, fwd, _ := strings.Cut(client, "|")
+				r.RemoteAddr = addr + ":1234"
+				if fwd != "" {
+					r.Header.Set("X-Forwarded-For", fwd)
+				}
+				w := serve(h, r)
+				if w.Code != tt.want[i] {
+					t.Errorf("request %d from %s: status %d, want %d", i, client, w.Code, tt.want[i])
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+					t.Error("429 without Retry-After")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	setup(t)
+	set(t, &adminKey, "admin-secret")
+	up := uploaded(t, "/upload", "a.txt", "hello")
+	archive := exportArchive(t)
+	readOnly.Store(true)
+	t.Cleanup(func() { readOnly.Store(false) })
+
+	mux := http.NewServeMux()
+	mux.Handle("/upload", rejectWhenReadOnly(http.HandlerFunc(uploadFile)))
+	mux.Handle("DELETE /files/{name...}", rejectWhenReadOnly(http.HandlerFunc(deleteFile)))
+	mux.Handle("POST /api/import", rejectWhenReadOnly(requireAdmin(trackUploads(importStore))))
+	mux.Handle("POST /api/admin/purge", rejectWhenReadOnly(requireAdmin(http.HandlerFunc(purgeFiles))))
+	mux.Handle("GET "+downloadPath, http.StripPrefix(downloadPath, http.HandlerFunc(serveUploaded)))
+
+	requests := map[string]*http.Request{
+		"upload": uploadRequest(t, "/upload", file("b.txt", "world")),
+		"delete": httptest.NewRequest(http.MethodDelete, "/files/"+up.Filename, nil),
+		"import": httptest.NewRequest(http.MethodPost, "/api/import", bytes.NewReader(archive)),
+		"purge":  httptest.NewRequest(http.MethodPost, "/api/admin/purge", strings.NewReader(`{"mode": "all"}`)),
+	}
+	for name, r := range requests {
+		r.Header.Set("X-API-Key", "admin-secret")
+		w := serve(mux, r)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: status %d, Retry-After %q", name, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	if names := stored(t); len(names) != 1 || names[0] != up.Filename {
+		t.Errorf("stored %v after read-only requests, want only %s", names, up.Filename)
+	}
+	if w := serve(mux, httptest.NewRequest(http.MethodGet, downloadPath+up.Filename, nil)); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("download: status %d, body %q", w.Code, w.Body)
+	}
+
+	readOnly.Store(false)
+	if w := serve(mux, uploadRequest(t, "/upload", file("b.txt", "world"))); w.Code != http.StatusOK {
+		t.Errorf("upload after read-only mode: status %d", w.Code)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redirectPaths, set with -redirect-paths, are the only paths ?redirect=
+// may send browsers to. When empty any path on this server is allowed.
+var redirectPaths map[string]bool
+
+// checkRedirect validates a ?redirect= target, which has to be on this
+// server so uploads can't be used to send people elsewhere. It is either a
+// path or an absolute URL on -hostname.
+func checkRedirect(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Opaque != "" || u.User != nil || !strings.HasPrefix(u.Path, "/") ||
+		strings.HasPrefix(u.Path, "//") || strings.HasPrefix(target, "//") || strings.Contains(target, `\`) {
+		return nil, errors.New("redirect must be a path or URL on this server")
+	}
+	if u.Scheme != "" || u.Host != "" {
+		base, err := url.Parse(hostname)
+		if err != nil || !strings.EqualFold(u.Scheme, base.Scheme) || !strings.EqualFold(u.Host, base.Host) {
+			return nil, errors.New("redirect must be a path or URL on this server")
+		}
+	}
+	if len(redirectPaths) > 0 && !redirectPaths[u.Path] {
+		return nil, errors.New("redirect is not an allowed path")
+	}
+	return u, nil
+}
+
+// redirectAfterUpload sends a browser that posted an upload form on to u
+// with 303 See Other, adding a url parameter for each stored file.
+func redirectAfterUpload(w http.ResponseWriter, r *http.Request, u *url.URL, responses []any) {
+	q := u.Query()
+	for _, resp := range responses {
+		if upload, ok := resp.(UploadResponse); ok {
+			link := upload.URL
+			if requireSigned {
+				link = upload.SignedURL
+			}
+			q.Add("url", link)
+		}
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
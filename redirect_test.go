@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestUploadRedirect(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload?redirect="+url.QueryEscape("/done?from=form"), file("a.txt", "a"), file("b.txt", "b"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || loc.Path != "/done" || loc.Query().Get("from") != "form" {
+		t.Fatalf("Location %q", w.Header().Get("Location"))
+	}
+	var want []string
+	for _, name := range stored(t) {
+		want = append(want, fileURL(name))
+	}
+	got := loc.Query()["url"]
+	slices.Sort(got)
+	slices.Sort(want)
+	if len(want) != 2 || !slices.Equal(got, want) {
+		t.Errorf("redirected with urls %v, want %v", got, want)
+	}
+}
+
+// TestUploadWithoutRedirect checks uploads without ?redirect= still answer
+// with JSON, and a failed upload isn't redirected so its error is seen.
+func TestUploadWithoutRedirect(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload", file("a.txt", "a"))
+	if w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+		t.Fatalf("status %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	if ups := decodeUploads(t, w); len(ups) != 1 || ups[0].URL == "" {
+		t.Errorf("response %+v", ups)
+	}
+	if w := upload(t, "/upload?redirect=/done", file("run.exe", "MZ")); w.Code == http.StatusSeeOther {
+		t.Errorf("failed upload redirected to %s", w.Header().Get("Location"))
+	}
+}
+
+func TestUploadRedirectOffSite(t *testing.T) {
+	for _, target := range []string{
+		"https://evil.example/done",
+		"//evil.example/done",
+		`/\evil.example`,
+		"https://localhost/done",
+		"javascript:alert(1)",
+		"done",
+	} {
+		t.Run(target, func(t *testing.T) {
+			setup(t)
+			w := upload(t, "/upload?redirect="+url.QueryEscape(target), file("a.txt", "a"))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status %d, Location %q", w.Code, w.Header().Get("Location"))
+			}
+			if names := stored(t); len(names) != 0 {
+				t.Errorf("stored %v", names)
+			}
+		})
+	}
+	setup(t)
+	if w := upload(t, "/upload?redirect="+url.QueryEscape("http://localhost/done"), file("a.txt", "a")); w.Code != http.StatusSeeOther {
+		t.Errorf("absolute URL on -hostname: status %d", w.Code)
+	}
+}
+
+func TestRedirectPaths(t *testing.T) {
+	setup(t)
+	set(t, &redirectPaths, map[string]bool{"/done": true})
+	if w := upload(t, "/upload?redirect=/done", file("a.txt", "a")); w.Code != http.StatusSeeOther {
+		t.Errorf("allowed path: status %d", w.Code)
+	}
+	if w := upload(t, "/upload?redirect=/elsewhere", file("b.txt", "b")); w.Code != http.StatusBadRequest {
+		t.Errorf("path not in -redirect-paths: status %d", w.Code)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// fileRenamer is implemented by backends that can rename a stored file in
+// place. Rename fails with os.ErrExist if newName is taken and
+// os.ErrNotExist if oldName is missing.
+type fileRenamer interface {
+	Rename(oldName, newName string) error
+}
+
+// renameIn renames a file in s, copying it when s can't rename in place.
+func renameIn(s Storage, oldName, newName string) error {
+	if r, ok := s.(fileRenamer); ok {
+		return r.Rename(oldName, newName)
+	}
+	f, err := s.Get(oldName)
+	if err != nil {
+		return err
+	}
+	err = s.Put(newName, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return s.Delete(oldName)
+}
+
+// Rename links the file under its new name before removing the old one,
+// since os.Rename would silently replace an existing file.
+func (s localStorage) Rename(oldName, newName string) error {
+	if err := s.makeParent(newName); err != nil {
+		return err
+	}
+	if err := os.Link(s.path(oldName), s.path(newName)); err != nil {
+		return err
+	}
+	return s.Delete(oldName)
+}
+
+// Encryption doesn't depend on the name, so the ciphertext can be renamed
+// as it is.
+func (s *encryptedStorage) Rename(oldName, newName string) error {
+	return renameIn(s.Storage, oldName, newName)
+}
+
+func (s *cachedStorage) Rename(oldName, newName string) error {
+	s.invalidate(oldName)
+	s.invalidate(newName)
+	defer s.invalidate(oldName)
+	return renameIn(s.Storage, oldName, newName)
+}
+
+// renameUpload renames a stored file along with its metadata, download
+// stats, quota usage and thumbnail. Failing to move any of those is logged
+// rather than returned, as the file itself has been renamed by then.
+func renameUpload(logger *slog.Logger, oldName, newName string) error {
+	if err := renameIn(store, oldName, newName); err != nil {
+		return err
+	}
+	quotas.rename(oldName, newName)
+	downloadStats.rename(oldName, newName)
+	if err := renameIn(store, thumbName(oldName), thumbName(newName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("Error renaming thumbnail", "file", oldName, "err", err)
+	}
+	if err := metadata.rename(oldName, newName); err != nil {
+		logger.Error("Error updating metadata", "file", newName, "err", err)
+	}
+	return nil
+}
+
+type renameRequest struct {
+	NewName string `json:"newName"`
+}
+
+// RenameResponse is the PATCH /api/files/{name} response.
+type RenameResponse struct {
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+}
+
+// renameFile gives a stored file a new name, moving its metadata, download
+// stats, quota usage and thumbnail along with it. The new name gets the same
+// extension and content checks as an upload.
+func renameFile(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	name := r.PathValue("name")
+	if !isValidName(name) {
+		writeJSONError(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	var req renameRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		writeJSONError(w, "Request body must be JSON with a newName", http.StatusBadRequest)
+		return
+	}
+	newName := req.NewName
+	if !isValidName(newName) || isThumbnail(newName) {
+		writeJSONError(w, "Invalid new filename", http.StatusBadRequest)
+		return
+	}
+	ext := path.Ext(newName)
+	if err := checkExtension(ext); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m, _ := metadata.get(name)
+	if m.expired(time.Now()) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	f, err := store.Get(name)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Error opening file", "file", name, "err", err)
+		writeJSONError(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	_, head, err := peekHead(f)
+	f.Close()
+	if err != nil {
+		logger.Error("Error reading file", "file", name, "err", err)
+		writeJSONError(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	if _, err := validateContent(head, ext); err != nil {
+		writeJSONError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	err = renameUpload(logger, name, newName)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, os.ErrExist) {
+		writeJSONError(w, "A file named "+newName+" already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.Error("Error renaming file", "file", name, "new_name", newName, "err", err)
+		writeJSONError(w, "Unable to rename file", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Renamed file", "file", name, "new_name", newName)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RenameResponse{Filename: newName, URL: fileURL(newName)})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// renameRequestTo builds a PATCH renaming name to newName.
+func renameRequestTo(name, newName string) *http.Request {
+	body, _ := json.Marshal(renameRequest{NewName: newName})
+	return httptest.NewRequest(http.MethodPatch, "/api/files/"+name, strings.NewReader(string(body)))
+}
+
+// rename runs r through the rename route.
+func rename(r *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PATCH /api/files/{name...}", renameFile)
+	return serve(mux, r)
+}
+
+func TestRenameFile(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload", "a.txt", "content")
+	get(up.Filename)
+
+	w := rename(renameRequestTo(up.Filename, "renamed.txt"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp RenameResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Filename != "renamed.txt" || resp.URL != fileURL("renamed.txt") {
+		t.Errorf("response = %+v", resp)
+	}
+	if w := get(up.Filename); w.Code != http.StatusNotFound {
+		t.Errorf("old name: status %d, want 404", w.Code)
+	}
+	if w := get("renamed.txt"); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Errorf("new name: status %d, body %q", w.Code, w.Body)
+	}
+	// The download before the rename is counted under the new name.
+	if st, _ := fileStatsOf(t, "renamed.txt"); st.Downloads != 2 {
+		t.Errorf("downloads = %d, want 2", st.Downloads)
+	}
+	if m, ok := metadata.get("renamed.txt"); !ok || m.Sha256 != up.Sha256 {
+		t.Errorf("metadata = %+v, %v; want it moved", m, ok)
+	}
+	if _, ok := metadata.get(up.Filename); ok {
+		t.Error("metadata is still kept under the old name")
+	}
+}
+
+func TestRenameFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		newName string
+		body    string
+		status  int
+	}{
+		{"clash", "", "taken.txt", "", http.StatusConflict},
+		{"missing source", "missing.txt", "new.txt", "", http.StatusNotFound},
+		{"traversal in new name", "", "../escaped.txt", "", http.StatusBadRequest},
+		{"traversal in source", "../etc/passwd", "new.txt", "", http.StatusBadRequest},
+		{"hidden new name", "", ".meta.json", "", http.StatusBadRequest},
+		{"thumbnail name", "", thumbPrefix + "x.txt", "", http.StatusBadRequest},
+		{"disallowed extension", "", "evil.exe", "", http.StatusBadRequest},
+		{"content mismatch", "", "image.png", "", http.StatusUnsupportedMediaType},
+		{"not JSON", "", "", "newName=x.txt", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			up := uploaded(t, "/upload", "a.txt", "content")
+			if err := store.Put("taken.txt", strings.NewReader("taken")); err != nil {
+				t.Fatal(err)
+			}
+			from := tt.from
+			if from == "" {
+				from = up.Filename
+			}
+			r := renameRequestTo(from, tt.newName)
+			if tt.body != "" {
+				r = httptest.NewRequest(http.MethodPatch, "/api/files/"+from, strings.NewReader(tt.body))
+			}
+			// The mux would clean a path with .. in it, so set it directly.
+			r.SetPathValue("name", from)
+			w := serve(http.HandlerFunc(renameFile), r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if w := get(up.Filename); w.Code != http.StatusOK {
+				t.Errorf("source after failed rename: status %d", w.Code)
+			}
+			if w := get("taken.txt"); w.Body.String() != "taken" {
+				t.Errorf("taken.txt = %q, want it untouched", w.Body)
+			}
+		})
+	}
+}
+
+// TestRenameIn renames in each backend, including those that copy.
+func TestRenameIn(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := backend.new(t)
+			for name, content := range map[string]string{"old.txt": "content", "taken.txt": "taken"} {
+				if err := s.Put(name, strings.NewReader(content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := renameIn(s, "old.txt", "taken.txt"); !errors.Is(err, os.ErrExist) {
+				t.Errorf("rename onto a taken name = %v, want ErrExist", err)
+			}
+			if err := renameIn(s, "missing.txt", "new.txt"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("rename of a missing file = %v, want ErrNotExist", err)
+			}
+			if err := renameIn(s, "old.txt", "dir/new.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get("old.txt"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("old name after rename: %v", err)
+			}
+			f, err := s.Get("dir/new.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if data, _ := io.ReadAll(f); string(data) != "content" {
+				t.Errorf("renamed file = %q", data)
+			}
+		})
+	}
+}
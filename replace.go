@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// fileReplacer is implemented by backends that can replace the content of
+// a stored file so readers see either the old content or the new, never a
+// mix. Replace fails with os.ErrNotExist if name is missing.
+type fileReplacer interface {
+	Replace(name string, r io.Reader) error
+}
+
+// replaceIn replaces the content of name in s.
+func replaceIn(s Storage, name string, r io.Reader) error {
+	if rp, ok := s.(fileReplacer); ok {
+		return rp.Replace(name, r)
+	}
+	return errors.ErrUnsupported
+}
+
+// Replace writes the new content to a temp file next to the old one and
+// renames it over it.
+func (s localStorage) Replace(name string, r io.Reader) error {
+	p := s.path(name)
+	if _, err := os.Stat(p); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = tmp.Chmod(fileMode)
+	if err == nil {
+		_, err = io.Copy(tmp, r)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Replace relies on S3 PUTs being atomic: the object is only swapped once
+// the new one has been received in full.
+func (s *s3Storage) Replace(name string, r io.Reader) error {
+	exists, err := s.Exists(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return os.ErrNotExist
+	}
+	return s.upload(name, r, false)
+}
+
+func (s *encryptedStorage) Replace(name string, r io.Reader) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(s.encrypt(pw, r))
+	}()
+	err := replaceIn(s.Storage, name, pr)
+	pr.CloseWithError(errors.New("storage stopped reading"))
+	<-done
+	return err
+}
+
+func (s *cachedStorage) Replace(name string, r io.Reader) error {
+	s.invalidate(name)
+	defer s.invalidate(name)
+	return replaceIn(s.Storage, name, r)
+}
+
+// replaceFile replaces the content of a stored file with the request body,
+// keeping its name and URL. The new content gets the same checks as an
+// upload under that name. Metadata is kept apart from what describes the
+// content: its hash, size and type.
+func replaceFile(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	name := r.PathValue("name")
+	if !isValidName(name) || isThumbnail(name) {
+		writeJSONError(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	m, _ := metadata.get(name)
+	if m.expired(time.Now()) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if isContentAddressed(name, m.Sha256) {
+		writeJSONError(w, "File is named after its content and can't be replaced", http.StatusConflict)
+		return
+	}
+	if exists, err := store.Exists(name); err != nil {
+		logger.Error("Error checking file", "file", name, "err", err)
+		writeJSONError(w, "Unable to replace file", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Quota is claimed as for an upload, so while it streams in the new
+	// content has to fit next to the old.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadSize))
+	quotaSrc := &quotaReader{owner: m.Owner, r: r.Body}
+	defer quotaSrc.release()
+	scanned, signature, err := scanUpload(quotaSrc)
+	if err != nil {
+		replaceError(w, r, err)
+		return
+	}
+	defer scanned.Close()
+	if signature != "" {
+		logger.Warn("Rejected infected upload", "file", name, "signature", signature)
+		writeJSONError(w, "File is infected: "+signature, http.StatusUnprocessableEntity)
+		return
+	}
+	body, head, err := peekHead(scanned)
+	if err != nil {
+		replaceError(w, r, err)
+		return
+	}
+	if len(head) == 0 {
+		writeJSONError(w, "Empty file", http.StatusBadRequest)
+		return
+	}
+	contentType, err := validateContent(head, path.Ext(name))
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	checked, err := checkUploadArchive(body, contentType, name)
+	if err != nil {
+		var aerr archiveError
+		if errors.As(err, &aerr) {
+			logger.Warn("Rejected archive", "file", name, "err", err)
+			writeJSONError(w, aerr.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		replaceError(w, r, err)
+		return
+	}
+	defer checked.Close()
+	body = checked
+	if stripEXIF && contentType == "image/jpeg" {
+		stripped := stripJPEGReader(body)
+		defer stripped.Close()
+		body = stripped
+	}
+
+	// Under -strict-unique the new content is spooled to learn its hash, so
+	// it can be refused before anything is replaced if it is stored under
+	// another name.
+	replace := func(src io.Reader) error {
+		hasher := sha256.New()
+		var counter countingWriter
+		if err := replaceIn(store, name, io.TeeReader(src, io.MultiWriter(hasher, &counter))); err != nil {
+			return err
+		}
+		m.Sha256 = hex.EncodeToString(hasher.Sum(nil))
+		m.Size = counter.n
+		m.ContentType = contentType
+		m.Encrypted = encryptUploads
+		if err := metadata.set(name, m); err != nil {
+			logger.Error("Error saving metadata", "file", name, "err", err)
+		}
+		return nil
+	}
+	if strictUnique {
+		err = replaceSpooled(name, body, replace)
+	} else {
+		err = replace(body)
+	}
+	var dupErr *duplicateError
+	if errors.As(err, &dupErr) {
+		uerr := duplicateUploadError(logger, dupErr.name)
+		writeJSONError(w, uerr.message, uerr.status)
+		return
+	}
+	if err != nil {
+		replaceError(w, r, err)
+		return
+	}
+
+	quotas.remove(name)
+	if m.Owner != "" {
+		quotas.add(name, m.Owner, m.Size)
+	}
+	removeThumbnail(name)
+	thumbnail := canThumbnail(contentType) && m.PasswordHash == ""
+	if thumbnail {
+		startThumbnail(name)
+	}
+	logger.Info("Replaced file", "file", name, "size", m.Size)
+
+	response := UploadResponse{
+		Filename:     name,
+		OriginalName: m.OriginalName,
+		URL:          fileURL(name),
+		Sha256:       m.Sha256,
+		Size:         m.Size,
+		UploadedAt:   m.UploadedAt,
+		Description:  m.Description,
+	}
+	if thumbnail {
+		response.ThumbnailURL = fileURL(thumbName(name))
+	}
+	if len(signingKey) > 0 {
+		expires := time.Now().Add(signedURLTTL)
+		response.SignedURL = generateSignedURL(name, expires)
+		if requireSigned && thumbnail {
+			response.ThumbnailURL = generateSignedURL(thumbName(name), expires)
+		}
+	}
+	response.setDispositionURLs()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// replaceSpooled spools src and replaces the content of name with it
+// through replace under replaceUnique.
+func replaceSpooled(name string, src io.Reader, replace func(io.Reader) error) error {
+	tmpPath, sum, _, err := spoolUpload(src)
+	if tmpPath != "" {
+		defer os.Remove(tmpPath)
+	}
+	if err != nil {
+		return err
+	}
+	return replaceUnique(name, sum, func() error {
+		f, err := os.Open(tmpPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return replace(f)
+	})
+}
+
+// replaceError writes the response for a replacement that failed while
+// reading or storing the new content.
+func replaceError(w http.ResponseWriter, r *http.Request, err error) {
+	logger := requestLogger(r)
+	if uerr := streamError(logger, err); uerr != nil {
+		writeJSONError(w, uerr.message, uerr.status)
+		return
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeJSONError(w, "File not found", http.StatusNotFound)
+	case isDiskFull(err):
+		uerr := diskFullError(logger, err)
+		writeJSONError(w, uerr.message, uerr.status)
+	default:
+		logger.Error("Error replacing file", "file", r.PathValue("name"), "err", err)
+		writeJSONError(w, "Unable to replace file", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// replaceRequest PUTs content over the stored file name.
+func replaceRequest(name, content string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /files/{name...}", replaceFile)
+	return serve(mux, httptest.NewRequest(http.MethodPut, "/files/"+name, strings.NewReader(content)))
+}
+
+func TestReplaceFile(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			setup(t)
+			set(t, &store, backend.new(t))
+			up := uploaded(t, "/upload?ttl=1h&description=kept", "notes.txt", "first draft")
+			before, _ := metadata.get(up.Filename)
+
+			w := replaceRequest(up.Filename, "second, longer draft")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var resp UploadResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Filename != up.Filename || resp.URL != up.URL || resp.Sha256 != sha256Hex("second, longer draft") || resp.Size != 20 {
+				t.Errorf("response %+v", resp)
+			}
+			if got := get(up.Filename).Body.String(); got != "second, longer draft" {
+				t.Errorf("download %q", got)
+			}
+
+			m, _ := metadata.get(up.Filename)
+			if m.OriginalName != "notes.txt" || m.Description != "kept" || !m.ExpiresAt.Equal(before.ExpiresAt) || !m.UploadedAt.Equal(before.UploadedAt) {
+				t.Errorf("metadata %+v, before %+v", m, before)
+			}
+			if m.Sha256 != resp.Sha256 || m.Size != 20 {
+				t.Errorf("content metadata %+v", m)
+			}
+		})
+	}
+}
+
+func TestReplaceFileErrors(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload", "notes.txt", "content")
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		status  int
+	}{
+		{"missing", "nope_missing.txt", "content", http.StatusNotFound},
+		{"thumbnail", thumbName(up.Filename), "content", http.StatusBadRequest},
+		{"empty", up.Filename, "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := replaceRequest(tt.file, tt.content); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+	if names := stored(t); len(names) != 1 || get(up.Filename).Body.String() != "content" {
+		t.Errorf("stored %v after failed replacements", names)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// dirRoute sends uploads matching any of its patterns into dir. Patterns
+// are extensions like .pdf or media types like image/png or image/*.
+type dirRoute struct {
+	dir      string
+	patterns []string
+}
+
+// dirRoutes, set with -route-dirs, are tried in order; uploads matching
+// none stay at the top of uploadDir.
+var dirRoutes []dirRoute
+
+// parseDirRoutes reads a -route-dirs value such as
+// "images=image/*;docs=.pdf,.doc,.docx".
+func parseDirRoutes(value string) error {
+	var routes []dirRoute
+	for _, spec := range strings.Split(value, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		dir, list, ok := strings.Cut(spec, "=")
+		dir = strings.Trim(strings.TrimSpace(dir), "/")
+		if !ok || !isValidName(dir) || isThumbnail(dir) {
+			return fmt.Errorf("invalid route %q, expected dir=pattern,...", spec)
+		}
+		route := dirRoute{dir: dir}
+		for _, p := range strings.Split(list, ",") {
+			p = strings.ToLower(strings.TrimSpace(p))
+			if !strings.HasPrefix(p, ".") && !strings.Contains(p, "/") {
+				return fmt.Errorf("invalid pattern %q for %s, expected an extension or a media type", p, dir)
+			}
+			route.patterns = append(route.patterns, p)
+		}
+		routes = append(routes, route)
+	}
+	dirRoutes = routes
+	return nil
+}
+
+// routeDir returns the subdirectory of uploadDir that files with extension
+// ext and detected contentType are stored in, or "" for uploadDir itself.
+func routeDir(ext, contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	ext = strings.ToLower(ext)
+	for _, route := range dirRoutes {
+		for _, p := range route.patterns {
+			if p == ext || (mediaType != "" && !strings.HasPrefix(p, ".") && mediaRangeRank(p, mediaType) > 0) {
+				return route.dir
+			}
+		}
+	}
+	return ""
+}
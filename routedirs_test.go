@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParseDirRoutes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []dirRoute
+		wantErr bool
+	}{
+		{"images=image/*;docs=.PDF, .docx", []dirRoute{
+			{dir: "images", patterns: []string{"image/*"}},
+			{dir: "docs", patterns: []string{".pdf", ".docx"}},
+		}, false},
+		{" /media/audio/ = audio/mpeg ;", []dirRoute{{dir: "media/audio", patterns: []string{"audio/mpeg"}}}, false},
+		{"", nil, false},
+		{"images", nil, true},
+		{"=image/*", nil, true},
+		{"../up=image/*", nil, true},
+		{"images=png", nil, true},
+		{"images=", nil, true},
+	}
+	for _, tt := range tests {
+		set(t, &dirRoutes, nil)
+		err := parseDirRoutes(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDirRoutes(%q) error %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(dirRoutes, tt.want) {
+			t.Errorf("parseDirRoutes(%q) = %+v, want %+v", tt.value, dirRoutes, tt.want)
+		}
+	}
+}
+
+func TestRouteDirs(t *testing.T) {
+	setup(t)
+	set(t, &dirRoutes, nil)
+	if err := parseDirRoutes("images=image/*;docs=.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	img := testPNG(t, 4, 4)
+	tests := []struct {
+		name, content, wantDir string
+	}{
+		{"shot.png", img, "images"},
+		{"report.pdf", "%PDF-1.4\n", "docs"},
+		{"notes.txt", "hello", "."},
+	}
+	for _, tt := range tests {
+		up := uploaded(t, "/upload", tt.name, tt.content)
+		if dir := path.Dir(up.Filename); dir != tt.wantDir {
+			t.Errorf("%s stored as %s, want it in %s", tt.name, up.Filename, tt.wantDir)
+		}
+		u, err := url.Parse(up.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := download(httptest.NewRequest(http.MethodGet, u.Path, nil)); w.Code != http.StatusOK || w.Body.String() != tt.content {
+			t.Errorf("%s: GET %s: status %d, %d bytes", tt.name, u.Path, w.Code, w.Body.Len())
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Storage keeps files in an S3-compatible bucket. Requests are signed with
+// AWS Signature Version 4 using credentials from the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables, and objects are addressed path-style so any S3-compatible
+// endpoint works.
+type s3Storage struct {
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+func newS3Storage(endpoint, bucket, region string) (*s3Storage, error) {
+	if bucket == "" {
+		return nil, errors.New("-bucket is required with -storage s3")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	s := &s3Storage{
+		endpoint:     u,
+		bucket:       bucket,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       http.DefaultClient,
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for -storage s3")
+	}
+	return s, nil
+}
+
+// Put uploads r as the object name. S3 needs the length up front, so unless r
+// is already a local file it is spooled to a temp file first. The existence
+// check is repeated server-side with If-None-Match so a concurrent upload of
+// the same name can't be overwritten.
+func (s *s3Storage) Put(name string, r io.Reader) error {
+	exists, err := s.Exists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	return s.upload(name, r, true)
+}
+
+// upload does the PUT for Put and Replace. Unless exclusive, it overwrites
+// whatever object is already at name.
+func (s *s3Storage) upload(name string, r io.Reader, exclusive bool) error {
+	f, ok := r.(*os.File)
+	if !ok {
+		tmp, err := os.CreateTemp("", "filehost-s3-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		f = tmp
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(http.MethodPut, name, io.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	if exclusive {
+		req.Header.Set("If-None-Match", "*")
+	}
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return os.ErrExist
+	default:
+		return fmt.Errorf("s3 put %s: %s", name, resp.Status)
+	}
+}
+
+func (s *s3Storage) Get(name string) (StoredFile, error) {
+	size, modTime, err := s.head(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{s: s, name: name, size: size, modTime: modTime}, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	// DELETE succeeds for missing keys, so check first to report ErrNotExist
+	// like the local backend does.
+	if _, _, err := s.head(name); err != nil {
+		return err
+	}
+	req, err := s.newRequest(http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 delete %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (s *s3Storage) Exists(name string) (bool, error) {
+	_, _, err := s.head(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List pages through ListObjectsV2 for the whole bucket.
+func (s *s3Storage) List() ([]FileInfo, error) {
+	var files []FileInfo
+	token := ""
+	for {
+		req, err := s.newRequest(http.MethodGet, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		q := url.Values{"list-type": {"2"}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req.URL.RawQuery = q.Encode()
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("s3 list: %s", resp.Status)
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			if isInternal(c.Key) {
+				continue
+			}
+			files = append(files, FileInfo{Name: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) head(name string) (int64, time.Time, error) {
+	req, err := s.newRequest(http.MethodHead, name, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return 0, time.Time{}, os.ErrNotExist
+	default:
+		return 0, time.Time{}, fmt.Errorf("s3 head %s: %s", name, resp.Status)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+func (s *s3Storage) newRequest(method, name string, body io.ReadCloser) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + name
+	u.RawPath = "/" + s3Escape(s.bucket) + "/" + s3Escape(name)
+	return http.NewRequest(method, u.String(), body)
+}
+
+func (s *s3Storage) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds SigV4 authentication headers to req. The payload is left
+// unsigned so bodies can be streamed without hashing them twice.
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	names := []string{"host"}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || lk == "content-type" || lk == "if-none-match" || strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, n := range names {
+		canonicalHeaders.WriteString(n + ":" + headers[n] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := q[k]
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, queryEscape(k)+"="+queryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes s the way SigV4 expects: everything except
+// unreserved characters and '/' is escaped.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func queryEscape(s string) string {
+	return strings.ReplaceAll(s3Escape(s), "/", "%2F")
+}
+
+// s3Object reads an object lazily with ranged GETs, starting a new request
+// after each Seek, so http.ServeContent can serve byte ranges from S3.
+type s3Object struct {
+	s       *s3Storage
+	name    string
+	size    int64
+	modTime time.Time
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := o.s.newRequest(http.MethodGet, o.name, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+		resp, err := o.s.do(req)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return 0, fmt.Errorf("s3 get %s: %s", o.name, resp.Status)
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative seek offset")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+func (o *s3Object) Size() int64        { return o.size }
+func (o *s3Object) ModTime() time.Time { return o.modTime }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ShareXConfig is a ShareX custom uploader, the .sxcu file ShareX imports.
+// The $json:...$ syntax for reading the response is the one ShareX used
+// before version 13, which newer versions convert on import.
+type ShareXConfig struct {
+	Version         string            `json:"Version"`
+	Name            string            `json:"Name"`
+	DestinationType string            `json:"DestinationType"`
+	RequestMethod   string            `json:"RequestMethod"`
+	RequestURL      string            `json:"RequestURL"`
+	Headers         map[string]string `json:"Headers,omitempty"`
+	Body            string            `json:"Body"`
+	FileFormName    string            `json:"FileFormName"`
+	URL             string            `json:"URL"`
+	ThumbnailURL    string            `json:"ThumbnailURL"`
+	ErrorMessage    string            `json:"ErrorMessage"`
+}
+
+// shareXConfig returns the uploader config for this server. A valid apiKey
+// is included so the config works as it is.
+func shareXConfig(apiKey string) ShareXConfig {
+	urlField := "url"
+	if requireSigned {
+		urlField = "signedUrl"
+	}
+	c := ShareXConfig{
+		Version:         "12.4.1",
+		Name:            strings.TrimPrefix(strings.TrimPrefix(hostname, "https://"), "http://"),
+		DestinationType: "ImageUploader, TextUploader, FileUploader",
+		RequestMethod:   "POST",
+		RequestURL:      hostname + urlPrefix + "/upload",
+		Body:            "MultipartFormData",
+		FileFormName:    "file",
+		URL:             "$json:[0]." + urlField + "$",
+		ThumbnailURL:    "$json:[0].thumbnailUrl$",
+		ErrorMessage:    "$json:error$",
+	}
+	if apiKey != "" {
+		c.Headers = map[string]string{"X-API-Key": apiKey}
+	}
+	return c
+}
+
+// serveShareXConfig sends the ShareX uploader config as a download. When API
+// keys are required, the key the config is requested with goes into it.
+func serveShareXConfig(w http.ResponseWriter, r *http.Request) {
+	var key string
+	if len(apiKeys) > 0 {
+		if k := requestAPIKey(r); k != "" && validAPIKey(k) {
+			key = k
+		}
+	}
+	c := shareXConfig(key)
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		requestLogger(r).Error("Error marshalling JSON", "err", err)
+		writeJSONError(w, "Unable to marshal JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", strings.ReplaceAll(c.Name, ":", "_")+".sxcu"))
+	if key != "" {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func getShareXConfig(t *testing.T, apiKey string) ShareXConfig {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/sharex", nil)
+	if apiKey != "" {
+		r.Header.Set("X-API-Key", apiKey)
+	}
+	w := serve(http.HandlerFunc(serveShareXConfig), r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var c ShareXConfig
+	if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestShareXConfig checks an upload made the way the config describes
+// stores the file at the URL the config reads from the response.
+func TestShareXConfig(t *testing.T) {
+	setup(t)
+	set(t, &hostname, "https://files.example.com")
+	set(t, &urlPrefix, "/fh")
+	c := getShareXConfig(t, "")
+	if c.RequestURL != "https://files.example.com/fh/upload" || c.RequestMethod != "POST" || c.Body != "MultipartFormData" {
+		t.Errorf("request %s %s as %s", c.RequestMethod, c.RequestURL, c.Body)
+	}
+	if c.FileFormName != "file" || c.URL != "$json:[0].url$" || c.Headers != nil {
+		t.Errorf("config %+v", c)
+	}
+
+	target, err := url.Parse(c.RequestURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := upload(t, target.Path, formPart{field: c.FileFormName, filename: "a.png", content: testPNG(t, 8, 8)})
+	var resp []map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp) != 1 {
+		t.Fatalf("response %v, %v", resp, err)
+	}
+	fileURL, _ := resp[0]["url"].(string)
+	if want := "https://files.example.com/fh" + downloadPath + resp[0]["filename"].(string); fileURL != want {
+		t.Errorf("url %q, want %q", fileURL, want)
+	}
+	if resp[0]["thumbnailUrl"] == "" {
+		t.Error("no thumbnailUrl for the config to read")
+	}
+}
+
+func TestShareXConfigKeys(t *testing.T) {
+	setup(t)
+	set(t, &apiKeys, []string{"secret"})
+	if c := getShareXConfig(t, "secret"); c.Headers["X-API-Key"] != "secret" {
+		t.Errorf("headers with a valid key %v", c.Headers)
+	}
+	if c := getShareXConfig(t, "guess"); c.Headers != nil {
+		t.Errorf("headers with an invalid key %v", c.Headers)
+	}
+
+	set(t, &signingKey, []byte("0123456789abcdef"))
+	set(t, &requireSigned, true)
+	if c := getShareXConfig(t, ""); c.URL != "$json:[0].signedUrl$" {
+		t.Errorf("URL under -require-signed %q", c.URL)
+	}
+}
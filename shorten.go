@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// linksFilename holds the short links next to the metadata index.
+const linksFilename = ".filehost-links.json"
+
+// shortCodeLength is the length of generated short link codes.
+const shortCodeLength = 6
+
+// maxTargetLength bounds the URLs that can be shortened.
+const maxTargetLength = 2048
+
+type shortLink struct {
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// linkStore maps short link codes to their targets. Like metaStore, every
+// change is written through to disk.
+type linkStore struct {
+	mu    sync.Mutex
+	path  string
+	links map[string]shortLink
+}
+
+var links *linkStore
+
+func loadLinkStore(path string) (*linkStore, error) {
+	s := &linkStore{path: path, links: make(map[string]shortLink)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.links); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *linkStore) get(code string) (shortLink, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[code]
+	return l, ok
+}
+
+// add stores l under code, failing with os.ErrExist if code is taken.
+func (s *linkStore) add(code string, l shortLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.links[code]; ok {
+		return os.ErrExist
+	}
+	s.links[code] = l
+	if err := s.save(); err != nil {
+		delete(s.links, code)
+		return err
+	}
+	return nil
+}
+
+// merge adds links to the store, replacing those with the same codes.
+func (s *linkStore) merge(links map[string]shortLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for code, l := range links {
+		s.links[code] = l
+	}
+	return s.save()
+}
+
+// save writes the store to disk. The caller must hold s.mu.
+func (s *linkStore) save() error {
+	data, err := json.Marshal(s.links)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// ShortenRequest is the body of POST /shorten. Slug picks the code instead
+// of a random one, with the same rules as upload slugs.
+type ShortenRequest struct {
+	URL  string `json:"url"`
+	Slug string `json:"slug"`
+}
+
+type ShortenResponse struct {
+	Code   string `json:"code"`
+	URL    string `json:"url"`
+	Target string `json:"target"`
+}
+
+// checkTarget validates a URL to shorten: an absolute http or https URL.
+func checkTarget(target string) error {
+	if len(target) > maxTargetLength {
+		return errors.New("URL is too long")
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("URL must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// shortenURL creates a short link that followShortLink redirects to the URL
+// in the request.
+func shortenURL(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	var req ShortenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTargetLength+1024)).Decode(&req); err != nil {
+		writeJSONError(w, "Request body must be JSON like {\"url\": \"https://example.com\"}", http.StatusBadRequest)
+		return
+	}
+	if err := checkTarget(req.URL); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Slug != "" {
+		if err := checkSlug(req.Slug); err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	link := shortLink{URL: req.URL, CreatedAt: time.Now().UTC()}
+	var code string
+	err := os.ErrExist
+	if req.Slug != "" {
+		code = req.Slug
+		err = links.add(code, link)
+		if errors.Is(err, os.ErrExist) {
+			writeJSONError(w, "Slug "+req.Slug+" is already in use", http.StatusConflict)
+			return
+		}
+	} else {
+		for i := 0; i < maxNameAttempts && errors.Is(err, os.ErrExist); i++ {
+			code = generateRandomString(shortCodeLength)
+			err = links.add(code, link)
+		}
+	}
+	if err != nil {
+		logger.Error("Error saving short link", "err", err)
+		writeJSONError(w, "Unable to save short link", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Created short link", "code", code, "target", req.URL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ShortenResponse{
+		Code:   code,
+		URL:    hostname + urlPrefix + "/s/" + code,
+		Target: req.URL,
+	})
+}
+
+// followShortLink redirects to the target of the short link in the path.
+func followShortLink(w http.ResponseWriter, r *http.Request) {
+	l, ok := links.get(r.PathValue("code"))
+	if !ok {
+		writeJSONError(w, "Short link not found", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, l.URL, http.StatusFound)
+}
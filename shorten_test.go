@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// shortenMux serves POST /shorten and GET /s/{code} as main registers them.
+func shortenMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /shorten", shortenURL)
+	mux.HandleFunc("GET /s/{code}", followShortLink)
+	return mux
+}
+
+func shorten(body string) *httptest.ResponseRecorder {
+	return serve(shortenMux(), httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(body)))
+}
+
+func TestShortenAndFollow(t *testing.T) {
+	setup(t)
+	const target = "https://example.com/some/long/path?q=1"
+	w := shorten(`{"url": "` + target + `"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp ShortenResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Code) != shortCodeLength || resp.URL != hostname+"/s/"+resp.Code || resp.Target != target {
+		t.Errorf("response %+v", resp)
+	}
+
+	follow := func(code string) *httptest.ResponseRecorder {
+		return serve(shortenMux(), httptest.NewRequest(http.MethodGet, "/s/"+code, nil))
+	}
+	if w := follow(resp.Code); w.Code != http.StatusFound || w.Header().Get("Location") != target {
+		t.Errorf("follow: status %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := follow("nope"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown code: status %d", w.Code)
+	}
+
+	// Links survive a restart.
+	reloaded, err := loadLinkStore(filepath.Join(uploadDir, linksFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, &links, reloaded)
+	if w := follow(resp.Code); w.Header().Get("Location") != target {
+		t.Errorf("follow after reload: status %d", w.Code)
+	}
+}
+
+func TestShortenSlug(t *testing.T) {
+	setup(t)
+	if w := shorten(`{"url": "https://example.com", "slug": "docs"}`); w.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if w := shorten(`{"url": "https://example.org", "slug": "docs"}`); w.Code != http.StatusConflict {
+		t.Errorf("taken slug: status %d", w.Code)
+	}
+	if w := shorten(`{"url": "https://example.org", "slug": "no_underscores"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid slug: status %d", w.Code)
+	}
+}
+
+func TestShortenRejects(t *testing.T) {
+	setup(t)
+	for _, body := range []string{
+		`{"url": "javascript:alert(1)"}`,
+		`{"url": "ftp://example.com/file"}`,
+		`{"url": "file:///etc/passwd"}`,
+		`{"url": "data:text/html,hi"}`,
+		`{"url": "/relative/path"}`,
+		`{"url": "https://"}`,
+		`{"url": "https://example.com/` + strings.Repeat("x", maxTargetLength) + `"}`,
+		`{}`,
+		`not json`,
+	} {
+		if w := shorten(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%.60s: status %d, want 400", body, w.Code)
+		}
+	}
+	if len(links.links) != 0 {
+		t.Errorf("stored %v", links.links)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// signingKey, when set, is used to sign download URLs in upload
+	// responses.
+	signingKey []byte
+	// requireSigned rejects downloads that don't carry a valid, unexpired
+	// signature.
+	requireSigned bool
+	// signedURLTTL is how long a signed URL stays valid when the upload
+	// doesn't ask for something else with its signed parameter.
+	signedURLTTL = 24 * time.Hour
+)
+
+var (
+	errSignatureMissing = errors.New("Download requires a signed URL")
+	errSignatureInvalid = errors.New("Invalid URL signature")
+	errSignatureExpired = errors.New("Signed URL has expired")
+)
+
+// loadSigningKey accepts the key itself, or the path of a file holding it.
+func loadSigningKey(value string) ([]byte, error) {
+	if data, err := os.ReadFile(value); err == nil {
+		value = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(value) < 16 {
+		return nil, errors.New("key must be at least 16 characters")
+	}
+	return []byte(value), nil
+}
+
+// urlSignature is the HMAC-SHA256 of a stored filename and the Unix time its
+// URL expires at.
+func urlSignature(name string, expires int64) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(name + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedQuery returns the expires and signature parameters that make a
+// download of name valid until expires.
+func signedQuery(name string, expires time.Time) string {
+	unix := expires.Unix()
+	return "expires=" + strconv.FormatInt(unix, 10) + "&signature=" + urlSignature(name, unix)
+}
+
+// generateSignedURL returns the URL of a stored file, signed to be valid
+// until expires.
+func generateSignedURL(name string, expires time.Time) string {
+	return fileURL(name) + "?" + signedQuery(name, expires)
+}
+
+// checkSignature verifies the expires and signature parameters of a
+// download of name.
+func checkSignature(name string, q url.Values, now time.Time) error {
+	if q.Get("signature") == "" {
+		return errSignatureMissing
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	if !hmac.Equal([]byte(q.Get("signature")), []byte(urlSignature(name, expires))) {
+		return errSignatureInvalid
+	}
+	if now.Unix() >= expires {
+		return errSignatureExpired
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSignature(t *testing.T) {
+	set(t, &signingKey, []byte("0123456789abcdef"))
+	now := time.Now()
+	valid, err := url.ParseQuery(signedQuery("a.txt", now.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(key, value string) url.Values {
+		q := url.Values{}
+		for k, v := range valid {
+			q[k] = v
+		}
+		q.Set(key, value)
+		return q
+	}
+	expired, _ := url.ParseQuery(signedQuery("a.txt", now.Add(-time.Second)))
+	tests := []struct {
+		name string
+		file string
+		q    url.Values
+		want error
+	}{
+		{"valid", "a.txt", valid, nil},
+		{"expired", "a.txt", expired, errSignatureExpired},
+		{"missing", "a.txt", url.Values{}, errSignatureMissing},
+		{"tampered signature", "a.txt", with("signature", strings.Repeat("A", len(valid.Get("signature")))), errSignatureInvalid},
+		{"extended expiry", "a.txt", with("expires", strconv.FormatInt(now.Add(48*time.Hour).Unix(), 10)), errSignatureInvalid},
+		{"unparsable expiry", "a.txt", with("expires", "soon"), errSignatureInvalid},
+		{"other file", "b.txt", valid, errSignatureInvalid},
+	}
+	for _, tt := range tests {
+		if err := checkSignature(tt.file, tt.q, now); err != tt.want {
+			t.Errorf("%s: checkSignature = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// A URL signed with another key isn't accepted either.
+	set(t, &signingKey, []byte("fedcba9876543210"))
+	if err := checkSignature("a.txt", valid, now); err != errSignatureInvalid {
+		t.Errorf("other key: checkSignature = %v", err)
+	}
+}
+
+func TestRequireSigned(t *testing.T) {
+	setup(t)
+	set(t, &signingKey, []byte("0123456789abcdef"))
+	set(t, &requireSigned, true)
+	up := uploaded(t, "/upload?signed=1h", "a.txt", "hello")
+	signed, err := url.Parse(up.SignedURL)
+	if err != nil || signed.Query().Get("signature") == "" {
+		t.Fatalf("signed URL %q", up.SignedURL)
+	}
+	if exp, _ := strconv.ParseInt(signed.Query().Get("expires"), 10, 64); time.Until(time.Unix(exp, 0)) > time.Hour {
+		t.Errorf("signed URL expires at %v, want within ?signed=1h", time.Unix(exp, 0))
+	}
+	tampered := strings.Replace(signed.RequestURI(), "signature=", "signature=x", 1)
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"signed", signed.RequestURI(), http.StatusOK},
+		{"unsigned", downloadPath + up.Filename, http.StatusForbidden},
+		{"tampered", tampered, http.StatusForbidden},
+		{"expired", strings.TrimPrefix(generateSignedURL(up.Filename, time.Now().Add(-time.Minute)), hostname), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := download(httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// checkContent controls whether uploads are validated against their actual
+// content rather than trusting the filename extension alone.
+var checkContent = true
+
+// executableMagic lists signatures of native executables, which
+// http.DetectContentType reports as plain application/octet-stream.
+var executableMagic = []struct {
+	prefix      string
+	contentType string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+}
+
+// detectContentType is http.DetectContentType extended to recognise
+// executables.
+func detectContentType(head []byte) string {
+	for _, m := range executableMagic {
+		if bytes.HasPrefix(head, []byte(m.prefix)) {
+			return m.contentType
+		}
+	}
+	return http.DetectContentType(head)
+}
+
+// validateContent checks the first bytes of a file against its claimed
+// extension and returns the detected content type. Executables are always
+// rejected. Images, audio, video and PDFs must actually look like what their
+// extension claims; other types are too loosely detected to compare, so they
+// are only rejected when they turn out to be executables.
+func validateContent(head []byte, ext string) (string, error) {
+	detected := detectContentType(head)
+	if !checkContent {
+		return detected, nil
+	}
+	for _, m := range executableMagic {
+		if detected == m.contentType {
+			return detected, errors.New("Executable content is not allowed")
+		}
+	}
+
+	claimed, _, _ := strings.Cut(mime.TypeByExtension(strings.ToLower(ext)), ";")
+	if claimed == "" || claimed == "image/svg+xml" || detected == "application/octet-stream" {
+		return detected, nil
+	}
+	claimedFamily, _, _ := strings.Cut(claimed, "/")
+	detectedFamily, _, _ := strings.Cut(detected, "/")
+	switch claimedFamily {
+	case "image":
+		if detectedFamily == "image" {
+			return detected, nil
+		}
+	case "audio", "video":
+		// Containers like MP4 and Ogg are shared between audio and video.
+		if detectedFamily == "audio" || detectedFamily == "video" || detected == "application/ogg" {
+			return detected, nil
+		}
+	default:
+		if claimed != "application/pdf" || detected == claimed {
+			return detected, nil
+		}
+	}
+	return detected, errors.New("File content does not match its " + ext + " extension")
+}
+
+// peekHead returns a reader yielding all of r along with its first sniffLen
+// bytes, so content can be checked before anything is written.
+func peekHead(r io.Reader) (io.Reader, []byte, error) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return br, head, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateContent(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32)
+	tests := []struct {
+		name     string
+		content  string
+		ext      string
+		wantType string
+		wantErr  bool
+	}{
+		{"png as png", png, ".png", "image/png", false},
+		{"png as jpg", png, ".jpg", "image/png", false},
+		{"text as png", "just some text", ".png", "text/plain; charset=utf-8", true},
+		{"text as pdf", "just some text", ".pdf", "text/plain; charset=utf-8", true},
+		{"pdf", "%PDF-1.7\n", ".pdf", "application/pdf", false},
+		{"windows executable", "MZ\x90\x00", ".txt", "application/x-msdownload", true},
+		{"elf executable", "\x7fELF\x02\x01", ".bin", "application/x-executable", true},
+		{"mach-o executable", "\xcf\xfa\xed\xfe", ".dat", "application/x-mach-binary", true},
+		{"unknown binary as png", "\x00\x01\x02\x03", ".png", "application/octet-stream", false},
+		{"text as csv", "a,b\n1,2\n", ".csv", "text/plain; charset=utf-8", false},
+		{"ogg as mp3", "OggS\x00\x02", ".mp3", "application/ogg", false},
+		{"svg", "<svg xmlns='http://www.w3.org/2000/svg'/>", ".svg", "text/plain; charset=utf-8", false},
+		{"claimed extension in upper case", "text", ".PNG", "text/plain; charset=utf-8", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateContent([]byte(tt.content), tt.ext)
+			if got != tt.wantType || (err != nil) != tt.wantErr {
+				t.Errorf("validateContent = %q, %v; want %q, error %v", got, err, tt.wantType, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateContentDisabled(t *testing.T) {
+	set(t, &checkContent, false)
+	if _, err := validateContent([]byte("MZ\x90\x00"), ".png"); err != nil {
+		t.Errorf("with checks off: %v", err)
+	}
+}
+
+func TestUploadContentMismatch(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload", file("photo.png", "not really a picture"))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("status %d, want 415: %s", w.Code, w.Body)
+	}
+	if names := stored(t); len(names) != 0 {
+		t.Errorf("stored %v", names)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// embeddedStatic holds the upload page and a default favicon, so the binary
+// serves them without a static directory next to it.
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+// staticFiles returns the files served at /: the embedded copy, overlaid
+// with staticDir when one is given. Files placed in staticDir replace the
+// built-in ones, and any it lacks, such as favicon.ico, still come from the
+// binary.
+func staticFiles() http.FileSystem {
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		log.Fatalf("Error loading embedded static files: %v", err)
+	}
+	if _, err := fs.Stat(sub, "index.html"); err != nil {
+		slog.Warn("The embedded static files have no index.html; / will only list them")
+	}
+	if staticDir == "" {
+		return http.FS(sub)
+	}
+	if fi, err := os.Stat(staticDir); err != nil || !fi.IsDir() {
+		log.Fatalf("Static directory %s does not exist", staticDir)
+	}
+	return overlayFS{http.Dir(staticDir), http.FS(sub)}
+}
+
+// overlayFS serves files from top, falling back to base for those it
+// doesn't have.
+type overlayFS struct {
+	top, base http.FileSystem
+}
+
+func (o overlayFS) Open(name string) (http.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.base.Open(name)
+	}
+	return f, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("custom page"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "extra.css"), []byte("body {}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &staticDir, dir)
+	h := http.FileServer(staticFiles())
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "custom page"},
+		{"/extra.css", http.StatusOK, "body {}"},
+		// Files the directory lacks come from the binary.
+		{"/favicon.ico", http.StatusOK, ""},
+		{"/missing.js", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := serve(h, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("GET %s: status %d, body %q; want %d with %q", tt.path, w.Code, w.Body, tt.status, tt.body)
+		}
+	}
+}
+
+// TestEmptyStaticDir checks a fresh deployment with nothing in -static-dir
+// still serves the built-in page and favicon.
+func TestEmptyStaticDir(t *testing.T) {
+	set(t, &staticDir, t.TempDir())
+	h := http.FileServer(staticFiles())
+	for _, tt := range []struct{ path, file string }{
+		{"/favicon.ico", "static/favicon.ico"},
+		{"/", "static/index.html"},
+	} {
+		want, err := embeddedStatic.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := serve(h, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != string(want) {
+			t.Errorf("GET %s: status %d, %d bytes; want the %d embedded in %s", tt.path, w.Code, w.Body.Len(), len(want), tt.file)
+		}
+	}
+}
+
+func TestEmbeddedStatic(t *testing.T) {
+	set(t, &staticDir, "")
+	h := http.FileServer(staticFiles())
+	tests := []struct {
+		path, file string
+	}{
+		{"/", "static/index.html"},
+		{"/favicon.ico", "static/favicon.ico"},
+		{"/style.css", "static/style.css"},
+	}
+	for _, tt := range tests {
+		want, err := embeddedStatic.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := serve(h, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != string(want) {
+			t.Errorf("GET %s: status %d, %d bytes; want the %d embedded in %s", tt.path, w.Code, w.Body.Len(), len(want), tt.file)
+		}
+	}
+	if w := serve(h, httptest.NewRequest(http.MethodGet, "/missing.js", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("GET /missing.js: status %d, want 404", w.Code)
+	}
+}
+
+func TestOverlayFS(t *testing.T) {
+	top, base := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(top, "both.txt"), []byte("top"), 0o644)
+	os.WriteFile(filepath.Join(base, "both.txt"), []byte("base"), 0o644)
+	os.WriteFile(filepath.Join(base, "base.txt"), []byte("base only"), 0o644)
+	h := http.FileServer(overlayFS{http.Dir(top), http.Dir(base)})
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/both.txt", http.StatusOK, "top"},
+		{"/base.txt", http.StatusOK, "base only"},
+		{"/neither.txt", http.StatusNotFound, "404 page not found\n"},
+	}
+	for _, tt := range tests {
+		w := serve(h, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("GET %s: status %d, body %q; want %d, %q", tt.path, w.Code, w.Body, tt.status, tt.body)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// statsFilename holds download counts next to the metadata index. Counts
+// change on every download, so unlike metadata they are kept in memory and
+// flushed to disk periodically rather than written through.
+const statsFilename = ".filehost-stats.json"
+
+const statsFlushInterval = 10 * time.Second
+
+type fileStats struct {
+	Downloads    int64     `json:"downloads"`
+	LastAccessed time.Time `json:"lastAccessed,omitzero"`
+}
+
+type statsStore struct {
+	mu    sync.Mutex
+	path  string
+	files map[string]fileStats
+	dirty bool
+}
+
+var downloadStats *statsStore
+
+func loadStatsStore(path string) (*statsStore, error) {
+	s := &statsStore{path: path, files: make(map[string]fileStats)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// record counts a completed download of name.
+func (s *statsStore) record(name string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.files[name]
+	st.Downloads++
+	st.LastAccessed = now
+	s.files[name] = st
+	s.dirty = true
+}
+
+func (s *statsStore) get(name string) fileStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[name]
+}
+
+func (s *statsStore) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; ok {
+		delete(s.files, name)
+		s.dirty = true
+	}
+}
+
+func (s *statsStore) rename(oldName, newName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.files[oldName]; ok {
+		delete(s.files, oldName)
+		s.files[newName] = st
+		s.dirty = true
+	}
+}
+
+// merge adds the counts in files, replacing those for the same names.
+func (s *statsStore) merge(files map[string]fileStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, st := range files {
+		s.files[name] = st
+	}
+	s.dirty = true
+}
+
+// flush writes the counts to disk if they changed since the last flush.
+func (s *statsStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(s.files)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func flushStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := downloadStats.flush(); err != nil {
+			slog.Error("Error saving download stats", "err", err)
+		}
+	}
+}
+
+// FileStats is the GET /api/files/{name}/stats response.
+type FileStats struct {
+	Filename     string    `json:"filename"`
+	Description  string    `json:"description,omitempty"`
+	Downloads    int64     `json:"downloads"`
+	LastAccessed time.Time `json:"lastAccessed,omitzero"`
+}
+
+func serveFileStats(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !isValidName(name) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	exists, err := store.Exists(name)
+	if err != nil {
+		requestLogger(r).Error("Error checking file", "file", name, "err", err)
+		writeJSONError(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	m, _ := metadata.get(name)
+	if !exists || m.expired(time.Now()) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	st := downloadStats.get(name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FileStats{Filename: name, Description: m.Description, Downloads: st.Downloads, LastAccessed: st.LastAccessed})
+}
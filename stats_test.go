@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// statsMux routes the stats endpoints as main does, next to the file
+// details they must not clash with.
+func statsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/files/{name...}", serveFileDetails)
+	mux.HandleFunc("GET /api/files/{name}/stats", serveFileStats)
+	mux.HandleFunc("GET /api/stats/files/{name...}", serveFileStats)
+	return mux
+}
+
+func fileStatsOf(t *testing.T, name string) (FileStats, int) {
+	t.Helper()
+	return fileStatsAt(t, "/api/files/"+name+"/stats")
+}
+
+func fileStatsAt(t *testing.T, target string) (FileStats, int) {
+	t.Helper()
+	w := serve(statsMux(), httptest.NewRequest(http.MethodGet, target, nil))
+	var st FileStats
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return st, w.Code
+}
+
+func TestDownloadCounting(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		header  string
+		value   string
+		counted bool
+	}{
+		{"full download", "GET", "", "", true},
+		{"HEAD", "HEAD", "", "", false},
+		{"range", "GET", "Range", "bytes=0-2", false},
+		{"not modified", "GET", "If-None-Match", "*", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			up := uploaded(t, "/upload?description=counted", "a.txt", "hello world")
+			r := httptest.NewRequest(tt.method, downloadPath+up.Filename, nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			download(r)
+			st, status := fileStatsOf(t, up.Filename)
+			if status != http.StatusOK {
+				t.Fatalf("stats: status %d", status)
+			}
+			if counted := st.Downloads == 1; counted != tt.counted || counted == st.LastAccessed.IsZero() {
+				t.Errorf("stats %+v, want counted %v", st, tt.counted)
+			}
+			if st.Description != "counted" {
+				t.Errorf("description %q", st.Description)
+			}
+		})
+	}
+}
+
+func TestFileStatsErrors(t *testing.T) {
+	setup(t)
+	expired := uploaded(t, "/upload?ttl=1ns", "a.txt", "gone")
+	for _, name := range []string{"missing.txt", expired.Filename, metaFilename} {
+		if _, status := fileStatsOf(t, name); status != http.StatusNotFound {
+			t.Errorf("stats of %s: status %d, want 404", name, status)
+		}
+	}
+}
+
+func TestStatsPersist(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload", "a.txt", "hello")
+	get(up.Filename)
+	get(up.Filename)
+	if err := downloadStats.flush(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadStatsStore(downloadStats.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.get(up.Filename).Downloads; got != 2 {
+		t.Errorf("%d downloads after reload, want 2", got)
+	}
+}
+
+func TestFileStatsNested(t *testing.T) {
+	setup(t)
+	w := upload(t, "/upload?preservePaths=1", file("docs/a.txt", "hello"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+	}
+	name := decodeUploads(t, w)[0].Filename
+	get(name)
+	st, status := fileStatsAt(t, "/api/stats/files/"+name)
+	if status != http.StatusOK || st.Downloads != 1 || st.Filename != name {
+		t.Errorf("stats %+v, status %d", st, status)
+	}
+	// The details of the file are still served alongside.
+	if w := serve(statsMux(), httptest.NewRequest(http.MethodGet, "/api/files/"+name, nil)); w.Code != http.StatusOK {
+		t.Errorf("details: status %d", w.Code)
+	}
+}
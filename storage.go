@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Storage is where uploaded files are kept. Names are the stored filenames
+// handed out in upload responses; callers validate them before use. Names
+// may contain slashes for uploads that kept their directory structure.
+type Storage interface {
+	// Put stores the content of r under name. It fails with an error
+	// matching os.ErrExist, without consuming r, if name is already taken.
+	Put(name string, r io.Reader) error
+	// Get opens the named file. It fails with os.ErrNotExist if it's missing.
+	Get(name string) (StoredFile, error)
+	// Delete removes the named file, failing with os.ErrNotExist if it's
+	// missing.
+	Delete(name string) error
+	Exists(name string) (bool, error)
+	// List returns every stored file, excluding internal files whose names,
+	// or the name of a directory they are in, start with a dot.
+	List() ([]FileInfo, error)
+}
+
+// FileInfo describes a stored file without opening it.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// StoredFile is an open file from a Storage backend. It is seekable so it
+// can be served with http.ServeContent.
+type StoredFile interface {
+	io.ReadSeekCloser
+	Size() int64
+	ModTime() time.Time
+}
+
+// fileAdopter is implemented by backends that can take ownership of a file
+// on local disk without copying it, e.g. by hard linking it into place.
+type fileAdopter interface {
+	PutFile(name, path string) error
+}
+
+var store Storage
+
+// isInternal reports whether name or one of its directories starts with a
+// dot, marking it as internal rather than an upload.
+func isInternal(name string) bool {
+	for _, s := range strings.Split(name, "/") {
+		if strings.HasPrefix(s, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// adoptFile stores the local file at path under name, using the backend's
+// fileAdopter fast path when it has one. The caller removes path afterwards.
+func adoptFile(name, path string) error {
+	if a, ok := store.(fileAdopter); ok {
+		return a.PutFile(name, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.Put(name, f)
+}
+
+// localStorage keeps files in a directory on disk. It is the default backend.
+type localStorage struct {
+	dir string
+}
+
+func (s localStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+// makeParent creates the directories a nested name is stored in.
+func (s localStorage) makeParent(name string) error {
+	if !strings.Contains(name, "/") {
+		return nil
+	}
+	return os.MkdirAll(filepath.Dir(s.path(name)), dirMode)
+}
+
+func (s localStorage) Put(name string, r io.Reader) error {
+	f, err := s.create(name)
+	if err != nil {
+		return err
+	}
+	return fill(f, r)
+}
+
+// create makes the empty file name, failing with os.ErrExist if it's taken.
+func (s localStorage) create(name string) (*os.File, error) {
+	if err := s.makeParent(name); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	// Set the mode again so the umask doesn't change it.
+	if err := f.Chmod(fileMode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// fill copies r into a file from create and closes it, removing the file if
+// that fails.
+func fill(f *os.File, r io.Reader) error {
+	_, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s localStorage) PutFile(name, path string) error {
+	if err := s.makeParent(name); err != nil {
+		return err
+	}
+	// Temp files are private to the server; give the file the mode regular
+	// uploads get.
+	if err := os.Chmod(path, fileMode); err != nil {
+		return err
+	}
+	return os.Link(path, s.path(name))
+}
+
+func (s localStorage) Get(name string) (StoredFile, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return localFile{f, fi}, nil
+}
+
+// Delete removes the file and then any directories it leaves empty.
+func (s localStorage) Delete(name string) error {
+	if err := os.Remove(s.path(name)); err != nil {
+		return err
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(s.path(dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s localStorage) Exists(name string) (bool, error) {
+	_, err := os.Stat(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s localStorage) List() ([]FileInfo, error) {
+	var files []FileInfo
+	err := filepath.WalkDir(s.dir, func(p string, e fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p == s.dir {
+			return nil
+		}
+		if strings.HasPrefix(e.Name(), ".") {
+			if e.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !e.Type().IsRegular() {
+			return nil
+		}
+		fi, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Name: filepath.ToSlash(rel), Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+type localFile struct {
+	*os.File
+	fi os.FileInfo
+}
+
+func (f localFile) Size() int64        { return f.fi.Size() }
+func (f localFile) ModTime() time.Time { return f.fi.ModTime() }
+
+// isDiskFull reports whether err comes from running out of disk space or
+// hitting a disk quota.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeS3 is enough of the S3 API for s3Storage: objects in one bucket,
+// listed two per page to exercise continuation.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !ok && r.URL.Path != "/bucket/" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, exists := f.objects[key]
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		if exists && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		f.objects[key], _ = io.ReadAll(r.Body)
+	case !exists:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		offset := 0
+		if rng, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			offset, _ = strconv.Atoi(strings.TrimSuffix(rng, "-"))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-offset))
+		if offset > 0 {
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data[offset:])
+		}
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	type object struct {
+		Key          string
+		Size         int
+		LastModified time.Time
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	for i := start; i < len(keys) && i < start+2; i++ {
+		result.Contents = append(result.Contents, object{Key: keys[i], Size: len(f.objects[keys[i]]), LastModified: time.Now()})
+	}
+	if start+2 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 2)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// newTestS3Storage returns an s3Storage talking to a fake S3.
+func newTestS3Storage(t *testing.T) *s3Storage {
+	t.Helper()
+	srv := httptest.NewServer(&fakeS3{objects: make(map[string][]byte)})
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	s, err := newS3Storage(srv.URL, "bucket", "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// storageBackends are the backends every Storage test runs against.
+var storageBackends = []struct {
+	name string
+	new  func(t *testing.T) Storage
+}{
+	{"local", func(t *testing.T) Storage { return localStorage{dir: t.TempDir()} }},
+	{"s3", func(t *testing.T) Storage { return newTestS3Storage(t) }},
+	{"encrypted", func(t *testing.T) Storage { return newTestEncryptedStorage(t, localStorage{dir: t.TempDir()}) }},
+	{"cached", func(t *testing.T) Storage { return newCachedStorage(localStorage{dir: t.TempDir()}, 1<<20, 64<<10) }},
+}
+
+func TestStorage(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := backend.new(t)
+			files := map[string]string{
+				"a.txt":       "first",
+				"b.txt":       strings.Repeat("second", 1000),
+				"dir/c.txt":   "nested",
+				".internal":   "hidden",
+				".dir/d.txt":  "hidden too",
+				"dir/e f.txt": "spaced",
+			}
+			for name, content := range files {
+				if err := s.Put(name, strings.NewReader(content)); err != nil {
+					t.Fatalf("Put(%s): %v", name, err)
+				}
+			}
+			if err := s.Put("a.txt", strings.NewReader("again")); !errors.Is(err, os.ErrExist) {
+				t.Errorf("Put of a taken name = %v, want ErrExist", err)
+			}
+
+			for name, content := range files {
+				f, err := s.Get(name)
+				if err != nil {
+					t.Fatalf("Get(%s): %v", name, err)
+				}
+				if f.Size() != int64(len(content)) {
+					t.Errorf("%s: Size() = %d, want %d", name, f.Size(), len(content))
+				}
+				// Seek as http.ServeContent does for a range request.
+				if _, err := f.Seek(2, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(f)
+				f.Close()
+				if err != nil || string(got) != content[2:] {
+					t.Errorf("%s from offset 2 = %q, %v; want %q", name, got, err, content[2:])
+				}
+			}
+
+			list, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range list {
+				names = append(names, f.Name)
+			}
+			slices.Sort(names)
+			if want := []string{"a.txt", "b.txt", "dir/c.txt", "dir/e f.txt"}; !slices.Equal(names, want) {
+				t.Errorf("List() = %v, want %v", names, want)
+			}
+
+			tests := []struct {
+				name   string
+				exists bool
+			}{
+				{"a.txt", true},
+				{"dir/c.txt", true},
+				{"missing.txt", false},
+			}
+			for _, tt := range tests {
+				if exists, err := s.Exists(tt.name); err != nil || exists != tt.exists {
+					t.Errorf("Exists(%s) = %v, %v; want %v", tt.name, exists, err, tt.exists)
+				}
+			}
+
+			if err := s.Delete("a.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get("a.txt"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Get after Delete = %v, want ErrNotExist", err)
+			}
+			if err := s.Delete("a.txt"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("second Delete = %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+// TestUploadToS3 runs an upload and download through the S3 backend.
+func TestUploadToS3(t *testing.T) {
+	setup(t)
+	set(t, &store, Storage(newTestS3Storage(t)))
+	up := uploaded(t, "/upload", "a.txt", "stored in s3")
+	w := get(up.Filename)
+	if w.Code != http.StatusOK || w.Body.String() != "stored in s3" {
+		t.Errorf("download: status %d, body %q", w.Code, w.Body)
+	}
+}
+
+// failingReader returns err once n bytes have been read.
+type failingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, r.err
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+// failingStorage stores files locally but fails with err partway through
+// writing each one, as a filling disk does.
+type failingStorage struct {
+	localStorage
+	err error
+}
+
+func (s failingStorage) Put(name string, r io.Reader) error {
+	return s.localStorage.Put(name, &failingReader{r: r, n: 10, err: s.err})
+}
+
+func TestWriteErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"disk full", syscall.ENOSPC, http.StatusInsufficientStorage},
+		{"quota exceeded", syscall.EDQUOT, http.StatusInsufficientStorage},
+		{"other error", syscall.EIO, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &store, Storage(failingStorage{localStorage{dir: uploadDir}, &os.PathError{Op: "write", Path: "x", Err: tt.err}}))
+			w := upload(t, "/upload", file("a.txt", strings.Repeat("x", 100)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusInsufficientStorage && !strings.Contains(w.Body.String(), "Not enough storage space") {
+				t.Errorf("body = %s", w.Body)
+			}
+			// The partial file is removed, as are temp files.
+			entries, err := os.ReadDir(uploadDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.Name() != metaFilename && e.Name() != statsFilename && e.Name() != linksFilename {
+					t.Errorf("%s left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestIsDiskFull(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{syscall.ENOSPC, true},
+		{&os.PathError{Op: "write", Path: "f", Err: syscall.EDQUOT}, true},
+		{syscall.EIO, false},
+		{os.ErrNotExist, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isDiskFull(tt.err); got != tt.want {
+			t.Errorf("isDiskFull(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestFillRemovesPartialFile checks the local backend cleans up after a
+// failed copy on its own.
+func TestFillRemovesPartialFile(t *testing.T) {
+	dir := t.TempDir()
+	s := localStorage{dir: dir}
+	err := s.Put("partial.txt", &failingReader{r: strings.NewReader(strings.Repeat("x", 100)), n: 10, err: syscall.ENOSPC})
+	if !isDiskFull(err) {
+		t.Errorf("Put = %v, want ENOSPC", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial.txt")); !os.IsNotExist(err) {
+		t.Errorf("partial file still there: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverStatsTTL is how long a computed /api/stats summary is reused, so
+// frequent calls don't walk a large upload directory every time.
+const serverStatsTTL = 30 * time.Second
+
+// ServerStats is the GET /api/stats response, covering every stored file
+// apart from thumbnails and internal files.
+type ServerStats struct {
+	Files       int            `json:"files"`
+	TotalBytes  int64          `json:"totalBytes"`
+	AverageSize int64          `json:"averageSize"`
+	MedianSize  int64          `json:"medianSize"`
+	Oldest      time.Time      `json:"oldest,omitzero"`
+	Newest      time.Time      `json:"newest,omitzero"`
+	Extensions  map[string]int `json:"extensions"`
+}
+
+var serverStatsCache struct {
+	sync.Mutex
+	stats    ServerStats
+	computed time.Time
+}
+
+func computeServerStats() (ServerStats, error) {
+	files, err := store.List()
+	if err != nil {
+		return ServerStats{}, err
+	}
+	stats := ServerStats{Extensions: make(map[string]int)}
+	var sizes []int64
+	for _, f := range files {
+		if isThumbnail(f.Name) {
+			continue
+		}
+		stats.Files++
+		stats.TotalBytes += f.Size
+		sizes = append(sizes, f.Size)
+		// The modification time changes when a file is replaced, and isn't
+		// kept by backups, so it's only used for files without metadata.
+		uploadedAt := f.ModTime
+		if m, ok := metadata.get(f.Name); ok && !m.UploadedAt.IsZero() {
+			uploadedAt = m.UploadedAt
+		}
+		if stats.Oldest.IsZero() || uploadedAt.Before(stats.Oldest) {
+			stats.Oldest = uploadedAt
+		}
+		if uploadedAt.After(stats.Newest) {
+			stats.Newest = uploadedAt
+		}
+		stats.Extensions[strings.ToLower(path.Ext(f.Name))]++
+	}
+	if len(sizes) > 0 {
+		stats.AverageSize = stats.TotalBytes / int64(len(sizes))
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+		mid := len(sizes) / 2
+		stats.MedianSize = sizes[mid]
+		if len(sizes)%2 == 0 {
+			stats.MedianSize = (sizes[mid-1] + sizes[mid]) / 2
+		}
+	}
+	return stats, nil
+}
+
+func serveServerStats(w http.ResponseWriter, r *http.Request) {
+	serverStatsCache.Lock()
+	if time.Since(serverStatsCache.computed) >= serverStatsTTL {
+		stats, err := computeServerStats()
+		if err != nil {
+			serverStatsCache.Unlock()
+			requestLogger(r).Error("Error listing files", "err", err)
+			writeJSONError(w, "Unable to compute stats", http.StatusInternalServerError)
+			return
+		}
+		serverStatsCache.stats, serverStatsCache.computed = stats, time.Now()
+	}
+	stats := serverStatsCache.stats
+	serverStatsCache.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
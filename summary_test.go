@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerStats(t *testing.T) {
+	setup(t)
+	serverStatsCache.computed = time.Time{}
+	t.Cleanup(func() { serverStatsCache.computed = time.Time{} })
+	a := uploaded(t, "/upload", "a.txt", "12345")
+	uploaded(t, "/upload", "b.txt", "1234567890")
+	uploaded(t, "/upload", "c.PNG", testPNG(t, 4, 4))
+	uploaded(t, "/upload", "d.png", testPNG(t, 64, 64))
+	thumbnailJobs.Wait()
+
+	// The recorded upload time counts, not when the file was last written.
+	oldest := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	m, _ := metadata.get(a.Filename)
+	m.UploadedAt = oldest
+	metadata.set(a.Filename, m)
+
+	w := httptest.NewRecorder()
+	serveServerStats(w, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var stats ServerStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	for _, name := range stored(t) {
+		m, _ := metadata.get(name)
+		total += m.Size
+	}
+	// Thumbnails of the PNGs are left out.
+	if stats.Files != 4 || stats.TotalBytes != total || stats.AverageSize != total/4 {
+		t.Errorf("files %d, total %d, average %d; want 4, %d, %d", stats.Files, stats.TotalBytes, stats.AverageSize, total, total/4)
+	}
+	if stats.Extensions[".txt"] != 2 || stats.Extensions[".png"] != 2 || len(stats.Extensions) != 2 {
+		t.Errorf("extensions %v", stats.Extensions)
+	}
+	if !stats.Oldest.Equal(oldest) {
+		t.Errorf("oldest %v, want %v", stats.Oldest, oldest)
+	}
+	if time.Since(stats.Newest) > time.Minute {
+		t.Errorf("newest %v", stats.Newest)
+	}
+
+	// Within the TTL the cached summary is served.
+	uploaded(t, "/upload", "e.txt", "more")
+	w = httptest.NewRecorder()
+	serveServerStats(w, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	var cached ServerStats
+	json.NewDecoder(w.Body).Decode(&cached)
+	if cached.Files != 4 {
+		t.Errorf("cached summary counts %d files", cached.Files)
+	}
+}
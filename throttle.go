@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most written to a throttled connection at once, so
+// the rate stays smooth rather than arriving in large bursts.
+const throttleChunk = 16 << 10
+
+// byteBucket is a token bucket of bytes refilled at rate per second, holding
+// up to a second's worth.
+type byteBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(rate int64) *byteBucket {
+	return &byteBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take claims n bytes and returns how long to wait before sending them.
+func (b *byteBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttleDownloads returns middleware limiting how fast responses are sent
+// to rate bytes per second, either for each request on its own or, with
+// global, for all requests through any handler it wraps together.
+func throttleDownloads(rate int64, global bool) func(http.Handler) http.Handler {
+	shared := newByteBucket(rate)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bucket := shared
+			if !global {
+				bucket = newByteBucket(rate)
+			}
+			next.ServeHTTP(&throttledWriter{ResponseWriter: w, bucket: bucket, ctx: r.Context()}, r)
+		})
+	}
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	bucket *byteBucket
+	ctx    context.Context
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		if wait := w.bucket.take(len(chunk)); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-w.ctx.Done():
+				t.Stop()
+				return written, w.ctx.Err()
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
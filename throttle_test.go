@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRate = 256 << 10
+
+// throttledGet downloads name through throttleDownloads and returns how long
+// it took.
+func throttledGet(t *testing.T, h http.Handler, name string) time.Duration {
+	t.Helper()
+	start := time.Now()
+	w := serve(h, httptest.NewRequest(http.MethodGet, downloadPath+name, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d", w.Code)
+	}
+	return time.Since(start)
+}
+
+func TestThrottleDownloads(t *testing.T) {
+	setup(t)
+	// The first second's worth is sent at once, the rest at the rate.
+	up := uploaded(t, "/upload", "a.bin", strings.Repeat("x", testRate*3/2))
+	h := http.StripPrefix(downloadPath, throttleDownloads(testRate, false)(http.HandlerFunc(serveUploaded)))
+	if took := throttledGet(t, h, up.Filename); took < 450*time.Millisecond {
+		t.Errorf("1.5s worth of data took %v, want at least 0.5s", took)
+	}
+	// Each request has a bucket of its own.
+	if took := throttledGet(t, h, up.Filename); took < 450*time.Millisecond || took > 2*time.Second {
+		t.Errorf("second download took %v", took)
+	}
+}
+
+func TestThrottleDownloadsGlobal(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload", "a.bin", strings.Repeat("x", testRate))
+	for _, tt := range []struct {
+		global  bool
+		atLeast time.Duration
+		atMost  time.Duration
+	}{
+		// Two seconds' worth through one bucket.
+		{true, 950 * time.Millisecond, 3 * time.Second},
+		// A second's worth each, sent at once.
+		{false, 0, 500 * time.Millisecond},
+	} {
+		h := http.StripPrefix(downloadPath, throttleDownloads(testRate, tt.global)(http.HandlerFunc(serveUploaded)))
+		start := time.Now()
+		var wg sync.WaitGroup
+		for range 2 {
+			wg.Go(func() { throttledGet(t, h, up.Filename) })
+		}
+		wg.Wait()
+		if took := time.Since(start); took < tt.atLeast || took > tt.atMost {
+			t.Errorf("global %v: two downloads took %v, want %v to %v", tt.global, took, tt.atLeast, tt.atMost)
+		}
+	}
+}
+
+func TestThrottledWriterCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &throttledWriter{ResponseWriter: httptest.NewRecorder(), bucket: newByteBucket(1 << 10), ctx: ctx}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	n, err := w.Write(make([]byte, 64<<10))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Write error %v, want context.Canceled", err)
+	}
+	if n >= 64<<10 || time.Since(start) > time.Second {
+		t.Errorf("wrote %d bytes in %v before giving up", n, time.Since(start))
+	}
+}
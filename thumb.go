@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// thumbSize is the largest width or height of generated thumbnails. Zero
+// disables them.
+var thumbSize = 256
+
+// thumbPrefix marks stored thumbnails. Upload names never start with it since
+// their random prefix has no underscore in it.
+const thumbPrefix = "thumb_"
+
+// maxThumbPixels bounds the images we are willing to decode, so a small file
+// claiming huge dimensions can't exhaust memory.
+const maxThumbPixels = 64 << 20
+
+// thumbnailTypes are the detected content types we can decode.
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// thumbnailJobs tracks thumbnails still being generated so shutdown can let
+// them finish.
+var thumbnailJobs sync.WaitGroup
+
+func thumbName(name string) string {
+	return thumbPrefix + name + ".jpg"
+}
+
+func isThumbnail(name string) bool {
+	return strings.HasPrefix(name, thumbPrefix)
+}
+
+func canThumbnail(contentType string) bool {
+	return thumbSize > 0 && thumbnailTypes[contentType]
+}
+
+// startThumbnail generates the thumbnail for a stored file in the background
+// so the upload response isn't held up by decoding. Failures, e.g. from a
+// corrupt image, are only logged.
+func startThumbnail(name string) {
+	thumbnailJobs.Add(1)
+	go func() {
+		defer thumbnailJobs.Done()
+		if err := makeThumbnail(name); err != nil {
+			slog.Error("Error generating thumbnail", "file", name, "err", err)
+		}
+	}()
+}
+
+// removeThumbnail deletes the thumbnail of a removed file, if it had one.
+func removeThumbnail(name string) {
+	err := store.Delete(thumbName(name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Error removing thumbnail", "file", name, "err", err)
+	}
+}
+
+func makeThumbnail(name string) error {
+	f, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > maxThumbPixels {
+		return fmt.Errorf("image is too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(img, thumbSize), &jpeg.Options{Quality: 85}); err != nil {
+		return err
+	}
+	err = store.Put(thumbName(name), &buf)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+// scaleDown shrinks img to fit within size×size, averaging the source pixels
+// covered by each output pixel. Images that already fit are only flattened
+// onto white, since JPEG has no transparency.
+func scaleDown(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	src := flatten(img)
+
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, sh*size/sw
+		} else {
+			dw, dh = sw*size/sh, size
+		}
+	}
+	if dw == sw && dh == sh {
+		return src
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+			var r, g, bl, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4:]
+					r, g, bl = r+int(p[0]), g+int(p[1]), bl+int(p[2])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(bl/n), 0xff
+		}
+	}
+	return dst
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"image"
+	"image/jpeg"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestScaleDown(t *testing.T) {
+	tests := []struct {
+		w, h         int
+		wantW, wantH int
+	}{
+		{100, 50, 100, 50},
+		{512, 256, 256, 128},
+		{256, 1024, 64, 256},
+		{3000, 2, 256, 1},
+	}
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, tt.w, tt.h))
+		b := scaleDown(img, 256).Bounds()
+		if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("scaleDown of %dx%d = %dx%d, want %dx%d", tt.w, tt.h, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		filename  string
+		content   func(t *testing.T) string
+		wantThumb bool
+	}{
+		{"large png", "", "big.png", func(t *testing.T) string { return testPNG(t, 600, 300) }, true},
+		{"small png", "", "small.png", func(t *testing.T) string { return testPNG(t, 20, 20) }, true},
+		{"text", "", "notes.txt", func(t *testing.T) string { return "not an image" }, false},
+		{"password-protected png", "?password=secret", "big.png", func(t *testing.T) string { return testPNG(t, 600, 300) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			up := uploaded(t, "/upload"+tt.query, tt.filename, tt.content(t))
+			thumbnailJobs.Wait()
+			if (up.ThumbnailURL != "") != tt.wantThumb {
+				t.Fatalf("thumbnailUrl = %q", up.ThumbnailURL)
+			}
+			w := get(thumbName(up.Filename))
+			if (w.Code == http.StatusOK) != tt.wantThumb {
+				t.Fatalf("GET thumbnail: status %d", w.Code)
+			}
+			if !tt.wantThumb {
+				return
+			}
+			if up.ThumbnailURL != fileURL(thumbName(up.Filename)) {
+				t.Errorf("thumbnailUrl = %s", up.ThumbnailURL)
+			}
+			cfg, err := jpeg.DecodeConfig(strings.NewReader(w.Body.String()))
+			if err != nil || max(cfg.Width, cfg.Height) > thumbSize {
+				t.Errorf("thumbnail is %dx%d, %v", cfg.Width, cfg.Height, err)
+			}
+			// Thumbnails go with their file.
+			forgetUpload(up.Filename)
+			if w := get(thumbName(up.Filename)); w.Code != http.StatusNotFound {
+				t.Errorf("thumbnail kept after its file was removed: status %d", w.Code)
+			}
+		})
+	}
+}
+
+// TestThumbnailAfterRejectedBatch checks thumbnails only start once a whole
+// upload is accepted, so none outlive a rolled back batch.
+func TestThumbnailAfterRejectedBatch(t *testing.T) {
+	setup(t)
+	set(t, &maxFiles, 1)
+	w := upload(t, "/upload", file("a.png", testPNG(t, 50, 50)), file("b.png", testPNG(t, 50, 50)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	thumbnailJobs.Wait()
+	files, _ := store.List()
+	if len(files) != 0 {
+		t.Errorf("left %v behind", files)
+	}
+}
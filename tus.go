@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads follow the core tus 1.0 protocol plus the creation
+// extension: POST /files creates an upload, HEAD /files/{id} reports how much
+// has been received and PATCH /files/{id} appends from that offset. Partial
+// data lives in a hidden .part file in uploadDir next to a small JSON file
+// describing the upload, so an interrupted upload can resume after a restart.
+const tusVersion = "1.0.0"
+
+type tusUpload struct {
+	Length       int64  `json:"length"`
+	Filename     string `json:"filename"`
+	OriginalName string `json:"originalName"`
+	Owner        string `json:"owner,omitempty"`
+}
+
+// tusExpiry is how long an unfinished resumable upload is kept after data
+// last arrived for it.
+var tusExpiry = 24 * time.Hour
+
+// tusLocks serialises PATCH requests per upload id so two clients can't
+// append to the same .part file at once.
+var tusLocks sync.Map
+
+// tusName is the name an unfinished upload's files share in uploadDir, and
+// its quota claim is held under.
+func tusName(id string) string {
+	return ".tus-" + id
+}
+
+func tusPaths(id string) (part, info string) {
+	return filepath.Join(uploadDir, tusName(id)+".part"), filepath.Join(uploadDir, tusName(id)+".json")
+}
+
+// discardTusUpload removes an upload's partial files and hands back the
+// quota claimed for it.
+func discardTusUpload(id string) {
+	partPath, infoPath := tusPaths(id)
+	os.Remove(partPath)
+	os.Remove(infoPath)
+	tusLocks.Delete(id)
+	quotas.remove(tusName(id))
+}
+
+// tusUploadIDs lists the ids of the unfinished uploads in uploadDir.
+func tusUploadIDs() ([]string, error) {
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if id, ok := strings.CutPrefix(e.Name(), ".tus-"); ok {
+			if id, ok := strings.CutSuffix(id, ".json"); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// loadTusClaims claims quota again for the uploads left unfinished by the
+// last run.
+func loadTusClaims() error {
+	ids, err := tusUploadIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if u, err := loadTusUpload(id); err == nil && u.Owner != "" {
+			quotas.add(tusName(id), u.Owner, u.Length)
+		}
+	}
+	return nil
+}
+
+// removeStaleTusUploads removes the unfinished uploads no data has arrived
+// for in tusExpiry, so abandoned ones don't fill the disk.
+func removeStaleTusUploads(now time.Time) {
+	ids, err := tusUploadIDs()
+	if err != nil {
+		slog.Error("Error listing resumable uploads", "err", err)
+		return
+	}
+	for _, id := range ids {
+		mu, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+		mu.(*sync.Mutex).Lock()
+		partPath, _ := tusPaths(id)
+		fi, err := os.Stat(partPath)
+		if err != nil || now.Sub(fi.ModTime()) >= tusExpiry {
+			discardTusUpload(id)
+			slog.Info("Removed abandoned resumable upload", "upload_id", id)
+		}
+		mu.(*sync.Mutex).Unlock()
+	}
+}
+
+func loadTusUpload(id string) (tusUpload, error) {
+	var u tusUpload
+	if !isValidFilename(id) {
+		return u, os.ErrNotExist
+	}
+	_, infoPath := tusPaths(id)
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return u, err
+	}
+	err = json.Unmarshal(data, &u)
+	return u, err
+}
+
+func tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(int64(maxUploadSize), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeJSONError(w, "Missing or invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+	if length == 0 {
+		writeJSONError(w, "Empty file", http.StatusBadRequest)
+		return
+	}
+	if length > int64(maxUploadSize) {
+		writeJSONError(w, "Upload exceeds maximum size of "+maxUploadSize.String(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	filename := tusMetadata(r.Header.Get("Upload-Metadata"))["filename"]
+	if err := checkExtension(filepath.Ext(sanitizeFilename(filename))); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The whole length is claimed up front and held until the upload is
+	// stored or discarded, so unfinished uploads can't add up to more than
+	// the quota.
+	owner := requestKeyID(r)
+	id := generateRandomString(16)
+	if !quotas.claim(tusName(id), owner, length) {
+		writeJSONError(w, "Upload exceeds storage quota of "+quota.String(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	partPath, infoPath := tusPaths(id)
+	info, err := json.Marshal(tusUpload{
+		Length:       length,
+		Filename:     sanitizeFilename(filename),
+		OriginalName: filename,
+		Owner:        owner,
+	})
+	if err == nil {
+		err = os.WriteFile(infoPath, info, 0644)
+	}
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+		if err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		logger.Error("Error creating resumable upload", "err", err)
+		discardTusUpload(id)
+		writeJSONError(w, "Unable to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Created resumable upload", "upload_id", id, "length", length)
+	w.Header().Set("Location", prefixedPath("/files/"+id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusHead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+
+	id := r.PathValue("id")
+	u, err := loadTusUpload(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	partPath, _ := tusPaths(id)
+	fi, err := os.Stat(partPath)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(fi.Size(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatch(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeJSONError(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeJSONError(w, "Missing or invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	id := r.PathValue("id")
+	mu, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	u, err := loadTusUpload(id)
+	if err != nil {
+		writeJSONError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	partPath, _ := tusPaths(id)
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		writeJSONError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		logger.Error("Error reading resumable upload", "upload_id", id, "err", err)
+		writeJSONError(w, "Unable to read upload", http.StatusInternalServerError)
+		return
+	}
+	if fi.Size() != offset {
+		f.Close()
+		writeJSONError(w, fmt.Sprintf("Upload-Offset %d does not match current offset %d", offset, fi.Size()), http.StatusConflict)
+		return
+	}
+
+	// Whatever arrives before the connection drops is kept, so the client can
+	// resume from the offset reported by HEAD.
+	n, err := io.Copy(f, io.LimitReader(r.Body, u.Length-offset))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		// The data received so far is kept either way, so once space is freed
+		// the client can resume.
+		if isDiskFull(err) {
+			logger.Error("Out of storage space", "upload_id", id, "offset", offset, "err", err)
+			writeJSONError(w, "Not enough storage space left on the server", http.StatusInsufficientStorage)
+			return
+		}
+		logger.Warn("Resumable upload interrupted", "upload_id", id, "offset", offset, "err", err)
+		writeJSONError(w, "Upload interrupted", http.StatusInternalServerError)
+		return
+	}
+
+	if offset == u.Length {
+		response, uerr := finishTusUpload(logger, id, u)
+		if uerr != nil {
+			if uerr.reason != "" {
+				uploadErrorsTotal.WithLabelValues(uerr.reason).Inc()
+			}
+			writeJSONError(w, uerr.message, uerr.status)
+			return
+		}
+		w.Header().Set("X-Upload-URL", response.URL)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload stores a completed resumable upload through saveUpload, so
+// it is checked, named, routed, converted and recorded just like the same
+// file sent as a multipart upload. An upload that can never be stored is
+// discarded; after a failure on the server's side its data is kept, so the
+// client can retry with an empty PATCH at the final offset.
+func finishTusUpload(logger *slog.Logger, id string, u tusUpload) (UploadResponse, *uploadError) {
+	partPath, _ := tusPaths(id)
+	f, err := os.Open(partPath)
+	if err != nil {
+		logger.Error("Error reading resumable upload", "upload_id", id, "err", err)
+		return UploadResponse{}, &uploadError{status: http.StatusInternalServerError, message: "Unable to read upload"}
+	}
+	// saveUpload claims quota as it reads the file, in place of the claim
+	// held while the upload was unfinished.
+	quotas.remove(tusName(id))
+	response, uerr := saveUpload(logger, f, u.OriginalName, u.Filename, "", uploadOptions{owner: u.Owner})
+	f.Close()
+	if uerr != nil && uerr.status >= http.StatusInternalServerError {
+		if u.Owner != "" {
+			quotas.add(tusName(id), u.Owner, u.Length)
+		}
+		return UploadResponse{}, uerr
+	}
+	discardTusUpload(id)
+	if uerr != nil {
+		return UploadResponse{}, uerr
+	}
+	acceptUploads(logger, []any{response})
+	return response, nil
+}
+
+// tusMetadata decodes an Upload-Metadata header: comma-separated pairs of a
+// key and an optional base64 value.
+func tusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	return meta
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tusHandler routes the resumable upload endpoints as main does.
+func tusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /files", tusCreate)
+	mux.HandleFunc("HEAD /files/{id}", tusHead)
+	mux.HandleFunc("PATCH /files/{id}", tusPatch)
+	return mux
+}
+
+// tusCreateRequest is a POST /files for length bytes named filename.
+func tusCreateRequest(length, filename string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/files", nil)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	if length != "" {
+		r.Header.Set("Upload-Length", length)
+	}
+	r.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(filename)))
+	return r
+}
+
+// tusStart creates a resumable upload of content and returns its path.
+func tusStart(t *testing.T, filename, content string) string {
+	t.Helper()
+	w := serve(tusHandler(), tusCreateRequest(strconv.Itoa(len(content)), filename))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func tusPatchRequest(location string, offset int, chunk string) *http.Request {
+	r := httptest.NewRequest(http.MethodPatch, location, strings.NewReader(chunk))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return r
+}
+
+func TestTusUpload(t *testing.T) {
+	setup(t)
+	content := "hello resumable world"
+	location := tusStart(t, "notes.txt", content)
+
+	offset := 0
+	for _, chunk := range []string{content[:5], content[5:12], content[12:]} {
+		head := serve(tusHandler(), httptest.NewRequest(http.MethodHead, location, nil))
+		if got := head.Header().Get("Upload-Offset"); got != strconv.Itoa(offset) {
+			t.Fatalf("HEAD Upload-Offset = %s, want %d", got, offset)
+		}
+		w := serve(tusHandler(), tusPatchRequest(location, offset, chunk))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("PATCH at %d: status %d: %s", offset, w.Code, w.Body)
+		}
+		offset += len(chunk)
+		if got := w.Header().Get("Upload-Offset"); got != strconv.Itoa(offset) {
+			t.Errorf("PATCH Upload-Offset = %s, want %d", got, offset)
+		}
+		if done := offset == len(content); (w.Header().Get("X-Upload-URL") != "") != done {
+			t.Errorf("X-Upload-URL = %q with upload complete %v", w.Header().Get("X-Upload-URL"), done)
+		}
+	}
+	names := stored(t)
+	if len(names) != 1 || !strings.HasSuffix(names[0], "_notes.txt") {
+		t.Fatalf("stored %v, want one notes.txt", names)
+	}
+	if got := get(names[0]).Body.String(); got != content {
+		t.Errorf("stored %q, want %q", got, content)
+	}
+	if m, _ := metadata.get(names[0]); m.OriginalName != "notes.txt" {
+		t.Errorf("original name %q, want notes.txt", m.OriginalName)
+	}
+}
+
+func TestTusCreate(t *testing.T) {
+	tests := []struct {
+		name     string
+		length   string
+		filename string
+		status   int
+	}{
+		{"valid", "10", "a.txt", http.StatusCreated},
+		{"missing length", "", "a.txt", http.StatusBadRequest},
+		{"invalid length", "ten", "a.txt", http.StatusBadRequest},
+		{"empty file", "0", "a.txt", http.StatusBadRequest},
+		{"too large", strconv.Itoa(2 << 20), "a.txt", http.StatusRequestEntityTooLarge},
+		{"disallowed extension", "10", "a.exe", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			set(t, &maxUploadSize, 1<<20)
+			w := serve(tusHandler(), tusCreateRequest(tt.length, tt.filename))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if w.Header().Get("Tus-Resumable") != tusVersion {
+				t.Errorf("Tus-Resumable = %q", w.Header().Get("Tus-Resumable"))
+			}
+		})
+	}
+}
+
+func TestTusPatchErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		offset      int
+		id          string
+		status      int
+	}{
+		{"wrong offset", "application/offset+octet-stream", 3, "", http.StatusConflict},
+		{"wrong content type", "application/octet-stream", 0, "", http.StatusUnsupportedMediaType},
+		{"unknown upload", "application/offset+octet-stream", 0, "/files/nosuchupload", http.StatusNotFound},
+		{"traversal", "application/offset+octet-stream", 0, "/files/..%2f..%2fetc", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			location := tusStart(t, "a.txt", "hello")
+			if tt.id != "" {
+				location = tt.id
+			}
+			r := tusPatchRequest(location, tt.offset, "hello")
+			r.Header.Set("Content-Type", tt.contentType)
+			if w := serve(tusHandler(), r); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if names := stored(t); len(names) != 0 {
+				t.Errorf("stored %v", names)
+			}
+		})
+	}
+}
+
+func TestTusLocationPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "/files/"},
+		{"/fh", "/fh/files/"},
+	}
+	for _, tt := range tests {
+		t.Run("prefix "+tt.prefix, func(t *testing.T) {
+			setup(t)
+			set(t, &urlPrefix, tt.prefix)
+			w := serve(tusHandler(), tusCreateRequest("5", "a.txt"))
+			if got := w.Header().Get("Location"); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("Location = %q, want under %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveStaleTusUploads(t *testing.T) {
+	setup(t)
+	stale := tusStart(t, "stale.txt", "hello")
+	fresh := tusStart(t, "fresh.txt", "hello")
+	partPath, _ := tusPaths(path.Base(stale))
+	old := time.Now().Add(-tusExpiry - time.Minute)
+	if err := os.Chtimes(partPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	removeStaleTusUploads(time.Now())
+	for location, want := range map[string]int{stale: http.StatusNotFound, fresh: http.StatusOK} {
+		if w := serve(tusHandler(), httptest.NewRequest(http.MethodHead, location, nil)); w.Code != want {
+			t.Errorf("HEAD %s: status %d, want %d", location, w.Code, want)
+		}
+	}
+	if _, err := os.Stat(partPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stale upload's data left behind: %v", err)
+	}
+}
+
+// tusFinish sends content as a resumable upload in one PATCH and returns the
+// name it was stored under.
+func tusFinish(t *testing.T, filename, content string) string {
+	t.Helper()
+	w := serve(tusHandler(), tusPatchRequest(tusStart(t, filename, content), 0, content))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: status %d: %s", w.Code, w.Body)
+	}
+	names := stored(t)
+	if len(names) != 1 {
+		t.Fatalf("stored %v, want one file", names)
+	}
+	if want := fileURL(names[0]); w.Header().Get("X-Upload-URL") != want {
+		t.Errorf("X-Upload-URL = %q, want %q", w.Header().Get("X-Upload-URL"), want)
+	}
+	return names[0]
+}
+
+// TestTusStoredLikeMultipart checks a finished resumable upload goes through
+// the same steps after its content checks as a multipart upload.
+func TestTusStoredLikeMultipart(t *testing.T) {
+	img := testPNG(t, 4, 4)
+
+	t.Run("sha256", func(t *testing.T) {
+		setup(t)
+		name := tusFinish(t, "a.txt", "hello")
+		if m, _ := metadata.get(name); m.Sha256 != sha256Hex("hello") {
+			t.Errorf("sha256 = %q, want %s", m.Sha256, sha256Hex("hello"))
+		}
+	})
+	t.Run("thumbnail", func(t *testing.T) {
+		setup(t)
+		name := tusFinish(t, "a.png", img)
+		thumbnailJobs.Wait()
+		if w := get(thumbName(name)); w.Code != http.StatusOK {
+			t.Errorf("thumbnail: status %d", w.Code)
+		}
+	})
+	t.Run("route dirs", func(t *testing.T) {
+		setup(t)
+		set(t, &dirRoutes, nil)
+		if err := parseDirRoutes("images=image/*"); err != nil {
+			t.Fatal(err)
+		}
+		if name := tusFinish(t, "a.png", img); path.Dir(name) != "images" {
+			t.Errorf("stored as %s, want it in images", name)
+		}
+		thumbnailJobs.Wait()
+	})
+	t.Run("convert images", func(t *testing.T) {
+		setup(t)
+		set(t, &convertImages, "jpeg")
+		if name := tusFinish(t, "a.png", img); path.Ext(name) != ".jpg" {
+			t.Errorf("stored as %s, want a .jpg", name)
+		}
+		thumbnailJobs.Wait()
+	})
+	t.Run("dedupe", func(t *testing.T) {
+		setup(t)
+		set(t, &dedupe, true)
+		if name, want := tusFinish(t, "a.txt", "hello"), sha256Hex("hello")+".txt"; name != want {
+			t.Errorf("stored as %s, want %s", name, want)
+		}
+	})
+	t.Run("strict unique", func(t *testing.T) {
+		setup(t)
+		set(t, &strictUnique, true)
+		uploaded(t, "/upload", "a.txt", "hello")
+		location := tusStart(t, "b.txt", "hello")
+		if w := serve(tusHandler(), tusPatchRequest(location, 0, "hello")); w.Code != http.StatusConflict {
+			t.Errorf("duplicate: status %d, want 409: %s", w.Code, w.Body)
+		}
+		if w := serve(tusHandler(), httptest.NewRequest(http.MethodHead, location, nil)); w.Code != http.StatusNotFound {
+			t.Errorf("rejected upload left behind: HEAD status %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// templatePart is a piece of a parsed -url-template: literal text or the
+// name of a placeholder.
+type templatePart struct {
+	literal     string
+	placeholder string
+}
+
+// urlTemplate replaces the default hostname, prefix and download path of
+// file URLs when -url-template is set.
+var urlTemplate []templatePart
+
+// urlPlaceholders are the placeholders -url-template accepts: {host} is the
+// -hostname value, {name} the stored filename, and {prefix} and {orig} its
+// random prefix and the rest of it. Names without a prefix, such as those
+// stored with -dedupe, have an empty {prefix} and all of the name as {orig}.
+var urlPlaceholders = map[string]bool{"host": true, "name": true, "prefix": true, "orig": true}
+
+// parseURLTemplate parses a -url-template. It has to place the file in the
+// URL, with {name} or both {prefix} and {orig}.
+func parseURLTemplate(s string) ([]templatePart, error) {
+	var parts []templatePart
+	seen := make(map[string]bool)
+	for s != "" {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			parts = append(parts, templatePart{literal: s})
+			break
+		}
+		if i > 0 {
+			parts = append(parts, templatePart{literal: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, errors.New("unclosed { in URL template")
+		}
+		p := s[i+1 : i+j]
+		if !urlPlaceholders[p] {
+			return nil, fmt.Errorf("unknown placeholder {%s} in URL template", p)
+		}
+		seen[p] = true
+		parts = append(parts, templatePart{placeholder: p})
+		s = s[i+j+1:]
+	}
+	if !seen["name"] && !(seen["prefix"] && seen["orig"]) {
+		return nil, errors.New("URL template must contain {name}, or {prefix} and {orig}")
+	}
+	return parts, nil
+}
+
+// renderURL fills in parts for the stored file name.
+func renderURL(parts []templatePart, name string) string {
+	// The prefix is on the last element of names routed into a
+	// subdirectory, which stays part of {orig}.
+	i := strings.LastIndexByte(name, '/') + 1
+	prefix, orig, ok := strings.Cut(name[i:], "_")
+	if !ok {
+		prefix, orig = "", name[i:]
+	}
+	orig = name[:i] + orig
+	var b strings.Builder
+	for _, p := range parts {
+		switch p.placeholder {
+		case "":
+			b.WriteString(p.literal)
+		case "host":
+			b.WriteString(hostname)
+		case "name":
+			b.WriteString(name)
+		case "prefix":
+			b.WriteString(prefix)
+		case "orig":
+			b.WriteString(orig)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseURLTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		wantErr  string
+	}{
+		{"{host}/f/{name}", ""},
+		{"https://cdn.example.com/{prefix}/{orig}", ""},
+		{"{host}/{orig}", "must contain"},
+		{"{host}/files", "must contain"},
+		{"{host}/{name", "unclosed"},
+		{"{host}/{file}", "unknown placeholder {file}"},
+	}
+	for _, tt := range tests {
+		_, err := parseURLTemplate(tt.template)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("parseURLTemplate(%q) = %v, want error containing %q", tt.template, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRenderURL(t *testing.T) {
+	set(t, &hostname, "https://files.example.com")
+	tests := []struct {
+		template string
+		name     string
+		want     string
+	}{
+		{"{host}/f/{name}", "aB3dE9_my_report.pdf", "https://files.example.com/f/aB3dE9_my_report.pdf"},
+		{"https://cdn.example.com/{prefix}/{orig}", "aB3dE9_my_report.pdf", "https://cdn.example.com/aB3dE9/my_report.pdf"},
+		// Routed into a subdirectory, which stays part of {orig}.
+		{"{host}/{prefix}/{orig}", "images/aB3dE9_cat.png", "https://files.example.com/aB3dE9/images/cat.png"},
+		// Stored by -dedupe, without a prefix.
+		{"{host}/{prefix}/{orig}", "2cf24dba.txt", "https://files.example.com//2cf24dba.txt"},
+	}
+	for _, tt := range tests {
+		parts, err := parseURLTemplate(tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := renderURL(parts, tt.name); got != tt.want {
+			t.Errorf("renderURL(%q, %q) = %q, want %q", tt.template, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUploadURLTemplate(t *testing.T) {
+	setup(t)
+	set(t, &hostname, "https://files.example.com")
+	parts, err := parseURLTemplate("{host}/d/{prefix}/{orig}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, &urlTemplate, parts)
+	up := uploaded(t, "/upload", "notes.txt", "hello")
+	prefix, orig, _ := strings.Cut(up.Filename, "_")
+	if want := "https://files.example.com/d/" + prefix + "/" + orig; up.URL != want {
+		t.Errorf("URL %q, want %q", up.URL, want)
+	}
+}
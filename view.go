@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// maxViewSize is the largest file /view renders; bigger ones are sent to
+// the raw download instead.
+const maxViewSize = 1 << 20
+
+var viewPage = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>{{.Name}}</title>
+<style>
+body { margin: 0; background: #1e1e1e; color: #d4d4d4; font-family: sans-serif; }
+header { padding: 0.5em 1em; background: #2d2d2d; display: flex; justify-content: space-between; }
+header a { color: #9cdcfe; }
+pre { margin: 0; padding: 1em; overflow-x: auto; font: 14px/1.4 monospace; tab-size: 4; }
+{{.CSS}}
+</style>
+</head>
+<body>
+<header><span>{{.Name}}</span><span><a href="{{.RawURL}}">raw</a> <a href="{{.DownloadURL}}">download</a></span></header>
+<pre class="chroma"><code>{{.Code}}</code></pre>
+</body>
+</html>
+`))
+
+// viewFile renders a stored text file as an HTML page with syntax
+// highlighting picked from its extension. Binary, oversized and one-time
+// files, and any file with ?raw=1, are redirected to the download instead.
+// Everything from the file is escaped, and a restrictive CSP keeps the page
+// from running scripts even if something slipped through.
+func viewFile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !isValidName(name) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	m, _ := metadata.get(name)
+	if m.expired(time.Now()) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	pathname := urlPrefix + downloadPath + name
+	downloadURL := pathname
+	rawTarget := pathname + "?inline=1"
+	if requireSigned {
+		q := r.URL.Query()
+		if err := checkSignature(name, q, time.Now()); err != nil {
+			writeJSONError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		// The links on the page need the signature too.
+		signed := url.Values{"expires": {q.Get("expires")}, "signature": {q.Get("signature")}}.Encode()
+		downloadURL += "?" + signed
+		rawTarget += "&" + signed
+	}
+	if password := r.URL.Query().Get("password"); password != "" {
+		rawTarget += "&password=" + url.QueryEscape(password)
+	}
+	if r.URL.Query().Get("raw") == "1" || m.OneTime {
+		http.Redirect(w, r, rawTarget, http.StatusFound)
+		return
+	}
+	if m.PasswordHash != "" && !checkPassword(m.PasswordHash, downloadPassword(r)) {
+		writePasswordRequired(w)
+		return
+	}
+
+	f, err := store.Get(name)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error opening file", "file", name, "err", err)
+		writeJSONError(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if f.Size() > maxViewSize {
+		http.Redirect(w, r, rawTarget, http.StatusFound)
+		return
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		requestLogger(r).Error("Error reading file", "file", name, "err", err)
+		writeJSONError(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	if !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+		http.Redirect(w, r, rawTarget, http.StatusFound)
+		return
+	}
+
+	var page bytes.Buffer
+	err = viewPage.Execute(&page, map[string]any{
+		"Name":        originalName(name, m),
+		"RawURL":      rawTarget,
+		"DownloadURL": downloadURL,
+		"Code":        highlight(string(content), name),
+		"CSS":         highlightCSS,
+	})
+	if err != nil {
+		requestLogger(r).Error("Error rendering file", "file", name, "err", err)
+		writeJSONError(w, "Unable to render file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", fmt.Sprintf(`"v%x-%x"`, f.ModTime().UnixNano(), f.Size()))
+	if m.PasswordHash != "" {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	http.ServeContent(w, r, "", f.ModTime(), bytes.NewReader(page.Bytes()))
+}
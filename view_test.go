@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name, src, filename, want string
+	}{
+		{"keyword", "func main() {}", "main.go", `<span class="kd">func</span>`},
+		{"string", `x := "hi"`, "a.go", `<span class="s">&#34;hi&#34;</span>`},
+		{"line comment", "// note\nx", "a.go", `<span class="c1">// note</span>`},
+		{"number", "x = 42", "a.py", `<span class="mi">42</span>`},
+		{"rust", "fn main() {}", "main.rs", `<span class="k">fn</span>`},
+		{"yaml", "key: value", "a.yaml", `<span class="nt">key</span>`},
+		{"unknown language", "func <b>", "notes.txt", "func &lt;b&gt;"},
+		{"escaped in strings", `"</span><script>"`, "a.js", `<span class="s2">&#34;&lt;/span&gt;&lt;script&gt;&#34;</span>`},
+		{"escaped in comments", "/* <img onerror=x> */", "a.c", `<span class="cm">/* &lt;img onerror=x&gt; */</span>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(highlight(tt.src, tt.filename)); !strings.Contains(got, tt.want) {
+				t.Errorf("highlight(%q) = %q, want it to contain %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+// view GETs /view/name through the route main registers.
+func view(target string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /view/{name...}", viewFile)
+	return serve(mux, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+func TestViewFile(t *testing.T) {
+	setup(t)
+	files := map[string]string{
+		"main.go":    "package main\n\nfunc main() {}\n",
+		"xss.txt":    "<script>alert(1)</script>",
+		"image.png":  testPNG(t, 2, 2),
+		"binary.dat": "text\x00with a NUL",
+		"big.txt":    strings.Repeat("x", maxViewSize+1),
+	}
+	for name, content := range files {
+		if err := store.Put(name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		status   int
+		contains string
+		location string
+	}{
+		{"go file", "/view/main.go", http.StatusOK, `<span class="kd">func</span>`, ""},
+		{"escaped", "/view/xss.txt", http.StatusOK, "&lt;script&gt;alert(1)&lt;/script&gt;", ""},
+		{"image", "/view/image.png", http.StatusFound, "", downloadPath + "image.png?inline=1"},
+		{"binary", "/view/binary.dat", http.StatusFound, "", downloadPath + "binary.dat?inline=1"},
+		{"too big", "/view/big.txt", http.StatusFound, "", downloadPath + "big.txt?inline=1"},
+		{"raw", "/view/main.go?raw=1", http.StatusFound, "", downloadPath + "main.go?inline=1"},
+		{"missing", "/view/missing.go", http.StatusNotFound, "", ""},
+		{"hidden", "/view/.meta.json", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := view(tt.target)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("body doesn't contain %q:\n%s", tt.contains, w.Body)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if strings.Contains(w.Body.String(), "<script>") {
+				t.Error("page contains an unescaped script tag")
+			}
+			for h, want := range map[string]string{
+				"Content-Type":            "text/html; charset=utf-8",
+				"Content-Security-Policy": "default-src 'none'; style-src 'unsafe-inline'",
+				"X-Content-Type-Options":  "nosniff",
+				"Cache-Control":           "public, max-age=3600",
+			} {
+				if got := w.Header().Get(h); got != want {
+					t.Errorf("%s = %q, want %q", h, got, want)
+				}
+			}
+			if w.Header().Get("ETag") == "" {
+				t.Error("no ETag")
+			}
+		})
+	}
+}
+
+// TestViewProtectedFiles checks that /view doesn't get around one-time and
+// password protection.
+func TestViewProtectedFiles(t *testing.T) {
+	setup(t)
+	oneTime := uploaded(t, "/upload?onetime=1", "once.txt", "read me once").Filename
+	protected := uploaded(t, "/upload?password=hunter2", "secret.txt", "secret").Filename
+
+	// The one-time file is sent to the download, which counts its only read.
+	if w := view("/view/" + oneTime); w.Code != http.StatusFound {
+		t.Errorf("one-time file: status %d, want 302", w.Code)
+	}
+	if w := get(oneTime); w.Code != http.StatusOK {
+		t.Errorf("one-time file after view: status %d, want it still there", w.Code)
+	}
+
+	if w := view("/view/" + protected); w.Code != http.StatusUnauthorized || strings.Contains(w.Body.String(), "secret\n") {
+		t.Errorf("protected file without password: status %d", w.Code)
+	}
+	w := view("/view/" + protected + "?password=hunter2")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("protected file with password: status %d", w.Code)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "private, no-cache" {
+		t.Errorf("Cache-Control = %q, want private", cc)
+	}
+	if !strings.Contains(w.Body.String(), "password=hunter2") {
+		t.Error("raw link doesn't carry the password")
+	}
+}
@@ -0,0 +1,552 @@
+//go:build webdav
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func init() {
+	newWebDAVHandler = func(prefix string) http.Handler {
+		h := &webdav.Handler{
+			Prefix:     prefix,
+			FileSystem: davFS{},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					requestLogger(r).Warn("WebDAV request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+				}
+			},
+		}
+		davName := func(r *http.Request) []string {
+			return []string{strings.TrimPrefix(path.Clean(r.URL.Path), prefix+"/")}
+		}
+		return auditDownloads(davName, davAuth(requireAPIKey(davRequireSigned(h))))
+	}
+}
+
+// davRequireSigned refuses downloads over WebDAV under -require-signed, as
+// its clients have no way to send a signature. Files are still listed, and
+// the webdav package opens them to do so, so this can't be left to davFS.
+func davRequireSigned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requireSigned && (r.Method == http.MethodGet || r.Method == http.MethodPost) {
+			writeJSONError(w, errSignatureMissing.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// davAuth lets WebDAV clients, which mostly only speak Basic auth, send
+// their API key as the password, and asks for Basic credentials when no key
+// was given. Without -api-keys the password means nothing and is left alone.
+// Under -basic-auth the Basic credentials are the server's, so the key has
+// to come in X-API-Key or as a bearer token like for the other endpoints.
+func davAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if basicAuthUser != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, password, ok := r.BasicAuth(); ok && len(apiKeys) > 0 {
+			r.Header.Set("X-API-Key", password)
+		}
+		if len(apiKeys) > 0 && requestAPIKey(r) == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="filehost"`)
+			writeJSONError(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func davLogger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// davFS presents the storage backend as a WebDAV file system. Stored names
+// map to paths directly; directories only exist through the files in them,
+// so an empty directory disappears. Files written over WebDAV get the same
+// extension, content, virus and quota checks as uploads, and internal files,
+// thumbnails, expired, one-time and password-protected files are left out.
+type davFS struct{}
+
+func davName(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// listDir returns the files and subdirectories directly inside dir, or nil
+// if dir doesn't exist.
+func (davFS) listDir(dir string) ([]os.FileInfo, error) {
+	files, err := listLiveFiles()
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	var infos []os.FileInfo
+	subdirs := make(map[string]*davInfo)
+	for _, f := range files {
+		rest, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok {
+			continue
+		}
+		if m, _ := metadata.get(f.Name); m.PasswordHash != "" {
+			continue
+		}
+		if sub, _, nested := strings.Cut(rest, "/"); nested {
+			d, ok := subdirs[sub]
+			if !ok {
+				d = &davInfo{name: sub, dir: true}
+				subdirs[sub] = d
+				infos = append(infos, d)
+			}
+			if f.ModTime.After(d.modTime) {
+				d.modTime = f.ModTime
+			}
+			continue
+		}
+		infos = append(infos, &davInfo{name: rest, size: f.Size, modTime: f.ModTime})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// getFile opens a stored file that may be read over WebDAV.
+func (davFS) getFile(name string) (StoredFile, error) {
+	if !isValidName(name) || isThumbnail(name) {
+		return nil, os.ErrNotExist
+	}
+	m, _ := metadata.get(name)
+	if m.expired(time.Now()) || m.OneTime {
+		return nil, os.ErrNotExist
+	}
+	if m.PasswordHash != "" {
+		return nil, os.ErrPermission
+	}
+	return store.Get(name)
+}
+
+func (fsys davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = davName(name)
+	if name == "" {
+		return &davInfo{name: "/", dir: true}, nil
+	}
+	f, err := fsys.getFile(name)
+	if err == nil {
+		defer f.Close()
+		return &davInfo{name: path.Base(name), size: f.Size(), modTime: f.ModTime()}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	entries, err := fsys.listDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return &davInfo{name: path.Base(name), dir: true}, nil
+}
+
+// Mkdir succeeds without doing anything, since a directory comes into
+// being with the first file stored in it.
+func (davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if !isValidName(davName(name)) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (fsys davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davName(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if name == "" || !isValidName(name) || isThumbnail(name) {
+			return nil, os.ErrPermission
+		}
+		if err := checkExtension(path.Ext(name)); err != nil {
+			return nil, os.ErrPermission
+		}
+		// As with PUT /files/{name}, a deduplicated file may be shared by
+		// several uploads, so it can't be written over.
+		if m, _ := metadata.get(name); isContentAddressed(name, m.Sha256) {
+			return nil, os.ErrPermission
+		}
+		tmp, err := os.CreateTemp(uploadDir, ".upload-*")
+		if err != nil {
+			return nil, err
+		}
+		return &davUpload{tmp: tmp, name: name, ctx: ctx}, nil
+	}
+
+	f, err := fsys.getFile(name)
+	if err == nil {
+		return &davFile{StoredFile: f, name: name}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	info, err := fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fsys.listDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &davDir{info: info, entries: entries}, nil
+}
+
+func (fsys davFS) RemoveAll(ctx context.Context, name string) error {
+	name = davName(name)
+	if name == "" {
+		return os.ErrPermission
+	}
+	files, err := store.List()
+	if err != nil {
+		return err
+	}
+	removed := false
+	for _, f := range files {
+		if f.Name != name && !strings.HasPrefix(f.Name, name+"/") {
+			continue
+		}
+		if err := store.Delete(f.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := forgetUpload(f.Name); err != nil {
+			davLogger(ctx).Error("Error updating metadata", "file", f.Name, "err", err)
+		}
+		removed = true
+	}
+	if !removed {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (fsys davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = davName(oldName), davName(newName)
+	if oldName == "" || !isValidName(newName) || isThumbnail(newName) {
+		return os.ErrPermission
+	}
+	files, err := store.List()
+	if err != nil {
+		return err
+	}
+	// Every file is checked before any is moved, so a refused rename of a
+	// directory leaves all of it where it was.
+	type move struct{ from, to string }
+	var moves []move
+	for _, f := range files {
+		var target string
+		switch {
+		case f.Name == oldName:
+			target = newName
+		case strings.HasPrefix(f.Name, oldName+"/"):
+			target = newName + strings.TrimPrefix(f.Name, oldName)
+		default:
+			continue
+		}
+		if err := checkRenamed(f.Name, target); err != nil {
+			return err
+		}
+		moves = append(moves, move{f.Name, target})
+	}
+	if len(moves) == 0 {
+		return os.ErrNotExist
+	}
+	for _, m := range moves {
+		if err := renameUpload(davLogger(ctx), m.from, m.to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRenamed applies the extension rules and content checks to a file
+// about to be renamed to target, as PATCH /api/files/{name} does.
+func checkRenamed(name, target string) error {
+	ext := path.Ext(target)
+	if checkExtension(ext) != nil {
+		return os.ErrPermission
+	}
+	f, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	_, head, err := peekHead(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if _, err := validateContent(head, ext); err != nil {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// davInfo is the os.FileInfo of a stored file or implied directory.
+type davInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *davInfo) Name() string       { return i.name }
+func (i *davInfo) Size() int64        { return i.size }
+func (i *davInfo) ModTime() time.Time { return i.modTime }
+func (i *davInfo) IsDir() bool        { return i.dir }
+func (i *davInfo) Sys() any           { return nil }
+
+func (i *davInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// davFile is a stored file opened for reading.
+type davFile struct {
+	StoredFile
+	name string
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	return &davInfo{name: path.Base(f.name), size: f.Size(), modTime: f.ModTime()}, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// davDir is a directory opened for listing.
+type davDir struct {
+	info    fs.FileInfo
+	entries []fs.FileInfo
+}
+
+func (d *davDir) Close() error                   { return nil }
+func (d *davDir) Read(p []byte) (int, error)     { return 0, os.ErrInvalid }
+func (d *davDir) Seek(int64, int) (int64, error) { return 0, os.ErrInvalid }
+func (d *davDir) Write(p []byte) (int, error)    { return 0, os.ErrPermission }
+func (d *davDir) Stat() (fs.FileInfo, error)     { return d.info, nil }
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// davUpload spools a file written over WebDAV and stores it on Close, once
+// it is complete and has passed the upload checks. Writing replaces the
+// content of any file already stored under the name, which is kept if
+// storing fails.
+type davUpload struct {
+	tmp  *os.File
+	name string
+	ctx  context.Context
+	size int64
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	if u.size+int64(len(p)) > int64(maxUploadSize) {
+		return 0, errors.New("upload exceeds maximum size of " + maxUploadSize.String())
+	}
+	n, err := u.tmp.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *davUpload) Read(p []byte) (int, error)               { return 0, os.ErrInvalid }
+func (u *davUpload) Seek(int64, int) (int64, error)           { return 0, os.ErrInvalid }
+func (u *davUpload) Readdir(count int) ([]fs.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (u *davUpload) Stat() (fs.FileInfo, error) {
+	return &davInfo{name: path.Base(u.name), size: u.size, modTime: time.Now()}, nil
+}
+
+func (u *davUpload) Close() error {
+	defer os.Remove(u.tmp.Name())
+	if err := u.tmp.Close(); err != nil {
+		return err
+	}
+	logger := davLogger(u.ctx)
+
+	contentType, err := validatePartContent(u.tmp.Name(), path.Ext(u.name))
+	if err != nil {
+		logger.Warn("Rejected WebDAV upload content", "file", u.name, "err", err)
+		return err
+	}
+	signature, err := scanFile(u.tmp.Name())
+	if err != nil {
+		return err
+	}
+	if signature != "" {
+		logger.Warn("Rejected infected WebDAV upload", "file", u.name, "signature", signature)
+		return errors.New("file is infected: " + signature)
+	}
+	if err := checkArchiveAt(u.tmp.Name(), contentType, u.name); err != nil {
+		archiveUploadError(logger, u.name, err)
+		return err
+	}
+	sum, err := fileSha256(u.tmp.Name())
+	if err != nil {
+		return err
+	}
+	owner, _ := u.ctx.Value(keyIDKey{}).(string)
+
+	exists, err := store.Exists(u.name)
+	if err != nil {
+		return err
+	}
+	// Writing over a file replaces its content the way PUT /files/{name}
+	// does, so its password, expiry, description and owner are kept. An
+	// expired file that hasn't been swept yet is replaced as a new one.
+	m, _ := metadata.get(u.name)
+	replacing := exists && !m.expired(time.Now())
+	if replacing {
+		if isContentAddressed(u.name, m.Sha256) {
+			return os.ErrPermission
+		}
+		owner = m.Owner
+	}
+	if !quotas.reserve(owner, u.size) {
+		return errQuotaExceeded
+	}
+	quotas.release(owner, u.size)
+
+	if !replacing {
+		m = fileMeta{
+			OriginalName: path.Base(u.name),
+			Owner:        owner,
+			UploadedAt:   time.Now().UTC(),
+		}
+	}
+	m.Encrypted = encryptUploads
+	m.Sha256 = sum
+	m.ContentType = contentType
+	m.Size = u.size
+	// Under -strict-unique the metadata is written before duplicateMu is
+	// released, so the next upload finds the new hash.
+	write := func() error {
+		var err error
+		if exists {
+			err = u.replace()
+		} else {
+			err = adoptFile(u.name, u.tmp.Name())
+		}
+		if err != nil {
+			return err
+		}
+		if replacing {
+			quotas.remove(u.name)
+			removeThumbnail(u.name)
+		} else if exists {
+			if err := forgetUpload(u.name); err != nil {
+				logger.Error("Error updating metadata", "file", u.name, "err", err)
+			}
+		}
+		if err := metadata.set(u.name, m); err != nil {
+			logger.Error("Error saving metadata", "err", err)
+		}
+		return nil
+	}
+	if strictUnique {
+		err = replaceUnique(u.name, sum, write)
+	} else {
+		err = write()
+	}
+	var dupErr *duplicateError
+	if errors.As(err, &dupErr) {
+		logger.Info("Rejected duplicate WebDAV upload", "file", u.name, "duplicate_of", dupErr.name)
+		return os.ErrExist
+	}
+	if err != nil {
+		return err
+	}
+	if owner != "" {
+		quotas.add(u.name, owner, u.size)
+	}
+	recordUpload(u.size)
+	// Thumbnails are served without a password, as with uploads.
+	if canThumbnail(contentType) && m.PasswordHash == "" {
+		startThumbnail(u.name)
+	}
+	logger.Info("Stored WebDAV upload", "file", u.name, "size", u.size)
+	return nil
+}
+
+// validatePartContent applies the same content checks as multipart uploads
+// to a file written over WebDAV, returning the detected content type.
+func validatePartContent(partPath, ext string) (string, error) {
+	f, err := os.Open(partPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return validateContent(head[:n], ext)
+}
+
+// fileSha256 returns the hex SHA-256 of the file at p.
+func fileSha256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// replace swaps the spooled content in for the stored file's in one step.
+func (u *davUpload) replace() error {
+	f, err := os.Open(u.tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return replaceIn(store, u.name, f)
+}
@@ -0,0 +1,161 @@
+//go:build webdav
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// dav sends a WebDAV request for the stored file name.
+func dav(method, name, body string) *httptest.ResponseRecorder {
+	return serve(newWebDAVHandler("/dav"), httptest.NewRequest(method, "/dav/"+name, strings.NewReader(body)))
+}
+
+func TestWebDAVPutThenGet(t *testing.T) {
+	setup(t)
+	if w := dav(http.MethodPut, "docs/notes.txt", "first draft"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: status %d: %s", w.Code, w.Body)
+	}
+	if w := dav(http.MethodGet, "docs/notes.txt", ""); w.Code != http.StatusOK || w.Body.String() != "first draft" {
+		t.Fatalf("GET: status %d, body %q", w.Code, w.Body)
+	}
+	if w := get("docs/notes.txt"); w.Body.String() != "first draft" {
+		t.Errorf("download: body %q", w.Body)
+	}
+	m, _ := metadata.get("docs/notes.txt")
+	if m.Sha256 != sha256Hex("first draft") || m.OriginalName != "notes.txt" {
+		t.Errorf("metadata %+v", m)
+	}
+	if w := dav(http.MethodPut, "run.exe", "MZ"); w.Code != http.StatusNotFound {
+		t.Errorf("PUT of .exe: status %d", w.Code)
+	}
+}
+
+func TestWebDAVOverwriteKeepsMetadata(t *testing.T) {
+	setup(t)
+	up := uploaded(t, "/upload?password=hunter2&ttl=1h&description=kept", "a.txt", "old content")
+	before, _ := metadata.get(up.Filename)
+	if w := dav(http.MethodPut, up.Filename, "new content"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: status %d: %s", w.Code, w.Body)
+	}
+	m, _ := metadata.get(up.Filename)
+	if m.PasswordHash != before.PasswordHash || !m.ExpiresAt.Equal(before.ExpiresAt) || m.Description != "kept" || m.OriginalName != "a.txt" {
+		t.Errorf("metadata after overwrite %+v, before %+v", m, before)
+	}
+	if m.Sha256 != sha256Hex("new content") || m.Size != int64(len("new content")) {
+		t.Errorf("content metadata %+v", m)
+	}
+	if w := get(up.Filename); w.Code != http.StatusUnauthorized {
+		t.Errorf("download without password: status %d", w.Code)
+	}
+	if w := get(up.Filename + "?password=hunter2"); w.Body.String() != "new content" {
+		t.Errorf("download: body %q", w.Body)
+	}
+}
+
+func TestWebDAVOverwriteDeduplicated(t *testing.T) {
+	setup(t)
+	set(t, &dedupe, true)
+	up := uploaded(t, "/upload", "a.txt", "shared")
+	if w := dav(http.MethodPut, up.Filename, "changed"); w.Code == http.StatusCreated {
+		t.Fatalf("PUT over a deduplicated file: status %d", w.Code)
+	}
+	if w := get(up.Filename); w.Body.String() != "shared" {
+		t.Errorf("download: body %q", w.Body)
+	}
+}
+
+// TestWebDAVBasicAuth checks the API key isn't read from the Basic auth
+// password under -basic-auth, where it holds the server's credentials.
+func TestWebDAVBasicAuth(t *testing.T) {
+	setup(t)
+	set(t, &apiKeys, []string{"secret"})
+	set(t, &basicAuthUser, "admin")
+	set(t, &basicAuthPassword, "s3cret")
+	h := requireBasicAuth(newWebDAVHandler("/dav"))
+	for _, tt := range []struct {
+		name   string
+		key    string
+		status int
+	}{
+		{"no key", "", http.StatusUnauthorized},
+		{"X-API-Key", "secret", http.StatusCreated},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/dav/a.txt", strings.NewReader("hello"))
+		r.SetBasicAuth("admin", "s3cret")
+		if tt.key != "" {
+			r.Header.Set("X-API-Key", tt.key)
+		}
+		if w := serve(h, r); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestWebDAVStrictUnique(t *testing.T) {
+	setup(t)
+	set(t, &strictUnique, true)
+	up := uploaded(t, "/upload", "a.txt", "stored once")
+	if w := dav(http.MethodPut, "b.txt", "stored once"); w.Code == http.StatusCreated {
+		t.Errorf("PUT of stored content: status %d", w.Code)
+	}
+	if w := dav(http.MethodPut, up.Filename, "stored once"); w.Code != http.StatusCreated {
+		t.Errorf("PUT of a file's own content: status %d", w.Code)
+	}
+	if names := stored(t); len(names) != 1 {
+		t.Errorf("stored %v, want one file", names)
+	}
+}
+
+func TestWebDAVAuditsDownloads(t *testing.T) {
+	setup(t)
+	events := auditTo(t)
+	dav(http.MethodPut, "docs/notes.txt", "first draft")
+	if w := dav(http.MethodGet, "docs/notes.txt", ""); w.Code != http.StatusOK {
+		t.Fatalf("GET: status %d", w.Code)
+	}
+	got := events()
+	if len(got) != 1 {
+		t.Fatalf("audit lines %+v, want one for the GET", got)
+	}
+	if e := got[0]; e.Method != http.MethodGet || e.Filename != "docs/notes.txt" || e.Status != http.StatusOK || e.Bytes != int64(len("first draft")) {
+		t.Errorf("logged %+v", e)
+	}
+}
+
+// move sends a WebDAV MOVE of the stored file name to newName.
+func move(name, newName string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("MOVE", "/dav/"+name, nil)
+	r.Header.Set("Destination", "http://example.com/dav/"+newName)
+	return serve(newWebDAVHandler("/dav"), r)
+}
+
+// TestWebDAVMoveChecksNewName checks MOVE can't give a file an extension or
+// name uploads would be refused, password-protected files included.
+func TestWebDAVMoveChecksNewName(t *testing.T) {
+	setup(t)
+	protected := uploaded(t, "/upload?password=secret", "a.txt", "<script>alert(1)</script>")
+	plain := uploaded(t, "/upload", "notes.txt", "hello")
+	for _, tt := range []struct{ name, newName string }{
+		{protected.Filename, "a.html"},
+		{plain.Filename, "notes.exe"},
+		{plain.Filename, "notes.png"},
+	} {
+		if w := move(tt.name, tt.newName); w.Code < 400 {
+			t.Errorf("MOVE %s to %s: status %d", tt.name, tt.newName, w.Code)
+		}
+	}
+	if names := stored(t); !slices.Contains(names, protected.Filename) || !slices.Contains(names, plain.Filename) || len(names) != 2 {
+		t.Errorf("stored %v after refused moves", names)
+	}
+	if w := move(plain.Filename, "docs/notes.md"); w.Code != http.StatusCreated {
+		t.Errorf("MOVE to an allowed name: status %d", w.Code)
+	}
+	if w := get("docs/notes.md"); w.Body.String() != "hello" {
+		t.Errorf("moved file: status %d, body %q", w.Code, w.Body)
+	}
+}
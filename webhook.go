@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// webhookURL, set with -webhook-url, is sent a message for every stored
+// upload. Empty disables notifications.
+var webhookURL string
+
+// webhookTemplate renders the text of each message from a webhookUpload.
+var webhookTemplate = template.Must(template.New("webhook").Parse(defaultWebhookTemplate))
+
+const defaultWebhookTemplate = "New upload: {{.OriginalName}} ({{.Size}}){{with .URL}} {{.}}{{end}}"
+
+// webhookQueueSize bounds how many notifications wait to be sent. More are
+// dropped rather than held up behind a slow webhook.
+const webhookQueueSize = 100
+
+var webhookQueue = make(chan webhookUpload, webhookQueueSize)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookUpload is what a notification says about an upload.
+type webhookUpload struct {
+	Filename     string   `json:"filename"`
+	OriginalName string   `json:"originalName"`
+	Size         byteSize `json:"size"`
+	URL          string   `json:"url"`
+}
+
+// webhookPayload works with both Slack, which shows text, and Discord,
+// which shows content. The upload's fields are there too for other
+// receivers.
+type webhookPayload struct {
+	Text    string `json:"text"`
+	Content string `json:"content"`
+	webhookUpload
+}
+
+// parseWebhookTemplate sets webhookTemplate from a -webhook-template value.
+func parseWebhookTemplate(value string) error {
+	t, err := template.New("webhook").Option("missingkey=error").Parse(value)
+	if err != nil {
+		return err
+	}
+	// Catch fields that don't exist now rather than on the first upload.
+	if err := t.Execute(&strings.Builder{}, webhookUpload{}); err != nil {
+		return err
+	}
+	webhookTemplate = t
+	return nil
+}
+
+// notifyUpload queues a notification for a stored upload. It never blocks.
+// Slack and Discord fetch the links in messages to preview them, which
+// would use up a one-time file, so as in duplicateUploadError the URL of
+// one-time and password-protected files is left out.
+func notifyUpload(logger *slog.Logger, name, originalName string, size int64) {
+	if webhookURL == "" {
+		return
+	}
+	u := webhookUpload{Filename: name, OriginalName: originalName, Size: byteSize(size)}
+	if m, _ := metadata.get(name); !m.OneTime && m.PasswordHash == "" {
+		u.URL = fileURL(name)
+		if requireSigned {
+			u.URL = generateSignedURL(name, time.Now().Add(signedURLTTL))
+		}
+	}
+	select {
+	case webhookQueue <- u:
+	default:
+		logger.Warn("Dropped upload notification, webhook queue is full", "file", name)
+	}
+}
+
+// sendWebhooks posts queued notifications one at a time. It runs for the
+// lifetime of the process.
+func sendWebhooks() {
+	for u := range webhookQueue {
+		if err := postWebhook(u); err != nil {
+			slog.Warn("Error sending upload notification", "file", u.Filename, "err", err)
+		}
+	}
+}
+
+func postWebhook(u webhookUpload) error {
+	var text strings.Builder
+	if err := webhookTemplate.Execute(&text, u); err != nil {
+		return err
+	}
+	body, err := json.Marshal(webhookPayload{Text: text.String(), Content: text.String(), webhookUpload: u})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeWebhook points webhookURL at a server that passes on each payload
+// posted to it.
+func fakeWebhook(t *testing.T) <-chan webhookPayload {
+	t.Helper()
+	payloads := make(chan webhookPayload, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		payloads <- p
+	}))
+	t.Cleanup(srv.Close)
+	set(t, &webhookURL, srv.URL)
+	return payloads
+}
+
+// sendQueued posts the next queued notification, as sendWebhooks would.
+func sendQueued(t *testing.T) {
+	t.Helper()
+	select {
+	case u := <-webhookQueue:
+		if err := postWebhook(u); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notification queued")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	setup(t)
+	payloads := fakeWebhook(t)
+	up := uploaded(t, "/upload", "report.txt", "hello")
+	sendQueued(t)
+	p := <-payloads
+	if p.Filename != up.Filename || p.OriginalName != "report.txt" || p.Size != 5 || p.URL != up.URL {
+		t.Errorf("payload %+v", p)
+	}
+	if want := "New upload: report.txt (5) " + up.URL; p.Text != want || p.Content != want {
+		t.Errorf("text %q, content %q; want %q", p.Text, p.Content, want)
+	}
+}
+
+func TestWebhookRejectedUpload(t *testing.T) {
+	setup(t)
+	fakeWebhook(t)
+	if w := upload(t, "/upload", file("a.exe", "MZ")); w.Code == http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	select {
+	case u := <-webhookQueue:
+		t.Errorf("notification %+v for a rejected upload", u)
+	default:
+	}
+}
+
+// TestWebhookHidesProtectedURLs checks link previews can't use up one-time
+// files or reveal protected ones.
+func TestWebhookHidesProtectedURLs(t *testing.T) {
+	setup(t)
+	payloads := fakeWebhook(t)
+	for _, query := range []string{"?onetime=1", "?password=hunter2"} {
+		uploaded(t, "/upload"+query, "secret.txt", "hello")
+		sendQueued(t)
+		if p := <-payloads; p.URL != "" || p.Text != "New upload: secret.txt (5)" {
+			t.Errorf("%s: payload %+v", query, p)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build webp
+
+package main
+
+import (
+	"image"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// WebP is written lossless, which still comes out well under PNG. Importing
+// the encoder also registers its decoder, so WebP uploads get thumbnails.
+func init() {
+	imageFormats["webp"] = imageFormat{"image/webp", ".webp", true, func(w io.Writer, img image.Image) error {
+		return nativewebp.Encode(w, img, nil)
+	}}
+	thumbnailTypes["image/webp"] = true
+}
@@ -0,0 +1,38 @@
+//go:build webp
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestConvertToWebP(t *testing.T) {
+	testConversions(t, []convertCase{
+		{"png", "webp", "a.png", func(t *testing.T) string { return testPNG(t, 40, 30) }, ".webp", "webp"},
+		{"gif", "webp", "a.gif", func(t *testing.T) string { return testGIF(t, 1) }, ".webp", "webp"},
+		{"jpeg left alone", "webp", "a.jpg", func(t *testing.T) string { return testJPEG(t, 40, 30) }, ".jpg", "jpeg"},
+	})
+}
+
+func TestConvertWebPSmallerThanPNG(t *testing.T) {
+	setup(t)
+	set(t, &convertImages, "webp")
+	src := testPNG(t, 200, 200)
+	up := uploaded(t, "/upload", "a.png", src)
+	if up.Size >= int64(len(src)) {
+		t.Errorf("webp is %d bytes, the png %d", up.Size, len(src))
+	}
+	if up.ThumbnailURL == "" {
+		t.Error("no thumbnail for the webp")
+	}
+	img, _, err := image.Decode(get(up.Filename).Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lossless, so every pixel survives.
+	if got := color.RGBAModel.Convert(img.At(17, 42)).(color.RGBA); got != (color.RGBA{17, 42, 200, 255}) {
+		t.Errorf("pixel (17, 42) = %v", got)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxZipFiles bounds how many files one archive request may name.
+const maxZipFiles = 100
+
+// downloadZip streams the files named in ?files=a,b,c as a ZIP archive, with
+// entries named after the files' original names. Every file is checked
+// before anything is written, so a bad name still gets a proper error
+// response. Protected and one-time files have to be downloaded on their own.
+func downloadZip(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	// A zip would hand out files without their signatures.
+	if requireSigned {
+		writeJSONError(w, errSignatureMissing.Error(), http.StatusForbidden)
+		return
+	}
+	names := zippedNames(r)
+	if len(names) == 0 {
+		writeJSONError(w, "No files requested", http.StatusBadRequest)
+		return
+	}
+	if len(names) > maxZipFiles {
+		writeJSONError(w, fmt.Sprintf("At most %d files can be zipped at once", maxZipFiles), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	entries := make([]string, len(names))
+	seen := make(map[string]int)
+	for i, name := range names {
+		if !isValidName(name) {
+			writeJSONError(w, "Invalid filename "+name, http.StatusBadRequest)
+			return
+		}
+		m, _ := metadata.get(name)
+		exists, err := store.Exists(name)
+		if err != nil {
+			logger.Error("Error checking file", "file", name, "err", err)
+			writeJSONError(w, "Unable to read file", http.StatusInternalServerError)
+			return
+		}
+		if !exists || m.expired(now) {
+			writeJSONError(w, "File not found: "+name, http.StatusNotFound)
+			return
+		}
+		if m.PasswordHash != "" || m.OneTime {
+			writeJSONError(w, name+" can only be downloaded on its own", http.StatusForbidden)
+			return
+		}
+
+		// Uploads of the same name get distinct prefixes but would clash
+		// inside the archive.
+		base := path.Base(originalName(name, m))
+		entries[i] = base
+		if n := seen[base]; n > 0 {
+			ext := path.Ext(base)
+			entries[i] = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), n+1, ext)
+		}
+		seen[base]++
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", "files.zip"))
+	zw := zip.NewWriter(w)
+	for i, name := range names {
+		if err := addZipEntry(zw, name, entries[i]); err != nil {
+			// The response has started, so all we can do is cut it short.
+			logger.Error("Error writing zip archive", "file", name, "err", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		logger.Error("Error writing zip archive", "err", err)
+	}
+}
+
+// zippedNames returns the files named in a request to downloadZip.
+func zippedNames(r *http.Request) []string {
+	var names []string
+	for _, name := range strings.Split(r.URL.Query().Get("files"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func addZipEntry(zw *zip.Writer, name, entry string) error {
+	f, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     entry,
+		Method:   zip.Deflate,
+		Modified: f.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func zipRequest(names ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/api/zip?files="+strings.Join(names, ","), nil)
+	return serve(http.HandlerFunc(downloadZip), r)
+}
+
+func TestDownloadZip(t *testing.T) {
+	setup(t)
+	a := uploaded(t, "/upload", "report.txt", "first")
+	b := uploaded(t, "/upload", "report.txt", "second")
+	c := uploaded(t, "/upload", "notes.txt", "third")
+
+	w := zipRequest(a.Filename, b.Filename, c.Filename)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status %d, Content-Type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"report.txt": "first", "report (2).txt": "second", "notes.txt": "third"}
+	if len(zr.File) != len(want) {
+		t.Errorf("%d entries, want %d", len(zr.File), len(want))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(got) != want[f.Name] {
+			t.Errorf("entry %s = %q, want %q", f.Name, got, want[f.Name])
+		}
+	}
+}
+
+func TestDownloadZipErrors(t *testing.T) {
+	setup(t)
+	plain := uploaded(t, "/upload", "a.txt", "plain").Filename
+	oneTime := uploaded(t, "/upload?onetime=1", "b.txt", "once").Filename
+	protected := uploaded(t, "/upload?password=pw", "c.txt", "locked").Filename
+	tests := []struct {
+		name   string
+		files  []string
+		status int
+	}{
+		{"nothing requested", nil, http.StatusBadRequest},
+		{"missing file", []string{plain, "missing.txt"}, http.StatusNotFound},
+		{"traversal", []string{"../etc/passwd"}, http.StatusBadRequest},
+		{"one-time file", []string{plain, oneTime}, http.StatusForbidden},
+		{"password-protected file", []string{protected}, http.StatusForbidden},
+		{"too many files", slices.Repeat([]string{plain}, maxZipFiles+1), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := zipRequest(tt.files...); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+	// The one-time file wasn't used up by the refused request.
+	if w := get(oneTime); w.Code != http.StatusOK {
+		t.Errorf("one-time file after refused zip: status %d", w.Code)
+	}
+}